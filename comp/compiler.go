@@ -2,12 +2,15 @@
 package comp
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path"
 	"reflect"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -30,14 +33,16 @@ var builtinDeferOp = map[string]vm.Op{
 // Compiler represents the state of a compiler.
 type Compiler struct {
 	*goparser.Parser
-	vm.Code            // produced code, to fill VM with
-	Data    []vm.Value // produced data, will be at the bottom of VM stack
-	Entry   int        // offset in Code to start execution from
+	vm.Code             // produced code, to fill VM with
+	Data     []vm.Value // produced data, will be at the bottom of VM stack
+	Entry    int        // offset in Code to start execution from
+	OptLevel int        // optimization level of produced code, see package opt
 
 	strings   map[string]int                  // locations of strings in Data
 	methodIDs map[string]int                  // global method ID by method name
 	typeIdxs  map[*vm.Type]int                // dedup cache for typeIndex, keyed by parscan type pointer
 	typeSyms  map[reflect.Type]*symbol.Symbol // dedup cache for typeSym, keyed by reflect.Type
+	inlined   []vm.InlinedCall                // calls replaced by the function body
 }
 
 // NewCompiler returns a new compiler state for a given scanner.
@@ -60,6 +65,20 @@ func (c *Compiler) Compile(name, src string) error {
 	if err != nil {
 		return err
 	}
+	return c.compile(remaining)
+}
+
+// CompileFiles is like Compile for the files of a package, compiled together.
+func (c *Compiler) CompileFiles(files ...goparser.File) error {
+	remaining, err := c.ParseFiles(files...)
+	if err != nil {
+		return err
+	}
+	return c.compile(remaining)
+}
+
+func (c *Compiler) compile(remaining []goparser.Tokens) error {
+	start := len(c.Code)
 	c.allocGlobalSlots()
 	var rest []goparser.Tokens
 	for _, decl := range remaining {
@@ -76,6 +95,7 @@ func (c *Compiler) Compile(name, src string) error {
 			return err
 		}
 	}
+	c.optimize(start)
 	return nil
 }
 
@@ -87,8 +107,11 @@ func (c *Compiler) compileDecl(decl goparser.Tokens) error {
 	return c.generate(toks)
 }
 
+// allocGlobalSlots allocates the data slots of new global symbols, in
+// name order so that compiling the same source gives the same layout.
 func (c *Compiler) allocGlobalSlots() {
-	for _, s := range c.Symbols {
+	for _, name := range slices.Sorted(maps.Keys(c.Symbols)) {
+		s := c.Symbols[name]
 		if s.Index != symbol.UnsetAddr {
 			continue
 		}
@@ -293,7 +316,7 @@ func (c *Compiler) emit(t goparser.Token, op vm.Op, arg ...int) {
 		_, file, line, _ := runtime.Caller(1)
 		fmt.Fprintf(os.Stderr, "%s:%d: %v emit %v %v\n", path.Base(file), line, t, op, arg)
 	}
-	inst := vm.Instruction{Op: op, Pos: vm.Pos(t.Pos + c.PosBase)} //nolint:gosec
+	inst := vm.Instruction{Op: op, Pos: vm.Pos(t.Pos)} //nolint:gosec
 	if len(arg) > 0 {
 		inst.A = int32(arg[0]) //nolint:gosec
 	}
@@ -379,19 +402,25 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 	flen := []int{}               // stack length according to function scopes
 	funcStack := []string{}       // names of functions currently being compiled
 	jumpDepth := map[string]int{} // expected compile-stack depth at short-circuit merge labels
+	labelPos := -1                // code position of the last label
 	exprBase := -1                // compile-stack depth at start of current expression statement (-1 = not in expr stmt)
 	growPos := []int{}            // code positions of Grow instructions per function scope
 	maxExprDepth := []int{}       // max expression depth above locals per function scope
 	hasDefer := []bool{}          // whether current function scope uses defer
 
-	push := func(s *symbol.Symbol) {
-		stack = append(stack, s)
+	// reserve records that n values are pushed above the stack by the code
+	// being emitted, in the expression depth of the function.
+	reserve := func(n int) {
 		if len(maxExprDepth) > 0 {
-			if d := len(stack) - flen[len(flen)-1]; d > maxExprDepth[len(maxExprDepth)-1] {
+			if d := len(stack) + n - flen[len(flen)-1]; d > maxExprDepth[len(maxExprDepth)-1] {
 				maxExprDepth[len(maxExprDepth)-1] = d
 			}
 		}
 	}
+	push := func(s *symbol.Symbol) {
+		stack = append(stack, s)
+		reserve(0)
+	}
 	top := func() *symbol.Symbol { return stack[len(stack)-1] }
 	pop := func() *symbol.Symbol { l := len(stack) - 1; s := stack[l]; stack = stack[:l]; return s }
 	// checkTopN returns ErrUndefined if any of the top n stack entries is an unresolved
@@ -458,6 +487,17 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 			push(&symbol.Symbol{Kind: symbol.Const, Value: v, Type: c.Symbols["float64"].Type})
 			c.emit(t, vm.GetGlobal, di)
 
+		case lang.Imag:
+			z, err := strconv.ParseComplex(t.Str, 128)
+			if err != nil {
+				return err
+			}
+			v := vm.ValueOf(z)
+			di := len(c.Data)
+			c.Data = append(c.Data, v)
+			push(&symbol.Symbol{Kind: symbol.Const, Value: v, Type: c.Symbols["complex128"].Type})
+			c.emit(t, vm.GetGlobal, di)
+
 		case lang.String:
 			if t.Prefix() == "'" {
 				r, _, _, err2 := strconv.UnquoteChar(t.Block(), '\'')
@@ -502,7 +542,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 				return err
 			}
 			typ := symbol.Vtype(top())
-			c.emit(t, numericOp(vm.NegInt, typ))
+			c.emit(t, arithOp(vm.NegInt, typ))
 
 		case lang.Not:
 			if err := checkTopN(1); err != nil {
@@ -649,7 +689,11 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 			if err := checkTopN(2); err != nil {
 				return err
 			}
-			push(&symbol.Symbol{Type: booleanOpType(pop(), pop())})
+			right, left := pop(), pop()
+			typ := arithmeticOpType(right, left)
+			c.emitConstConvert(t, right, typ, 0)
+			c.emitConstConvert(t, left, typ, 1)
+			push(&symbol.Symbol{Type: booleanOpType(right, left)})
 			c.emit(t, vm.Equal)
 			c.emit(t, vm.Not)
 
@@ -799,6 +843,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 					c.emit(t, vm.Deref)
 				}
 				// Create closure binding receiver to method.
+				reserve(1)
 				c.emit(t, vm.HeapAlloc)
 				c.emit(t, vm.GetGlobal, s.Index)
 				c.emit(t, vm.Swap, 0, 1)
@@ -974,6 +1019,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 							if ft != nil && ft.Rtype.Kind() == reflect.Func {
 								c.emit(t, vm.WrapFunc, c.typeIndex(ft))
 							}
+							c.emitConstConvert(t, vs, ft, 0)
 							c.emitIfaceWrap(t, ft, vs.Type)
 						}
 						c.emit(t, vm.FieldFset)
@@ -982,6 +1028,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 					if ts.Type.Elem().IsPtr() && vs.Kind == symbol.Type {
 						c.emit(t, vm.Addr)
 					}
+					c.emitConstConvert(t, vs, ts.Type.Elem(), 0)
 					c.emitIfaceWrap(t, ts.Type.Elem(), vs.Type)
 					c.emit(t, vm.IndexSet)
 				case reflect.Map:
@@ -989,6 +1036,8 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 					if elemTyp.IsPtr() && vs.Kind == symbol.Type {
 						c.emit(t, vm.Addr)
 					}
+					c.emitConstConvert(t, ks, ts.Type.Key(), 1)
+					c.emitConstConvert(t, vs, elemTyp, 0)
 					c.emitMapValueWrap(t, elemTyp, vs)
 					c.emit(t, vm.MapSet)
 				}
@@ -1012,6 +1061,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 				if ft != nil && ft.Rtype.Kind() == reflect.Func {
 					c.emit(t, vm.WrapFunc, c.typeIndex(ft))
 				}
+				c.emitConstConvert(t, vs, ft, 0)
 				c.emitIfaceWrap(t, ft, vs.Type)
 				c.emit(t, vm.FieldSet, j...)
 
@@ -1035,6 +1085,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 				if ft != nil && ft.Rtype.Kind() == reflect.Func {
 					c.emit(t, vm.WrapFunc, c.typeIndex(ft))
 				}
+				c.emitConstConvert(t, vs, ft, 0)
 				c.emitIfaceWrap(t, ft, vs.Type)
 				c.emit(t, vm.FieldSet, j...)
 
@@ -1044,6 +1095,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 					if elemTyp.IsPtr() && vs.Kind == symbol.Type {
 						c.emit(t, vm.Addr)
 					}
+					c.emitConstConvert(t, vs, elemTyp, 0)
 					c.emitMapValueWrap(t, elemTyp, vs)
 					c.emit(t, vm.MapSet)
 				}
@@ -1099,7 +1151,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 						typ = vm.TypeOf(r.Value.Interface())
 					}
 					lhs[i].Type = typ
-					if !lhs[i].NeedsCell() {
+					if !lhs[i].NeedsCell() && !lhs[i].ByValue() {
 						typeIdx := c.typeSym(typ).Index
 						c.fixPtrFnewE(typ, typeIdx)
 						c.emit(t, vm.New, lhs[i].Index, typeIdx)
@@ -1107,11 +1159,17 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 					lhs[i].Used = true
 				}
 				for i := n - 1; i >= 0; i-- {
-					if lhs[i].NeedsCell() {
+					switch {
+					case lhs[i].NeedsCell():
 						c.emit(t, vm.HeapAlloc)
 						lhs[i].CellSlot = true
+						c.emit(t, vm.SetLocal, lhs[i].Index, 0)
+					case lhs[i].ByValue():
+						// Never written: a copy replaces the slot, to be copied again in closures.
+						c.emit(t, vm.SetLocal, lhs[i].Index, 1)
+					default:
+						c.emit(t, vm.SetLocal, lhs[i].Index, 0)
 					}
-					c.emit(t, vm.SetLocal, lhs[i].Index, 0)
 				}
 				c.emit(t, vm.Pop, n)
 				break
@@ -1158,7 +1216,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 						continue
 					}
 					c.emitIfaceWrap(t, lhss[i].Type, rhss[i].Type)
-					c.emitNumConvert(t, lhss[i].Type, rhss[i].Type, 0)
+					c.emitValueConvert(t, lhss[i].Type, rhss[i], 0)
 					switch {
 					case lhss[i].Kind == symbol.LocalVar:
 						if lhss[i].CellSlot {
@@ -1194,6 +1252,11 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 				c.emit(t, vm.Pop, 1)
 				break
 			}
+			if check, ok := t.Arg[len(t.Arg)-1].(goparser.ConstCheck); ok {
+				if err := check(lhs.Type); err != nil {
+					return err
+				}
+			}
 			if lhs.Kind == symbol.LocalVar {
 				// Captured variable write inside closure body: use HeapSet.
 				if cf := curFunc(); cf != "" {
@@ -1215,7 +1278,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 				}
 				// Wrap concrete value in Iface when assigning to interface local.
 				c.emitIfaceWrap(t, lhs.Type, rhs.Type)
-				c.emitNumConvert(t, lhs.Type, rhs.Type, 0)
+				c.emitValueConvert(t, lhs.Type, rhs, 0)
 				switch {
 				case lhs.CellSlot:
 					c.emit(t, vm.CellSet, lhs.Index)
@@ -1229,7 +1292,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 				c.emit(t, vm.Pop, 1) // pop stale lhs value left by Ident's Get
 				break
 			}
-			c.emitNumConvert(t, lhs.Type, rhs.Type, 0)
+			c.emitValueConvert(t, lhs.Type, rhs, 0)
 			if lhs.Index != symbol.UnsetAddr {
 				if v := c.Data[lhs.Index]; !v.IsValid() && rhs.Type != nil {
 					c.Data[lhs.Index] = vm.NewValue(rhs.Type.Rtype)
@@ -1265,10 +1328,14 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 			if typ.IsPtr() {
 				typ = typ.Elem()
 			}
+			ks, vs := stack[len(stack)-2], stack[len(stack)-1]
 			switch typ.Rtype.Kind() {
 			case reflect.Array, reflect.Slice:
+				c.emitConstConvert(t, vs, typ.Elem(), 0)
 				c.emit(t, vm.IndexSet)
 			case reflect.Map:
+				c.emitConstConvert(t, ks, typ.Key(), 1)
+				c.emitConstConvert(t, vs, typ.Elem(), 0)
 				c.emit(t, vm.MapSet)
 			default:
 				return errorf("not a map or array: %s", s.Name)
@@ -1280,7 +1347,11 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 			if err := checkTopN(2); err != nil {
 				return err
 			}
-			push(&symbol.Symbol{Type: booleanOpType(pop(), pop())})
+			right, left := pop(), pop()
+			typ := arithmeticOpType(right, left)
+			c.emitConstConvert(t, right, typ, 0)
+			c.emitConstConvert(t, left, typ, 1)
+			push(&symbol.Symbol{Type: booleanOpType(right, left)})
 			c.emit(t, vm.Equal)
 
 		case lang.EqualSet:
@@ -1302,6 +1373,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 			}
 			// Closure creation: emit code address + captured cell pointers + MkClosure.
 			if s.Kind == symbol.Func && len(s.FreeVars) > 0 {
+				reserve(len(s.FreeVars))
 				c.emit(t, vm.GetGlobal, s.Index)
 				// Determine the current function's FreeVars for transitive capture.
 				var outerCloSym *symbol.Symbol
@@ -1322,10 +1394,8 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 						}
 					}
 					if fvSym.Kind == symbol.LocalVar {
+						// The cell pointer, or the value itself for a snapshot, copied by MkClosure.
 						c.emit(t, vm.GetLocal, fvSym.Index)
-						if !fvSym.CellSlot {
-							c.emit(t, vm.HeapAlloc) // snapshot: not promoted to cell
-						}
 					} else {
 						c.emit(t, vm.GetGlobal, fvSym.Index)
 						c.emit(t, vm.HeapAlloc)
@@ -1371,6 +1441,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 				return fmt.Errorf("stack depth mismatch at label %s: got %d, want %d", t.Str, len(stack), expected)
 			}
 			lc := len(c.Code)
+			labelPos = lc
 			if s, ok := c.Symbols[t.Str]; ok {
 				s.Value = vm.ValueOf(lc)
 				if s.Kind == symbol.Func {
@@ -1431,10 +1502,11 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 			if err := checkTopN(1); err != nil {
 				return err
 			}
-			if c.fuseCmpJump(t, &fixList, vm.LowerIntImm, vm.LowerIntImmJumpFalse,
+			// The jump can't be fused with the comparison if it is a jump target.
+			if labelPos != len(c.Code) && (c.fuseCmpJump(t, &fixList, vm.LowerIntImm, vm.LowerIntImmJumpFalse,
 				vm.GetLocalLowerIntImm, vm.GetLocalLowerIntImmJumpFalse, 0) ||
 				c.fuseCmpJump(t, &fixList, vm.GreaterIntImm, vm.LowerIntImmJumpTrue,
-					vm.GetLocalGreaterIntImm, vm.GetLocalLowerIntImmJumpTrue, 1) {
+					vm.GetLocalGreaterIntImm, vm.GetLocalLowerIntImmJumpTrue, 1)) {
 				break
 			}
 			c.emitJump(t, &fixList, vm.JumpFalse)
@@ -1586,6 +1658,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 					// Get Global m.Index: push method code address above the cell.
 					// Swap 0 1: put code addr below cell (MkClosure convention: code at sp-n-1).
 					// MkClosure 1: produce Closure{code, [receiver_cell]}.
+					reserve(1)
 					c.emit(t, vm.HeapAlloc)
 					c.emit(t, vm.GetGlobal, m.Index)
 					c.emit(t, vm.Swap, 0, 1)
@@ -1724,19 +1797,20 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 				}
 				return vm.Global
 			}
+			// Range variables are below the iterable, the next and stop functions.
 			switch n {
 			case 0:
 				c.emit(t, vm.Next0, i)
 			case 1:
-				k := stack[len(stack)-2]
+				k := stack[len(stack)-4]
 				if lf(k) == vm.Local {
 					c.emit(t, vm.NextLocal, i, k.Index)
 				} else {
 					c.emit(t, vm.Next, i, k.Index)
 				}
 			case 2:
-				v := stack[len(stack)-2]
-				k := stack[len(stack)-3]
+				v := stack[len(stack)-4]
+				k := stack[len(stack)-5]
 				// Pack kAddr (low 16) and vAddr (high 16) into one int.
 				packed := k.Index | (v.Index << 16)
 				if lf(k) == vm.Local {
@@ -1864,8 +1938,13 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 					c.emit(t, vm.Pull)
 				}
 			}
+			// The iterator next and stop functions stay on stack during the loop.
+			push(&symbol.Symbol{})
+			push(&symbol.Symbol{})
 
 		case lang.Stop:
+			pop()
+			pop()
 			c.emit(t, vm.Stop, t.Arg[0].(int))
 
 		case lang.Defer:
@@ -1936,6 +2015,11 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 					c.emitIfaceWrapAt(t, funcType.ReturnType(i), stackSym.Type, numOut-1-i)
 				}
 			}
+			if n := len(c.Code) - 1; numOut > 0 && n >= 0 && c.Code[n].Op == vm.CallImm && int(c.Code[n].B&0xFFFF) == numOut {
+				// The results of a call in tail position are returned as is: the
+				// callee frame can replace the current one.
+				c.Code[n].Op = vm.TailCall
+			}
 			if len(hasDefer) == 0 || hasDefer[len(hasDefer)-1] || !c.fuseGetLocal(vm.GetLocalReturn, 0) {
 				c.emit(t, vm.Return)
 			}
@@ -2011,7 +2095,7 @@ func (c *Compiler) generate(tokens goparser.Tokens) (err error) {
 			metaIdx := len(c.Data)
 			c.Data = append(c.Data, vm.ValueOf(meta))
 			push(&symbol.Symbol{Kind: symbol.Value, Type: c.Symbols["int"].Type})
-			c.emit(t, vm.SelectExec, metaIdx, len(descs))
+			c.emit(t, vm.SelectExec, metaIdx, meta.TotalPop<<16|len(descs))
 
 		default:
 			return fmt.Errorf("generate: unsupported token %v", t)
@@ -2038,17 +2122,25 @@ func arithmeticOpType(right, left *symbol.Symbol) *vm.Type {
 	if left.Kind == symbol.Const && right.Kind != symbol.Const {
 		return symbol.Vtype(right)
 	}
-	// Both constants (or both non-const): pick the wider numeric type (float > int per Go spec).
+	// Both constants (or both non-const): pick the wider numeric type (complex > float > int per Go spec).
 	rt, lt := symbol.Vtype(right), symbol.Vtype(left)
-	if rt != nil && lt != nil {
-		rk, lk := rt.Rtype.Kind(), lt.Rtype.Kind()
-		if (lk == reflect.Float32 || lk == reflect.Float64) && rk != reflect.Float32 && rk != reflect.Float64 {
-			return lt
-		}
+	if rt != nil && lt != nil && numRank(lt.Rtype.Kind()) > numRank(rt.Rtype.Kind()) {
+		return lt
 	}
 	return rt
 }
 
+// numRank orders the numeric kinds of untyped constants: int, float, complex.
+func numRank(k reflect.Kind) int {
+	switch k {
+	case reflect.Float32, reflect.Float64:
+		return 1
+	case reflect.Complex64, reflect.Complex128:
+		return 2
+	}
+	return 0
+}
+
 func constKind(right, left *symbol.Symbol) symbol.Kind {
 	if right.Kind == symbol.Const && left.Kind == symbol.Const {
 		return symbol.Const
@@ -2063,6 +2155,19 @@ func (c *Compiler) emitConstConvert(t goparser.Token, s *symbol.Symbol, typ *vm.
 	c.emitNumConvert(t, typ, symbol.Vtype(s), depth)
 }
 
+// emitValueConvert is emitNumConvert for the assigned value s, which also
+// narrows a complex constant, checked representable by the parser, to an
+// integer or float type.
+func (c *Compiler) emitValueConvert(t goparser.Token, typ *vm.Type, s *symbol.Symbol, depth int) {
+	if vt := symbol.Vtype(s); s.Kind == symbol.Const && typ != nil && vt != nil && isComplexKind(vt.Rtype.Kind()) {
+		if k := typ.Rtype.Kind(); k >= reflect.Int && k <= reflect.Float64 {
+			c.emit(t, vm.Convert, c.typeSym(typ).Index, depth)
+			return
+		}
+	}
+	c.emitNumConvert(t, typ, s.Type, depth)
+}
+
 // emitNumConvert emits a Convert when lhs and rhs have different numeric types
 // (e.g. assigning int to float64). depth is the stack offset of the value.
 func (c *Compiler) emitNumConvert(t goparser.Token, lhsType, rhsType *vm.Type, depth int) {
@@ -2070,7 +2175,8 @@ func (c *Compiler) emitNumConvert(t goparser.Token, lhsType, rhsType *vm.Type, d
 		return
 	}
 	lk, rk := lhsType.Rtype.Kind(), rhsType.Rtype.Kind()
-	if lk >= reflect.Int && lk <= reflect.Float64 && rk >= reflect.Int && rk <= reflect.Float64 {
+	if (lk >= reflect.Int && lk <= reflect.Float64 || isComplexKind(lk)) && (rk >= reflect.Int && rk <= reflect.Float64 || isComplexKind(rk)) &&
+		(isComplexKind(lk) || !isComplexKind(rk)) {
 		c.emit(t, vm.Convert, c.typeSym(lhsType).Index, depth)
 	}
 }
@@ -2169,6 +2275,25 @@ func numericOp(base vm.Op, typ *vm.Type) vm.Op {
 	return base + vm.Op(vm.NumKindOffset[k]) //nolint:gosec
 }
 
+// complexOps maps the base numeric opcodes to their complex variant.
+var complexOps = map[vm.Op]vm.Op{
+	vm.AddInt: vm.AddComplex,
+	vm.SubInt: vm.SubComplex,
+	vm.MulInt: vm.MulComplex,
+	vm.DivInt: vm.DivComplex,
+	vm.NegInt: vm.NegComplex,
+}
+
+func isComplexKind(k reflect.Kind) bool { return k == reflect.Complex64 || k == reflect.Complex128 }
+
+// arithOp returns the arithmetic opcode for base and typ, complex or per-type numeric.
+func arithOp(base vm.Op, typ *vm.Type) vm.Op {
+	if op, ok := complexOps[base]; ok && typ != nil && isComplexKind(typ.Rtype.Kind()) {
+		return op
+	}
+	return numericOp(base, typ)
+}
+
 func (c *Compiler) emitArithmeticOp(t goparser.Token, right *symbol.Symbol, typ *vm.Type, baseOp, immOp, fuseOp, strOp vm.Op) {
 	if strOp != 0 && typ != nil && typ.Rtype.Kind() == reflect.String {
 		c.emit(t, strOp)
@@ -2182,7 +2307,7 @@ func (c *Compiler) emitArithmeticOp(t goparser.Token, right *symbol.Symbol, typ
 			return
 		}
 	}
-	c.emit(t, numericOp(baseOp, typ))
+	c.emit(t, arithOp(baseOp, typ))
 }
 
 func (c *Compiler) emitComparisonOp(t goparser.Token, s2 *symbol.Symbol, typ *vm.Type, baseOp, intImm, uintImm, fuseInt, fuseUint, strOp vm.Op, negate bool) {
@@ -2258,7 +2383,7 @@ func (c *Compiler) PrintCode() {
 			if d, ok := labels[i+int(l.A)]; ok {
 				extra = "// " + d[0]
 			}
-		case vm.Get, vm.GetLocal, vm.GetGlobal, vm.SetLocal, vm.SetGlobal, vm.CallImm, vm.CellGet, vm.CellSet:
+		case vm.Get, vm.GetLocal, vm.GetGlobal, vm.SetLocal, vm.SetGlobal, vm.CallImm, vm.TailCall, vm.CellGet, vm.CellSet:
 			if d, ok := data[int(l.A)]; ok {
 				extra = "// " + d
 			}
@@ -2296,8 +2421,8 @@ func (c *Compiler) PrintData() {
 func (c *Compiler) symbolsByIndex() map[int]entry {
 	dict := map[int]entry{}
 	for name, sym := range c.Symbols {
-		if sym.Index == symbol.UnsetAddr {
-			continue
+		if sym.Index == symbol.UnsetAddr || sym.Kind == symbol.Label {
+			continue // Label indexes are code addresses.
 		}
 		dict[sym.Index] = entry{name, sym}
 	}
@@ -2309,6 +2434,7 @@ func (c *Compiler) symbolsByIndex() map[int]entry {
 func (c *Compiler) BuildDebugInfo() *vm.DebugInfo {
 	di := vm.NewDebugInfo()
 	di.Sources = c.Sources
+	funcs := map[int]*symbol.Symbol{}
 
 	for name, sym := range c.Symbols {
 		switch {
@@ -2320,9 +2446,14 @@ func (c *Compiler) BuildDebugInfo() *vm.DebugInfo {
 			// Prefer shorter (less-scoped) names when multiple funcs share an address.
 			if existing, ok := di.Labels[addr]; !ok || len(name) < len(existing) {
 				di.Labels[addr] = name
+				funcs[addr] = sym
+			}
+			if end, ok := c.Symbols[name+"_end"]; ok && end.Value.IsValid() {
+				di.Ends[addr] = int(end.Value.Int())
 			}
 
-		case sym.Kind == symbol.LocalVar && sym.Used && sym.Index != symbol.UnsetAddr:
+		case sym.Kind == symbol.LocalVar && (sym.Used || sym.Index < 0) && sym.Index != symbol.UnsetAddr:
+			// Parameters (negative index) are listed even if unused.
 			// Extract function scope and short variable name from scoped name.
 			// Scoped name format: "main/foo/for0/x" -> funcScope = closest Func ancestor.
 			shortName := name
@@ -2337,14 +2468,63 @@ func (c *Compiler) BuildDebugInfo() *vm.DebugInfo {
 			})
 		}
 	}
-	for idx, e := range c.symbolsByIndex() {
-		if e.Kind != symbol.LocalVar {
-			di.Globals[idx] = e.name
+	for _, lv := range di.Locals {
+		slices.SortFunc(lv, func(a, b vm.LocalVar) int { return a.Offset - b.Offset })
+	}
+	di.Inlined = slices.Clone(c.inlined)
+	traceNames(di, funcs)
+	for name, sym := range c.Symbols {
+		if sym.Kind != symbol.Var || sym.Index == symbol.UnsetAddr {
+			continue
+		}
+		if existing, ok := di.Globals[sym.Index]; !ok || len(name) < len(existing) {
+			di.Globals[sym.Index] = name
 		}
 	}
 	return di
 }
 
+// traceNames sets the stack trace names of functions in di, in the Go
+// runtime form: package qualified, methods as pkg.(*T).m, init functions as
+// pkg.init.N, and closures numbered after their enclosing function, as in
+// pkg.f.func1 or pkg.f.func1.2 for nested ones.
+func traceNames(di *vm.DebugInfo, funcs map[int]*symbol.Symbol) {
+	addrs := slices.Sorted(maps.Keys(funcs))
+	nclo := map[string]int{}
+	for i, addr := range addrs {
+		sym, label := funcs[addr], di.Labels[addr]
+		pkg := cmp.Or(sym.PkgPath, "main")
+		fi := vm.FuncInfo{Args: sym.RecvName != ""}
+		if sym.Type != nil && sym.Type.Rtype != nil && sym.Type.Rtype.Kind() == reflect.Func && sym.Type.Rtype.NumIn() > 0 {
+			fi.Args = true
+		}
+		switch {
+		case strings.HasPrefix(label, "#init"):
+			fi.Name = pkg + ".init." + label[len("#init"):]
+		case strings.HasPrefix(label, "#f"):
+			// Closure code is nested in the code of its enclosing function.
+			parent, sep := pkg+".init", ".func"
+			for _, a := range slices.Backward(addrs[:i]) {
+				if addr < di.Ends[a] {
+					parent = di.Funcs[a].Name
+					if strings.HasPrefix(di.Labels[a], "#f") {
+						sep = "."
+					}
+					break
+				}
+			}
+			nclo[parent]++
+			fi.Name = parent + sep + strconv.Itoa(nclo[parent])
+		case strings.HasPrefix(label, "*"):
+			typ, meth, _ := strings.Cut(label[1:], ".")
+			fi.Name = pkg + ".(*" + typ + ")." + meth
+		default:
+			fi.Name = pkg + "." + label
+		}
+		di.Funcs[addr] = fi
+	}
+}
+
 func enclosingFunc(scopedName string, syms symbol.SymMap) string {
 	scope := scopedName
 	for {
@@ -2381,7 +2561,7 @@ func (c *Compiler) removeFnew(index int) {
 	for i := len(c.Code) - 1; i >= 0; i-- {
 		op := c.Code[i].Op
 		if (op == vm.Fnew || op == vm.FnewE) && int(c.Code[i].A) == index {
-			c.Code[i] = vm.Instruction{Op: vm.Nop}
+			c.Code[i] = vm.Instruction{Op: vm.Nop, Pos: c.Code[i].Pos}
 			return
 		}
 	}
@@ -2391,7 +2571,7 @@ func (c *Compiler) removeGetLocal(index int) {
 	for i := len(c.Code) - 1; i >= 0; i-- {
 		op := c.Code[i].Op
 		if (op == vm.GetLocal || op == vm.CellGet) && int(c.Code[i].A) == index {
-			c.Code[i] = vm.Instruction{Op: vm.Nop}
+			c.Code[i] = vm.Instruction{Op: vm.Nop, Pos: c.Code[i].Pos}
 			return
 		}
 		if op == vm.GetLocal2 && int(c.Code[i].A) == index {
@@ -2411,7 +2591,7 @@ func (c *Compiler) removeGetGlobal(index int) bool {
 			if i+1 < len(c.Code) && c.Code[i+1].Op == vm.Swap {
 				return false
 			}
-			c.Code[i] = vm.Instruction{Op: vm.Nop}
+			c.Code[i] = vm.Instruction{Op: vm.Nop, Pos: c.Code[i].Pos}
 			return true
 		}
 	}
@@ -2626,6 +2806,47 @@ func (c *Compiler) compileBuiltin(
 		c.emit(t, op, narg, int(argSym.Type.Rtype.Kind())) //nolint:gosec
 		return true, nil
 
+	case "complex":
+		if narg != 2 {
+			return true, errors.New("invalid argument count for complex")
+		}
+		im, re := pop(), pop()
+		pop() // complex symbol
+		ftyp := arithmeticOpType(im, re)
+		if ftyp == nil || numRank(ftyp.Rtype.Kind()) != 1 {
+			ftyp = c.Symbols["float64"].Type
+		}
+		c.emitConstConvert(t, im, ftyp, 0)
+		c.emitConstConvert(t, re, ftyp, 1)
+		ctyp := c.Symbols["complex128"].Type
+		if ftyp.Rtype.Kind() == reflect.Float32 {
+			ctyp = c.Symbols["complex64"].Type
+		}
+		push(&symbol.Symbol{Kind: constKind(im, re), Type: ctyp})
+		c.emit(t, vm.Complex)
+		return true, nil
+
+	case "real", "imag":
+		if narg != 1 {
+			return true, fmt.Errorf("invalid argument count for %s", s.Name)
+		}
+		arg := pop()
+		pop() // real/imag symbol
+		typ := c.Symbols["float64"].Type
+		if at := symbol.Vtype(arg); at != nil && at.Rtype.Kind() == reflect.Complex64 {
+			typ = c.Symbols["float32"].Type
+		} else if at == nil || !isComplexKind(at.Rtype.Kind()) {
+			// Untyped numeric constant: its imaginary part is 0.
+			c.emitNumConvert(t, c.Symbols["complex128"].Type, at, 0)
+		}
+		push(&symbol.Symbol{Kind: constKind(arg, arg), Type: typ})
+		op := vm.Real
+		if s.Name == "imag" {
+			op = vm.Imag
+		}
+		c.emit(t, op)
+		return true, nil
+
 	case "unsafe.Sizeof", "unsafe.Alignof":
 		if narg != 1 {
 			return true, fmt.Errorf("invalid argument count for %s", s.Name)
@@ -2746,6 +2967,11 @@ var intrinsicOp = map[string]intrinsicInfo{
 	"math.Min":      {vm.MinFloat64, 2},
 	"math.Max":      {vm.MaxFloat64, 2},
 	"math.Copysign": {vm.CopysignFloat64, 2},
+	// math: float bit patterns.
+	"math.Float32bits":     {vm.Float32Bits, 1},
+	"math.Float32frombits": {vm.Float32FromBits, 1},
+	"math.Float64bits":     {vm.Float64Bits, 1},
+	"math.Float64frombits": {vm.Float64FromBits, 1},
 	// math/bits: leading/trailing zeros.
 	"math/bits.LeadingZeros":    {vm.Clz64, 1},
 	"math/bits.LeadingZeros32":  {vm.Clz32, 1},
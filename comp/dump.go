@@ -1,8 +1,16 @@
 package comp
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
+	"slices"
+	"unsafe"
+
+	"github.com/mvertes/parscan/symbol"
+	"github.com/mvertes/parscan/vm"
 )
 
 // Dump represents the state of a data dump.
@@ -19,6 +27,20 @@ type DumpValue struct {
 	Value any
 }
 
+// Migration converts a dump entry which MigrateDump can not apply as is.
+// typ is the type of the global variable of the same name, or nil if there
+// is none. It returns the entry to apply instead, possibly renamed or with
+// a new value, or nil to skip it.
+type Migration func(dv *DumpValue, typ reflect.Type) (*DumpValue, error)
+
+// DumpReport lists the dump entries and variables not restored as is by MigrateDump.
+type DumpReport struct {
+	Converted []string // entries converted to the type of their variable
+	Migrated  []string // entries changed by the migration callback
+	Removed   []string // entries without variable in the program, skipped
+	Added     []string // variables without entry in the dump, unchanged
+}
+
 // Dump creates a snapshot of the execution state of global variables.
 // This method is specifically implemented in the Compiler to minimize the coupling between
 // the dump format and other components. By situating the dump logic in the Compiler,
@@ -28,16 +50,19 @@ type DumpValue struct {
 // without compromising backward compatibility with dumps generated by previous versions.
 func (c *Compiler) Dump() *Dump {
 	dict := c.symbolsByIndex()
-	dv := make([]*DumpValue, len(c.Data))
+	dv := make([]*DumpValue, 0, len(c.Data))
 	for i, d := range c.Data {
-		e := dict[i]
-		dv[i] = &DumpValue{
+		e, ok := dict[i]
+		if !ok || !d.IsValid() {
+			continue
+		}
+		dv = append(dv, &DumpValue{
 			Index: e.Index,
 			Name:  e.name,
 			Kind:  int(e.Kind),
-			Type:  e.Type.Name,
+			Type:  typeName(e.Type),
 			Value: d.Interface(),
-		}
+		})
 	}
 	return &Dump{Values: dv}
 }
@@ -53,7 +78,7 @@ func (c *Compiler) ApplyDump(d *Dump) error {
 		}
 
 		if dv.Name != e.name ||
-			dv.Type != e.Type.Name ||
+			dv.Type != typeName(e.Type) ||
 			dv.Kind != int(e.Kind) {
 			return fmt.Errorf("entry with index %d does not match with provided entry. "+
 				"dumpValue: %s, %s, %d. memoryValue: %s, %s, %d",
@@ -70,3 +95,267 @@ func (c *Compiler) ApplyDump(d *Dump) error {
 	}
 	return nil
 }
+
+// dumpEntry is the encoded form of a DumpValue. Its type is unnamed, to be
+// decoded without being registered.
+type dumpEntry = struct {
+	Index, Kind int
+	Name, Type  string
+	Value       any
+}
+
+var dumpEntryRtype = reflect.TypeFor[dumpEntry]()
+
+// Encode writes the dump to w. Unlike a snapshot, it does not depend on the
+// code of the program, so that DecodeDump can read it in another version,
+// for MigrateDump. Entries of functions and types are not written. Values
+// of native package symbols, found in pkgs, the values of packages by
+// import path, are written by package path and name.
+func (d *Dump) Encode(w io.Writer, pkgs map[string]map[string]vm.Value) error {
+	vals := make([]vm.Value, 0, len(d.Values))
+	for _, dv := range d.Values {
+		if symbol.Kind(dv.Kind) != symbol.Var {
+			continue
+		}
+		vals = append(vals, vm.ValueOf(dumpEntry{dv.Index, dv.Kind, dv.Name, dv.Type, dv.Value}))
+	}
+	return vm.EncodeValues(w, vals, pkgs)
+}
+
+// DecodeDump reads a dump written by Dump.Encode. Native symbols and named
+// types are resolved in pkgs.
+func DecodeDump(r io.Reader, pkgs map[string]map[string]vm.Value) (*Dump, error) {
+	vals, err := vm.DecodeValues(r, pkgs)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dump{Values: make([]*DumpValue, len(vals))}
+	for i, v := range vals {
+		rv := v.Reflect()
+		if !rv.IsValid() || !rv.CanConvert(dumpEntryRtype) {
+			return nil, errors.New("dump: invalid entry")
+		}
+		e := rv.Convert(dumpEntryRtype).Interface().(dumpEntry)
+		d.Values[i] = &DumpValue{Index: e.Index, Name: e.Name, Kind: e.Kind, Type: e.Type, Value: e.Value}
+	}
+	return d, nil
+}
+
+// MigrateDump restores the global variables saved in a dump of another
+// version of the program. Entries are matched to variables by qualified
+// symbol name instead of index, and values are converted to the type of
+// their variable: integers to wider ones, structs field by field, also in
+// pointers, slices, arrays and maps. The entries which can not be applied,
+// or have no variable, are passed to migrate if not nil. Otherwise, the
+// former are an error and the latter are skipped. Non nil func values can
+// not be applied, as they refer to the code of the program. The variables
+// are set only if all entries are migrated, and left unchanged on error.
+func (c *Compiler) MigrateDump(d *Dump, migrate Migration) (*DumpReport, error) {
+	vars := map[string]*symbol.Symbol{}
+	for name, sym := range c.Symbols {
+		if sym.Kind == symbol.Var && sym.Index >= 0 && sym.Index < len(c.Data) {
+			vars[name] = sym
+		}
+	}
+	report := &DumpReport{}
+	done := map[string]bool{}
+	var dsts, vals []reflect.Value
+	for _, dv := range d.Values {
+		if symbol.Kind(dv.Kind) != symbol.Var {
+			// Functions and types belong to the program, not to its state.
+			continue
+		}
+		name := dv.Name
+		sym := vars[dv.Name]
+		var v reflect.Value
+		err := errNoVar
+		switch {
+		case sym == nil:
+		case sym.Type.Rtype.Kind() == reflect.Func && dv.Value != nil:
+			// A func value is a code address, meaningless in another program.
+			err = errFuncValue
+		default:
+			v, err = migrateValue(c.Data[sym.Index].Reflect(), reflect.ValueOf(dv.Value))
+		}
+		if err != nil && migrate != nil {
+			var typ reflect.Type
+			if sym != nil {
+				typ = sym.Type.Rtype
+			}
+			if dv, err = migrate(dv, typ); err != nil {
+				return nil, fmt.Errorf("entry %s: %w", name, err)
+			}
+			if dv == nil {
+				report.Removed = append(report.Removed, name)
+				continue
+			}
+			report.Migrated = append(report.Migrated, name)
+			if sym = vars[dv.Name]; sym == nil {
+				return nil, fmt.Errorf("entry %s: %w: %s", name, errNoVar, dv.Name)
+			}
+			v, err = migrateValue(c.Data[sym.Index].Reflect(), reflect.ValueOf(dv.Value))
+		} else if err == nil && reflect.TypeOf(dv.Value) != sym.Type.Rtype {
+			report.Converted = append(report.Converted, name)
+		}
+		switch {
+		case errors.Is(err, errNoVar):
+			report.Removed = append(report.Removed, name)
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("entry %s: %w", name, err)
+		}
+		dsts, vals = append(dsts, c.Data[sym.Index].Reflect()), append(vals, v)
+		done[dv.Name] = true
+	}
+	for i, dst := range dsts {
+		dst.Set(vals[i])
+	}
+	for name := range vars {
+		if !done[name] {
+			report.Added = append(report.Added, name)
+		}
+	}
+	slices.Sort(report.Added)
+	return report, nil
+}
+
+var (
+	errNoVar     = errors.New("no such variable")
+	errFuncValue = errors.New("cannot migrate func value")
+)
+
+// migrateValue returns src converted to the type of dst, in a copy of dst.
+func migrateValue(dst, src reflect.Value) (reflect.Value, error) {
+	v := reflect.New(dst.Type()).Elem()
+	v.Set(dst)
+	if err := convertValue(v, src, nil); err != nil {
+		return reflect.Value{}, err
+	}
+	return v, nil
+}
+
+// convertValue sets the settable dst to src, converted to the type of dst.
+// Pointers already converted are in seen, to preserve cycles.
+func convertValue(dst, src reflect.Value, seen map[unsafe.Pointer]reflect.Value) error {
+	if !src.IsValid() {
+		dst.SetZero()
+		return nil
+	}
+	if src.Kind() == reflect.Interface && dst.Kind() != reflect.Interface {
+		return convertValue(dst, src.Elem(), seen)
+	}
+	dt, st := dst.Type(), src.Type()
+	if st.AssignableTo(dt) {
+		dst.Set(src)
+		return nil
+	}
+	switch dk := dt.Kind(); {
+	case dk == st.Kind() && (dk == reflect.Bool || dk == reflect.String):
+		dst.Set(src.Convert(dt))
+		return nil
+	case isInt(dk) && isInt(st.Kind()) && !dst.OverflowInt(src.Int()):
+		dst.SetInt(src.Int())
+		return nil
+	case isUint(dk) && isUint(st.Kind()) && !dst.OverflowUint(src.Uint()):
+		dst.SetUint(src.Uint())
+		return nil
+	case isInt(dk) && isUint(st.Kind()) && src.Uint() <= math.MaxInt64 && !dst.OverflowInt(int64(src.Uint())): //nolint:gosec
+		dst.SetInt(int64(src.Uint())) //nolint:gosec
+		return nil
+	case isUint(dk) && isInt(st.Kind()) && src.Int() >= 0 && !dst.OverflowUint(uint64(src.Int())): //nolint:gosec
+		dst.SetUint(uint64(src.Int())) //nolint:gosec
+		return nil
+	case isFloat(dk) && isFloat(st.Kind()) && dt.Size() >= st.Size():
+		dst.SetFloat(src.Float())
+		return nil
+	case isFloat(dk) && isInt(st.Kind()):
+		dst.SetFloat(float64(src.Int()))
+		return nil
+	case isFloat(dk) && isUint(st.Kind()):
+		dst.SetFloat(float64(src.Uint()))
+		return nil
+	case dk != st.Kind():
+	case dk == reflect.Struct:
+		if !src.CanAddr() {
+			v := reflect.New(st).Elem()
+			v.Set(src)
+			src = v
+		}
+		for i := range dt.NumField() {
+			sf := src.FieldByName(dt.Field(i).Name)
+			if !sf.IsValid() {
+				continue // A new field, left to its zero value.
+			}
+			df := dst.Field(i)
+			df = reflect.NewAt(df.Type(), unsafe.Pointer(df.UnsafeAddr())).Elem()
+			sf = reflect.NewAt(sf.Type(), unsafe.Pointer(sf.UnsafeAddr())).Elem()
+			if err := convertValue(df, sf, seen); err != nil {
+				return fmt.Errorf("field %s: %w", dt.Field(i).Name, err)
+			}
+		}
+		return nil
+	case dk == reflect.Pointer:
+		if src.IsNil() {
+			dst.SetZero()
+			return nil
+		}
+		if p, ok := seen[src.UnsafePointer()]; ok && p.Type() == dt {
+			dst.Set(p)
+			return nil
+		}
+		if seen == nil {
+			seen = map[unsafe.Pointer]reflect.Value{}
+		}
+		p := reflect.New(dt.Elem())
+		seen[src.UnsafePointer()] = p
+		dst.Set(p)
+		return convertValue(p.Elem(), src.Elem(), seen)
+	case dk == reflect.Slice:
+		if src.IsNil() {
+			dst.SetZero()
+			return nil
+		}
+		dst.Set(reflect.MakeSlice(dt, src.Len(), src.Len()))
+		return convertElems(dst, src, seen)
+	case dk == reflect.Array && dt.Len() == st.Len():
+		return convertElems(dst, src, seen)
+	case dk == reflect.Map:
+		if src.IsNil() {
+			dst.SetZero()
+			return nil
+		}
+		dst.Set(reflect.MakeMapWithSize(dt, src.Len()))
+		for it := src.MapRange(); it.Next(); {
+			k, v := reflect.New(dt.Key()).Elem(), reflect.New(dt.Elem()).Elem()
+			if err := convertValue(k, it.Key(), seen); err != nil {
+				return err
+			}
+			if err := convertValue(v, it.Value(), seen); err != nil {
+				return err
+			}
+			dst.SetMapIndex(k, v)
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot convert %s to %s", st, dt)
+}
+
+func convertElems(dst, src reflect.Value, seen map[unsafe.Pointer]reflect.Value) error {
+	for i := range src.Len() {
+		if err := convertValue(dst.Index(i), src.Index(i), seen); err != nil {
+			return fmt.Errorf("index %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func isInt(k reflect.Kind) bool   { return k >= reflect.Int && k <= reflect.Int64 }
+func isUint(k reflect.Kind) bool  { return k >= reflect.Uint && k <= reflect.Uintptr }
+func isFloat(k reflect.Kind) bool { return k == reflect.Float32 || k == reflect.Float64 }
+
+func typeName(t *vm.Type) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
@@ -0,0 +1,51 @@
+package comp
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/mvertes/parscan/symbol"
+	"github.com/mvertes/parscan/vm"
+)
+
+// Image returns the compiled program as a bytecode image, to be run later
+// without the compiler. The values of native packages in data are recorded
+// by package path and name, to be resolved again when the image is loaded.
+func (c *Compiler) Image() *vm.Image {
+	img := &vm.Image{
+		Code:        c.Code,
+		Data:        c.Data,
+		MethodNames: c.MethodNames(),
+		Entry:       c.Entry,
+		Debug:       c.BuildDebugInfo(),
+	}
+	for name, s := range c.Symbols {
+		if s.Kind != symbol.Value || s.Index == symbol.UnsetAddr {
+			continue
+		}
+		if pkg, ok := c.nativePkg(name); ok {
+			img.Natives = append(img.Natives, vm.NativeSym{Index: s.Index, Pkg: pkg, Name: name[len(pkg)+1:]})
+		}
+	}
+	slices.SortFunc(img.Natives, func(a, b vm.NativeSym) int { return a.Index - b.Index })
+	for _, fn := range append(slices.Clip(c.InitFuncs), "main") {
+		if s, ok := c.Symbols[fn]; ok {
+			img.Start = append(img.Start, s.Index)
+		}
+	}
+	return img
+}
+
+// nativePkg returns the path of the native package defining the symbol of
+// qualified name, the longest in case of ambiguity.
+func (c *Compiler) nativePkg(name string) (string, bool) {
+	path := ""
+	for p, pkg := range c.Packages {
+		if pkg.Bin && len(p) > len(path) && strings.HasPrefix(name, p+".") {
+			if _, ok := pkg.Values[name[len(p)+1:]]; ok {
+				path = p
+			}
+		}
+	}
+	return path, path != ""
+}
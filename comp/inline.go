@@ -0,0 +1,222 @@
+package comp
+
+import (
+	"math"
+	"reflect"
+	"slices"
+
+	"github.com/mvertes/parscan/comp/opt"
+	"github.com/mvertes/parscan/symbol"
+	"github.com/mvertes/parscan/vm"
+)
+
+// inlineMax is the maximum number of instructions of an inlined function.
+const inlineMax = 12
+
+// inlinee is a function which can be inlined.
+type inlinee struct {
+	name    string  // function name
+	entry   int     // index of its Grow
+	body    vm.Code // instructions after Grow, with jumps inside body
+	depth   []int   // stack depth at each instruction of body
+	reserve int     // stack depth reserved by Grow
+}
+
+// inline substitutes in the code produced from start the direct calls of
+// small leaf functions by their body. The function arguments are left in
+// place on the caller stack and addressed as locals of the caller, as its
+// expression stack depth at the call is known. Returns drop the arguments
+// below the results and jump after the inlined body. Callers with defer
+// are skipped, as deferred calls are recorded on their stack at run time.
+//
+// Inlined functions have no locals other than parameters, no calls, no
+// defer, no closures, and no access to the frame other than by parameters.
+// Inlined instructions keep their source position.
+func (c *Compiler) inline(start int) {
+	// Code is followed by the start code, which ends execution.
+	depth, from, err := vm.Depths(append(slices.Clip(c.Code), vm.Instruction{Op: vm.Exit}), len(c.Data))
+	if err != nil {
+		return
+	}
+	size := map[int]int{}       // number of instructions reached from each entry
+	deferring := map[int]bool{} // entries of functions with defer
+	for ip, f := range from {
+		size[f]++
+		if ip < len(c.Code) && c.Code[ip].Op == vm.DeferPush {
+			deferring[f] = true
+		}
+	}
+	cache := map[int]*inlinee{}
+	callee := func(index int) *inlinee {
+		f, ok := cache[index]
+		if !ok {
+			f = c.inlinee(index, from, depth, size)
+			cache[index] = f
+		}
+		return f
+	}
+
+	var code vm.Code
+	var orig []int // index in c.Code of each instruction of code, or -1
+	var inlined []vm.InlinedCall
+	reloc := make([]int, len(c.Code)-start+1)
+	grow := map[int]int{} // stack depth to reserve by callers, by entry
+	for ip := start; ip < len(c.Code); ip++ {
+		reloc[ip-start] = len(code)
+		in := c.Code[ip]
+		if e := from[ip]; (in.Op == vm.CallImm || in.Op == vm.TailCall) && e >= start && c.Code[e].Op == vm.Grow && !deferring[e] {
+			narg, nret := int(in.B>>16), int(in.B&0xFFFF)
+			if f := callee(int(in.A)); f != nil && f.entry != e && depth[ip] >= narg {
+				shift := int(c.Code[e].A) + depth[ip] + 3 // parameter -narg-2 is the first argument
+				if x := f.expand(narg, nret, shift); x != nil {
+					inlined = append(inlined, vm.InlinedCall{Start: start + len(code), End: start + len(code) + len(x), Func: f.name, Pos: in.Pos})
+					code = append(code, x...)
+					for range x {
+						orig = append(orig, -1)
+					}
+					grow[e] = max(grow[e], depth[ip]+f.reserve)
+					continue
+				}
+			}
+		}
+		code = append(code, in)
+		orig = append(orig, ip)
+	}
+	if len(code) == len(c.Code)-start {
+		return
+	}
+	reloc[len(c.Code)-start] = len(code)
+	for i, ip := range orig {
+		if ip >= 0 && opt.Jumps(code[i].Op) {
+			if t := ip + int(code[i].A) - start; t >= 0 && t < len(reloc) {
+				code[i].A = int32(reloc[t] - i) //nolint:gosec
+			}
+		}
+	}
+	for e, d := range grow {
+		g := &code[reloc[e-start]]
+		g.B = max(g.B, int32(d)) //nolint:gosec
+	}
+	syms := c.codeSymbols(start)
+	c.Code = append(c.Code[:start], code...)
+	c.relocate(start, syms, reloc)
+	c.inlined = append(c.inlined, inlined...)
+}
+
+// inlinee returns the function whose code address is in data at index if
+// it can be inlined, or nil.
+func (c *Compiler) inlinee(index int, from, depth []int, size map[int]int) *inlinee {
+	if index < 0 || index >= len(c.Data) || c.Data[index].Kind() != reflect.Int {
+		return nil
+	}
+	e := int(c.Data[index].Int())
+	if e < 0 || e >= len(c.Code) || from[e] != e || c.Code[e].Op != vm.Grow || c.Code[e].A != 0 {
+		return nil
+	}
+	// The body must be contiguous, with all its jumps inside.
+	n := size[e] - 1
+	if n < 1 || n > inlineMax || e+n >= len(c.Code) {
+		return nil
+	}
+	body := c.Code[e+1 : e+1+n]
+	for i, in := range body {
+		if from[e+1+i] != e || !inlinable(in.Op) {
+			return nil
+		}
+		if opt.Jumps(in.Op) {
+			if t := i + int(in.A); t < 0 || t >= n {
+				return nil
+			}
+		}
+	}
+	name := ""
+	for n, s := range c.Symbols {
+		// Prefer shorter (less-scoped) names, as in debug information.
+		if s.Kind == symbol.Func && s.Index == index && (name == "" || len(n) < len(name)) {
+			name = n
+		}
+	}
+	return &inlinee{name: name, entry: e, body: body, depth: depth[e+1 : e+1+n], reserve: int(c.Code[e].B)}
+}
+
+// inlinable reports whether op can be part of an inlined function.
+func inlinable(op vm.Op) bool {
+	switch op {
+	case vm.Call, vm.CallImm, vm.TailCall, vm.GoCall, vm.GoCallImm, vm.DeferPush, vm.DeferRet, vm.Recover,
+		vm.MkClosure, vm.HeapAlloc, vm.HeapGet, vm.HeapPtr, vm.HeapSet, vm.CellGet, vm.CellSet,
+		vm.AddrLocal, vm.Get, vm.Grow, vm.Trap, vm.Panic, vm.PanicUnwind, vm.Exit,
+		vm.Next, vm.Next0, vm.Next2, vm.NextLocal, vm.Next2Local, vm.Pull, vm.Pull2, vm.Stop, vm.SelectExec:
+		return false
+	}
+	return true
+}
+
+// expand returns the body of f called with narg arguments for nret results,
+// its parameters shifted by shift to caller locals, or nil if not possible.
+func (f *inlinee) expand(narg, nret, shift int) vm.Code {
+	local := func(a int32) (int32, bool) {
+		if a > -3 || a < int32(-narg-2) { //nolint:gosec
+			return 0, false // not a parameter
+		}
+		return a + int32(shift), a+int32(shift) <= math.MaxInt16 //nolint:gosec
+	}
+	var x vm.Code
+	pos := make([]int, len(f.body)) // index in x of each instruction of body
+	var exits []int                 // jumps to the end of x
+	for i, in := range f.body {
+		pos[i] = len(x)
+		ok := true
+		switch in.Op {
+		case vm.GetLocal, vm.SetLocal, vm.New, vm.GetLocalAddIntImm, vm.GetLocalSubIntImm, vm.GetLocalMulIntImm,
+			vm.GetLocalLowerIntImm, vm.GetLocalLowerUintImm, vm.GetLocalGreaterIntImm, vm.GetLocalGreaterUintImm:
+			in.A, ok = local(in.A)
+		case vm.GetLocal2:
+			var ok2 bool
+			in.A, ok = local(in.A)
+			in.B, ok2 = local(in.B)
+			ok = ok && ok2
+		case vm.GetLocalLowerIntImmJumpFalse, vm.GetLocalLowerIntImmJumpTrue:
+			var l int32
+			l, ok = local(in.B >> 16)
+			in.B = l<<16 | in.B&0xFFFF
+		case vm.GetLocalReturn, vm.Return:
+			d := f.depth[i]
+			if in.Op == vm.GetLocalReturn {
+				var a int32
+				if a, ok = local(in.A); !ok {
+					return nil
+				}
+				x = append(x, vm.Instruction{Op: vm.GetLocal, A: a, Pos: in.Pos})
+				d++
+			}
+			if d != nret {
+				return nil // values left below results
+			}
+			// Move the results over the arguments, and drop them.
+			if narg > 0 {
+				for r := range nret {
+					x = append(x, vm.Instruction{Op: vm.Swap, A: int32(nret - 1 - r), B: int32(narg + nret - 1 - r), Pos: in.Pos}) //nolint:gosec
+				}
+				x = append(x, vm.Instruction{Op: vm.Pop, A: int32(narg), Pos: in.Pos}) //nolint:gosec
+			}
+			if i < len(f.body)-1 {
+				exits = append(exits, len(x))
+				x = append(x, vm.Instruction{Op: vm.Jump, Pos: in.Pos})
+			}
+			continue
+		}
+		if !ok {
+			return nil
+		}
+		x = append(x, in)
+	}
+	for i, in := range f.body {
+		if opt.Jumps(in.Op) {
+			x[pos[i]].A = int32(pos[i+int(in.A)] - pos[i]) //nolint:gosec
+		}
+	}
+	for _, j := range exits {
+		x[j].A = int32(len(x) - j) //nolint:gosec
+	}
+	return x
+}
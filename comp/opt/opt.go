@@ -0,0 +1,405 @@
+// Package opt optimizes the code produced by the compiler, once complete.
+//
+// Instructions are rewritten in place and the removed ones are only marked,
+// so jump offsets remain valid until the code is compacted and jumps are
+// relocated, at the end.
+package opt
+
+import (
+	"math"
+
+	"github.com/mvertes/parscan/vm"
+)
+
+// Optimization levels.
+const (
+	InlineLevel = 3 // lowest level at which the compiler inlines functions
+	MaxLevel    = 3 // highest optimization level
+)
+
+// Optimize returns code optimized at level:
+//
+//   - 0: no change;
+//   - 1: jump threading and dead code elimination;
+//   - 2: also constant folding and elimination of redundant local stores;
+//   - 3: the same, the compiler having inlined small functions before.
+//
+// Execution starts at instruction 0, at function entries (Grow) and at
+// the other entries given, and continues past the end of code. Optimize
+// also returns the new index of each instruction of code, or of the next
+// instruction kept if it was removed, up to len(code) included, to relocate
+// the code addresses held outside of code.
+func Optimize(code vm.Code, entries []int, level int) (vm.Code, []int) {
+	o := &optimizer{
+		code:    append(vm.Code{}, code...),
+		removed: make([]bool, len(code)+1),
+		target:  make([]bool, len(code)+1),
+		root:    make([]bool, len(code)+1),
+	}
+	for i, c := range code {
+		o.root[i] = i == 0 || c.Op == vm.Grow
+	}
+	for _, e := range entries {
+		if e >= 0 && e < len(code) {
+			o.root[e] = true
+		}
+	}
+	if level > 0 && len(code) > 0 {
+		for changed := true; changed; {
+			o.targets()
+			changed = o.deadCode()
+			o.targets()
+			changed = o.thread() || changed
+			if level > 1 {
+				o.targets()
+				changed = o.fold() || changed
+				changed = o.locals() || changed
+			}
+		}
+	}
+	return o.compact()
+}
+
+type optimizer struct {
+	code    vm.Code
+	removed []bool // instruction is removed, the last entry is the end of code
+	target  []bool // instruction is reached otherwise than by falling through
+	root    []bool // execution may start at instruction
+}
+
+// next returns the index of the first instruction kept from i.
+func (o *optimizer) next(i int) int {
+	for i < len(o.code) && o.removed[i] {
+		i++
+	}
+	return i
+}
+
+// prev returns the index of the last instruction kept before i, or -1.
+func (o *optimizer) prev(i int) int {
+	for i--; i >= 0 && o.removed[i]; i-- {
+	}
+	return i
+}
+
+// Jumps reports whether op jumps to ip + A.
+func Jumps(op vm.Op) bool {
+	switch op {
+	case vm.Jump, vm.JumpTrue, vm.JumpFalse, vm.JumpSetTrue, vm.JumpSetFalse,
+		vm.LowerIntImmJumpFalse, vm.LowerIntImmJumpTrue,
+		vm.GetLocalLowerIntImmJumpFalse, vm.GetLocalLowerIntImmJumpTrue,
+		vm.TypeBranch, vm.Next, vm.Next0, vm.Next2, vm.NextLocal, vm.Next2Local:
+		return true
+	}
+	return false
+}
+
+// ends reports whether execution never continues after op.
+func ends(op vm.Op) bool {
+	switch op {
+	case vm.Jump, vm.Return, vm.GetLocalReturn, vm.Exit, vm.Panic:
+		return true
+	}
+	return false
+}
+
+// dest returns the index of the instruction executed after the jump at i.
+func (o *optimizer) dest(i int) int { return o.next(i + int(o.code[i].A)) }
+
+// targets marks the entries and the destinations of jumps.
+func (o *optimizer) targets() {
+	clear(o.target)
+	for i, c := range o.code {
+		if o.root[i] {
+			o.target[o.next(i)] = true
+		}
+		if !o.removed[i] && Jumps(c.Op) {
+			o.target[o.dest(i)] = true
+		}
+	}
+}
+
+// deadCode removes the instructions not reachable from an entry.
+func (o *optimizer) deadCode() bool {
+	reached := make([]bool, len(o.code)+1)
+	var work []int
+	for i := range o.code {
+		if r := o.next(i); o.root[i] && !reached[r] {
+			reached[r] = true
+			work = append(work, r)
+		}
+	}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i == len(o.code) {
+			continue
+		}
+		var succ []int
+		if Jumps(o.code[i].Op) {
+			succ = append(succ, o.dest(i))
+		}
+		if !ends(o.code[i].Op) {
+			succ = append(succ, o.next(i+1))
+		}
+		for _, s := range succ {
+			if !reached[s] {
+				reached[s] = true
+				work = append(work, s)
+			}
+		}
+	}
+	changed := false
+	for i := range o.code {
+		if !o.removed[i] && !reached[i] {
+			o.removed[i], changed = true, true
+		}
+	}
+	return changed
+}
+
+// thread retargets the jumps to unconditional jumps, replaces the jumps to
+// a return by the return itself, inverts the conditional jumps over an
+// unconditional one, and removes the jumps to the next instruction and the
+// Nop instructions.
+func (o *optimizer) thread() bool {
+	changed := false
+	for i, c := range o.code {
+		if !o.removed[i] && c.Op == vm.Nop {
+			o.removed[i], changed = true, true
+		}
+		if o.removed[i] || !Jumps(c.Op) {
+			continue
+		}
+		d := o.dest(i)
+		for n := 0; d < len(o.code) && o.code[d].Op == vm.Jump && d != i && n < len(o.code); n++ {
+			d = o.dest(d)
+		}
+		if d != o.dest(i) {
+			o.code[i].A = int32(d - i) //nolint:gosec
+			changed = true
+		}
+		switch {
+		case c.Op == vm.Jump && d < len(o.code) && (o.code[d].Op == vm.Return || o.code[d].Op == vm.GetLocalReturn):
+			o.code[i] = o.code[d]
+			changed = true
+		case d != o.next(i+1):
+		case c.Op == vm.Jump:
+			o.removed[i], changed = true, true
+		case c.Op == vm.JumpTrue || c.Op == vm.JumpFalse:
+			if p := o.prev(i); p < 0 || o.code[p].Op != vm.EqualSet {
+				o.code[i] = vm.Instruction{Op: vm.Pop, A: 1, Pos: c.Pos}
+				changed = true
+			}
+		}
+		if c.Op != vm.JumpTrue && c.Op != vm.JumpFalse || o.removed[i] || o.code[i].Op != c.Op {
+			continue
+		}
+		if p := o.prev(i); p >= 0 && o.code[p].Op == vm.EqualSet {
+			continue
+		}
+		if j := o.next(i + 1); j < len(o.code) && o.code[j].Op == vm.Jump && !o.target[j] && o.dest(i) == o.next(j+1) {
+			o.code[i].Op = vm.JumpTrue
+			if c.Op == vm.JumpTrue {
+				o.code[i].Op = vm.JumpFalse
+			}
+			o.code[i].A = int32(o.dest(j) - i) //nolint:gosec
+			o.removed[j], changed = true, true
+		}
+	}
+	return changed
+}
+
+// fold computes the arithmetic on constants pushed on stack, and removes
+// the values pushed then popped.
+func (o *optimizer) fold() bool {
+	changed := false
+	for i, c := range o.code {
+		if o.removed[i] {
+			continue
+		}
+		j := o.next(i + 1)
+		if j == len(o.code) || o.target[j] {
+			continue
+		}
+		d := o.code[j]
+		switch c.Op {
+		case vm.Push:
+			a := int64(c.A)
+			if r, ok := foldUnary(d.Op, a, int64(d.A)); ok {
+				o.code[i].A = int32(r) //nolint:gosec
+				o.removed[j], changed = true, true
+				continue
+			}
+			k := o.next(j + 1)
+			if d.Op != vm.Push || k == len(o.code) || o.target[k] {
+				break
+			}
+			if r, ok := foldBinary(o.code[k].Op, a, int64(d.A)); ok {
+				o.code[i].A = int32(r) //nolint:gosec
+				o.removed[j], o.removed[k], changed = true, true, true
+				continue
+			}
+		case vm.GetLocal, vm.GetGlobal:
+		default:
+			continue
+		}
+		if d.Op == vm.Pop && d.A > 0 {
+			o.removed[i], changed = true, true
+			if d.A == 1 {
+				o.removed[j] = true
+			} else {
+				o.code[j].A--
+			}
+		}
+	}
+	return changed
+}
+
+func foldUnary(op vm.Op, a, b int64) (int64, bool) {
+	switch op {
+	case vm.AddIntImm:
+		return fits(a + b)
+	case vm.SubIntImm:
+		return fits(a - b)
+	case vm.MulIntImm:
+		return fits(a * b)
+	case vm.NegInt:
+		return fits(-a)
+	}
+	return 0, false
+}
+
+func foldBinary(op vm.Op, a, b int64) (int64, bool) {
+	switch op {
+	case vm.AddInt:
+		return fits(a + b)
+	case vm.SubInt:
+		return fits(a - b)
+	case vm.MulInt:
+		return fits(a * b)
+	}
+	return 0, false
+}
+
+// fits reports whether r can be pushed as an operand.
+func fits(r int64) (int64, bool) { return r, r >= math.MinInt32 && r <= math.MaxInt32 }
+
+// locals eliminates, in each function, the stores of local variables
+// which are never read, and the store of a value immediately read back
+// if it is the only use of the variable.
+func (o *optimizer) locals() bool {
+	changed := false
+	for entry := range o.code {
+		if o.removed[entry] || o.code[entry].Op != vm.Grow {
+			continue
+		}
+		body := o.function(entry)
+		stores := map[int32][]int{} // SetLocal instructions by local
+		reads := map[int32][]int{}  // other instructions using a local, by local
+		for _, i := range body {
+			c := o.code[i]
+			if c.Op == vm.SetLocal {
+				stores[c.A] = append(stores[c.A], i)
+				continue
+			}
+			for _, l := range usedLocals(c) {
+				reads[l] = append(reads[l], i)
+			}
+		}
+		for l, s := range stores {
+			r := reads[l]
+			switch {
+			case l <= 0:
+			case len(r) == 0:
+				for _, i := range s {
+					o.code[i] = vm.Instruction{Op: vm.Pop, A: 1, Pos: o.code[i].Pos}
+				}
+				changed = true
+			case len(s) == 1 && len(r) == 1 && o.code[r[0]].Op == vm.GetLocal &&
+				o.next(s[0]+1) == r[0] && !o.target[r[0]]:
+				o.removed[s[0]], o.removed[r[0]], changed = true, true, true
+			}
+		}
+	}
+	return changed
+}
+
+// function returns the indexes of the instructions of the function
+// starting at entry.
+func (o *optimizer) function(entry int) []int {
+	seen := map[int]bool{entry: true}
+	work := []int{entry}
+	var body []int
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i == len(o.code) {
+			continue
+		}
+		body = append(body, i)
+		var succ []int
+		if Jumps(o.code[i].Op) {
+			succ = append(succ, o.dest(i))
+		}
+		if !ends(o.code[i].Op) {
+			succ = append(succ, o.next(i+1))
+		}
+		for _, s := range succ {
+			if !seen[s] {
+				seen[s] = true
+				work = append(work, s)
+			}
+		}
+	}
+	return body
+}
+
+// usedLocals returns the local variables used by an instruction, other
+// than SetLocal.
+func usedLocals(c vm.Instruction) []int32 {
+	switch c.Op {
+	case vm.GetLocal, vm.AddrLocal, vm.CellGet, vm.CellSet, vm.New, vm.GetLocalReturn,
+		vm.GetLocalAddIntImm, vm.GetLocalSubIntImm, vm.GetLocalMulIntImm,
+		vm.GetLocalLowerIntImm, vm.GetLocalLowerUintImm, vm.GetLocalGreaterIntImm, vm.GetLocalGreaterUintImm:
+		return []int32{c.A}
+	case vm.GetLocal2:
+		return []int32{c.A, c.B}
+	case vm.Get:
+		if c.A == vm.Local {
+			return []int32{c.B}
+		}
+	case vm.NextLocal:
+		return []int32{c.B}
+	case vm.Next2Local:
+		return []int32{int32(int16(c.B)), int32(int16(c.B >> 16))} //nolint:gosec
+	case vm.GetLocalLowerIntImmJumpFalse, vm.GetLocalLowerIntImmJumpTrue:
+		return []int32{c.B >> 16}
+	}
+	return nil
+}
+
+// compact returns the code kept, with relocated jumps, and the new index
+// of each instruction.
+func (o *optimizer) compact() (vm.Code, []int) {
+	reloc := make([]int, len(o.code)+1)
+	n := 0
+	for i := range o.code {
+		reloc[i] = n
+		if !o.removed[i] {
+			n++
+		}
+	}
+	reloc[len(o.code)] = n
+	code := make(vm.Code, 0, n)
+	for i, c := range o.code {
+		if o.removed[i] {
+			continue
+		}
+		if Jumps(c.Op) {
+			c.A = int32(reloc[o.dest(i)] - reloc[i]) //nolint:gosec
+		}
+		code = append(code, c)
+	}
+	return code, reloc
+}
@@ -0,0 +1,74 @@
+package opt
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/mvertes/parscan/vm"
+)
+
+func TestOptimize(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		level int
+		code  vm.Code
+		want  vm.Code
+	}{
+		{"none", 0,
+			vm.Code{{Op: vm.Jump, A: 1}, {Op: vm.Exit}},
+			vm.Code{{Op: vm.Jump, A: 1}, {Op: vm.Exit}}},
+		{"jump next", 1,
+			vm.Code{{Op: vm.Jump, A: 1}, {Op: vm.Exit}},
+			vm.Code{{Op: vm.Exit}}},
+		{"dead code", 1,
+			vm.Code{{Op: vm.Jump, A: 3}, {Op: vm.Push, A: 1}, {Op: vm.Pop, A: 1}, {Op: vm.Exit}},
+			vm.Code{{Op: vm.Exit}}},
+		{"thread", 1,
+			vm.Code{{Op: vm.Push}, {Op: vm.JumpFalse, A: 2}, {Op: vm.Exit}, {Op: vm.Jump, A: -1}},
+			vm.Code{{Op: vm.Push}, {Op: vm.Pop, A: 1}, {Op: vm.Exit}}},
+		{"invert", 1,
+			vm.Code{{Op: vm.Push}, {Op: vm.JumpFalse, A: 2}, {Op: vm.Jump, A: 3}, {Op: vm.Push, A: 1}, {Op: vm.Exit}, {Op: vm.Exit}},
+			vm.Code{{Op: vm.Push}, {Op: vm.JumpTrue, A: 3}, {Op: vm.Push, A: 1}, {Op: vm.Exit}, {Op: vm.Exit}}},
+		{"equal set", 1,
+			vm.Code{{Op: vm.Push}, {Op: vm.Push}, {Op: vm.EqualSet}, {Op: vm.JumpFalse, A: 1}, {Op: vm.Exit}},
+			vm.Code{{Op: vm.Push}, {Op: vm.Push}, {Op: vm.EqualSet}, {Op: vm.JumpFalse, A: 1}, {Op: vm.Exit}}},
+		{"return", 1,
+			vm.Code{{Op: vm.Grow, A: 1}, {Op: vm.Jump, A: 2}, {Op: vm.Exit}, {Op: vm.GetLocalReturn, A: 1, B: 1}},
+			vm.Code{{Op: vm.Grow, A: 1}, {Op: vm.GetLocalReturn, A: 1, B: 1}}},
+		{"fold", 2,
+			vm.Code{{Op: vm.Push, A: 2}, {Op: vm.Push, A: 3}, {Op: vm.MulInt}, {Op: vm.AddIntImm, A: 1}, {Op: vm.Exit}},
+			vm.Code{{Op: vm.Push, A: 7}, {Op: vm.Exit}}},
+		{"overflow", 2,
+			vm.Code{{Op: vm.Push, A: 1 << 30}, {Op: vm.MulIntImm, A: 4}, {Op: vm.Exit}},
+			vm.Code{{Op: vm.Push, A: 1 << 30}, {Op: vm.MulIntImm, A: 4}, {Op: vm.Exit}}},
+		{"push pop", 2,
+			vm.Code{{Op: vm.GetGlobal}, {Op: vm.Pop, A: 1}, {Op: vm.Exit}},
+			vm.Code{{Op: vm.Exit}}},
+		{"store load", 2,
+			vm.Code{{Op: vm.Grow, A: 1, B: 1}, {Op: vm.Push, A: 1}, {Op: vm.SetLocal, A: 1}, {Op: vm.GetLocal, A: 1}, {Op: vm.Return, A: 1, B: 1}},
+			vm.Code{{Op: vm.Grow, A: 1, B: 1}, {Op: vm.Push, A: 1}, {Op: vm.Return, A: 1, B: 1}}},
+		{"dead store", 2,
+			vm.Code{{Op: vm.Grow, A: 1, B: 1}, {Op: vm.GetGlobal}, {Op: vm.SetLocal, A: 1}, {Op: vm.Return}},
+			vm.Code{{Op: vm.Grow, A: 1, B: 1}, {Op: vm.Return}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			code, reloc := Optimize(test.code, nil, test.level)
+			if !slices.Equal(code, test.want) {
+				t.Errorf("got %v, want %v", code, test.want)
+			}
+			if len(reloc) != len(test.code)+1 || reloc[len(test.code)] != len(code) {
+				t.Errorf("got reloc %v", reloc)
+			}
+		})
+	}
+}
+
+func TestOptimizeEntries(t *testing.T) {
+	// Instruction 1 is only reached from an entry given by the caller.
+	code := vm.Code{{Op: vm.Exit}, {Op: vm.Nop}, {Op: vm.Exit}}
+	got, reloc := Optimize(code, []int{1}, 1)
+	want := vm.Code{{Op: vm.Exit}, {Op: vm.Exit}}
+	if !slices.Equal(got, want) || reloc[1] != 1 {
+		t.Errorf("got %v %v, want %v with 1 relocated to 1", got, reloc, want)
+	}
+}
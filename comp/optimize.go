@@ -0,0 +1,62 @@
+package comp
+
+import (
+	"reflect"
+
+	"github.com/mvertes/parscan/comp/opt"
+	"github.com/mvertes/parscan/symbol"
+	"github.com/mvertes/parscan/vm"
+)
+
+// optimize optimizes the code produced from start at c.OptLevel, then
+// relocates the code addresses of functions and labels, in symbols and data.
+func (c *Compiler) optimize(start int) {
+	if c.OptLevel <= 0 || start >= len(c.Code) {
+		return
+	}
+	if c.OptLevel >= opt.InlineLevel {
+		c.inline(start)
+	}
+	var entries []int
+	syms := c.codeSymbols(start)
+	for s, a := range syms {
+		if s.Kind == symbol.Func {
+			entries = append(entries, a)
+		}
+	}
+	code, reloc := opt.Optimize(c.Code[start:], entries, c.OptLevel)
+	c.Code = append(c.Code[:start], code...)
+	c.relocate(start, syms, reloc)
+}
+
+// codeSymbols returns the func and label symbols set to an address in the
+// code produced from start, with the address relative to start.
+func (c *Compiler) codeSymbols(start int) map[*symbol.Symbol]int {
+	syms := map[*symbol.Symbol]int{}
+	for _, s := range c.Symbols {
+		if s.Kind != symbol.Func && s.Kind != symbol.Label || !s.Value.IsValid() || s.Value.Kind() != reflect.Int {
+			continue
+		}
+		if a := int(s.Value.Int()) - start; a >= 0 && a <= len(c.Code)-start {
+			syms[s] = a
+		}
+	}
+	return syms
+}
+
+// relocate sets the symbols syms, and the data of funcs, to their address
+// relative to start relocated by reloc, and relocates the inlined calls.
+func (c *Compiler) relocate(start int, syms map[*symbol.Symbol]int, reloc []int) {
+	for i, ic := range c.inlined {
+		if ic.Start >= start {
+			c.inlined[i].Start, c.inlined[i].End = start+reloc[ic.Start-start], start+reloc[ic.End-start]
+		}
+	}
+	for s, a := range syms {
+		v := vm.ValueOf(start + reloc[a])
+		if s.Kind == symbol.Func && s.Index >= 0 && s.Index < len(c.Data) && c.Data[s.Index].Int() == s.Value.Int() {
+			c.Data[s.Index] = v
+		}
+		s.Value = v
+	}
+}
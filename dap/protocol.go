@@ -0,0 +1,209 @@
+// Package dap implements a Debug Adapter Protocol server for programs run
+// by the parscan virtual machine.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Protocol messages. Only the fields used by the server are declared.
+type (
+	message struct {
+		Seq  int    `json:"seq"`
+		Type string `json:"type"`
+	}
+
+	request struct {
+		message
+		Command   string          `json:"command"`
+		Arguments json.RawMessage `json:"arguments,omitempty"`
+	}
+
+	response struct {
+		message
+		RequestSeq int    `json:"request_seq"`
+		Success    bool   `json:"success"`
+		Command    string `json:"command"`
+		Message    string `json:"message,omitempty"`
+		Body       any    `json:"body,omitempty"`
+	}
+
+	event struct {
+		message
+		Event string `json:"event"`
+		Body  any    `json:"body,omitempty"`
+	}
+)
+
+// Request arguments.
+type (
+	launchArgs struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+
+	source struct {
+		Name string `json:"name,omitempty"`
+		Path string `json:"path,omitempty"`
+	}
+
+	sourceBreakpoint struct {
+		Line      int    `json:"line"`
+		Condition string `json:"condition,omitempty"`
+	}
+
+	setBreakpointsArgs struct {
+		Source      source             `json:"source"`
+		Breakpoints []sourceBreakpoint `json:"breakpoints"`
+	}
+
+	functionBreakpoint struct {
+		Name      string `json:"name"`
+		Condition string `json:"condition,omitempty"`
+	}
+
+	setFunctionBreakpointsArgs struct {
+		Breakpoints []functionBreakpoint `json:"breakpoints"`
+	}
+
+	stackTraceArgs struct {
+		ThreadID   int64 `json:"threadId"`
+		StartFrame int   `json:"startFrame"`
+		Levels     int   `json:"levels"`
+	}
+
+	scopesArgs struct {
+		FrameID int `json:"frameId"`
+	}
+
+	variablesArgs struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+)
+
+// Response and event bodies.
+type (
+	capabilities struct {
+		SupportsConfigurationDoneRequest bool `json:"supportsConfigurationDoneRequest"`
+		SupportsConditionalBreakpoints   bool `json:"supportsConditionalBreakpoints"`
+		SupportsFunctionBreakpoints      bool `json:"supportsFunctionBreakpoints"`
+		SupportsTerminateRequest         bool `json:"supportsTerminateRequest"`
+	}
+
+	breakpoint struct {
+		ID       int     `json:"id,omitempty"`
+		Verified bool    `json:"verified"`
+		Message  string  `json:"message,omitempty"`
+		Source   *source `json:"source,omitempty"`
+		Line     int     `json:"line,omitempty"`
+	}
+
+	breakpointsBody struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+
+	thread struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+
+	threadsBody struct {
+		Threads []thread `json:"threads"`
+	}
+
+	stackFrame struct {
+		ID     int     `json:"id"`
+		Name   string  `json:"name"`
+		Source *source `json:"source,omitempty"`
+		Line   int     `json:"line"`
+		Column int     `json:"column"`
+	}
+
+	stackTraceBody struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+		TotalFrames int          `json:"totalFrames"`
+	}
+
+	scope struct {
+		Name               string `json:"name"`
+		VariablesReference int    `json:"variablesReference"`
+		Expensive          bool   `json:"expensive"`
+	}
+
+	scopesBody struct {
+		Scopes []scope `json:"scopes"`
+	}
+
+	variable struct {
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+		Type               string `json:"type,omitempty"`
+		VariablesReference int    `json:"variablesReference"`
+	}
+
+	variablesBody struct {
+		Variables []variable `json:"variables"`
+	}
+
+	continueBody struct {
+		AllThreadsContinued bool `json:"allThreadsContinued"`
+	}
+
+	stoppedBody struct {
+		Reason            string `json:"reason"`
+		ThreadID          int64  `json:"threadId"`
+		AllThreadsStopped bool   `json:"allThreadsStopped"`
+		HitBreakpointIDs  []int  `json:"hitBreakpointIds,omitempty"`
+	}
+
+	outputBody struct {
+		Category string `json:"category"`
+		Output   string `json:"output"`
+	}
+
+	exitedBody struct {
+		ExitCode int `json:"exitCode"`
+	}
+)
+
+// readMessage reads the content of a base protocol message.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("dap: invalid content length: %w", err)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("dap: missing content length")
+	}
+	buf := make([]byte, length)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// writeMessage writes v as a base protocol message.
+func writeMessage(w io.Writer, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	return err
+}
@@ -0,0 +1,519 @@
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mvertes/parscan/vm"
+)
+
+// maxChildren is the maximum number of elements of a slice, array or map
+// shown as variables.
+const maxChildren = 100
+
+// Launcher runs the Go program at path under the debugger d, writing its
+// output to stdout and stderr, until it ends or ctx is cancelled.
+type Launcher func(ctx context.Context, path string, d *vm.Debugger, stdout, stderr io.Writer) error
+
+// Server is a Debug Adapter Protocol server, debugging one program per
+// session. While a goroutine is stopped, all the other ones are, and are
+// resumed with it.
+type Server struct {
+	r      *bufio.Reader
+	w      io.Writer
+	launch Launcher
+
+	wmu sync.Mutex // serializes writes
+	seq int
+
+	// Program state.
+	d          *vm.Debugger
+	program    string
+	configured bool
+	cancel     context.CancelFunc
+	done       chan struct{} // closed once the program has ended
+	srcBps     map[string][]int
+	funcBps    []int
+
+	mu       sync.Mutex // protects the stop state below
+	quitting bool       // the program is being aborted
+	stopped  *vm.Stopped
+	frames   []frameRef
+	vars     []varRef
+	resume   chan vm.Resume
+}
+
+// frameRef is a stack frame reported to the client, indexed by id-1.
+type frameRef struct {
+	vm.Frame
+	stack *vm.StackFrame // nil if not a frame of the stopped goroutine
+}
+
+// varRef is a variable container reported to the client, indexed by
+// reference-1: either a scope or a variable value.
+type varRef struct {
+	vars []vm.Variable
+	val  reflect.Value
+}
+
+// NewServer returns a server reading requests from r and writing responses
+// and events to w, which runs programs with launch.
+func NewServer(r io.Reader, w io.Writer, launch Launcher) *Server {
+	return &Server{
+		r:      bufio.NewReader(r),
+		w:      w,
+		launch: launch,
+		srcBps: map[string][]int{},
+		resume: make(chan vm.Resume),
+	}
+}
+
+// Serve handles requests until the client disconnects or its input ends.
+// The program, if still running, is then aborted.
+func (s *Server) Serve() error {
+	defer s.stop()
+	for {
+		buf, err := readMessage(s.r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(buf, &req); err != nil {
+			return fmt.Errorf("dap: %w", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if s.handle(&req) {
+			return nil
+		}
+	}
+}
+
+// handle processes a request and reports whether the session ends.
+func (s *Server) handle(req *request) (end bool) {
+	var body any
+	var err error
+	switch req.Command {
+	case "initialize":
+		body = capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsConditionalBreakpoints:   true,
+			SupportsFunctionBreakpoints:      true,
+			SupportsTerminateRequest:         true,
+		}
+		defer s.event("initialized", nil)
+	case "launch":
+		err = s.onLaunch(req.Arguments)
+	case "configurationDone":
+		s.configured = true
+		defer s.start()
+	case "setBreakpoints":
+		body, err = s.onSetBreakpoints(req.Arguments)
+	case "setFunctionBreakpoints":
+		body, err = s.onSetFunctionBreakpoints(req.Arguments)
+	case "setExceptionBreakpoints":
+	case "threads":
+		body = s.onThreads()
+	case "stackTrace":
+		body, err = s.onStackTrace(req.Arguments)
+	case "scopes":
+		body, err = s.onScopes(req.Arguments)
+	case "variables":
+		body, err = s.onVariables(req.Arguments)
+	case "continue":
+		body = continueBody{AllThreadsContinued: true}
+		defer s.resumeWith(vm.ResumeContinue)
+	case "next":
+		defer s.resumeWith(vm.ResumeStepOver)
+	case "stepIn":
+		defer s.resumeWith(vm.ResumeStepIn)
+	case "stepOut":
+		defer s.resumeWith(vm.ResumeStepOut)
+	case "terminate":
+		defer s.stop()
+	case "disconnect":
+		end = true
+	default:
+		err = fmt.Errorf("unsupported request: %s", req.Command)
+	}
+	resp := response{
+		message:    message{Type: "response"},
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	s.send(&resp)
+	return end
+}
+
+// send writes a response or an event, numbered in sequence.
+func (s *Server) send(msg any) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	switch msg := msg.(type) {
+	case *response:
+		msg.Seq = s.seq
+	case *event:
+		msg.Seq = s.seq
+	}
+	_ = writeMessage(s.w, msg)
+}
+
+func (s *Server) event(name string, body any) {
+	s.send(&event{message: message{Type: "event"}, Event: name, Body: body})
+}
+
+func (s *Server) onLaunch(args json.RawMessage) error {
+	var a launchArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return err
+	}
+	if a.Program == "" {
+		return errors.New("missing program")
+	}
+	if s.program != "" {
+		return errors.New("program already launched")
+	}
+	s.program = a.Program
+	s.debugger().StopOnEntry = a.StopOnEntry
+	if s.configured {
+		s.start()
+	}
+	return nil
+}
+
+// debugger returns the debugger of the session, created on first use.
+func (s *Server) debugger() *vm.Debugger {
+	if s.d == nil {
+		s.d = vm.NewDebugger(strings.NewReader(""), &output{s, "stderr"})
+		s.d.Handler = s.onStop
+	}
+	return s.d
+}
+
+// start runs the launched program once configured.
+func (s *Server) start() {
+	if s.program == "" || s.done != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel, s.done = cancel, make(chan struct{})
+	d := s.debugger()
+	go func() {
+		defer close(s.done)
+		code := 0
+		err := s.launch(ctx, s.program, d, &output{s, "stdout"}, &output{s, "stderr"})
+		if err != nil && !errors.Is(err, vm.ErrDebugQuit) && !errors.Is(err, context.Canceled) {
+			msg := err.Error()
+			var pe *vm.PanicError
+			if errors.As(err, &pe) {
+				msg += "\n\n" + pe.Trace()
+			}
+			s.event("output", outputBody{Category: "stderr", Output: strings.TrimSuffix(msg, "\n") + "\n"})
+			code = 1
+		}
+		s.event("exited", exitedBody{ExitCode: code})
+		s.event("terminated", nil)
+	}()
+}
+
+// stop aborts the program if it is running, and waits for its end.
+func (s *Server) stop() {
+	if s.done == nil {
+		return
+	}
+	s.cancel()
+	s.mu.Lock()
+	s.quitting = true
+	s.mu.Unlock()
+	s.resumeWith(vm.ResumeQuit)
+	<-s.done
+}
+
+// onStop is the debugger handler: it reports the stop to the client, and
+// waits for the request resuming the program.
+func (s *Server) onStop(st *vm.Stopped) vm.Resume {
+	s.mu.Lock()
+	if s.quitting {
+		s.mu.Unlock()
+		return vm.ResumeQuit
+	}
+	s.stopped, s.frames, s.vars = st, nil, nil
+	s.mu.Unlock()
+	body := stoppedBody{Reason: st.Reason, ThreadID: st.Goroutine, AllThreadsStopped: true}
+	switch {
+	case st.Reason == "trap":
+		body.Reason = "pause"
+	case st.Breakpoint != nil:
+		body.HitBreakpointIDs = []int{st.Breakpoint.ID}
+		if st.Breakpoint.Func != "" {
+			body.Reason = "function breakpoint"
+		}
+	}
+	s.event("stopped", body)
+	return <-s.resume
+}
+
+// resumeWith resumes the stopped goroutine, if any.
+func (s *Server) resumeWith(r vm.Resume) {
+	s.mu.Lock()
+	st := s.stopped
+	s.stopped = nil
+	s.mu.Unlock()
+	if st != nil {
+		s.resume <- r
+	}
+}
+
+func (s *Server) onSetBreakpoints(args json.RawMessage) (any, error) {
+	var a setBreakpointsArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	d := s.debugger()
+	path := a.Source.Path
+	for _, id := range s.srcBps[path] {
+		d.Clear(id)
+	}
+	s.srcBps[path] = nil
+	bps := make([]breakpoint, len(a.Breakpoints))
+	for i, sb := range a.Breakpoints {
+		bps[i] = breakpoint{Source: &a.Source, Line: sb.Line}
+		b, err := d.Break(path+":"+strconv.Itoa(sb.Line), sb.Condition)
+		if err != nil {
+			bps[i].Message = err.Error()
+			continue
+		}
+		bps[i].ID, bps[i].Verified = b.ID, true
+		s.srcBps[path] = append(s.srcBps[path], b.ID)
+	}
+	return breakpointsBody{Breakpoints: bps}, nil
+}
+
+func (s *Server) onSetFunctionBreakpoints(args json.RawMessage) (any, error) {
+	var a setFunctionBreakpointsArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	d := s.debugger()
+	for _, id := range s.funcBps {
+		d.Clear(id)
+	}
+	s.funcBps = nil
+	bps := make([]breakpoint, len(a.Breakpoints))
+	for i, fb := range a.Breakpoints {
+		b, err := d.Break(fb.Name, fb.Condition)
+		if err != nil {
+			bps[i].Message = err.Error()
+			continue
+		}
+		bps[i].ID, bps[i].Verified = b.ID, true
+		s.funcBps = append(s.funcBps, b.ID)
+	}
+	return breakpointsBody{Breakpoints: bps}, nil
+}
+
+func (s *Server) onThreads() any {
+	var threads []thread
+	if s.d != nil {
+		for _, g := range s.d.Goroutines() {
+			threads = append(threads, thread{ID: g.ID, Name: fmt.Sprintf("goroutine %d %s", g.ID, funcName(g.Frame))})
+		}
+	}
+	if len(threads) == 0 {
+		threads = []thread{{ID: 1, Name: "goroutine 1"}}
+	}
+	return threadsBody{Threads: threads}
+}
+
+func (s *Server) onStackTrace(args json.RawMessage) (any, error) {
+	var a stackTraceArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	var refs []frameRef
+	s.mu.Lock()
+	if st := s.stopped; st != nil && st.Goroutine == a.ThreadID {
+		for _, f := range st.Frames() {
+			refs = append(refs, frameRef{Frame: f.Frame, stack: &f})
+		}
+	} else if s.d != nil {
+		for _, g := range s.d.Goroutines() {
+			if g.ID == a.ThreadID {
+				refs = append(refs, frameRef{Frame: g.Frame})
+			}
+		}
+	}
+	total := len(refs)
+	refs = refs[min(a.StartFrame, total):]
+	if a.Levels > 0 && a.Levels < len(refs) {
+		refs = refs[:a.Levels]
+	}
+	frames := make([]stackFrame, len(refs))
+	for i, r := range refs {
+		s.frames = append(s.frames, r)
+		frames[i] = stackFrame{ID: len(s.frames), Name: funcName(r.Frame), Line: r.Line, Column: r.Col}
+		if r.File != "" {
+			frames[i].Source = &source{Name: baseName(r.File), Path: r.File}
+		}
+	}
+	s.mu.Unlock()
+	return stackTraceBody{StackFrames: frames, TotalFrames: total}, nil
+}
+
+func (s *Server) onScopes(args json.RawMessage) (any, error) {
+	var a scopesArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a.FrameID <= 0 || a.FrameID > len(s.frames) || s.stopped == nil {
+		return nil, fmt.Errorf("invalid frame: %d", a.FrameID)
+	}
+	f := s.frames[a.FrameID-1]
+	if f.stack == nil {
+		return scopesBody{Scopes: []scope{}}, nil
+	}
+	return scopesBody{Scopes: []scope{
+		{Name: "Locals", VariablesReference: s.addVars(varRef{vars: s.stopped.Locals(*f.stack)})},
+		{Name: "Globals", VariablesReference: s.addVars(varRef{vars: s.stopped.Globals()})},
+	}}, nil
+}
+
+// addVars registers a variable container and returns its reference. It must
+// be called with s.mu held.
+func (s *Server) addVars(r varRef) int {
+	s.vars = append(s.vars, r)
+	return len(s.vars)
+}
+
+func (s *Server) onVariables(args json.RawMessage) (any, error) {
+	var a variablesArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a.VariablesReference <= 0 || a.VariablesReference > len(s.vars) || s.stopped == nil {
+		return nil, fmt.Errorf("invalid variables reference: %d", a.VariablesReference)
+	}
+	r := s.vars[a.VariablesReference-1]
+	vars := r.vars
+	if vars == nil {
+		vars = children(r.val)
+	}
+	out := make([]variable, len(vars))
+	for i, v := range vars {
+		rv := v.Value
+		for rv.Kind() == reflect.Interface && !rv.IsNil() {
+			rv = rv.Elem()
+		}
+		out[i] = variable{Name: v.Name, Value: formatValue(rv)}
+		if rv.IsValid() {
+			out[i].Type = rv.Type().String()
+		}
+		if hasChildren(rv) {
+			out[i].VariablesReference = s.addVars(varRef{val: rv})
+		}
+	}
+	return variablesBody{Variables: out}, nil
+}
+
+// hasChildren reports whether the value has elements shown as variables.
+func hasChildren(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Pointer:
+		return !rv.IsNil()
+	case reflect.Struct:
+		return rv.NumField() > 0
+	case reflect.Array, reflect.Slice, reflect.Map:
+		return rv.Len() > 0
+	}
+	return false
+}
+
+// children returns the elements of a value as variables.
+func children(rv reflect.Value) []vm.Variable {
+	var vars []vm.Variable
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if e := rv.Elem(); e.Kind() == reflect.Struct {
+			return children(e)
+		}
+		vars = append(vars, vm.Variable{Name: "*", Value: rv.Elem()})
+	case reflect.Struct:
+		for i := range rv.NumField() {
+			vars = append(vars, vm.Variable{Name: rv.Type().Field(i).Name, Value: rv.Field(i)})
+		}
+	case reflect.Array, reflect.Slice:
+		for i := range min(rv.Len(), maxChildren) {
+			vars = append(vars, vm.Variable{Name: "[" + strconv.Itoa(i) + "]", Value: rv.Index(i)})
+		}
+	case reflect.Map:
+		it := rv.MapRange()
+		for it.Next() {
+			vars = append(vars, vm.Variable{Name: "[" + formatValue(it.Key()) + "]", Value: it.Value()})
+		}
+		slices.SortFunc(vars, func(a, b vm.Variable) int { return strings.Compare(a.Name, b.Name) })
+		vars = vars[:min(len(vars), maxChildren)]
+	}
+	return vars
+}
+
+// formatValue formats a value for display.
+func formatValue(rv reflect.Value) string {
+	switch {
+	case !rv.IsValid():
+		return "nil"
+	case rv.Kind() == reflect.String:
+		return strconv.Quote(rv.String())
+	}
+	str := fmt.Sprintf("%+v", rv)
+	if len(str) > 200 {
+		str = str[:197] + "..."
+	}
+	return str
+}
+
+// funcName returns the name of the function of a frame.
+func funcName(f vm.Frame) string {
+	if f.Func == "" {
+		return "main"
+	}
+	return f.Func
+}
+
+// baseName returns the last element of a source path.
+func baseName(path string) string {
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// output is a program output stream, forwarded to the client as events.
+type output struct {
+	s        *Server
+	category string
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.s.event("output", outputBody{Category: o.category, Output: string(p)})
+	return len(p), nil
+}
@@ -0,0 +1,339 @@
+package dap_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mvertes/parscan/dap"
+	"github.com/mvertes/parscan/interp"
+	"github.com/mvertes/parscan/lang/golang"
+	"github.com/mvertes/parscan/vm"
+)
+
+const src = `package main
+
+type P struct{ X, Y int }
+
+var total int
+
+func add(a, b int) int {
+	c := a + b
+	total += c
+	return c
+}
+
+func main() {
+	p := P{1, 2}
+	for i := 0; i < 3; i++ {
+		add(i, p.Y)
+	}
+	println(total)
+}
+`
+
+func launch(ctx context.Context, path string, d *vm.Debugger, stdout, stderr io.Writer) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	i := interp.NewInterpreter(golang.GoSpec)
+	i.SetIO(strings.NewReader(""), stdout, stderr)
+	i.SetDebugger(d)
+	_, err = i.EvalContext(ctx, "f:"+path, string(buf))
+	return err
+}
+
+type client struct {
+	t   *testing.T
+	w   io.Writer
+	r   *bufio.Reader
+	seq int
+	out strings.Builder // program output
+}
+
+// message is a decoded protocol message.
+type message struct {
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	RequestSeq int             `json:"request_seq"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func (c *client) send(command string, args any) {
+	c.t.Helper()
+	c.seq++
+	buf, _ := json.Marshal(map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(buf), buf); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next returns the next message, skipping and recording output events.
+func (c *client) next() message {
+	c.t.Helper()
+	for {
+		var n int
+		for {
+			line, err := c.r.ReadString('\n')
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			if line == "\r\n" {
+				break
+			}
+			_, _ = fmt.Sscanf(line, "Content-Length: %d", &n)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		var m message
+		if err := json.Unmarshal(buf, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		if m.Event != "output" {
+			return m
+		}
+		var o struct{ Output string }
+		_ = json.Unmarshal(m.Body, &o)
+		c.out.WriteString(o.Output)
+	}
+}
+
+// request sends a request and decodes the body of its response into body.
+func (c *client) request(command string, args, body any) {
+	c.t.Helper()
+	c.send(command, args)
+	m := c.next()
+	if m.Type != "response" || m.Command != command || m.RequestSeq != c.seq {
+		c.t.Fatalf("got %+v, want %s response", m, command)
+	}
+	if !m.Success {
+		c.t.Fatalf("%s failed: %s", command, m.Message)
+	}
+	if body != nil {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// event waits for the named event and decodes its body into body.
+func (c *client) event(name string, body any) {
+	c.t.Helper()
+	m := c.next()
+	if m.Type != "event" || m.Event != name {
+		c.t.Fatalf("got %+v, want %s event", m, name)
+	}
+	if body != nil {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+type (
+	stopped struct {
+		Reason           string
+		ThreadID         int64
+		HitBreakpointIDs []int
+	}
+	frame struct {
+		ID   int
+		Name string
+		Line int
+	}
+	variable struct {
+		Name               string
+		Value              string
+		VariablesReference int
+	}
+)
+
+// stack returns the frames of the thread as "name:line".
+func (c *client) stack(thread int64) ([]string, []frame) {
+	c.t.Helper()
+	var st struct{ StackFrames []frame }
+	c.request("stackTrace", map[string]any{"threadId": thread}, &st)
+	var s []string
+	for _, f := range st.StackFrames {
+		s = append(s, fmt.Sprintf("%s:%d", f.Name, f.Line))
+	}
+	return s, st.StackFrames
+}
+
+// variables returns the variables of ref as "name=value".
+func (c *client) variables(ref int) (map[string]string, []variable) {
+	c.t.Helper()
+	var v struct{ Variables []variable }
+	c.request("variables", map[string]any{"variablesReference": ref}, &v)
+	m := map[string]string{}
+	for _, x := range v.Variables {
+		m[x.Name] = x.Value
+	}
+	return m, v.Variables
+}
+
+func TestServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	srv := dap.NewServer(sr, sw, launch)
+	served := make(chan error)
+	go func() { served <- srv.Serve() }()
+	c := &client{t: t, w: cw, r: bufio.NewReader(cr)}
+
+	var caps struct{ SupportsConfigurationDoneRequest bool }
+	c.request("initialize", map[string]any{"adapterID": "parscan"}, &caps)
+	if !caps.SupportsConfigurationDoneRequest {
+		t.Error("configurationDone not supported")
+	}
+	c.event("initialized", nil)
+	c.request("launch", map[string]any{"program": path}, nil)
+	var bps struct{ Breakpoints []struct{ ID int } }
+	c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": path},
+		"breakpoints": []map[string]any{{"line": 8, "condition": "a == 1"}},
+	}, &bps)
+	c.request("configurationDone", nil, nil)
+
+	var s stopped
+	c.event("stopped", &s)
+	if s.Reason != "breakpoint" || s.ThreadID != 1 || len(s.HitBreakpointIDs) != 1 || s.HitBreakpointIDs[0] != bps.Breakpoints[0].ID {
+		t.Fatalf("got stop %+v", s)
+	}
+	var threads struct{ Threads []struct{ ID int64 } }
+	c.request("threads", nil, &threads)
+	if len(threads.Threads) != 1 || threads.Threads[0].ID != 1 {
+		t.Errorf("got threads %+v", threads.Threads)
+	}
+	names, frames := c.stack(1)
+	if want := "[main.add:8 main.main:16]"; fmt.Sprint(names) != want {
+		t.Errorf("got stack %v, want %s", names, want)
+	}
+
+	var scopes struct {
+		Scopes []struct {
+			Name               string
+			VariablesReference int
+		}
+	}
+	c.request("scopes", map[string]any{"frameId": frames[0].ID}, &scopes)
+	if len(scopes.Scopes) != 2 {
+		t.Fatalf("got scopes %+v", scopes.Scopes)
+	}
+	if locals, _ := c.variables(scopes.Scopes[0].VariablesReference); locals["a"] != "1" || locals["b"] != "2" {
+		t.Errorf("got locals %v", locals)
+	}
+	if globals, _ := c.variables(scopes.Scopes[1].VariablesReference); globals["total"] != "2" {
+		t.Errorf("got globals %v", globals)
+	}
+
+	// Structured variables of the caller frame.
+	c.request("scopes", map[string]any{"frameId": frames[1].ID}, &scopes)
+	_, vars := c.variables(scopes.Scopes[0].VariablesReference)
+	var p variable
+	for _, v := range vars {
+		if v.Name == "p" {
+			p = v
+		}
+	}
+	if p.VariablesReference == 0 {
+		t.Fatalf("got variables %+v, want p with fields", vars)
+	}
+	if fields, _ := c.variables(p.VariablesReference); fields["X"] != "1" || fields["Y"] != "2" {
+		t.Errorf("got fields %v", fields)
+	}
+
+	c.request("next", nil, nil)
+	c.event("stopped", &s)
+	if names, _ := c.stack(1); s.Reason != "step" || names[0] != "main.add:9" {
+		t.Errorf("got %s stop at %v, want step at main.add:9", s.Reason, names)
+	}
+	c.request("stepOut", nil, nil)
+	c.event("stopped", &s)
+	if names, _ := c.stack(1); names[0] != "main.main:16" {
+		t.Errorf("got stop at %v, want main.main:16", names)
+	}
+	c.request("stepIn", nil, nil)
+	c.event("stopped", &s)
+	if names, _ := c.stack(1); names[0] != "main.main:15" {
+		t.Errorf("got stop at %v, want main.main:15", names)
+	}
+
+	c.request("setBreakpoints", map[string]any{"source": map[string]any{"path": path}, "breakpoints": []any{}}, nil)
+	c.request("continue", map[string]any{"threadId": 1}, nil)
+	var exited struct{ ExitCode int }
+	c.event("exited", &exited)
+	c.event("terminated", nil)
+	if exited.ExitCode != 0 {
+		t.Errorf("got exit code %d", exited.ExitCode)
+	}
+	if got := c.out.String(); got != "9\n" {
+		t.Errorf("got output %q, want %q", got, "9\n")
+	}
+
+	c.request("disconnect", nil, nil)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not return")
+	}
+}
+
+func TestServerDisconnectStopped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	served := make(chan error)
+	go func() { served <- dap.NewServer(sr, sw, launch).Serve() }()
+	c := &client{t: t, w: cw, r: bufio.NewReader(cr)}
+
+	c.request("initialize", nil, nil)
+	c.event("initialized", nil)
+	c.request("launch", map[string]any{"program": path, "stopOnEntry": true}, nil)
+	c.request("configurationDone", nil, nil)
+	var s stopped
+	c.event("stopped", &s)
+	if s.Reason != "entry" {
+		t.Errorf("got stop reason %q, want entry", s.Reason)
+	}
+	go func() {
+		// Drain the events sent while the program is aborted.
+		for {
+			if _, err := c.r.ReadByte(); err != nil {
+				return
+			}
+		}
+	}()
+	c.send("disconnect", nil)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not return")
+	}
+	_ = cr.Close()
+}
@@ -10,6 +10,13 @@ func (p *Parser) parseAssign(in Tokens, aindex int) (out Tokens, err error) {
 	rhs := in[aindex+1:].Split(lang.Comma)
 	lhs := in[:aindex].Split(lang.Comma)
 	define := in[aindex].Tok == lang.Define
+	if !define {
+		for _, e := range lhs {
+			if len(e) == 1 && e[0].Tok == lang.Ident {
+				p.markReassigned(e[0].Str)
+			}
+		}
+	}
 	if len(rhs) == 1 {
 		var isRange bool
 		// Track positions of LHS tokens for local fixup (one entry per lhs element).
@@ -72,6 +79,9 @@ func (p *Parser) parseAssign(in Tokens, aindex int) (out Tokens, err error) {
 				out[len(out)-1].Arg = []any{nVars}
 			} else {
 				out = append(out, newToken(in[aindex].Tok, "", in[aindex].Pos, len(lhs)))
+				if check := p.complexConstCheck(rhs[0], toks, "assignment"); check != nil && !define && len(lhs) == 1 {
+					out[len(out)-1].Arg = append(out[len(out)-1].Arg, check)
+				}
 			}
 		}
 		// Register define symbols after parsing both LHS and RHS so that
@@ -351,6 +351,13 @@ func (p *Parser) parseSwitch(in Tokens) (out Tokens, err error) {
 		out = append(out, co...)
 		prevFallthrough = hasFallthrough
 	}
+	if condSwitch && (nc < 0 || sc[nc][1].Tok != lang.Colon) {
+		// No default clause: drop the switch expression if no case matches.
+		if nc >= 0 {
+			out = append(out, newGoto(p.breakLabel, 0), newLabel(p.scope+"m", 0))
+		}
+		out = append(out, newDrop(0))
+	}
 	out = append(out, newLabel(p.breakLabel, in[len(in)-1].Pos))
 	return out, err
 }
@@ -529,8 +536,11 @@ func (p *Parser) parseCaseClause(in Tokens, index, maximum int, condSwitch, prev
 	isMulti := len(lcond) > 1
 	bodyLabel := caseBodyLabel(p.scope, index)
 	miss := p.scope + "e"
-	if index < maximum {
+	switch {
+	case index < maximum:
 		miss = caseLabel(p.scope, index+1, 0)
+	case condSwitch:
+		miss = p.scope + "m" // drop the switch expression, see parseSwitch
 	}
 	for i, cond := range lcond {
 		if cond, err = p.parseExpr(cond, ""); err != nil {
@@ -635,6 +645,7 @@ func (p *Parser) parseSelectCase(cl Tokens, index int, pos int, ci *selectCase)
 					scopedName = p.addGlobalVar(name)
 				}
 			} else {
+				p.markReassigned(name)
 				if _, sn, ok := p.Symbols.Get(name, p.scope); ok && sn != "" {
 					scopedName = sn + "/" + name
 				} else {
@@ -6,6 +6,7 @@ import (
 	"go/constant"
 	"go/token"
 	"reflect"
+	"slices"
 
 	"github.com/mvertes/parscan/lang"
 	"github.com/mvertes/parscan/symbol"
@@ -139,6 +140,9 @@ func (p *Parser) parseConstLine(in Tokens) (out Tokens, err error) {
 		var typ *vm.Type
 		if i < len(types) {
 			typ = types[i]
+			if err := p.complexConstError(cval, ctyp, typ, values[i], "constant declaration"); err != nil {
+				return out, err
+			}
 			cval = constConvert(cval, typ)
 		} else if ctyp != nil {
 			typ = ctyp
@@ -399,6 +403,21 @@ func (p *Parser) evalConstExpr(in Tokens) (cval constant.Value, ctyp *vm.Type, l
 			}
 			return nil, nil, 0, errors.New("len: unsupported constant argument type")
 		}
+		switch fname {
+		case "real", "imag":
+			if narg != 1 {
+				return nil, nil, 0, fmt.Errorf("%s: wrong number of arguments", fname)
+			}
+			if fname == "real" {
+				return constant.Real(args[0]), nil, totalLen, nil
+			}
+			return constant.Imag(args[0]), nil, totalLen, nil
+		case "complex":
+			if narg != 2 {
+				return nil, nil, 0, errors.New("complex: wrong number of arguments")
+			}
+			return constant.BinaryOp(args[0], token.ADD, constant.MakeImag(args[1])), nil, totalLen, nil
+		}
 		if s, _, ok := p.Symbols.Get(fname, p.scope); ok && s.Kind == symbol.Type {
 			if narg != 1 {
 				return nil, nil, 0, errors.New("type conversion requires exactly one argument")
@@ -504,12 +523,17 @@ func constValue(c constant.Value) any {
 	case constant.Float:
 		v, _ := constant.Float64Val(c)
 		return v
+	case constant.Complex:
+		re, _ := constant.Float64Val(constant.Real(c))
+		im, _ := constant.Float64Val(constant.Imag(c))
+		return complex(re, im)
 	}
 	return nil
 }
 
 // defaultConstType returns the default Go type for an untyped constant value
-// (int for Int, float64 for Float, string for String, bool for Bool). The
+// (int for Int, float64 for Float, complex128 for Complex, string for String,
+// bool for Bool). The
 // parser is consulted so canonical *vm.Type instances are returned.
 func defaultConstType(c constant.Value, p *Parser) *vm.Type {
 	if c == nil {
@@ -521,6 +545,8 @@ func defaultConstType(c constant.Value, p *Parser) *vm.Type {
 		name = "int"
 	case constant.Float:
 		name = "float64"
+	case constant.Complex:
+		name = "complex128"
 	case constant.String:
 		name = "string"
 	case constant.Bool:
@@ -545,6 +571,62 @@ func typedConstValue(c constant.Value, typ *vm.Type) any {
 }
 
 // constConvert converts a constant value to the target type, as in Go type conversions.
+// complexConstError returns the Go error for a complex constant cval of
+// type ctyp (nil if untyped) not representable by the integer or float type
+// typ. in is the expression, ctx the kind of declaration.
+func (p *Parser) complexConstError(cval constant.Value, ctyp, typ *vm.Type, in Tokens, ctx string) error {
+	if cval.Kind() != constant.Complex || typ == nil {
+		return nil
+	}
+	k := typ.Rtype.Kind()
+	if k < reflect.Int || k > reflect.Float64 {
+		return nil
+	}
+	reason := "truncated"
+	if k == reflect.Float32 || k == reflect.Float64 {
+		if constant.ToFloat(cval).Kind() != constant.Unknown {
+			return nil
+		}
+		reason = "overflows"
+	} else if constant.ToInt(cval).Kind() != constant.Unknown {
+		return nil
+	}
+	what := "untyped complex constant " + cval.String()
+	if ctyp != nil {
+		what = "constant " + cval.String() + " of type " + ctyp.Rtype.String()
+	}
+	msg := fmt.Sprintf("cannot use %s as %s value in %s (%s)", what, typ.Rtype, ctx, reason)
+	if len(in) > 0 {
+		if loc := p.Sources.FormatPos(in[0].Pos); loc != "" {
+			msg += " (" + loc + ")"
+		}
+	}
+	return errors.New(msg)
+}
+
+// checkComplexInit checks the initializer in of a variable of type typ with
+// complexConstError, if in is a constant expression with an imaginary literal.
+func (p *Parser) checkComplexInit(in, expr Tokens, typ *vm.Type) error {
+	if check := p.complexConstCheck(in, expr, "variable declaration"); check != nil {
+		return check(typ)
+	}
+	return nil
+}
+
+// complexConstCheck returns the check of complexConstError for the value in
+// of a ctx statement, or nil if in is not a constant expression with an
+// imaginary literal. expr is in parsed.
+func (p *Parser) complexConstCheck(in, expr Tokens, ctx string) ConstCheck {
+	if !slices.ContainsFunc(expr, func(t Token) bool { return t.Tok == lang.Imag }) {
+		return nil
+	}
+	cval, ctyp, l, err := p.evalConstExpr(expr)
+	if err != nil || l != len(expr) {
+		return nil // not a constant expression
+	}
+	return func(typ *vm.Type) error { return p.complexConstError(cval, ctyp, typ, in, ctx) }
+}
+
 func constConvert(cv constant.Value, typ *vm.Type) constant.Value {
 	rt := typ.Rtype
 	switch {
@@ -564,6 +646,8 @@ func constConvert(cv constant.Value, typ *vm.Type) constant.Value {
 		return constant.MakeUint64(uint64(v)) //nolint:gosec // intentional wraparound
 	case rt.Kind() == reflect.Float32 || rt.Kind() == reflect.Float64:
 		return constant.ToFloat(cv)
+	case rt.Kind() == reflect.Complex64 || rt.Kind() == reflect.Complex128:
+		return constant.ToComplex(cv)
 	case rt.Kind() == reflect.String:
 		if cv.Kind() == constant.Int {
 			v, _ := constant.Int64Val(cv)
@@ -586,6 +670,9 @@ func vmValueToConst(v vm.Value) (constant.Value, error) {
 		return constant.MakeUint64(v.Uint()), nil
 	case k == reflect.Float32 || k == reflect.Float64:
 		return constant.MakeFloat64(v.Float()), nil
+	case k == reflect.Complex64 || k == reflect.Complex128:
+		c := v.Reflect().Complex()
+		return constant.BinaryOp(constant.MakeFloat64(real(c)), token.ADD, constant.MakeImag(constant.MakeFloat64(imag(c)))), nil
 	case k == reflect.String:
 		return constant.MakeString(v.Reflect().String()), nil
 	}
@@ -832,7 +919,12 @@ func (p *Parser) zeroInitLocals(vars []string, types []*vm.Type) (out Tokens) {
 			p.SymAdd(symbol.UnsetAddr, typKey, vm.NewValue(typ.Rtype), symbol.Type, typ)
 		}
 		out = append(out, newIdent(v, 0))
-		out = append(out, newIdent(typKey, 0))
+		if k := typ.Rtype.Kind(); k == reflect.Slice || k == reflect.Map {
+			// The type would make an empty slice or map, not a nil one.
+			out = append(out, newIdent("nil", 0))
+		} else {
+			out = append(out, newIdent(typKey, 0))
+		}
 		out = append(out, newToken(lang.Assign, "", 0, 1))
 	}
 	return out
@@ -887,6 +979,11 @@ func (p *Parser) parseVarLine(in Tokens) (out Tokens, err error) {
 		if err != nil {
 			return out, err
 		}
+		if !undefinedType && len(vars) == 1 {
+			if err := p.checkComplexInit(values[0], toks, types[0]); err != nil {
+				return out, err
+			}
+		}
 		out = append(out, toks...)
 		if undefinedType {
 			out = append(out, newToken(lang.Define, "", 0, len(vars)))
@@ -902,6 +999,11 @@ func (p *Parser) parseVarLine(in Tokens) (out Tokens, err error) {
 		if v, err = p.parseExpr(v, ""); err != nil {
 			return out, err
 		}
+		if !undefinedType && i < len(types) {
+			if err := p.checkComplexInit(values[i], v, types[i]); err != nil {
+				return out, err
+			}
+		}
 		out = append(out, newIdent(vars[i], 0))
 		out = append(out, v...)
 		if undefinedType {
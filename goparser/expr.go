@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/mvertes/parscan/lang"
+	"github.com/mvertes/parscan/scan"
 	"github.com/mvertes/parscan/symbol"
 	"github.com/mvertes/parscan/vm"
 )
@@ -52,7 +53,7 @@ func (p *Parser) parseExpr(in Tokens, typeStr string) (out Tokens, err error) {
 	lin := len(in)
 	for i := 0; i < lin; i++ {
 		switch t := in[i]; t.Tok {
-		case lang.Int, lang.Float, lang.String:
+		case lang.Int, lang.Float, lang.Imag, lang.String:
 			out = append(out, t)
 
 		case lang.Func:
@@ -130,6 +131,9 @@ func (p *Parser) parseExpr(in Tokens, typeStr string) (out Tokens, err error) {
 		case lang.Add, lang.And, lang.AndNot, lang.Equal, lang.Greater, lang.GreaterEqual, lang.Less, lang.LessEqual, lang.Not, lang.NotEqual, lang.Or, lang.Quo, lang.Rem, lang.Sub, lang.Shl, lang.Shr, lang.Xor:
 			if isUnaryCtx(i) {
 				t.Tok = lang.UnaryOp[t.Tok]
+				if t.Tok == lang.Addr && i+1 < lin && in[i+1].Tok == lang.Ident {
+					p.markReassigned(in[i+1].Str)
+				}
 			}
 			addop(t)
 
@@ -273,7 +277,7 @@ func (p *Parser) parseExpr(in Tokens, typeStr string) (out Tokens, err error) {
 				}
 				ctype = p.registerType(sym.Type.Elem(), t.Pos, &out)
 			}
-			toks, sliceLen, err := p.parseComposite(t.Block(), ctype)
+			toks, sliceLen, err := p.parseComposite(t.Token, ctype)
 			out = append(out, toks...)
 			if err != nil {
 				return out, err
@@ -432,8 +436,8 @@ func (p *Parser) addTypeExpr(in Tokens, out *Tokens) (string, int, error) {
 	return p.registerType(typ, in[0].Pos, out), n, nil
 }
 
-func (p *Parser) parseComposite(s, typ string) (Tokens, int, error) {
-	tokens, err := p.scan(s, false)
+func (p *Parser) parseComposite(bt scan.Token, typ string) (Tokens, int, error) {
+	tokens, err := p.scanBlock(bt, false)
 	if err != nil {
 		return nil, 0, err
 	}
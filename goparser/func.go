@@ -162,6 +162,7 @@ func (p *Parser) registerFunc(toks Tokens) (bool, error) {
 	}
 	s.Kind = symbol.Func
 	s.Type = typ
+	s.PkgPath = p.qualifier()
 	s.RecvName = recvVarName
 	s.InNames = inNames
 	s.OutNames = outNames
@@ -251,7 +252,7 @@ func (p *Parser) parseFunc(in Tokens) (out Tokens, err error) {
 	p.namedOut = nil
 	s, _, ok := p.Symbols.Get(fname, p.scope)
 	if !ok {
-		s = &symbol.Symbol{Name: fname, Used: true, Index: symbol.UnsetAddr}
+		s = &symbol.Symbol{Name: fname, Used: true, Index: symbol.UnsetAddr, PkgPath: p.qualifier()}
 		key := fname
 		if !strings.HasPrefix(fname, "#") {
 			key = p.scope + fname
@@ -726,6 +726,8 @@ func (p *Parser) postfixType(in Tokens) (*vm.Type, int) {
 			return p.Symbols["int"].Type, 1
 		case lang.Float:
 			return p.Symbols["float64"].Type, 1
+		case lang.Imag:
+			return p.Symbols["complex128"].Type, 1
 		case lang.String:
 			return p.Symbols["string"].Type, 1
 		case lang.Char:
@@ -15,9 +15,9 @@ import (
 func (p *Parser) importSrc(pkgPath string) (err error) {
 	// Save and restore parser state so the imported package's
 	// "package" declaration does not conflict with the current one.
-	savedPkgName := p.pkgName
-	p.pkgName = ""
-	defer func() { p.pkgName = savedPkgName }()
+	savedPkgName, savedPkgPath := p.pkgName, p.pkgPath
+	p.pkgName, p.pkgPath = "", pkgPath
+	defer func() { p.pkgName, p.pkgPath = savedPkgName, savedPkgPath }()
 
 	// Snapshot existing symbol pointers so we can identify bindings
 	// added or replaced by this import. A later import that redefines an
@@ -68,67 +68,77 @@ func (p *Parser) importSrc(pkgPath string) (err error) {
 	return nil
 }
 
+// File is the named source of a file.
+type File struct {
+	Name string
+	Src  string
+}
+
 // ParseAll parses code and its dependencies, and returns slices of Tokens or an error.
 func (p *Parser) ParseAll(name, src string) (out []Tokens, err error) {
-	var decls []Tokens
-
-	if src == "" {
-		// Get content from file(s). Primary pkgfs first; stdlib fallback resolves
-		// embedded generics-first packages (cmp, slices, ...) when the user pkgfs
-		// does not provide them.
-		if p.pkgfs == nil {
-			p.pkgfs = os.DirFS(".")
+	if src != "" {
+		if len(name) >= 2 && name[1] == ':' && (name[0] == 'f' || name[0] == 'm') {
+			name = name[2:]
 		}
-		fsys := p.pkgfs
-		fi, err := fs.Stat(fsys, name)
-		if err != nil && p.stdlibfs != nil {
-			if fi2, err2 := fs.Stat(p.stdlibfs, name); err2 == nil {
-				fsys = p.stdlibfs
-				fi = fi2
-				err = nil
-			}
+		return p.ParseFiles(File{Name: name, Src: src})
+	}
+
+	// Get content from file(s). Primary pkgfs first; stdlib fallback resolves
+	// embedded generics-first packages (cmp, slices, ...) when the user pkgfs
+	// does not provide them.
+	if p.pkgfs == nil {
+		p.pkgfs = os.DirFS(".")
+	}
+	fsys := p.pkgfs
+	fi, err := fs.Stat(fsys, name)
+	if err != nil && p.stdlibfs != nil {
+		if fi2, err2 := fs.Stat(p.stdlibfs, name); err2 == nil {
+			fsys = p.stdlibfs
+			fi = fi2
+			err = nil
 		}
+	}
+	if err != nil {
+		return out, err
+	}
+	var files []File
+	if fi.IsDir() {
+		entries, err := fs.ReadDir(fsys, name)
 		if err != nil {
 			return out, err
 		}
-		if fi.IsDir() {
-			files, err := fs.ReadDir(fsys, name)
+		for _, f := range entries {
+			if f.IsDir() || !strings.HasSuffix(f.Name(), ".go") || strings.HasSuffix(f.Name(), "_test.go") {
+				continue
+			}
+			if !MatchFileName(f.Name(), p.buildCtx) {
+				continue
+			}
+			buf, err := fs.ReadFile(fsys, name+"/"+f.Name())
 			if err != nil {
 				return out, err
 			}
-			for _, f := range files {
-				if f.IsDir() || !strings.HasSuffix(f.Name(), ".go") || strings.HasSuffix(f.Name(), "_test.go") {
-					continue
-				}
-				if !MatchFileName(f.Name(), p.buildCtx) {
-					continue
-				}
-				buf, err := fs.ReadFile(fsys, name+"/"+f.Name())
-				if err != nil {
-					return out, err
-				}
-				src := string(buf)
-				if !matchBuildDirective(src, p.buildCtx) {
-					continue
-				}
-				d, err := p.scanDecls(src)
-				p.PosBase = p.Sources.Add(name, src)
-				if err != nil {
-					return out, err
-				}
-				decls = append(decls, d...)
+			src := string(buf)
+			if !matchBuildDirective(src, p.buildCtx) {
+				continue
 			}
+			files = append(files, File{Name: name + "/" + f.Name(), Src: src})
 		}
-	} else {
-		decls, err = p.scanDecls(src)
-		srcName := name
-		if len(name) >= 2 && name[1] == ':' && (name[0] == 'f' || name[0] == 'm') {
-			srcName = name[2:]
-		}
-		p.PosBase = p.Sources.Add(srcName, src)
+	}
+	return p.ParseFiles(files...)
+}
+
+// ParseFiles is like ParseAll for the sources of the files of a package,
+// parsed together so that they can refer to each other.
+func (p *Parser) ParseFiles(files ...File) (out []Tokens, err error) {
+	var decls []Tokens
+	for _, f := range files {
+		p.PosBase = p.Sources.Add(f.Name, f.Src)
+		d, err := p.scanDecls(f.Src)
 		if err != nil {
 			return out, err
 		}
+		decls = append(decls, d...)
 	}
 
 	// Pre-register struct and interface type placeholders so that forward,
@@ -24,6 +24,7 @@ type Parser struct {
 	scope           string         // current scope
 	fname           string         // current function name
 	pkgName         string         // current package name
+	pkgPath         string         // import path of the current package, "" if main
 	noPkg           bool           // true if package statement is not mandatory (test, repl).
 	pkgfs           fs.FS          // filesystem to read imported sources from
 	stdlibfs        fs.FS          // fallback filesystem for embedded stdlib sources
@@ -202,7 +203,7 @@ func (p *Parser) parseStmts(in Tokens) (out Tokens, err error) {
 
 // scanDecls scans src and returns its top-level statements as token slices, without parsing them.
 func (p *Parser) scanDecls(src string) ([]Tokens, error) {
-	toks, err := p.scan(src, true)
+	toks, err := p.scanAt(p.PosBase, src, true)
 	if err != nil {
 		return nil, err
 	}
@@ -62,3 +62,15 @@ func (p *Parser) pushBreakScope(prefix, pendingLabel string, hasContinue bool) f
 		p.popScope()
 	}
 }
+
+// qualifier returns the package path qualifying the names of the current
+// package in stack traces.
+func (p *Parser) qualifier() string {
+	if p.pkgPath != "" {
+		return p.pkgPath
+	}
+	if p.pkgName != "" {
+		return p.pkgName
+	}
+	return "main"
+}
@@ -28,6 +28,14 @@ func (p *Parser) addLocalVar(name string) string {
 	return scoped
 }
 
+// markReassigned marks the local variable name, if any, as reassigned
+// after its definition.
+func (p *Parser) markReassigned(name string) {
+	if s, _, ok := p.Symbols.Get(name, p.scope); ok && s.Kind == symbol.LocalVar {
+		s.Reassigned = true
+	}
+}
+
 // addTempVar adds a temporary variable appropriate for the current scope.
 // At function scope it creates a local variable; at top level it creates a
 // global variable whose slot is allocated later by allocGlobalSlots.
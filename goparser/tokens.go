@@ -18,6 +18,11 @@ type Token struct {
 // Tokens represents slice of tokens.
 type Tokens []Token
 
+// ConstCheck is set in the arguments of an Assign token whose value is a
+// constant expression. It checks that the constant is representable by the
+// type of the assigned variable, which may be known only by the compiler.
+type ConstCheck func(typ *vm.Type) error
+
 func (toks Tokens) String() (s string) {
 	var sb strings.Builder
 	for _, t := range toks {
@@ -1,8 +1,11 @@
 package interp_test
 
 import (
+	"bytes"
+	"reflect"
 	"testing"
 
+	"github.com/mvertes/parscan/comp"
 	"github.com/mvertes/parscan/interp"
 	"github.com/mvertes/parscan/lang/golang"
 )
@@ -47,3 +50,160 @@ func TestDump(t *testing.T) {
 		t.Fatalf("unexpected result: %v", r)
 	}
 }
+
+func TestMigrateDump(t *testing.T) {
+	v1 := `
+type Point struct{ X, Y int32 }
+type Node struct {
+	V    int8
+	Next *Node
+}
+var (
+	count int16 = 3
+	old         = "gone"
+	name        = "a"
+	pts         = []Point{{1, 2}}
+	list        = &Node{1, &Node{2, nil}}
+	m           = map[string]Point{"a": {3, 4}}
+)
+func f() int { return 1 }`
+	v2 := `
+type Point struct{ X, Y, Z int64 }
+type Node struct {
+	V     int
+	Next  *Node
+	Label string
+}
+var (
+	count int64
+	title string
+	pts   []Point
+	list  *Node
+	m     map[string]Point
+	added = 7
+)
+func f() int { return 2 }`
+
+	intp := interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("m:test", v1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intp.Eval("m:test", `count = 300; name = "b"; list.Next.Next = list`); err != nil {
+		t.Fatal(err)
+	}
+	d := intp.Dump()
+	var buf bytes.Buffer
+	if err := intp.WriteDump(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dump is read back in another version of the program.
+	intp = interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("m:test", v2); err != nil {
+		t.Fatal(err)
+	}
+	d2, err := intp.ReadDump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := intp.MigrateDump(d2, func(dv *comp.DumpValue, typ reflect.Type) (*comp.DumpValue, error) {
+		if dv.Name != "name" {
+			return nil, nil
+		}
+		return &comp.DumpValue{Name: "title", Value: dv.Value}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &comp.DumpReport{
+		Converted: []string{"count", "list", "m", "pts"},
+		Migrated:  []string{"name"},
+		Removed:   []string{"old"},
+		Added:     []string{"added"},
+	}
+	if !reflect.DeepEqual(rep, want) {
+		t.Errorf("got report %+v, want %+v", rep, want)
+	}
+	r, err := intp.Eval("m:test", `int(count) + len(title) + int(pts[0].Y+pts[0].Z) + list.Next.Next.V + int(m["a"].Y) + added + f()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Interface() != 317 {
+		t.Errorf("got %v, want 317", r)
+	}
+
+	intp = interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("m:test", "var count string"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intp.MigrateDump(d, nil); err == nil {
+		t.Error("incompatible entry migrated")
+	}
+
+	// A failed conversion leaves the variable unchanged.
+	intp = interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("m:test", "type Node struct{ V int; Next string }; var list = &Node{V: 9}"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intp.MigrateDump(d, nil); err == nil {
+		t.Error("incompatible entry migrated")
+	}
+	if r, err := intp.Eval("m:test", "list.V"); err != nil {
+		t.Fatal(err)
+	} else if r.Interface() != 9 {
+		t.Errorf("got %v, want 9", r)
+	}
+
+	// A failed entry leaves all the variables unchanged.
+	intp = interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("m:test", "var count int64 = 5; var name int"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intp.MigrateDump(d, nil); err == nil {
+		t.Error("incompatible entry migrated")
+	}
+	if r, err := intp.Eval("m:test", "count"); err != nil {
+		t.Fatal(err)
+	} else if r.Interface() != int64(5) {
+		t.Errorf("got %v, want 5", r)
+	}
+}
+
+func TestEncodeDump(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("m:test", "var c = make(chan int)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := intp.WriteDump(&bytes.Buffer{}); err == nil {
+		t.Error("channel encoded")
+	}
+	if _, err := intp.ReadDump(bytes.NewReader([]byte("junk"))); err == nil {
+		t.Error("invalid dump decoded")
+	}
+
+	// Func values refer to the code, and are not migrated.
+	intp = interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("m:test", "var f = func() int { return 1 }; var g func()"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := intp.WriteDump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	intp = interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("m:test", "func h() int { return 2 }; var f = func() int { return 3 }; var g func()"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := intp.ReadDump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intp.MigrateDump(d, nil); err == nil {
+		t.Error("func value migrated")
+	}
+	if r, err := intp.Eval("m:test", "f()"); err != nil {
+		t.Fatal(err)
+	} else if r.Interface() != 3 {
+		t.Errorf("got %v, want 3", r)
+	}
+}
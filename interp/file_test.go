@@ -2,6 +2,7 @@ package interp
 
 import (
 	"bytes"
+	"flag"
 	"go/parser"
 	"go/token"
 	"os"
@@ -14,6 +15,9 @@ import (
 	_ "github.com/mvertes/parscan/stdlib/jsonx"
 )
 
+// OptLevel is the optimization level of the interpreted code under test.
+var OptLevel = flag.Int("O", 0, "optimization `level` of the interpreted code")
+
 func TestFile(t *testing.T) {
 	baseDir := filepath.Join("..", "_samples")
 	files, err := os.ReadDir(baseDir)
@@ -48,6 +52,7 @@ func runFile(t *testing.T, p string) {
 	i.ImportPackageValues(stdlib.Values)
 	i.SetIO(os.Stdin, &stdout, &stderr)
 	i.SetPkgfs("../_samples/pkg")
+	i.OptLevel = *OptLevel
 
 	_, err = i.Eval(p, string(buf))
 	if isErr {
@@ -67,6 +72,60 @@ func runFile(t *testing.T, p string) {
 	}
 }
 
+func TestFileImage(t *testing.T) {
+	baseDir := filepath.Join("..", "_samples")
+	files, err := os.ReadDir(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".go" {
+			continue
+		}
+		t.Run(file.Name(), func(t *testing.T) {
+			t.Parallel()
+			runImage(t, filepath.Join(baseDir, file.Name()))
+		})
+	}
+}
+
+// runImage compiles the sample p to an image, then loads and runs it in a
+// new interpreter.
+func runImage(t *testing.T, p string) {
+	t.Helper()
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, isErr, skip := commentData(p, buf)
+	if skip || isErr {
+		t.Skip()
+	}
+
+	var img, stdout bytes.Buffer
+
+	i := NewInterpreter(golang.GoSpec)
+	i.ImportPackageValues(stdlib.Values)
+	i.SetPkgfs("../_samples/pkg")
+	i.OptLevel = *OptLevel
+	if err := i.WriteImage(&img, p, string(buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	i = NewInterpreter(golang.GoSpec)
+	i.ImportPackageValues(stdlib.Values)
+	i.SetIO(os.Stdin, &stdout, os.Stderr)
+	if err := i.LoadImage(&img); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if res := stdout.String(); res != want {
+		t.Errorf("\ngot:  %q,\nwant: %q", res, want)
+	}
+}
+
 func TestImportDiamond(t *testing.T) {
 	// Both pkg2 and pkg3 import pkg1. Verify pkg1 is registered once.
 	src := `package main
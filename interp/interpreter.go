@@ -2,14 +2,22 @@
 package interp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
+	"slices"
+	"strings"
 
 	"github.com/mvertes/parscan/comp"
+	"github.com/mvertes/parscan/goparser"
 	"github.com/mvertes/parscan/lang"
 	"github.com/mvertes/parscan/stdlib"
+	"github.com/mvertes/parscan/symbol"
 	"github.com/mvertes/parscan/vm"
+	"github.com/mvertes/parscan/wasm"
 )
 
 var debug = os.Getenv("PARSCAN_DEBUG") != ""
@@ -31,6 +39,24 @@ func NewInterpreter(s *lang.Spec) *Interp {
 // Eval evaluates code string and return the last produced value if any, or an error.
 // name identifies the source ("m:<content>" for inline, "f:<path>" for file).
 func (i *Interp) Eval(name, src string) (res reflect.Value, err error) {
+	return i.EvalContext(context.Background(), name, src)
+}
+
+// EvalContext is like Eval, but execution stops when ctx is cancelled, in which
+// case the returned error is ctx.Err(). Goroutines started by the evaluated
+// code are stopped as well.
+func (i *Interp) EvalContext(ctx context.Context, name, src string) (res reflect.Value, err error) {
+	return i.eval(ctx, func() error { return i.Compile(name, src) })
+}
+
+// EvalFiles is like EvalContext for the files of a package, compiled
+// together.
+func (i *Interp) EvalFiles(ctx context.Context, files ...goparser.File) (res reflect.Value, err error) {
+	return i.eval(ctx, func() error { return i.CompileFiles(files...) })
+}
+
+// eval compiles code with compile, then runs it.
+func (i *Interp) eval(ctx context.Context, compile func() error) (res reflect.Value, err error) {
 	codeOffset := len(i.Code)
 	dataOffset := 0
 	if codeOffset > 0 {
@@ -40,12 +66,8 @@ func (i *Interp) Eval(name, src string) (res reflect.Value, err error) {
 	i.PopExit() // Remove last exit from previous run (re-entrance).
 	initsBefore := len(i.InitFuncs)
 
-	if !i.stdlibPatched {
-		i.patchStdlibOverrides()
-		i.stdlibPatched = true
-	}
-
-	if err = i.Compile(name, src); err != nil {
+	i.patchStdlib()
+	if err = compile(); err != nil {
 		return res, err
 	}
 
@@ -54,27 +76,158 @@ func (i *Interp) Eval(name, src string) (res reflect.Value, err error) {
 	i.TrimStack()
 	i.Push(i.Data[dataOffset:]...)
 	i.PushCode(i.Code[codeOffset:]...)
-	emitCall := func(fn string) {
+	var start []int
+	for _, fn := range append(slices.Clip(i.InitFuncs[initsBefore:]), "main") {
 		if s, ok := i.Symbols[fn]; ok {
-			i.PushCode(vm.Instruction{Op: vm.Push, A: int32(i.Data[s.Index].Int())}) //nolint:gosec
-			i.PushCode(vm.Instruction{Op: vm.Call})
+			start = append(start, s.Index)
 		}
 	}
-	for _, fn := range i.InitFuncs[initsBefore:] {
-		emitCall(fn)
-	}
-	emitCall("main")
-	i.PushCode(vm.Instruction{Op: vm.Exit})
+	i.PushCode(startCode(i.Data, start)...)
 	i.SetIP(max(codeOffset, i.Entry))
 	i.SetDebugInfo(func() *vm.DebugInfo { return i.BuildDebugInfo() })
 	if debug {
 		i.PrintData()
 		i.PrintCode()
 	}
-	err = i.Run()
+	err = i.RunContext(ctx)
 	return i.Top().Reflect(), err
 }
 
+// startCode returns the calls of the functions whose code addresses are
+// in data at indexes start, then the final exit.
+func startCode(data []vm.Value, start []int) vm.Code {
+	code := make(vm.Code, 0, 2*len(start)+1)
+	for _, idx := range start {
+		code = append(code,
+			vm.Instruction{Op: vm.Push, A: int32(data[idx].Int()), Pos: vm.NoPos}, //nolint:gosec
+			vm.Instruction{Op: vm.Call, Pos: vm.NoPos})
+	}
+	return append(code, vm.Instruction{Op: vm.Exit, Pos: vm.NoPos})
+}
+
+// WriteImage compiles src like Eval, but instead of running the program,
+// writes its bytecode image to w, to be loaded later by LoadImage.
+func (i *Interp) WriteImage(w io.Writer, name, src string) error {
+	i.patchStdlib()
+	if err := i.Compile(name, src); err != nil {
+		return err
+	}
+	return i.Image().Encode(w)
+}
+
+// WriteWasm compiles src and writes it to w as a WebAssembly module,
+// exporting its top-level functions of numbers and bools, except main and
+// init. It fails if there is none.
+func (i *Interp) WriteWasm(w io.Writer, name, src string) error {
+	i.patchStdlib()
+	if err := i.Compile(name, src); err != nil {
+		return err
+	}
+	img := i.Image()
+	var funcs []wasm.Func
+	for fname, s := range i.Symbols {
+		if s.Kind != symbol.Func || s.Index < 0 || s.Index >= len(img.Data) || s.Type == nil {
+			continue
+		}
+		_, ok := wasm.FuncTypeOf(s.Type.Rtype)
+		export := ok && fname != "main" && fname != "init" && !strings.ContainsAny(fname, "/.#")
+		funcs = append(funcs, wasm.Func{Name: fname, Addr: int(img.Data[s.Index].Int()), Type: s.Type.Rtype, Export: export})
+	}
+	if !slices.ContainsFunc(funcs, func(f wasm.Func) bool { return f.Export }) {
+		return errors.New("no exportable functions")
+	}
+	slices.SortFunc(funcs, func(a, b wasm.Func) int { return strings.Compare(a.Name, b.Name) })
+	mod, err := wasm.Compile(img, funcs)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(mod.Encode())
+	return err
+}
+
+// LoadImage reads a bytecode image written by WriteImage and prepares its
+// program to be run by Run or RunContext, without parsing nor compiling.
+// Native symbols are resolved by package path and name in the packages
+// imported by the interpreter, which must not have evaluated code before.
+func (i *Interp) LoadImage(r io.Reader) error {
+	if i.PushCode() > 0 {
+		return errors.New("image loaded after evaluation")
+	}
+	i.patchStdlib()
+	img, err := vm.DecodeImage(r, i.packageValues())
+	if err != nil {
+		return err
+	}
+	code := append(slices.Clip(img.Code), startCode(img.Data, img.Start)...)
+	if err := vm.Verify(code, img.Data); err != nil {
+		return err
+	}
+	i.Machine.MethodNames = img.MethodNames
+	i.Push(img.Data...)
+	i.PushCode(code...)
+	i.SetIP(max(0, img.Entry))
+	i.SetDebugInfo(func() *vm.DebugInfo { return img.Debug })
+	return nil
+}
+
+// WriteSnapshot writes snapshot s of the interpreter state to w, or the
+// state of its globals if s is nil. It can be read by ReadSnapshot in an
+// interpreter running the same program, from the same source or image.
+func (i *Interp) WriteSnapshot(w io.Writer, s *vm.Snapshot) error {
+	if s == nil {
+		s = i.Snapshot()
+	}
+	return s.Encode(w, i.packageValues())
+}
+
+// ReadSnapshot restores the interpreter state from a snapshot written by
+// WriteSnapshot. If it holds the stack of a paused run, Run resumes it.
+func (i *Interp) ReadSnapshot(r io.Reader) error {
+	i.patchStdlib()
+	s, err := i.DecodeSnapshot(r, i.packageValues())
+	if err != nil {
+		return err
+	}
+	if err := i.Restore(s); err != nil {
+		return err
+	}
+	// The compiler shares the globals, for Dump and later evaluations.
+	for k := range min(len(i.Data), len(s.Globals)) {
+		i.Data[k] = i.Global(k)
+	}
+	return nil
+}
+
+// WriteDump writes a dump of the global variables to w. Unlike a snapshot,
+// it can be read by ReadDump in another version of the program, to be
+// restored by MigrateDump.
+func (i *Interp) WriteDump(w io.Writer) error {
+	return i.Dump().Encode(w, i.packageValues())
+}
+
+// ReadDump reads a dump written by WriteDump.
+func (i *Interp) ReadDump(r io.Reader) (*comp.Dump, error) {
+	i.patchStdlib()
+	return comp.DecodeDump(r, i.packageValues())
+}
+
+// packageValues returns the values of the imported packages, by path.
+func (i *Interp) packageValues() map[string]map[string]vm.Value {
+	pkgs := make(map[string]map[string]vm.Value, len(i.Packages))
+	for path, pkg := range i.Packages {
+		pkgs[path] = pkg.Values
+	}
+	return pkgs
+}
+
+// patchStdlib applies the stdlib overrides, once.
+func (i *Interp) patchStdlib() {
+	if !i.stdlibPatched {
+		i.patchStdlibOverrides()
+		i.stdlibPatched = true
+	}
+}
+
 func (i *Interp) patchStdlibOverrides() {
 	i.patchFmtBindings()
 	for importPath, fns := range stdlib.PackagePatchers() {
@@ -1,15 +1,27 @@
 package interp_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mvertes/parscan/comp/opt"
+	"github.com/mvertes/parscan/goparser"
 	"github.com/mvertes/parscan/interp"
 	"github.com/mvertes/parscan/lang/golang"
 	"github.com/mvertes/parscan/stdlib"
+	"github.com/mvertes/parscan/vm"
 )
 
 type etest struct {
@@ -29,6 +41,7 @@ func gen(test etest) func(*testing.T) {
 		}
 		intp := interp.NewInterpreter(golang.GoSpec)
 		intp.ImportPackageValues(stdlib.Values)
+		intp.OptLevel = *interp.OptLevel
 		errStr := ""
 		r, e := intp.Eval("test", test.src)
 		t.Log(r, e)
@@ -109,6 +122,29 @@ func BenchmarkAppendLarge(b *testing.B) {
 	}
 }
 
+func BenchmarkClosure(b *testing.B) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	if _, err := intp.Eval("setup", `
+		func sum(n int) int {
+			s := 0
+			for i := 0; i < n; i++ {
+				a, b := i, i*2
+				f := func(x int) int { return x + a + b + n }
+				s = f(s)
+			}
+			return s
+		}
+	`); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := intp.Eval("bench", "sum(100)"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestExpr(t *testing.T) {
 	run(t, []etest{
 		{n: "#00", src: "", res: "<invalid reflect.Value>"},
@@ -270,6 +306,118 @@ func TestFusedOps(t *testing.T) {
 	})
 }
 
+func TestInline(t *testing.T) {
+	for _, test := range []struct {
+		n, src, res string
+		inlined     bool
+	}{
+		{"abs", "func abs(x int) int { if x < 0 { return -x }; return x }; func g() (s int) { for i := -3; i < 3; i++ { s += abs(i) }; return }; g()", "9", true},
+		{"min", "func min2(a, b int) int { if a < b { return a }; return b }; func g() int { return min2(3, 2)*10 + min2(1, 5) }; g()", "21", true},
+		{"nested", "func add(a, b int) int { return a + b }; func g() int { return 100 + add(1, add(2, 3)) }; g()", "106", true},
+		{"results", "func dup(a int) (int, int) { return a, a + 1 }; func g() int { x, y := dup(4); return x*10 + y }; g()", "45", true},
+		{"divmod", "func div(a, b int) (int, int) { return a / b, a % b }; func g() int { q, r := div(7, 2); return q*10 + r }; g()", "31", true},
+		{"param", "func inc(a int) int { a++; return a }; func g() int { x := 1; y := inc(x); return x*10 + y }; g()", "12", true},
+		{"getter", "type P struct{ x int }; func getX(p *P) int { return p.x }; func g() int { p := &P{7}; return getX(p) }; g()", "7", true},
+		{"recursive", "func fib(n int) int { if n < 2 { return n }; return fib(n-1) + fib(n-2) }; func g() int { return fib(10) }; g()", "55", false},
+		{"local", "func sq(x int) int { y := x * x; return y }; func g() int { return sq(5) }; g()", "25", false},
+		{"defer", "var n int; func f() int { defer func() { n++ }(); return n }; func g() int { return f() + f() }; g()", "1", false},
+	} {
+		t.Run(test.n, func(t *testing.T) {
+			intp := interp.NewInterpreter(golang.GoSpec)
+			intp.OptLevel = opt.MaxLevel
+			r, err := intp.Eval("test", test.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := fmt.Sprintf("%v", r); res != test.res {
+				t.Errorf("got %v, want %v", res, test.res)
+			}
+			if inlined := len(intp.BuildDebugInfo().Inlined) > 0; inlined != test.inlined {
+				t.Errorf("got inlined %v, want %v", inlined, test.inlined)
+			}
+		})
+	}
+}
+
+func TestInlineDefer(t *testing.T) {
+	for _, test := range []struct{ n, src, out string }{
+		{"println", `func sub(a, b int) int { return a - b }; func main() { defer fmt.Println("bye"); fmt.Println(sub(10, 3)) }`, "7\nbye\n"},
+		{"recover", `func div(a, b int) int { return a / b }
+func idx(s []int, i int) int { return s[i] }
+func main() {
+	defer func() { fmt.Println(recover()) }()
+	idx([]int{1}, div(1, 1))
+}`, "runtime error: index out of range [1] with length 1\n"},
+	} {
+		t.Run(test.n, func(t *testing.T) {
+			intp := interp.NewInterpreter(golang.GoSpec)
+			intp.ImportPackageValues(stdlib.Values)
+			intp.OptLevel = opt.MaxLevel
+			var out bytes.Buffer
+			intp.SetIO(nil, &out, nil)
+			if _, err := intp.Eval("m:test", `import "fmt"; `+test.src); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != test.out {
+				t.Errorf("got %q, want %q", got, test.out)
+			}
+		})
+	}
+}
+
+func TestInlinePanicTrace(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	intp.OptLevel = opt.MaxLevel
+	_, err := intp.Eval("test", `
+func at(s []int, i int) int { return s[i] }
+func main() {
+	at([]int{1}, 2)
+}`)
+	var pe *vm.PanicError
+	if !errors.As(err, &pe) {
+		t.Fatalf("got error %v, want a *vm.PanicError", err)
+	}
+	trace := pe.Trace()
+	t.Log(trace)
+	if i, j := strings.Index(trace, "main.at(...)\n\ttest:2:"), strings.Index(trace, "main.main()\n\ttest:4:"); i < 0 || j < i {
+		t.Errorf("unexpected trace:\n%s", trace)
+	}
+}
+
+func TestTailCall(t *testing.T) {
+	run(t, []etest{
+		{n: "self", src: `func sum(n, a int) int { if n == 0 { return a }; return sum(n-1, a+n) }; sum(100000, 0)`, res: "5000050000"},
+		{n: "mutual", src: `func even(n int) bool { if n == 0 { return true }; return odd(n - 1) }; func odd(n int) bool { if n == 0 { return false }; return even(n - 1) }; even(100001)`, res: "false"},
+		{n: "more_args", src: `func f(a int) int { return g(a, 2, 3) }; func g(a, b, c int) int { if a == 0 { return b + c }; return f(a - 1) }; f(10)`, res: "5"},
+		{n: "multi_results", src: `func f(n int) (int, int) { if n == 0 { return 1, 2 }; return f(n - 1) }; a, b := f(10); a*10 + b`, res: "12"},
+		{n: "from_closure", src: `func f(n int) int { if n == 0 { return 7 }; return f(n - 1) }; k := 3; g := func() int { return f(k) }; g() + k`, res: "10"},
+		{n: "defer", src: `a := 0; func f(n int) int { if n == 2 { defer func() { a = n }() }; if n == 0 { return 1 }; return f(n - 1) }; f(5) + a`, res: "3"},
+	})
+}
+
+func TestTailCallPanicTrace(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	_, err := intp.Eval("test", `
+func f(n int) int {
+	if n == 0 {
+		panic("zero")
+	}
+	return f(n - 1)
+}
+func main() {
+	f(3)
+}`)
+	var pe *vm.PanicError
+	if !errors.As(err, &pe) {
+		t.Fatalf("got error %v, want a *vm.PanicError", err)
+	}
+	trace := pe.Trace()
+	t.Log(trace)
+	if !strings.Contains(trace, "main.f(...)\n\ttest:4:8\n...3 frames elided by tail calls...\nmain.main()\n\ttest:9:") {
+		t.Errorf("unexpected trace:\n%s", trace)
+	}
+}
+
 func TestOutOfOrder(t *testing.T) {
 	run(t, []etest{
 		// function declared after use
@@ -463,6 +611,8 @@ func TestIf(t *testing.T) {
 		{n: "#05", src: "a := 1; if a < 0 || a < 2 { a = 3 }; a", res: "3"},
 		{n: "#06", src: `func f() (int, error) { return 3, nil }; r := 0; if a, err := f(); err != nil { r = 1 } else { r = a }; r`, res: "3"},
 		{n: "#07", src: `func f() (int, error) { return 0, nil }; func g() ([]int, error) { return []int{1,2}, nil }; r := 0; if a, err := f(); err != nil { r = a } else if _, err2 := g(); err2 != nil { r = 1 } else { r = 3 }; r`, res: "3"},
+		{n: "#08", src: "a := 0; if a > 0 && a < 2 { a = 3 }; a", res: "0"},
+		{n: "#09", src: "func f(a int) int { if a > 0 && a < 2 { a = 3 }; return a }; f(0)", res: "0"},
 	})
 }
 
@@ -1942,6 +2092,11 @@ f()`, res: "606"},
 		{n: "#13", src: `func f() int { n := 0; inc := func() { n = n+1 }; get := func() int { return n }; inc(); inc(); inc(); return get() }; f()`, res: "3"},
 		// Closure captures shadowed loop variable (not the post-increment loop var).
 		{n: "#14", src: `func f() int { foos := []func() int{}; for i := 0; i < 3; i++ { i := i; foos = append(foos, func() int { return i }) }; return foos[0]() + foos[1]()*10 + foos[2]()*100 }; f()`, res: "210"},
+		// Never written captures are copied by value, shared data remains shared.
+		{n: "#15", src: `func f() int { s := []int{1}; m := map[int]int{}; g := func() { s[0] = 5; m[1] = 2 }; g(); return s[0] + m[1] }; f()`, res: "7"},
+		{n: "#16", src: `func f() int { n := 4; a := func() int { return n }; b := func() int { return n * 2 }; return a() + b() }; f()`, res: "12"},
+		// Modified by a pointer method: shared cell.
+		{n: "#17", src: `type C int; func (c *C) Inc() { *c = *c + 1 }; func f() C { var c C; g := func() C { return c }; c.Inc(); return g() }; f()`, res: "1"},
 	})
 }
 
@@ -2196,6 +2351,65 @@ func TestArithFloat(t *testing.T) {
 		{n: "sub_assign", src: "var a float64 = 5.0; a -= 1.5; a", res: "3.5"},
 		{n: "mul_assign", src: "var a float64 = 2.5; a *= 4.0; a", res: "10"},
 		{n: "div_assign", src: "var a float64 = 7.0; a /= 2.0; a", res: "3.5"},
+
+		{n: "eq_int_const", src: "var a float64 = 1; a == 1", res: "true"},
+		{n: "eq_int_const_left", src: "var a float64 = 2; 2 == a", res: "true"},
+		{n: "ne_int_const", src: "var a float32 = 2; a != 2", res: "false"},
+		{n: "slice_int_const", src: "a := []float64{1, 2}; a[1] = 3; a", res: "[1 3]"},
+		{n: "array_int_const", src: "var a [2]float32; a[1] = 4; a", res: "[0 4]"},
+		{n: "map_int_const", src: "m := map[float64]float32{1: 2}; m[2] = 4; m", res: "map[1:2 2:4]"},
+		{n: "field_int_const", src: "type T struct{ X float64 }; T{X: 1}", res: "{1}"},
+		{n: "field_pos_int_const", src: "type T struct{ X float64 }; T{1}", res: "{1}"},
+		{n: "nested_int_const", src: "type T struct{ X float64 }; []*T{{X: 1}}[0].X + map[string][]float64{\"a\": {2}}[\"a\"][0]", res: "3"},
+	})
+}
+
+func TestArithComplex(t *testing.T) {
+	run(t, []etest{
+		{n: "lit", src: "1 + 2i", res: "(1+2i)"},
+		{n: "add", src: "a, b := 1+2i, 3+4i; a + b", res: "(4+6i)"},
+		{n: "sub", src: "a, b := 1+2i, 3+4i; a - b", res: "(-2-2i)"},
+		{n: "mul", src: "a, b := 1+2i, 3+4i; a * b", res: "(-5+10i)"},
+		{n: "div", src: "a, b := 1+2i, 3+4i; a / b", res: "(0.44+0.08i)"},
+		{n: "negate", src: "a := 1 + 2i; -a", res: "(-1-2i)"},
+		{n: "eq", src: "a := 1 + 2i; a == 1+2i", res: "true"},
+		{n: "ne", src: "a := 1 + 2i; a != 1", res: "true"},
+		{n: "eq_int_const", src: "var a complex128 = 1; a == 1", res: "true"},
+		{n: "add_assign", src: "var a complex128; a += 1i; a *= 2; a", res: "(0+2i)"},
+
+		{n: "c64", src: "var a complex64 = 1.5 - 0.5i; a * a", res: "(2-1.5i)"},
+		{n: "c64_type", src: `import "fmt"; var a complex64 = 1; fmt.Sprintf("%T", a*a)`, res: "complex64"},
+		{n: "c64_to_c128", src: "var a complex64 = 1i; complex128(a)", res: "(0+1i)"},
+
+		{n: "complex", src: "complex(3, 4)", res: "(3+4i)"},
+		{n: "complex_f32", src: `import "fmt"; var f float32 = 2; fmt.Sprintf("%T", complex(f, 1))`, res: "complex64"},
+		{n: "real", src: "a := 3 + 4i; real(a)", res: "3"},
+		{n: "imag", src: "a := 3 + 4i; imag(a)", res: "4"},
+		{n: "real_c64", src: `import "fmt"; var a complex64 = 3; fmt.Sprintf("%T", real(a))`, res: "float32"},
+
+		{n: "const", src: "const c = 2i * 2i; c", res: "(-4+0i)"},
+		{n: "const_real", src: "const c = real(3 + 4i); c", res: "3"},
+		{n: "slice", src: "[]complex128{1, 2i}", res: "[(1+0i) (0+2i)]"},
+		{n: "slice_int_const", src: "a := []complex128{1, 2}; a[1] = 3; a", res: "[(1+0i) (3+0i)]"},
+		{n: "map_int_const", src: "m := map[complex64]complex128{1: 2}; m[2] = 4; m", res: "map[(1+0i):(2+0i) (2+0i):(4+0i)]"},
+		{n: "field_int_const", src: "type T struct{ Z complex128 }; t := T{Z: 1}; t.Z = 2; t", res: "{(2+0i)}"},
+		{n: "var_int", src: "var n int = 2i * 2i; n", res: "-4"},
+		{n: "var_float", src: "var a, f float32 = 0, 1.5 + 0i; a + f", res: "1.5"},
+		{n: "var_local", src: "func f() uint8 { var n uint8 = 3 + 0i; return n }; f()", res: "3"},
+		{n: "const_int", src: "const n int = 2i * 2i; n", res: "-4"},
+		{n: "assign_int", src: "var n int; n = 2i * 2i; n", res: "-4"},
+		{n: "var_truncated", src: "var n int = 2i", err: "cannot use untyped complex constant (0 + 2i) as int value in variable declaration (truncated) (test:1:13)"},
+		{n: "var_frac", src: "var n int = 2.5 + 0i", err: "(truncated) (test:1:13)"},
+		{n: "var_overflows", src: "var f float64 = 1 + 1i", err: "as float64 value in variable declaration (overflows)"},
+		{n: "const_truncated", src: "func f() int { const n int = 2i * 2i + 1i; return n }; f()", err: "cannot use untyped complex constant (-4 + 1i) as int value in constant declaration (truncated)"},
+		{n: "var_local_int", src: "func f() int { var n int = 2i * 2i; return n }; f()", res: "-4"},
+		{n: "var_local_truncated", src: "func f() int { var n int = 2i*2i + 1i; return n }; f()", err: "cannot use untyped complex constant (-4 + 1i) as int value in variable declaration (truncated) (test:1:28)"},
+		{n: "assign_local_int", src: "func f() int { n := 0; n = 2i * 2i; return n }; f()", res: "-4"},
+		{n: "assign_truncated", src: "var n int; n = 2i*2i + 1i", err: "cannot use untyped complex constant (-4 + 1i) as int value in assignment (truncated) (test:1:16)"},
+		{n: "assign_local_truncated", src: "func f() int { n := 0; n = 2i*2i + 1i; return n }; f()", err: "cannot use untyped complex constant (-4 + 1i) as int value in assignment (truncated) (test:1:28)"},
+		{n: "assign_overflows", src: "func f() float64 { x := 1.5; x = 1 + 1i; return x }; f()", err: "as float64 value in assignment (overflows)"},
+		{n: "cmplx_abs", src: `import "math/cmplx"; cmplx.Abs(3 + 4i)`, res: "5"},
+		{n: "cmplx_sqrt", src: `import "math/cmplx"; cmplx.Sqrt(-1)`, res: "(0+1i)"},
 	})
 }
 
@@ -2753,3 +2967,837 @@ func TestRepl(t *testing.T) {
 		}
 	})
 }
+
+func TestEvalContext(t *testing.T) {
+	tests := []struct {
+		n, src string
+		cancel bool // cancel explicitly instead of using a deadline
+		want   error
+	}{
+		{n: "loop_deadline", src: `for {}`, want: context.DeadlineExceeded},
+		{n: "loop_cancel", src: `a := 0; for { a++ }`, cancel: true, want: context.Canceled},
+		{n: "recursion", src: `func f(n int) int { if n < 0 { return f(n) }; return f(n-1) }; f(1)`, want: context.DeadlineExceeded},
+		{n: "chan_recv", src: `c := make(chan int); <-c`, want: context.DeadlineExceeded},
+		{n: "chan_send", src: `c := make(chan int); c <- 1`, want: context.DeadlineExceeded},
+		{n: "select", src: `c := make(chan int); select { case <-c: }`, want: context.DeadlineExceeded},
+		{n: "range_chan", src: `c := make(chan int); for range c {}`, want: context.DeadlineExceeded},
+		{n: "range_chan_local", src: `func f(c chan int) (n int) { for v := range c { n += v }; return }; f(make(chan int))`, want: context.DeadlineExceeded},
+		{n: "callback", src: `import "sort"; s := []int{2, 1}; sort.Slice(s, func(i, j int) bool { for {} })`, want: context.DeadlineExceeded},
+		{n: "done", src: `a := 1; a + 1`},
+	}
+	for _, test := range tests {
+		t.Run(test.n, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if test.cancel {
+				ctx, cancel = context.WithCancel(context.Background())
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+			intp := interp.NewInterpreter(golang.GoSpec)
+			intp.ImportPackageValues(stdlib.Values)
+			_, err := intp.EvalContext(ctx, "test", test.src)
+			if !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestEvalContextGoroutine checks that goroutines spawned by the evaluated
+// code stop once the context is cancelled.
+func TestEvalContextGoroutine(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := intp.EvalContext(ctx, "test", `
+var n int
+func spin() { for { n++ } }
+go spin()
+c := make(chan int)
+<-c`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	r1, _ := intp.Eval("n1", "n")
+	time.Sleep(20 * time.Millisecond)
+	r2, _ := intp.Eval("n2", "n")
+	if r1.Int() != r2.Int() {
+		t.Errorf("goroutine still running after cancel: n went from %v to %v", r1, r2)
+	}
+}
+
+// TestEvalContextTrap checks that a trap waiting for debugger commands
+// stops once the context is cancelled.
+func TestEvalContextTrap(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	r, w := io.Pipe()
+	defer w.Close()
+	intp.SetDebugIO(r, io.Discard)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := intp.EvalContext(ctx, "test", `trap(); 1`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestEvalContextLock checks that a lock acquired by a call abandoned on
+// cancellation is released, instead of being held forever.
+func TestEvalContextLock(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	intp.ImportPackageValues(stdlib.Values)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := intp.EvalContext(ctx, "test", `import "sync"; var mu sync.Mutex; mu.Lock(); mu.Lock()`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := intp.Eval("unlock", "mu.Unlock()"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond) // for the abandoned call to acquire the lock
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := intp.EvalContext(ctx, "lock", "mu.Lock()"); err != nil {
+		t.Errorf("mutex held by the abandoned call: %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		n, src string
+		limits vm.Limits
+		kind   vm.LimitKind
+		ok     bool
+	}{
+		{n: "insns", src: `for {}`, limits: vm.Limits{MaxInstructions: 10000}, kind: vm.LimitInstructions},
+		{n: "insns_ok", src: `a := 0; for i := 0; i < 10; i++ { a += i }; a`, limits: vm.Limits{MaxInstructions: 10000}, ok: true},
+		{n: "insns_defer", src: `func g() { defer func() { for {} }(); for {} }; g()`, limits: vm.Limits{MaxInstructions: 10000}, kind: vm.LimitInstructions},
+		{n: "insns_goroutine", src: `func spin() { for {} }; go spin(); for {}`, limits: vm.Limits{MaxInstructions: 100000}, kind: vm.LimitInstructions},
+		{n: "stack", src: `func f(n int) int { return 1 + f(n+1) }; f(0)`, limits: vm.Limits{MaxStack: 10000}, kind: vm.LimitStack},
+		{n: "stack_ok", src: `func f(n int) int { if n == 0 { return 0 }; return 1 + f(n-1) }; f(100)`, limits: vm.Limits{MaxStack: 10000}, ok: true},
+		{n: "stack_tail", src: `func f(n, a int) int { if n == 0 { return a }; return f(n-1, a+n) }; f(100000, 0)`, limits: vm.Limits{MaxStack: 1000}, ok: true},
+		{n: "stack_mutual", src: `
+func even(n int) bool { if n == 0 { return true }; return odd(n - 1) }
+func odd(n int) bool { if n == 0 { return false }; return even(n - 1) }
+even(100001)`, limits: vm.Limits{MaxStack: 1000}, ok: true},
+		{n: "stack_defer", src: `func f(n int) int { defer func() {}(); if n == 0 { return 0 }; return f(n-1) }; f(100000)`, limits: vm.Limits{MaxStack: 10000}, kind: vm.LimitStack},
+		{n: "goroutines", src: `c := make(chan int); func f() { <-c }; for { go f() }`, limits: vm.Limits{MaxGoroutines: 10}, kind: vm.LimitGoroutines},
+		{n: "not_recovered", src: `
+func f(n int) int { return 1 + f(n+1) }
+func g() (r int) {
+	defer func() { recover(); r = -1 }()
+	return f(0)
+}
+g()`, limits: vm.Limits{MaxStack: 1000}, kind: vm.LimitStack},
+	}
+	for _, test := range tests {
+		t.Run(test.n, func(t *testing.T) {
+			t.Parallel()
+			intp := interp.NewInterpreter(golang.GoSpec)
+			intp.SetLimits(test.limits)
+			_, err := intp.Eval("test", test.src)
+			if test.ok {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			var le *vm.LimitError
+			if !errors.As(err, &le) {
+				t.Fatalf("got error %v, want a *vm.LimitError", err)
+			}
+			if le.Kind != test.kind {
+				t.Errorf("got limit %v, want %v", le.Kind, test.kind)
+			}
+		})
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	const rec = `var r any; func try(f func()) any { defer func() { r = recover() }(); f(); return nil }
+`
+	run(t, []etest{
+		{n: "index", src: rec + `s := []int{1, 2, 3}; i := 5; try(func() { println(s[i]) }); r.(error).Error()`, res: "runtime error: index out of range [5] with length 3"},
+		{n: "index_neg", src: rec + `s := []int{1, 2, 3}; i := -1; try(func() { println(s[i]) }); r.(error).Error()`, res: "runtime error: index out of range [-1] with length 3"},
+		{n: "index_set", src: rec + `var a [2]int; i := 2; try(func() { a[i] = 1 }); r.(error).Error()`, res: "runtime error: index out of range [2] with length 2"},
+		{n: "index_string", src: rec + `s := "abc"; i := 3; try(func() { println(s[i]) }); r.(error).Error()`, res: "runtime error: index out of range [3] with length 3"},
+		{n: "slice", src: rec + `s := []int{1, 2, 3}; i := 5; try(func() { println(s[1:i]) }); r.(error).Error()`, res: "runtime error: slice bounds out of range [:5] with capacity 3"},
+		{n: "div_zero", src: rec + `a, b := 1, 0; try(func() { println(a / b) }); r.(error).Error()`, res: "runtime error: integer divide by zero"},
+		{n: "nil_map", src: rec + `var m map[string]int; try(func() { m["a"] = 1 }); r.(error).Error()`, res: "assignment to entry in nil map"},
+		{n: "nil_deref", src: rec + `var p *int; try(func() { println(*p) }); r.(error).Error()`, res: "runtime error: invalid memory address or nil pointer dereference"},
+		{n: "nil_field", src: rec + `type T struct{ a int }; var p *T; try(func() { println(p.a) }); r.(error).Error()`, res: "runtime error: invalid memory address or nil pointer dereference"},
+		{n: "runtime_error", src: rec + `import "runtime"; s := []int{}; i := 1
+try(func() { println(s[i]) }); _, ok := r.(runtime.Error); ok`, res: "true"},
+		{n: "defer_runs", src: `a := 0; func f() { defer func() { a = 1 }(); var m map[int]int; m[1] = 1 }
+func g() { defer func() { recover() }(); f() }; g(); a`, res: "1"},
+		{n: "unrecovered", src: `a, b := 1, 0; a / b`, err: "panic: runtime error: integer divide by zero"},
+		{n: "nil_func", src: rec + `var f func(); try(f); r.(error).Error()`, res: "runtime error: invalid memory address or nil pointer dereference"},
+		{n: "nil_func_local", src: `var r any; func h() { var f func(); defer func() { r = recover() }(); f() }; h(); r.(error).Error()`, res: "runtime error: invalid memory address or nil pointer dereference"},
+		{n: "nil_func_defer", src: rec + `try(func() { var f func(); defer f() }); r.(error).Error()`, res: "runtime error: invalid memory address or nil pointer dereference"},
+		{n: "nil_func_go", src: rec + `var f func(); try(func() { go f() }); r.(error).Error()`, res: "go of nil func value"},
+		{n: "nil_func_unrecovered", src: `var f func(); f()`, err: "panic: runtime error: invalid memory address or nil pointer dereference"},
+		{n: "makeslice_len", src: rec + `n := -1; try(func() { _ = make([]int, n) }); r.(error).Error()`, res: "runtime error: makeslice: len out of range"},
+		{n: "makeslice_cap", src: rec + `n := 1; try(func() { _ = make([]int, 2, n) }); r.(error).Error()`, res: "runtime error: makeslice: cap out of range"},
+		{n: "makechan", src: rec + `n := -1; try(func() { _ = make(chan int, n) }); r.(error).Error()`, res: "runtime error: makechan: size out of range"},
+		{n: "nil_iface_method", src: rec + `type I interface{ M() }; func h() { var i I; i.M() }; try(h); r.(error).Error()`, res: "runtime error: invalid memory address or nil pointer dereference"},
+		{n: "type_assert", src: rec + `var i any = 1; try(func() { _ = i.(string) }); r.(error).Error()`, res: "interface conversion: interface {} is int, not string"},
+		{n: "type_assert_runtime_error", src: rec + `import "runtime"; var i any = 1
+try(func() { _ = i.(string) }); _, ok := r.(runtime.Error); ok`, res: "true"},
+		{n: "nil_map_local", src: rec + `func h() { var m map[string]int; m["a"] = 1 }; try(h); r.(error).Error()`, res: "assignment to entry in nil map"},
+		{n: "nil_slice_local", src: `func h() bool { var s []int; return s == nil }; h()`, res: "true"},
+		{n: "defer_builtin", src: rec + `try(func() { var c chan int; defer close(c) }); r.(error).Error()`, res: "close of nil channel"},
+	})
+}
+
+func TestGoroutinePanic(t *testing.T) {
+	run(t, []etest{
+		{n: "chan_wait", src: `c := make(chan int); func worker() { panic("boom") }; go worker(); <-c`, err: "panic: boom"},
+		{n: "waitgroup", src: `
+import "sync"
+var wg sync.WaitGroup
+wg.Add(1)
+go func() { panic("boom") }()
+wg.Wait()`, err: "panic: boom"},
+		{n: "mutex", src: `
+import "sync"
+var mu sync.Mutex
+mu.Lock()
+go func() { panic("boom") }()
+mu.Lock()`, err: "panic: boom"},
+		{n: "fault", src: `c := make(chan int); go func() { s := []int{}; i := 1; s[i] = 0 }(); <-c`, err: "panic: runtime error: index out of range [1] with length 0"},
+		{n: "spinning_main", src: `go func() { panic("boom") }(); for {}`, err: "panic: boom"},
+		{n: "recovered", src: `
+c := make(chan int)
+go func() { defer func() { c <- 1 }(); defer func() { recover() }(); panic("boom") }()
+<-c`, res: "1"},
+	})
+}
+
+func TestPanicFrames(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	_, err := intp.Eval("test", `
+func fail() { panic("boom") }
+func main() {
+	fail()
+}`)
+	var pe *vm.PanicError
+	if !errors.As(err, &pe) {
+		t.Fatalf("got error %v, want a *vm.PanicError", err)
+	}
+	var got []string
+	for _, f := range pe.Frames() {
+		got = append(got, fmt.Sprintf("%s %s:%d:%d", f.Func, f.File, f.Line, f.Col))
+	}
+	// The call of main added by the interpreter is not part of the trace.
+	if want := []string{"main.fail test:2:20", "main.main test:4:6"}; !slices.Equal(got, want) {
+		t.Errorf("got frames %q, want %q", got, want)
+	}
+}
+
+func TestPanicFrameNames(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	_, err := intp.Eval("test", `
+type T struct{}
+func (t *T) m(a int) { func() { func() { panic("boom") }() }() }
+func init() { _ = func() {} }
+func main() {
+	f := func() {}
+	f()
+	g := func() { var t *T; t.m(1) }
+	g()
+}`)
+	var pe *vm.PanicError
+	if !errors.As(err, &pe) {
+		t.Fatalf("got error %v, want a *vm.PanicError", err)
+	}
+	want := "main.(*T).m.func1.1()\n\ttest:3:47\nmain.(*T).m.func1()\n\ttest:3:57\nmain.(*T).m(...)\n\ttest:3:61\n" +
+		"main.main.func2()\n\ttest:8:29\nmain.main()\n\ttest:9:3\n"
+	if trace := pe.Trace(); !strings.HasSuffix(trace, want) {
+		t.Errorf("got trace:\n%s\nwant:\n%s", trace, want)
+	}
+}
+
+func TestExitOnReturn(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	intp.SetExitOnReturn(true)
+	if _, err := intp.Eval("test", `
+var n int
+c := make(chan int)
+go func() { for { n++ } }()
+go func() { <-c }()`); err != nil {
+		t.Fatal(err)
+	}
+	// The goroutines are stopped once Eval returns.
+	r1, _ := intp.Eval("n1", "n")
+	time.Sleep(10 * time.Millisecond)
+	r2, _ := intp.Eval("n2", "n")
+	if r1.Int() != r2.Int() {
+		t.Errorf("goroutine still running after main returned: %d != %d", r1.Int(), r2.Int())
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	run(t, []etest{
+		{n: "main_recv", src: `c := make(chan int); <-c`, err: "all goroutines are asleep - deadlock!"},
+		{n: "main_send", src: `c := make(chan int); c <- 1`, err: "goroutine 1 [ChanSend]"},
+		{n: "nil_chan", src: `var c chan int; <-c`, err: "goroutine 1 [ChanRecv]"},
+		{n: "empty_select", src: `select {}`, err: "goroutine 1 [SelectExec]"},
+		{n: "all_blocked", src: `
+c, d := make(chan int), make(chan int)
+go func() { <-d }()
+<-c`, err: "all goroutines are asleep - deadlock!"},
+		{n: "worker_exits", src: `c := make(chan int); go func() { c <- 1 }(); <-c; <-c`, err: "deadlock!"},
+		{n: "range", src: `c := make(chan int); go func() { c <- 1 }(); for range c {}`, err: "goroutine 1 [Next0]"},
+		{n: "range_value", src: `c := make(chan int); go func() { c <- 1 }(); s := 0; for v := range c { s += v }`, err: "goroutine 1 [Next]"},
+		{n: "range_local", src: `
+func sum(c chan int) (s int) { for v := range c { s += v }; return }
+c := make(chan int)
+go func() { c <- 1; c <- 2 }()
+sum(c)`, err: "goroutine 1 [NextLocal]"},
+		{n: "no_deadlock", src: `
+c := make(chan int)
+go func() { for i := 0; i < 3; i++ { c <- i } ; close(c) }()
+s := 0
+for v := range c { s += v }
+s`, res: "3"},
+		{n: "native_chan", src: `import "time"; <-time.After(150 * time.Millisecond); 1`, res: "1"},
+		{n: "native_callback", src: `
+import "time"
+c := make(chan int)
+time.AfterFunc(150 * time.Millisecond, func() { c <- 2 })
+<-c`, res: "2"},
+	})
+}
+
+func TestDeadlockTrace(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	_, err := intp.Eval("test", `
+c := make(chan int)
+go func() {
+	c <- 1
+}()
+<-c
+<-c`)
+	var de *vm.DeadlockError
+	if !errors.As(err, &de) {
+		t.Fatalf("got error %v, want a *vm.DeadlockError", err)
+	}
+	if len(de.Goroutines) != 1 || de.Goroutines[0].Goroutine != 1 || de.Goroutines[0].Op != vm.ChanRecv {
+		t.Fatalf("unexpected blocked goroutines: %+v", de.Goroutines)
+	}
+	t.Log(err)
+	if !strings.Contains(err.Error(), "\ttest:7:1") {
+		t.Errorf("missing blocking position in %q", err)
+	}
+}
+
+func TestGoroutinePanicTrace(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	_, err := intp.Eval("test", `
+func fail() { panic("boom") }
+func worker() { fail() }
+c := make(chan int)
+go worker()
+<-c`)
+	var pe *vm.PanicError
+	if !errors.As(err, &pe) {
+		t.Fatalf("got error %v, want a *vm.PanicError", err)
+	}
+	if pe.Value != "boom" || pe.Goroutine == 1 {
+		t.Errorf("got value %v in goroutine %d, want boom in a child goroutine", pe.Value, pe.Goroutine)
+	}
+	trace := pe.Trace()
+	t.Log(trace)
+	if i, j := strings.Index(trace, "main.fail()\n\ttest:2:"), strings.Index(trace, "main.worker()\n\ttest:3:"); i < 0 || j < i {
+		t.Errorf("unexpected trace:\n%s", trace)
+	}
+}
+
+const debugSrc = `package main
+
+var total int
+
+func add(a, b int) int {
+	c := a + b
+	total += c
+	return c
+}
+
+func main() {
+	for i := 0; i < 4; i++ {
+		add(i, 10)
+	}
+	println(total)
+}`
+
+func TestDebugger(t *testing.T) {
+	tests := []struct {
+		name, cmds string
+		want       []string
+	}{
+		{"entry", "", []string{"main() test:12:6 [goroutine 1]\n12\t\tfor i := 0; i < 4; i++ {"}},
+		{"break func", "b add\nc\np a\np b\nc\np a\n", []string{"breakpoint 1, main.add() test:5:1", "a = 0", "b = 10", "a = 1"}},
+		{"break line", "b 7\nc\np c\nlocals\n", []string{"breakpoint 1, main.add() test:7:2", "c = 10", "a = 0\nb = 10\nc = 10"}},
+		{"break cond", "b add if a == 2\nc\np a\nbl\n", []string{"a = 2", "1: add if a == 2 (hits 1)"}},
+		{"step", "s\ns\ns\ns\n", []string{"main.main() test:13:3", "main.add() test:6:2", "main.add() test:7:2"}},
+		{"next", "n\nn\nn\nn\n", []string{"main() test:13:3", "main() test:12:21"}},
+		{"finish", "b 6\nc\nfinish\np total\n", []string{"main() test:13:3", "total = 10"}},
+		{"print global", "b 15\nc\np total\n", []string{"total = 46"}},
+		{"where", "b 6\nc\nw\n", []string{"main.add(...)\n\ttest:6:2\nmain.main()\n\ttest:13:6"}},
+		{"bad print", "p nope\n", []string{"unknown variable: nope"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			d := vm.NewDebugger(strings.NewReader(test.cmds+"q\n"), &out)
+			d.StopOnEntry = true
+			intp := interp.NewInterpreter(golang.GoSpec)
+			intp.SetDebugger(d)
+			_, err := intp.Eval("test", debugSrc)
+			if !errors.Is(err, vm.ErrDebugQuit) {
+				t.Errorf("got error %v, want %v", err, vm.ErrDebugQuit)
+			}
+			for _, w := range test.want {
+				if !strings.Contains(out.String(), w) {
+					t.Errorf("missing %q in output:\n%s", w, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestProfile(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	var buf bytes.Buffer
+	if err := intp.StartProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intp.Eval("test", `
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+func main() { fib(30) }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := intp.StopProfile(); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The string table holds the sample types and the sampled functions.
+	for _, s := range []string{"cpu", "nanoseconds", "fib", "main"} {
+		if !bytes.Contains(p, []byte(s)) {
+			t.Errorf("profile does not contain %q", s)
+		}
+	}
+	if err := intp.StopProfile(); err == nil {
+		t.Error("StopProfile succeeded while not profiling")
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	intp := interp.NewInterpreter(golang.GoSpec)
+	if err := intp.StartCoverage("count"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intp.EvalFiles(context.Background(),
+		goparser.File{Name: "a.go", Src: `package main
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}`},
+		goparser.File{Name: "b.go", Src: `package main
+
+func main() {
+	for i := 0; i < 3; i++ {
+		abs(i)
+	}
+}`}); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := intp.Coverage(func(file string) bool { return file == "a.go" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := intp.WriteCoverProfile(&buf, blocks); err != nil {
+		t.Fatal(err)
+	}
+	want := `mode: count
+a.go:4.2,4.12 1 3
+a.go:5.3,5.12 1 0
+a.go:7.2,7.10 1 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got profile:\n%s\nwant:\n%s", got, want)
+	}
+	if p := vm.CoveredPercent(blocks); p < 66 || p > 67 {
+		t.Errorf("got %.1f%% covered, want 66.7%%", p)
+	}
+	if err := intp.StartCoverage("count"); err == nil {
+		t.Error("StartCoverage succeeded while enabled")
+	}
+}
+
+// recordTracer records the events of each goroutine, and the goroutines
+// started.
+type recordTracer struct {
+	mu     sync.Mutex
+	events map[int64][]string
+	spawns [][2]int64 // parent and child goroutines
+}
+
+func (r *recordTracer) add(goid int64, format string, a ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[goid] = append(r.events[goid], fmt.Sprintf(format, a...))
+}
+
+func (r *recordTracer) Call(goid int64, fn string)         { r.add(goid, "call %s", fn) }
+func (r *recordTracer) Return(goid int64, fn string)       { r.add(goid, "return %s", fn) }
+func (r *recordTracer) NativeCall(goid int64, fn string)   { r.add(goid, "native %s", fn) }
+func (r *recordTracer) NativeReturn(goid int64, fn string) { r.add(goid, "native return") }
+func (r *recordTracer) GoStart(goid, child int64, fn string) {
+	r.add(goid, "go %s", fn)
+	r.mu.Lock()
+	r.spawns = append(r.spawns, [2]int64{goid, child})
+	r.mu.Unlock()
+}
+func (r *recordTracer) GoExit(goid int64)                          { r.add(goid, "exit") }
+func (r *recordTracer) Panic(goid int64, v any)                    { r.add(goid, "panic %v", v) }
+func (r *recordTracer) Recover(goid int64, v any)                  { r.add(goid, "recover %v", v) }
+func (r *recordTracer) Chan(goid int64, op vm.Op, _ time.Duration) { r.add(goid, "%v", op) }
+
+func TestTracer(t *testing.T) {
+	const src = `package main
+
+import "strings"
+
+func double(x int) int { return 2 * x }
+
+func work(c chan int) {
+	defer func() {
+		recover()
+		c <- double(2)
+	}()
+	panic("boom")
+}
+
+func main() {
+	c := make(chan int)
+	go work(c)
+	strings.Repeat("a", <-c)
+}`
+	rt := &recordTracer{events: map[int64][]string{}}
+	intp := interp.NewInterpreter(golang.GoSpec)
+	intp.ImportPackageValues(stdlib.Values)
+	intp.SetTracer(rt)
+	if _, err := intp.Eval("m:main", src); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.spawns) != 1 {
+		t.Fatalf("got goroutines %v, want 1", rt.spawns)
+	}
+	want := map[int64][]string{
+		rt.spawns[0][0]: {"call main", "go work", "ChanRecv", "native strings.Repeat", "native return", "return main"},
+		rt.spawns[0][1]: {"call work", "panic boom", "call #f0", "recover boom", "call double", "return double", "ChanSend", "return #f0", "return work", "exit"},
+	}
+	for goid, w := range want {
+		if got := rt.events[goid]; !slices.Equal(got, w) {
+			t.Errorf("goroutine %d: got events %q, want %q", goid, got, w)
+		}
+	}
+
+	// Without a tracer, nothing is reported.
+	intp.SetTracer(nil)
+	rt.events = map[int64][]string{}
+	if _, err := intp.Eval("m:main", "main()"); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.events) != 0 {
+		t.Errorf("got events %q without tracer", rt.events)
+	}
+}
+
+func TestChromeTracer(t *testing.T) {
+	var buf bytes.Buffer
+	ct := vm.NewChromeTracer(&buf)
+	intp := interp.NewInterpreter(golang.GoSpec)
+	intp.SetTracer(ct)
+	if _, err := intp.Eval("m:main", "func f(n int) int { if n < 2 { return n }; return f(n-1) + f(n-2) }; f(5)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var events []struct {
+		Name string `json:"name"`
+		Ph   string `json:"ph"`
+		TID  int64  `json:"tid"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &events); err != nil {
+		t.Fatalf("invalid trace: %v\n%s", err, buf.String())
+	}
+	var begin, end int
+	for _, e := range events {
+		switch {
+		case e.Name == "f" && e.Ph == "B":
+			begin++
+		case e.Name == "f" && e.Ph == "E":
+			end++
+		}
+	}
+	if begin != 15 || end != 15 {
+		t.Errorf("got %d calls and %d returns of f, want 15", begin, end)
+	}
+}
+
+func TestRaceDetector(t *testing.T) {
+	for _, test := range []struct {
+		name, src string
+		races     int
+	}{
+		{"race", `
+var x int
+func main() {
+	done := make(chan bool)
+	go func() { x = 1; done <- true }()
+	x = 2
+	<-done
+}`, 1},
+		{"synchronized", `
+import (
+	"sync"
+	"sync/atomic"
+)
+var (
+	n, m, k, s int
+	ops        int64
+	mu         sync.Mutex
+	once       sync.Once
+	a          = []int{0, 0}
+)
+func main() {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock()
+			n++
+			a[1]++
+			mu.Unlock()
+			once.Do(func() { k = 1 })
+			if k != 1 {
+				panic("once")
+			}
+			atomic.AddInt64(&ops, 1)
+		}()
+	}
+	ch, sel := make(chan int), make(chan int, 1)
+	go func() { m = 1; ch <- 1 }()
+	<-ch
+	m++
+	go func() {
+		s = 1
+		select {
+		case sel <- 1:
+		}
+	}()
+	select {
+	case <-sel:
+	}
+	s++
+	wg.Wait()
+	if n+a[1]+m+k+s+int(ops) != 17 {
+		panic("result")
+	}
+}`, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			intp := interp.NewInterpreter(golang.GoSpec)
+			intp.ImportPackageValues(stdlib.Values)
+			var buf bytes.Buffer
+			if err := intp.StartRaceDetector(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := intp.Eval("m:main", test.src); err != nil {
+				t.Fatal(err)
+			}
+			if got := intp.Races(); got != test.races {
+				t.Fatalf("got %d races, want %d\n%s", got, test.races, buf.String())
+			}
+			if test.races == 0 {
+				return
+			}
+			for _, s := range []string{"WARNING: DATA RACE", "Write by goroutine", "Previous write by goroutine 1:", "main.main()", "main.main.func1()"} {
+				if !strings.Contains(buf.String(), s) {
+					t.Errorf("report does not contain %q\n%s", s, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	src := `
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+func main() {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ch, tick := make(chan int), make(chan bool)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				mu.Lock()
+				fmt.Print(i, j, " ")
+				mu.Unlock()
+			}
+			ch <- i
+		}()
+	}
+	go func() { time.Sleep(time.Hour); tick <- true }()
+	for i := 0; i < 4; i++ {
+		select {
+		case v := <-ch:
+			fmt.Print("<", v, "> ")
+		case <-tick:
+			fmt.Print("tick ")
+		}
+	}
+	wg.Wait()
+}`
+	run := func(seed int64) string {
+		intp := interp.NewInterpreter(golang.GoSpec)
+		intp.ImportPackageValues(stdlib.Values)
+		var out bytes.Buffer
+		intp.SetIO(nil, &out, nil)
+		if err := intp.StartScheduler(seed, 5); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := intp.Eval("m:main", src); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	outs := map[string]bool{}
+	for seed := range int64(8) {
+		out := run(seed)
+		if again := run(seed); again != out {
+			t.Errorf("seed %d: got %q, then %q", seed, out, again)
+		}
+		if !strings.HasSuffix(out, "tick ") {
+			t.Errorf("seed %d: got %q, want the sleeping goroutine last", seed, out)
+		}
+		outs[out] = true
+	}
+	if len(outs) < 2 {
+		t.Errorf("got the same interleaving for all seeds: %v", outs)
+	}
+
+	intp := interp.NewInterpreter(golang.GoSpec)
+	intp.ImportPackageValues(stdlib.Values)
+	if err := intp.StartScheduler(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	_, err := intp.Eval("m:main", `import "sync"; func main() { var mu sync.Mutex; go func() { mu.Lock(); mu.Unlock() }(); mu.Lock(); mu.Lock() }`)
+	var de *vm.DeadlockError
+	if !errors.As(err, &de) || de.Goroutines[0].Goroutine != 1 || de.Goroutines[0].Op != vm.Call {
+		t.Fatalf("got error %v, want a deadlock of the main goroutine in Lock", err)
+	}
+
+	intp = interp.NewInterpreter(golang.GoSpec)
+	if err := intp.StartScheduler(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	res, err := intp.Eval("test", `
+c := make(chan int)
+go func() {
+	for i := range 5 {
+		c <- i
+	}
+	close(c)
+}()
+s := 0
+for v := range c {
+	s += v
+}
+for range c {
+}
+s`)
+	if err != nil || res.Int() != 10 {
+		t.Fatalf("got %v, %v, want 10 from a range over a channel", res, err)
+	}
+}
+
+func TestImage(t *testing.T) {
+	src := `import "strings"; func f(n int) int { if n < 2 { return n }; return f(n-1) + f(n-2) }; strings.Repeat("a", f(6))`
+	intp := interp.NewInterpreter(golang.GoSpec)
+	intp.ImportPackageValues(stdlib.Values)
+	var img bytes.Buffer
+	if err := intp.WriteImage(&img, "m", src); err != nil {
+		t.Fatal(err)
+	}
+	image := img.Bytes()
+
+	intp = interp.NewInterpreter(golang.GoSpec)
+	intp.ImportPackageValues(stdlib.Values)
+	if err := intp.LoadImage(bytes.NewReader(image)); err != nil {
+		t.Fatal(err)
+	}
+	if err := intp.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := intp.Top().Reflect().String(); got != "aaaaaaaa" {
+		t.Errorf("got %q, want %q", got, "aaaaaaaa")
+	}
+	if err := intp.LoadImage(bytes.NewReader(image)); err == nil {
+		t.Error("got nil error loading an image twice")
+	}
+
+	badVersion := slices.Clone(image)
+	badVersion[len("parscan\x00")] = 99
+	var badCode bytes.Buffer
+	if err := (&vm.Image{Code: vm.Code{{Op: vm.Jump, A: 5}}, Entry: -1}).Encode(&badCode); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name  string
+		image []byte
+		pkgs  bool
+		err   string
+	}{
+		{"magic", []byte("not an image"), true, "invalid format"},
+		{"version", badVersion, true, "unsupported version 99"},
+		{"truncated", image[:len(image)/2], true, "image:"},
+		{"symbol", image, false, "symbol not found: strings.Repeat"},
+		{"code", badCode.Bytes(), true, "verify: 0: Jump: jump to 5 out of code"},
+	} {
+		intp := interp.NewInterpreter(golang.GoSpec)
+		if test.pkgs {
+			intp.ImportPackageValues(stdlib.Values)
+		}
+		err := intp.LoadImage(bytes.NewReader(test.image))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package interp_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mvertes/parscan/interp"
+	"github.com/mvertes/parscan/lang/golang"
+	"github.com/mvertes/parscan/stdlib"
+	"github.com/mvertes/parscan/vm"
+)
+
+const snapshotSrc = `package main
+
+import "fmt"
+
+type Shape interface{ Area() int }
+
+type Rect struct{ W, H int }
+
+func (r Rect) Area() int { return r.W * r.H }
+
+type Node struct {
+	V    int
+	Next *Node
+}
+
+var (
+	p      *int
+	arr    = []int{1, 2, 3, 4}
+	tail   = arr[2:]
+	m      = map[string][]int{"a": arr}
+	shape  Shape
+	list   *Node
+)
+
+func counter() func() int {
+	c := 0
+	return func() int { c++; return c }
+}
+
+func step(i int) {}
+
+func main() {
+	n := 0
+	p = &n
+	inc := counter()
+	for i := 0; i < 4; i++ {
+		step(i)
+		fmt.Print(i, " ")
+		n += inc()
+		tail[0] += 10
+		list = &Node{i, list}
+		shape = Rect{i, 2}
+	}
+	fmt.Println(*p, arr, m["a"], shape.Area(), list.V, list.Next.V, inc())
+}
+`
+
+func newSnapshotInterp() *interp.Interp {
+	i := interp.NewInterpreter(golang.GoSpec)
+	i.ImportPackageValues(stdlib.Values)
+	return i
+}
+
+func TestSnapshotResume(t *testing.T) {
+	var img bytes.Buffer
+	if err := newSnapshotInterp().WriteImage(&img, "m:test", snapshotSrc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pause the program in its third iteration, and checkpoint it.
+	var snap bytes.Buffer
+	a := newSnapshotInterp()
+	a.SetIO(nil, &bytes.Buffer{}, nil)
+	if err := a.LoadImage(bytes.NewReader(img.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	d := vm.NewDebugger(strings.NewReader(""), &bytes.Buffer{})
+	if _, err := d.Break("step", "i == 2"); err != nil {
+		t.Fatal(err)
+	}
+	d.Handler = func(s *vm.Stopped) vm.Resume {
+		if err := a.WriteSnapshot(&snap, s.Snapshot()); err != nil {
+			t.Error(err)
+		}
+		return vm.ResumeQuit
+	}
+	a.SetDebugger(d)
+	if err := a.Run(); !errors.Is(err, vm.ErrDebugQuit) {
+		t.Fatalf("got error %v, want %v", err, vm.ErrDebugQuit)
+	}
+
+	// Resume it in a new interpreter.
+	var out bytes.Buffer
+	b := newSnapshotInterp()
+	b.SetIO(nil, &out, nil)
+	if err := b.LoadImage(bytes.NewReader(img.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReadSnapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "2 3 10 [1 2 43 4] [1 2 43 4] 6 3 2 5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSnapshotGlobals(t *testing.T) {
+	src := `
+type T struct {
+	A []int
+	P *int
+}
+
+var (
+	x   = 1
+	t   = T{A: []int{1, 2, 3}, P: &x}
+	s   = t.A[1:]
+	f   = func() int { x++; return x }
+	ptr any = &t
+)`
+	a := newSnapshotInterp()
+	if _, err := a.Eval("m:test", src); err != nil {
+		t.Fatal(err)
+	}
+	// Change the state without evaluating new code.
+	for range 2 {
+		if _, err := a.CallFunc(a.Global(a.Symbols["f"].Index), reflect.TypeFor[func() int](), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var snap bytes.Buffer
+	if err := a.WriteSnapshot(&snap, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newSnapshotInterp()
+	if _, err := b.Eval("m:test", src+"\nvar y int"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReadSnapshot(bytes.NewReader(snap.Bytes())); err == nil {
+		t.Error("snapshot of another program restored")
+	}
+
+	b = newSnapshotInterp()
+	if _, err := b.Eval("m:test", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReadSnapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Eval("m:test", "x *= 10; s[0] = 7; y := f(); *t.P + t.A[1] + ptr.(*T).A[1] + y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Interface(); got != 76 {
+		t.Errorf("got %v, want 76", got)
+	}
+}
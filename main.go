@@ -2,19 +2,29 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 
+	"github.com/mvertes/parscan/dap"
+	"github.com/mvertes/parscan/goparser"
 	"github.com/mvertes/parscan/interp"
 	"github.com/mvertes/parscan/lang/golang"
 	"github.com/mvertes/parscan/stdlib"
 	_ "github.com/mvertes/parscan/stdlib/jsonx"
+	"github.com/mvertes/parscan/vm"
+	"github.com/mvertes/parscan/wasm"
 )
 
 // newlineTracker wraps a writer and tracks whether the last byte written was a newline.
@@ -35,10 +45,36 @@ func (t *newlineTracker) Write(p []byte) (int, error) {
 func main() {
 	log.SetFlags(log.Lshortfile)
 	if err := dispatch(os.Args[1:]); err != nil {
+		fatal(err)
+	}
+}
+
+// fatal reports err and exits. Interpreted panics and deadlocks are reported
+// like by the Go runtime, with the goroutine traces.
+func fatal(err error) {
+	var pe *vm.PanicError
+	var de *vm.DeadlockError
+	var re raceError
+	switch {
+	case errors.As(err, &re):
+		// Like programs built with go build -race.
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(66)
+	case errors.As(err, &pe):
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n\n%s", err, pe.Trace())
+	case errors.As(err, &de):
+		_, _ = fmt.Fprintf(os.Stderr, "fatal error: %v\n", err)
+	default:
 		log.Fatal(err)
 	}
+	os.Exit(2)
 }
 
+// raceError reports the number of data races found by run -race.
+type raceError int
+
+func (e raceError) Error() string { return fmt.Sprintf("Found %d data race(s)", int(e)) }
+
 func dispatch(args []string) error {
 	if len(args) == 0 {
 		return runCmd(nil)
@@ -51,6 +87,14 @@ func dispatch(args []string) error {
 		return runCmd(args[1:])
 	case "test":
 		return testCmd(args[1:])
+	case "build":
+		return buildCmd(args[1:])
+	case "exec":
+		return execCmd(args[1:])
+	case "debug":
+		return debugCmd(args[1:])
+	case "dap":
+		return dapCmd(args[1:])
 	}
 	return runCmd(args)
 }
@@ -59,34 +103,109 @@ func usage(w io.Writer) {
 	_, _ = fmt.Fprintln(w, "Usage: parscan <command> [arguments]")
 	_, _ = fmt.Fprintln(w)
 	_, _ = fmt.Fprintln(w, "Commands:")
-	_, _ = fmt.Fprintln(w, "  run    run a Go source file, evaluate an expression, or start the REPL")
+	_, _ = fmt.Fprintln(w, "  run    run a Go source file or .wasm module, evaluate an expression, or start the REPL")
 	_, _ = fmt.Fprintln(w, "  test   run Go tests in a package directory")
+	_, _ = fmt.Fprintln(w, "  build  compile a Go source file to a bytecode image")
+	_, _ = fmt.Fprintln(w, "  exec   run a bytecode image")
+	_, _ = fmt.Fprintln(w, "  debug  run a Go source file under the interactive debugger")
+	_, _ = fmt.Fprintln(w, "  dap    serve the Debug Adapter Protocol for editors")
 	_, _ = fmt.Fprintln(w, "  help   show this help")
 	_, _ = fmt.Fprintln(w)
 	_, _ = fmt.Fprintln(w, `Use "parscan <command> -h" for details on a command.`)
 }
 
+// optUsage describes the -O flag, common to the commands compiling code.
+const optUsage = "optimization `level` of the compiled code, from 0 (none) to 3"
+
+// isFlagSet reports whether the flag name was set on the command line.
+func isFlagSet(fs *flag.FlagSet, name string) (set bool) {
+	fs.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
 func runCmd(arg []string) error {
-	var str string
+	var str, cpuprofile, trace, invoke string
+	var optLevel, quantum int
+	var seed int64
+	var race bool
 	rflag := flag.NewFlagSet("run", flag.ContinueOnError)
 	rflag.Usage = func() {
 		fmt.Println("Usage: parscan run [options] [path] [args]")
+		fmt.Println("Runs a Go source file, or invokes a function of a WebAssembly module (.wasm).")
 		fmt.Println("Options:")
 		rflag.PrintDefaults()
 	}
 	rflag.StringVar(&str, "e", "", "string to eval")
+	rflag.StringVar(&cpuprofile, "cpuprofile", "", "write a CPU profile of the interpreted program to `file`")
+	rflag.StringVar(&trace, "trace", "", "write an execution trace in Chrome trace event format to `file`")
+	rflag.IntVar(&optLevel, "O", 0, optUsage)
+	rflag.BoolVar(&race, "race", false, "detect the data races between the goroutines of the program")
+	rflag.Int64Var(&seed, "sched-seed", 0, "run the goroutines one at a time, in an order drawn from `seed`, to replay their interleaving")
+	rflag.IntVar(&quantum, "sched-quantum", 100, "number of `instructions` between goroutine switches with -sched-seed (0: only at blocking operations)")
+	rflag.StringVar(&invoke, "invoke", "", "exported `function` of a .wasm module to call with args (default: _start or main)")
 	if err := rflag.Parse(arg); err != nil {
 		return err
 	}
 	args := rflag.Args()
+	if len(args) > 0 && filepath.Ext(args[0]) == ".wasm" {
+		return runWasm(args[0], invoke, args[1:])
+	}
 
 	i := interp.NewInterpreter(golang.GoSpec)
 	i.ImportPackageValues(stdlib.Values)
+	i.OptLevel = optLevel
 
 	out := &newlineTracker{w: os.Stdout}
 	i.SetIO(os.Stdin, out, os.Stderr)
 
 	var err error
+	if str != "" || len(args) > 0 {
+		// Like in Go, the program ends when main returns.
+		i.SetExitOnReturn(true)
+	}
+	if cpuprofile != "" {
+		f, err := os.Create(cpuprofile)
+		if err != nil {
+			return err
+		}
+		if err = i.StartProfile(f); err != nil {
+			return err
+		}
+		defer func() {
+			if err := i.StopProfile(); err != nil {
+				log.Println(err)
+			}
+			if err := f.Close(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	if trace != "" {
+		f, err := os.Create(trace)
+		if err != nil {
+			return err
+		}
+		t := vm.NewChromeTracer(f)
+		i.SetTracer(t)
+		defer func() {
+			if err := t.Close(); err != nil {
+				log.Println(err)
+			}
+			if err := f.Close(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	if race {
+		if err := i.StartRaceDetector(os.Stderr); err != nil {
+			return err
+		}
+	}
+	if isFlagSet(rflag, "sched-seed") {
+		if err := i.StartScheduler(seed, quantum); err != nil {
+			return err
+		}
+	}
 	switch {
 	case str != "":
 		i.AutoImportPackages()
@@ -107,25 +226,260 @@ func runCmd(arg []string) error {
 	if out.written && out.last != '\n' {
 		_, _ = fmt.Fprintln(os.Stdout)
 	}
+	if n := i.Races(); err == nil && n > 0 {
+		err = raceError(n)
+	}
+	return err
+}
+
+// runWasm instantiates the WebAssembly module in file fpath, calls its
+// exported function name with args parsed to the parameter types, and
+// prints the results.
+func runWasm(fpath, name string, args []string) error {
+	buf, err := os.ReadFile(filepath.Clean(fpath))
+	if err != nil {
+		return err
+	}
+	mod, err := wasm.Decode(buf)
+	if err != nil {
+		return err
+	}
+	in, err := wasm.Instantiate(mod, nil)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = "main"
+		if _, ok := in.FuncType("_start"); ok {
+			name = "_start"
+		}
+	}
+	ft, ok := in.FuncType(name)
+	if !ok {
+		return fmt.Errorf("wasm: no exported function %q", name)
+	}
+	if len(args) != len(ft.Params) {
+		return fmt.Errorf("wasm: %s: got %d arguments, want %d", name, len(args), len(ft.Params))
+	}
+	vals := make([]any, len(args))
+	for i, a := range args {
+		switch ft.Params[i] {
+		case wasm.F32, wasm.F64:
+			vals[i], err = strconv.ParseFloat(a, 64)
+		default:
+			vals[i], err = strconv.ParseInt(a, 0, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("wasm: %s: argument %d: %w", name, i, err)
+		}
+	}
+	res, err := in.Call(name, vals...)
+	if err != nil {
+		return err
+	}
+	if len(res) > 0 {
+		_, _ = fmt.Fprintln(os.Stdout, res...)
+	}
+	return nil
+}
+
+func debugCmd(arg []string) error {
+	dflag := flag.NewFlagSet("debug", flag.ContinueOnError)
+	dflag.Usage = func() {
+		fmt.Println("Usage: parscan debug path [args]")
+		fmt.Println("Runs a Go source file, stopping at its first line for debugger commands (type 'help').")
+	}
+	if err := dflag.Parse(arg); err != nil {
+		return err
+	}
+	args := dflag.Args()
+	if len(args) == 0 {
+		dflag.Usage()
+		return errors.New("missing source file")
+	}
+	fpath := filepath.Clean(args[0])
+	buf, err := os.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+
+	i := interp.NewInterpreter(golang.GoSpec)
+	i.ImportPackageValues(stdlib.Values)
+	i.SetIO(os.Stdin, os.Stdout, os.Stderr)
+	i.SetExitOnReturn(true)
+	d := vm.NewDebugger(os.Stdin, os.Stderr)
+	d.StopOnEntry = true
+	i.SetDebugger(d)
+
+	if _, err = i.Eval("f:"+fpath, string(buf)); errors.Is(err, vm.ErrDebugQuit) {
+		return nil
+	}
+	return err
+}
+
+func buildCmd(arg []string) error {
+	var out string
+	var optLevel int
+	bflag := flag.NewFlagSet("build", flag.ContinueOnError)
+	bflag.Usage = func() {
+		fmt.Println("Usage: parscan build [options] path")
+		fmt.Println("Compiles a Go source file to a bytecode image, to run with parscan exec,")
+		fmt.Println("or to a WebAssembly module if the output file has the .wasm extension.")
+		fmt.Println("Options:")
+		bflag.PrintDefaults()
+	}
+	bflag.StringVar(&out, "o", "", "write the image to `file` (default: source name with .pbc extension)")
+	bflag.IntVar(&optLevel, "O", 0, optUsage)
+	if err := bflag.Parse(arg); err != nil {
+		return err
+	}
+	args := bflag.Args()
+	if len(args) != 1 {
+		bflag.Usage()
+		return errors.New("expected one source file")
+	}
+	fpath := filepath.Clean(args[0])
+	buf, err := os.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		out = strings.TrimSuffix(filepath.Base(fpath), filepath.Ext(fpath)) + ".pbc"
+	}
+
+	i := interp.NewInterpreter(golang.GoSpec)
+	i.ImportPackageValues(stdlib.Values)
+	i.OptLevel = optLevel
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	write := i.WriteImage
+	if filepath.Ext(out) == ".wasm" {
+		write = i.WriteWasm
+	}
+	if err = write(f, "f:"+fpath, string(buf)); err != nil {
+		_ = f.Close()
+		_ = os.Remove(out)
+		return err
+	}
+	return f.Close()
+}
+
+func execCmd(arg []string) error {
+	eflag := flag.NewFlagSet("exec", flag.ContinueOnError)
+	eflag.Usage = func() {
+		fmt.Println("Usage: parscan exec path [args]")
+		fmt.Println("Runs a bytecode image produced by parscan build.")
+	}
+	if err := eflag.Parse(arg); err != nil {
+		return err
+	}
+	args := eflag.Args()
+	if len(args) == 0 {
+		eflag.Usage()
+		return errors.New("missing image file")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	i := interp.NewInterpreter(golang.GoSpec)
+	i.ImportPackageValues(stdlib.Values)
+	out := &newlineTracker{w: os.Stdout}
+	i.SetIO(os.Stdin, out, os.Stderr)
+	i.SetExitOnReturn(true)
+	if err = i.LoadImage(f); err != nil {
+		return err
+	}
+	err = i.Run()
+	if out.written && out.last != '\n' {
+		_, _ = fmt.Fprintln(os.Stdout)
+	}
+	return err
+}
+
+func dapCmd(arg []string) error {
+	var addr string
+	dflag := flag.NewFlagSet("dap", flag.ContinueOnError)
+	dflag.Usage = func() {
+		fmt.Println("Usage: parscan dap [options]")
+		fmt.Println("Serves the Debug Adapter Protocol on stdin and stdout, or on a TCP address.")
+		fmt.Println("Options:")
+		dflag.PrintDefaults()
+	}
+	dflag.StringVar(&addr, "listen", "", "serve one client on this TCP address, such as 127.0.0.1:4711")
+	if err := dflag.Parse(arg); err != nil {
+		return err
+	}
+	if addr == "" {
+		return dap.NewServer(os.Stdin, os.Stdout, dapLaunch).Serve()
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("listening on", l.Addr())
+	conn, err := l.Accept()
+	_ = l.Close()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	return dap.NewServer(conn, conn, dapLaunch).Serve()
+}
+
+// dapLaunch runs a Go source file for the DAP server.
+func dapLaunch(ctx context.Context, path string, d *vm.Debugger, stdout, stderr io.Writer) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	i := interp.NewInterpreter(golang.GoSpec)
+	i.ImportPackageValues(stdlib.Values)
+	i.SetIO(strings.NewReader(""), stdout, stderr)
+	i.SetExitOnReturn(true)
+	i.SetDebugger(d)
+	_, err = i.EvalContext(ctx, "f:"+path, string(buf))
 	return err
 }
 
 var (
 	testFuncRE  = regexp.MustCompile(`(?m)^func\s+(Test[A-Z][A-Za-z0-9_]*)\s*\(\s*\w+\s+\*testing\.T\s*\)`)
-	pkgClauseRE = regexp.MustCompile(`(?m)^package\s+\w+\s*$`)
+	pkgClauseRE = regexp.MustCompile(`(?m)^package[ \t]+\w+[ \t]*$`)
 )
 
 func testCmd(arg []string) error {
+	var cover bool
+	var covermode, coverprofile, coverpkg string
+	var optLevel int
 	tflag := flag.NewFlagSet("test", flag.ContinueOnError)
 	tflag.Usage = func() {
-		fmt.Println("Usage: parscan test [dir] [testing-flags]")
+		fmt.Println("Usage: parscan test [options] [dir] [testing-flags]")
 		fmt.Println("Runs Go tests found in *_test.go files of the given package directory (default \".\").")
 		fmt.Println("Flags after [dir] are forwarded to testing.Main; use the -test. prefix (e.g. -test.v, -test.run REGEX).")
+		fmt.Println("Options:")
+		tflag.PrintDefaults()
 	}
+	tflag.BoolVar(&cover, "cover", false, "enable statement coverage analysis")
+	tflag.StringVar(&covermode, "covermode", "", "coverage `mode`: set (default), count or atomic (implies -cover)")
+	tflag.StringVar(&coverprofile, "coverprofile", "", "write a coverage profile to `file` (implies -cover)")
+	tflag.StringVar(&coverpkg, "coverpkg", "", "apply coverage to the sources of the comma-separated `packages`: directories, or prefixes ending with /... (implies -cover)")
+	tflag.IntVar(&optLevel, "O", 0, optUsage)
 	if err := tflag.Parse(arg); err != nil {
 		return err
 	}
 	args := tflag.Args()
+	cover = cover || covermode != "" || coverprofile != "" || coverpkg != ""
+	if covermode == "" {
+		covermode = "set"
+	}
 
 	dir := "."
 	var pass []string
@@ -142,29 +496,32 @@ func testCmd(arg []string) error {
 	if err != nil {
 		return err
 	}
-	var pkgSources, testSources []string
+	var pkgFiles, testFiles []goparser.File
 	for _, e := range entries {
 		if e.IsDir() || !strings.HasSuffix(e.Name(), ".go") {
 			continue
 		}
-		buf, err := os.ReadFile(filepath.Join(absDir, e.Name()))
+		name := filepath.Join(absDir, e.Name())
+		buf, err := os.ReadFile(name)
 		if err != nil {
 			return err
 		}
+		// All files are compiled in package main, along with the test main.
+		f := goparser.File{Name: name, Src: pkgClauseRE.ReplaceAllString(string(buf), "package main")}
 		if strings.HasSuffix(e.Name(), "_test.go") {
-			testSources = append(testSources, string(buf))
+			testFiles = append(testFiles, f)
 		} else {
-			pkgSources = append(pkgSources, string(buf))
+			pkgFiles = append(pkgFiles, f)
 		}
 	}
-	if len(testSources) == 0 {
+	if len(testFiles) == 0 {
 		return fmt.Errorf("no *_test.go files found in %s", absDir)
 	}
 
 	seen := map[string]bool{}
 	var testNames []string
-	for _, s := range testSources {
-		for _, m := range testFuncRE.FindAllStringSubmatch(s, -1) {
+	for _, f := range testFiles {
+		for _, m := range testFuncRE.FindAllStringSubmatch(f.Src, -1) {
 			if !seen[m[1]] {
 				seen[m[1]] = true
 				testNames = append(testNames, m[1])
@@ -178,13 +535,8 @@ func testCmd(arg []string) error {
 
 	var b strings.Builder
 	b.WriteString("package main\n\nimport \"testing\"\n\n")
-	for _, s := range pkgSources {
-		b.WriteString(pkgClauseRE.ReplaceAllString(s, ""))
-		b.WriteString("\n")
-	}
-	for _, s := range testSources {
-		b.WriteString(pkgClauseRE.ReplaceAllString(s, ""))
-		b.WriteString("\n")
+	if cover {
+		b.WriteString("import \"parscan/testmain\"\n\n")
 	}
 	b.WriteString("func main() {\n")
 	b.WriteString("\ttesting.Main(\n")
@@ -194,7 +546,14 @@ func testCmd(arg []string) error {
 		fmt.Fprintf(&b, "\t\t\t{Name: %q, F: %s},\n", name, name)
 	}
 	b.WriteString("\t\t},\n")
-	b.WriteString("\t\tnil, nil,\n")
+	if cover {
+		// testing.Main exits when done: the coverage is reported by an
+		// example, run after the tests.
+		b.WriteString("\t\tnil,\n")
+		b.WriteString("\t\t[]testing.InternalExample{{Name: \"CoverageReport\", F: testmain.CoverReport}},\n")
+	} else {
+		b.WriteString("\t\tnil, nil,\n")
+	}
 	b.WriteString("\t)\n")
 	b.WriteString("}\n")
 
@@ -202,8 +561,87 @@ func testCmd(arg []string) error {
 
 	i := interp.NewInterpreter(golang.GoSpec)
 	i.ImportPackageValues(stdlib.Values)
+	i.OptLevel = optLevel
 	i.SetIO(os.Stdin, os.Stdout, os.Stderr)
+	if cover {
+		include, err := coverFilter(absDir, coverpkg)
+		if err != nil {
+			return err
+		}
+		if err := i.StartCoverage(covermode); err != nil {
+			return err
+		}
+		stdout := os.Stdout // not the one captured while running examples
+		report := func() {
+			blocks, err := i.Coverage(include)
+			if err == nil && coverprofile != "" {
+				err = writeCoverProfile(i, coverprofile, blocks)
+			}
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, "coverage:", err)
+				return
+			}
+			in := ""
+			if coverpkg != "" {
+				in = " in " + coverpkg
+			}
+			_, _ = fmt.Fprintf(stdout, "coverage: %.1f%% of statements%s\n", vm.CoveredPercent(blocks), in)
+		}
+		i.ImportPackageValues(map[string]map[string]reflect.Value{
+			"parscan/testmain": {"CoverReport": reflect.ValueOf(report)},
+		})
+	}
 
-	_, err = i.Eval("m:_testmain", b.String())
+	files := append(pkgFiles, testFiles...)
+	files = append(files, goparser.File{Name: "_testmain", Src: b.String()})
+	_, err = i.EvalFiles(context.Background(), files...)
 	return err
 }
+
+func writeCoverProfile(i *interp.Interp, name string, blocks []vm.CoverBlock) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := i.WriteCoverProfile(f, blocks); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// coverFilter returns a function reporting whether a source file is covered:
+// the non-test files of dir, or of the packages given in the comma-separated
+// list pkgs. A package is a directory, or a prefix of directories ending with
+// "/...". Directories starting with "." are relative to the current one.
+func coverFilter(dir, pkgs string) (func(file string) bool, error) {
+	patterns := []string{dir}
+	if pkgs != "" {
+		patterns = strings.Split(pkgs, ",")
+	}
+	for k, p := range patterns {
+		if d, all := strings.CutSuffix(p, "/..."); strings.HasPrefix(d, ".") {
+			abs, err := filepath.Abs(d)
+			if err != nil {
+				return nil, err
+			}
+			if all {
+				abs += "/..."
+			}
+			patterns[k] = abs
+		}
+	}
+	return func(file string) bool {
+		if strings.HasSuffix(file, "_test.go") {
+			return false
+		}
+		d := path.Dir(filepath.ToSlash(file))
+		for _, p := range patterns {
+			p = filepath.ToSlash(p)
+			if prefix, ok := strings.CutSuffix(p, "/..."); ok && (d == prefix || strings.HasPrefix(d, prefix+"/")) || d == p {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -358,6 +358,9 @@ func (sc *Scanner) getNum(src string) (s string, tok lang.Token) {
 			}
 		case r == '_':
 			// digit separator, ok
+		case r == 'i':
+			// Imaginary literal suffix ends the number.
+			return src[:i+1], lang.Imag
 		default:
 			return src[:i], tok
 		}
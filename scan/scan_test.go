@@ -110,6 +110,10 @@ def"`, err: "1:1: block not terminated"},
 	{n: "#45", src: "0xff + 3.14", tok: `Int"0xff" Add Float"3.14" Semicolon `},
 	{n: "#46", src: "123.String()", tok: `Int"123" Period"." Ident"String" ParenBlock"()" Semicolon `},
 
+	// Numbers: imaginary.
+	{n: "#46a", src: "1 + 2i", tok: `Int"1" Add Imag"2i" Semicolon `},
+	{n: "#46b", src: "1.5e3i*x", tok: `Imag"1.5e3i" Mul Ident"x" Semicolon `},
+
 	// Non-ASCII identifiers (Go spec allows any Unicode letter).
 	{n: "#47", src: "ж := 42", tok: `Ident"ж" Define Int"42" Semicolon `},
 	{n: "#48", src: "café + 1", tok: `Ident"café" Add Int"1" Semicolon `},
@@ -2,6 +2,7 @@ package scan
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -11,6 +12,7 @@ type Source struct {
 	Base    int    // base byte offset in the unified position space
 	Len     int    // length in bytes
 	content string // source text for line/col resolution
+	lines   []int  // byte offsets of line starts in content
 }
 
 // Sources is an ordered list of Source entries.
@@ -23,7 +25,7 @@ func (ss *Sources) Add(name, src string) int {
 		last := (*ss)[n-1]
 		base = last.Base + last.Len + 1 // +1 for implicit newline separator
 	}
-	*ss = append(*ss, Source{Name: name, Base: base, Len: len(src), content: src})
+	*ss = append(*ss, Source{Name: name, Base: base, Len: len(src), content: src, lines: lineStarts(src)})
 	return base
 }
 
@@ -42,10 +44,27 @@ func (ss Sources) Resolve(pos int) (name string, line, col int) {
 	if local < 0 || local > s.Len {
 		return "", 0, 0
 	}
-	line, col = lineCol(s.content, local)
+	line, col = s.lineCol(local)
 	return s.Name, line, col
 }
 
+// Line returns the text of the given 1-based line of the source named name,
+// without its trailing newline, or "" if there is no such line.
+func (ss Sources) Line(name string, line int) string {
+	for i := range ss {
+		s := &ss[i]
+		if s.Name != name || line < 1 || line > len(s.lines) {
+			continue
+		}
+		start, end := s.lines[line-1], len(s.content)
+		if line < len(s.lines) {
+			end = s.lines[line] - 1
+		}
+		return s.content[start:end]
+	}
+	return ""
+}
+
 // FormatPos converts a global byte offset to a "[file:]line:col" string.
 func (ss Sources) FormatPos(pos int) string {
 	name, line, col := ss.Resolve(pos)
@@ -55,6 +74,15 @@ func (ss Sources) FormatPos(pos int) string {
 	return fmt.Sprintf("%s:%d:%d", name, line, col)
 }
 
+// Text returns the source text.
+func (s *Source) Text() string { return s.content }
+
+func (s *Source) lineCol(offset int) (line, col int) {
+	offset = min(offset, len(s.content))
+	line = sort.SearchInts(s.lines, offset+1) // lines[line-1] <= offset
+	return line, offset - s.lines[line-1] + 1
+}
+
 func lineCol(src string, offset int) (line, col int) {
 	offset = min(offset, len(src))
 	prefix := src[:offset]
@@ -62,3 +90,13 @@ func lineCol(src string, offset int) (line, col int) {
 	col = offset - strings.LastIndex(prefix, "\n")
 	return line, col
 }
+
+func lineStarts(src string) []int {
+	lines := []int{0}
+	for i := range len(src) {
+		if src[i] == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
@@ -141,5 +141,35 @@ func TestLineCol(t *testing.T) {
 			t.Errorf("lineCol(%q, %d) = (%d, %d), want (%d, %d)",
 				tt.src, tt.offset, line, col, tt.wantLine, tt.wantCol)
 		}
+		s := Source{content: tt.src, lines: lineStarts(tt.src)}
+		if line, col := s.lineCol(tt.offset); line != tt.wantLine || col != tt.wantCol {
+			t.Errorf("Source.lineCol(%q, %d) = (%d, %d), want (%d, %d)",
+				tt.src, tt.offset, line, col, tt.wantLine, tt.wantCol)
+		}
+	}
+}
+
+func TestSourcesLine(t *testing.T) {
+	var ss Sources
+	ss.Add("first", "abc\ndef\n")
+	ss.Add("second", "ghi")
+
+	tests := []struct {
+		name string
+		line int
+		want string
+	}{
+		{"first", 1, "abc"},
+		{"first", 2, "def"},
+		{"first", 3, ""},
+		{"first", 4, ""},
+		{"second", 1, "ghi"},
+		{"second", 0, ""},
+		{"third", 1, ""},
+	}
+	for _, tt := range tests {
+		if got := ss.Line(tt.name, tt.line); got != tt.want {
+			t.Errorf("Line(%q, %d) = %q, want %q", tt.name, tt.line, got, tt.want)
+		}
 	}
 }
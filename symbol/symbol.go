@@ -45,6 +45,7 @@ type Symbol struct {
 	Captured   bool           // true if this variable escapes to a heap cell
 	LoopVar    bool           // true if this is a for-init or range variable (snapshot capture)
 	CellSlot   bool           // true if the local frame slot holds a heap cell pointer (promoted)
+	Reassigned bool           // true if assigned after its definition, or if its address is taken
 	FreeVars   []string       // closure: scoped names of captured outer-scope locals, in Heap order
 	RecvName   string         // for methods: raw receiver variable name
 	InNames    []string       // raw input param names, cached from Phase 1 for Phase 2
@@ -60,8 +61,31 @@ type Symbol struct {
 }
 
 // NeedsCell reports whether this variable should be promoted to a heap cell
-// (captured by a closure and not a loop iteration variable).
-func (s *Symbol) NeedsCell() bool { return s.Captured && !s.LoopVar }
+// (captured by a closure, not a loop iteration variable, and not copied by value).
+func (s *Symbol) NeedsCell() bool { return s.Captured && !s.LoopVar && !s.ByValue() }
+
+// ByValue reports whether a captured variable, other than a loop variable,
+// is copied by value in closures at their creation instead of being promoted
+// to a heap cell: it is never reassigned, and its type can not be modified in
+// place, as by a field or element assignment, or by a method with a pointer
+// receiver.
+func (s *Symbol) ByValue() bool {
+	t := s.Type
+	if !s.Captured || s.LoopVar || s.Reassigned || t == nil || t.Rtype == nil {
+		return false
+	}
+	switch rt := t.Rtype; rt.Kind() {
+	case reflect.Array, reflect.Struct, reflect.Invalid:
+		return false
+	case reflect.Pointer, reflect.Interface:
+		return true
+	default:
+		if len(t.Methods) > 0 || t.Base != nil && len(t.Base.Methods) > 0 {
+			return false // parscan methods, possibly with a pointer receiver
+		}
+		return reflect.PointerTo(rt).NumMethod() == rt.NumMethod()
+	}
+}
 
 // FreeVarIndex returns the index of name in FreeVars, or -1 if not found.
 func (s *Symbol) FreeVarIndex(name string) int {
@@ -237,5 +261,8 @@ func (sm SymMap) Init() {
 	sm["close"] = &Symbol{Name: "close", Kind: Builtin, Index: UnsetAddr}
 	sm["min"] = &Symbol{Name: "min", Kind: Builtin, Index: UnsetAddr}
 	sm["max"] = &Symbol{Name: "max", Kind: Builtin, Index: UnsetAddr}
+	sm["complex"] = &Symbol{Name: "complex", Kind: Builtin, Index: UnsetAddr}
+	sm["real"] = &Symbol{Name: "real", Kind: Builtin, Index: UnsetAddr}
+	sm["imag"] = &Symbol{Name: "imag", Kind: Builtin, Index: UnsetAddr}
 	sm["trap"] = &Symbol{Name: "trap", Kind: Builtin, Index: UnsetAddr}
 }
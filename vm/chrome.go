@@ -0,0 +1,144 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ChromeTracer is a Tracer writing the events in the Chrome trace event
+// format, as a JSON array read by chrome://tracing or Perfetto. Goroutines
+// are shown as threads, function calls as nested slices, channel operations
+// as slices of their blocking time, and the other events as instants.
+type ChromeTracer struct {
+	start time.Time
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	n       int            // number of events written
+	threads map[int64]bool // goroutines already named
+	err     error          // first write error
+}
+
+// chromeEvent is an event of the Chrome trace event format.
+type chromeEvent struct {
+	Name string         `json:"name"`
+	Cat  string         `json:"cat,omitempty"`
+	Ph   string         `json:"ph"`
+	TS   float64        `json:"ts"` // in microseconds
+	Dur  float64        `json:"dur,omitempty"`
+	PID  int            `json:"pid"`
+	TID  int64          `json:"tid"`
+	S    string         `json:"s,omitempty"` // scope of instant events
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// NewChromeTracer returns a tracer writing to w, until Close.
+func NewChromeTracer(w io.Writer) *ChromeTracer {
+	return &ChromeTracer{start: time.Now(), w: bufio.NewWriter(w), threads: map[int64]bool{}}
+}
+
+// Close ends the trace and flushes it. It returns the first write error.
+func (t *ChromeTracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n == 0 {
+		t.write("[")
+	}
+	t.write("\n]\n")
+	if err := t.w.Flush(); t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+// Call implements Tracer.
+func (t *ChromeTracer) Call(goid int64, fn string) {
+	t.emit(chromeEvent{Name: fn, Cat: "func", Ph: "B", TID: goid}, 0)
+}
+
+// Return implements Tracer.
+func (t *ChromeTracer) Return(goid int64, fn string) {
+	t.emit(chromeEvent{Name: fn, Cat: "func", Ph: "E", TID: goid}, 0)
+}
+
+// NativeCall implements Tracer.
+func (t *ChromeTracer) NativeCall(goid int64, fn string) {
+	t.emit(chromeEvent{Name: fn, Cat: "native", Ph: "B", TID: goid}, 0)
+}
+
+// NativeReturn implements Tracer.
+func (t *ChromeTracer) NativeReturn(goid int64, fn string) {
+	t.emit(chromeEvent{Name: fn, Cat: "native", Ph: "E", TID: goid}, 0)
+}
+
+// GoStart implements Tracer.
+func (t *ChromeTracer) GoStart(goid, child int64, fn string) {
+	args := map[string]any{"goroutine": child, "func": fn}
+	t.emit(chromeEvent{Name: "go " + fn, Cat: "goroutine", Ph: "i", TID: goid, S: "t", Args: args}, 0)
+}
+
+// GoExit implements Tracer.
+func (t *ChromeTracer) GoExit(goid int64) {
+	t.emit(chromeEvent{Name: "exit", Cat: "goroutine", Ph: "i", TID: goid, S: "t"}, 0)
+}
+
+// Panic implements Tracer.
+func (t *ChromeTracer) Panic(goid int64, v any) {
+	args := map[string]any{"value": fmt.Sprint(v)}
+	t.emit(chromeEvent{Name: "panic", Cat: "panic", Ph: "i", TID: goid, S: "t", Args: args}, 0)
+}
+
+// Recover implements Tracer.
+func (t *ChromeTracer) Recover(goid int64, v any) {
+	args := map[string]any{"value": fmt.Sprint(v)}
+	t.emit(chromeEvent{Name: "recover", Cat: "panic", Ph: "i", TID: goid, S: "t", Args: args}, 0)
+}
+
+// Chan implements Tracer.
+func (t *ChromeTracer) Chan(goid int64, op Op, blocked time.Duration) {
+	t.emit(chromeEvent{Name: op.String(), Cat: "chan", Ph: "X", TID: goid}, blocked)
+}
+
+// emit writes the event e, timestamped now, or at the start of its duration d.
+func (t *ChromeTracer) emit(e chromeEvent, d time.Duration) {
+	now := time.Since(t.start)
+	e.TS = float64(now-d) / float64(time.Microsecond)
+	if d > 0 {
+		e.Dur = float64(d) / float64(time.Microsecond)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.threads[e.TID] {
+		t.threads[e.TID] = true
+		t.event(chromeEvent{Name: "thread_name", Ph: "M", TID: e.TID, Args: map[string]any{"name": fmt.Sprintf("goroutine %d", e.TID)}})
+	}
+	t.event(e)
+}
+
+// event writes e. It must be called with t.mu held.
+func (t *ChromeTracer) event(e chromeEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		if t.err == nil {
+			t.err = err
+		}
+		return
+	}
+	if t.n == 0 {
+		t.write("[\n")
+	} else {
+		t.write(",\n")
+	}
+	t.n++
+	t.write(string(b))
+}
+
+func (t *ChromeTracer) write(s string) {
+	if _, err := t.w.WriteString(s); err != nil && t.err == nil {
+		t.err = err
+	}
+}
@@ -0,0 +1,184 @@
+package vm
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Coverage counting modes, as in go test -covermode.
+const (
+	coverSet    = iota + 1 // whether an instruction ran
+	coverCount             // how many times an instruction ran
+	coverAtomic            // like coverCount, safe for concurrent goroutines
+)
+
+var coverModes = []string{coverSet: "set", coverCount: "count", coverAtomic: "atomic"}
+
+// coverage holds the execution counters of the instructions of a machine,
+// shared with its goroutines and runners.
+type coverage struct {
+	mode int
+
+	mu     sync.Mutex
+	counts []uint32 // by code address
+}
+
+// CoverBlock is a block of source counted for statement coverage. Lines and
+// columns are 1-based; EndCol is the column after the block.
+type CoverBlock struct {
+	File                string
+	StartLine, StartCol int
+	EndLine, EndCol     int
+	NumStmt             int
+	Count               uint32
+}
+
+// StartCoverage enables statement coverage for the interpreted program, in
+// the given mode: "set", "count" or "atomic". It must be called before Run,
+// not concurrently with it.
+func (m *Machine) StartCoverage(mode string) error {
+	if m.cover != nil {
+		return errors.New("coverage already enabled")
+	}
+	i := slices.Index(coverModes, mode)
+	if i <= 0 {
+		return fmt.Errorf("invalid cover mode: %q", mode)
+	}
+	m.cover = &coverage{mode: i}
+	return nil
+}
+
+// counters returns the counters of the first n instructions. A machine uses
+// the same counters during a Run.
+func (c *coverage) counters(n int) []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.counts) < n {
+		c.counts = append(c.counts, make([]uint32, n-len(c.counts))...)
+	}
+	return c.counts
+}
+
+// hit records the execution of the instruction at ip.
+func (c *coverage) hit(counts []uint32, ip int) {
+	if ip >= len(counts) {
+		return
+	}
+	switch c.mode {
+	case coverSet:
+		counts[ip] = 1
+	case coverCount:
+		counts[ip]++
+	default:
+		atomic.AddUint32(&counts[ip], 1)
+	}
+}
+
+// Coverage returns the blocks of the source files accepted by include, with
+// their execution counts so far, ordered by file and position. A block is
+// a source line with instructions of a function body, without its leading
+// blanks, and its count is the highest of theirs. Top-level code is not counted.
+func (m *Machine) Coverage(include func(file string) bool) ([]CoverBlock, error) {
+	c := m.cover
+	if c == nil {
+		return nil, errors.New("coverage not enabled")
+	}
+	if m.debugInfoFn == nil {
+		return nil, errors.New("no debug information")
+	}
+	di := m.debugInfoFn()
+	code := m.code[:min(len(m.code), m.baseCodeLen)]
+	counts := c.counters(len(code))
+
+	// Instructions in function bodies, without the entries, which are at the
+	// function declarations, and the jumps over nested function bodies.
+	body := make([]bool, len(code))
+	for entry, end := range di.Ends {
+		for ip := entry + 1; ip < min(end, len(code)); ip++ {
+			body[ip] = true
+		}
+	}
+	for entry := range di.Ends {
+		if entry < len(code) {
+			body[entry] = false
+		}
+		if entry > 0 && entry <= len(code) && code[entry-1].Op == Jump {
+			body[entry-1] = false
+		}
+	}
+
+	type line struct {
+		file string
+		line int
+	}
+	blocks := map[line]*CoverBlock{}
+	for ip, in := range code {
+		if !body[ip] || in.Pos <= 0 { // implicit returns are at position 0
+			continue
+		}
+		file, l, col := di.Sources.Resolve(int(in.Pos))
+		if file == "" || include != nil && !include(file) {
+			continue
+		}
+		n := counts[ip]
+		if c.mode == coverAtomic {
+			n = atomic.LoadUint32(&counts[ip])
+		}
+		b := blocks[line{file, l}]
+		if b == nil {
+			text := di.Sources.Line(file, l)
+			start := len(text) - len(strings.TrimLeft(text, " \t")) + 1
+			b = &CoverBlock{File: file, StartLine: l, StartCol: min(start, col), EndLine: l, EndCol: len(text) + 1, NumStmt: 1}
+			blocks[line{file, l}] = b
+		}
+		b.Count = max(b.Count, n)
+	}
+
+	res := make([]CoverBlock, 0, len(blocks))
+	for _, b := range blocks {
+		res = append(res, *b)
+	}
+	slices.SortFunc(res, func(a, b CoverBlock) int {
+		return cmp.Or(cmp.Compare(a.File, b.File), cmp.Compare(a.StartLine, b.StartLine))
+	})
+	return res, nil
+}
+
+// WriteCoverProfile writes blocks in the format of go test -coverprofile,
+// read by go tool cover.
+func (m *Machine) WriteCoverProfile(w io.Writer, blocks []CoverBlock) error {
+	if m.cover == nil {
+		return errors.New("coverage not enabled")
+	}
+	if _, err := fmt.Fprintf(w, "mode: %s\n", coverModes[m.cover.mode]); err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		_, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n", b.File, b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmt, b.Count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CoveredPercent returns the percentage of statements of blocks which ran.
+func CoveredPercent(blocks []CoverBlock) float64 {
+	var n, covered int
+	for _, b := range blocks {
+		n += b.NumStmt
+		if b.Count > 0 {
+			covered += b.NumStmt
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(n)
+}
@@ -0,0 +1,447 @@
+package vm
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deadlockDelay is how long all the goroutines of a program must remain
+// blocked, with no channel operation completing meanwhile, before a deadlock
+// is reported. Goroutines register as blocked just before entering
+// reflect.Select, so a quiet period is needed to tell a deadlock from two
+// goroutines about to meet on a channel.
+const deadlockDelay = 100 * time.Millisecond
+
+// Blocked describes a goroutine blocked on a channel operation.
+type Blocked struct {
+	Goroutine int64 // goroutine id (1 is the main one)
+	Op        Op    // blocking instruction: ChanSend, ChanRecv, SelectExec, Next* of a range over a channel, or Call of a sync method
+	Frame           // address and source position of the blocking instruction
+}
+
+// DeadlockError is the error returned by Run when all the goroutines of the
+// program are blocked on channel operations which can never complete.
+// Goroutines blocked in sync methods, such as WaitGroup.Wait or Mutex.Lock,
+// are only seen under the scheduler (see StartScheduler), as the objects may
+// be shared with native code: otherwise such a deadlock blocks until the
+// context of the machine is done.
+type DeadlockError struct {
+	Goroutines []Blocked // by increasing goroutine id
+
+	debugInfoFn func() *DebugInfo
+}
+
+func (e *DeadlockError) Error() string {
+	var di *DebugInfo
+	if e.debugInfoFn != nil {
+		di = e.debugInfoFn()
+	}
+	var sb strings.Builder
+	sb.WriteString("all goroutines are asleep - deadlock!")
+	for _, g := range e.Goroutines {
+		_, _ = fmt.Fprintf(&sb, "\n\ngoroutine %d [%v]:\n", g.Goroutine, g.Op)
+		writeFrame(&sb, di.ResolveFrame(g.Frame))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// deadlockSignal is closed to wake up the goroutines of a deadlock.
+type deadlockSignal struct {
+	ch  chan struct{}
+	err *DeadlockError
+}
+
+// deadlockDetector tracks the goroutines of a program blocked on channel
+// operations, to report a deadlock once all of them are. Native goroutines
+// are invisible to it, so only channels made by the program and never passed
+// to native code are considered, and detection is disabled for good once
+// native code holds interpreted callbacks.
+type deadlockDetector struct {
+	mu        sync.Mutex
+	main      bool              // the main goroutine is running
+	live      int               // live goroutines, including main while running
+	blocked   map[int64]Blocked // blocked goroutines, by id
+	epoch     uint64            // number of resumed blocked goroutines
+	checking  bool              // a deadlock check is pending
+	sig       *deadlockSignal
+	chans     map[uintptr]struct{} // channels made by the program
+	callbacks atomic.Bool          // native code holds interpreted callbacks
+	spawned   atomic.Bool          // goroutines were started
+
+	debugInfoFn func() *DebugInfo
+}
+
+func newDeadlockDetector() *deadlockDetector {
+	return &deadlockDetector{
+		blocked: map[int64]Blocked{},
+		sig:     &deadlockSignal{ch: make(chan struct{})},
+		chans:   map[uintptr]struct{}{},
+	}
+}
+
+// enter accounts for the main goroutine m starting a top-level Run.
+func (d *deadlockDetector) enter(m *Machine) {
+	d.mu.Lock()
+	d.main = true
+	d.live++
+	d.debugInfoFn = m.debugInfoFn
+	d.mu.Unlock()
+}
+
+// leave accounts for the end of the top-level Run started by enter.
+func (d *deadlockDetector) leave() {
+	d.mu.Lock()
+	d.main = false
+	d.live--
+	d.mu.Unlock()
+}
+
+// spawn accounts for a new goroutine, interpreted or native.
+func (d *deadlockDetector) spawn() {
+	d.spawned.Store(true)
+	d.mu.Lock()
+	d.live++
+	d.mu.Unlock()
+}
+
+// active reports whether goroutines were started, so that all channel
+// operations must go through the detector.
+func (d *deadlockDetector) active() bool { return d != nil && d.spawned.Load() }
+
+// exit accounts for the end of a goroutine started after spawn.
+func (d *deadlockDetector) exit() {
+	d.mu.Lock()
+	d.live--
+	d.check()
+	d.mu.Unlock()
+}
+
+// addChan registers a channel made by the program.
+func (d *deadlockDetector) addChan(ch reflect.Value) {
+	p := ch.Pointer()
+	d.mu.Lock()
+	d.chans[p] = struct{}{}
+	d.mu.Unlock()
+	// Forget the channel once collected. A stale removal of a new channel
+	// at the same address only hides it from the detector.
+	runtime.AddCleanup((*byte)(ch.UnsafePointer()), func(p uintptr) {
+		d.mu.Lock()
+		delete(d.chans, p)
+		d.mu.Unlock()
+	}, p)
+}
+
+// escape forgets the channels passed to native code in args, also within
+// structs, arrays, slices, maps, pointers and interfaces, as they may then
+// be operated by goroutines the detector does not see.
+func (d *deadlockDetector) escape(args []reflect.Value) {
+	var chans []uintptr
+	var seen map[walked]bool
+	for _, a := range args {
+		if a.IsValid() && mayHoldChan(a.Type()) {
+			if seen == nil {
+				seen = map[walked]bool{}
+			}
+			chans = appendChans(chans, a, seen)
+		}
+	}
+	if len(chans) == 0 {
+		return
+	}
+	d.mu.Lock()
+	for _, p := range chans {
+		delete(d.chans, p)
+	}
+	d.mu.Unlock()
+}
+
+// walked identifies a pointer, map or slice walked by appendChans.
+type walked struct {
+	p   uintptr
+	typ reflect.Type
+	len int
+}
+
+// appendChans appends to chans the channels reachable from v. Pointers, maps
+// and slices already walked are in seen.
+func appendChans(chans []uintptr, v reflect.Value, seen map[walked]bool) []uintptr {
+	if !v.IsValid() || !mayHoldChan(v.Type()) {
+		return chans
+	}
+	switch v.Kind() {
+	case reflect.Chan:
+		if !v.IsNil() {
+			chans = append(chans, v.Pointer())
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			chans = appendChans(chans, v.Elem(), seen)
+		}
+	case reflect.Pointer, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			break
+		}
+		w := walked{p: v.Pointer(), typ: v.Type()}
+		if v.Kind() == reflect.Slice {
+			w.len = v.Len()
+		}
+		if seen[w] {
+			break
+		}
+		seen[w] = true
+		switch v.Kind() {
+		case reflect.Pointer:
+			chans = appendChans(chans, v.Elem(), seen)
+		case reflect.Map:
+			for it := v.MapRange(); it.Next(); {
+				chans = appendChans(chans, it.Key(), seen)
+				chans = appendChans(chans, it.Value(), seen)
+			}
+		default:
+			for i := range v.Len() {
+				chans = appendChans(chans, v.Index(i), seen)
+			}
+		}
+	case reflect.Array:
+		for i := range v.Len() {
+			chans = appendChans(chans, v.Index(i), seen)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			chans = appendChans(chans, v.Field(i), seen)
+		}
+	}
+	return chans
+}
+
+var chanTypes sync.Map // of reflect.Type to bool, by mayHoldChan
+
+// mayHoldChan reports whether a value of type t may hold a channel.
+func mayHoldChan(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Chan, reflect.Interface:
+		return true
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+	default:
+		return false
+	}
+	if b, ok := chanTypes.Load(t); ok {
+		return b.(bool)
+	}
+	b := holdsChan(t, map[reflect.Type]bool{})
+	chanTypes.Store(t, b)
+	return b
+}
+
+// holdsChan computes mayHoldChan, with the types being walked in visiting.
+func holdsChan(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if visiting[t] {
+		return false // A cycle adds no type.
+	}
+	visiting[t] = true
+	switch t.Kind() {
+	case reflect.Chan, reflect.Interface:
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return holdsChan(t.Elem(), visiting)
+	case reflect.Map:
+		return holdsChan(t.Key(), visiting) || holdsChan(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if holdsChan(t.Field(i).Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// owns reports whether the channels of cases can only be operated by the
+// goroutines known to the detector. Nil channels block forever.
+func (d *deadlockDetector) owns(cases []reflect.SelectCase) bool {
+	if d.callbacks.Load() {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range cases {
+		if !c.Chan.IsValid() || c.Chan.IsNil() {
+			continue
+		}
+		if _, ok := d.chans[c.Chan.Pointer()]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// block registers goroutine b as blocked and returns the signal closed if
+// it ends in a deadlock.
+func (d *deadlockDetector) block(b Blocked) *deadlockSignal {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.blocked[b.Goroutine] = b
+	d.check()
+	return d.sig
+}
+
+// resume unregisters a goroutine registered by block.
+func (d *deadlockDetector) resume(id int64) {
+	d.mu.Lock()
+	delete(d.blocked, id)
+	d.epoch++
+	d.mu.Unlock()
+}
+
+// asleep reports whether all the goroutines are blocked. It must be called
+// with d.mu held.
+func (d *deadlockDetector) asleep() bool {
+	return d.main && len(d.blocked) == d.live && !d.callbacks.Load()
+}
+
+// check starts a deadlock check if all the goroutines are blocked and none
+// is pending. It must be called with d.mu held.
+func (d *deadlockDetector) check() {
+	if d.checking || !d.asleep() {
+		return
+	}
+	d.checking = true
+	go d.watch(d.epoch)
+}
+
+// watch reports a deadlock if all the goroutines remain blocked without any
+// progress for deadlockDelay.
+func (d *deadlockDetector) watch(epoch uint64) {
+	for {
+		time.Sleep(deadlockDelay)
+		d.mu.Lock()
+		if d.asleep() && d.epoch != epoch {
+			// Some goroutines resumed then blocked again: wait more.
+			epoch = d.epoch
+			d.mu.Unlock()
+			continue
+		}
+		if d.asleep() {
+			d.sig.err = d.deadlockError()
+			close(d.sig.ch)
+			d.sig = &deadlockSignal{ch: make(chan struct{})}
+		}
+		d.checking = false
+		d.mu.Unlock()
+		return
+	}
+}
+
+// deadlockError returns the error reporting the blocked goroutines. It must
+// be called with d.mu held.
+func (d *deadlockDetector) deadlockError() *DeadlockError {
+	gs := make([]Blocked, 0, len(d.blocked))
+	for _, b := range d.blocked {
+		gs = append(gs, b)
+	}
+	slices.SortFunc(gs, func(a, b Blocked) int { return cmp.Compare(a.Goroutine, b.Goroutine) })
+	return &DeadlockError{Goroutines: gs, debugInfoFn: d.debugInfoFn}
+}
+
+// hasDefault reports whether cases contains a default case.
+func hasDefault(cases []reflect.SelectCase) bool {
+	for _, c := range cases {
+		if c.Dir == reflect.SelectDefault {
+			return true
+		}
+	}
+	return false
+}
+
+// chanDirect reports whether the channel operations of m may run directly,
+// going through chanSelect only if they would block: the goroutine is alone,
+// not scheduled, and can not be cancelled.
+func (m *Machine) chanDirect(done <-chan struct{}) bool {
+	return done == nil && m.sthread == nil && !m.deadlock.active()
+}
+
+// chanRecv receives from ch for the instruction at ip, like chanSelect.
+func (m *Machine) chanRecv(ch reflect.Value, ip int, done <-chan struct{}) (v reflect.Value, ok bool, err error) {
+	if m.chanDirect(done) && ch.IsValid() {
+		if v, ok = ch.TryRecv(); v.IsValid() {
+			return v, ok, nil
+		}
+	}
+	_, v, ok, err = m.chanSelect([]reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: ch}}, ip, done)
+	return v, ok, err
+}
+
+// trySelect runs the select of cases, without a default case, if it can
+// proceed without blocking.
+func trySelect(cases []reflect.SelectCase) (chosen int, recv reflect.Value, recvOK, ok bool) {
+	if len(cases) == 1 {
+		switch c := cases[0]; {
+		case !c.Chan.IsValid():
+			return 0, recv, false, false
+		case c.Dir == reflect.SelectSend:
+			return 0, recv, false, c.Chan.TrySend(c.Send)
+		default:
+			recv, recvOK = c.Chan.TryRecv()
+			return 0, recv, recvOK, recv.IsValid()
+		}
+	}
+	n := len(cases)
+	chosen, recv, recvOK = reflect.Select(append(cases, reflect.SelectCase{Dir: reflect.SelectDefault}))
+	return chosen, recv, recvOK, chosen < n
+}
+
+// chanSelect is reflect.Select for the channel operation at ip. It fails
+// with the context cause if done is closed, or with a DeadlockError if the
+// operation blocks and no goroutine of the program can ever complete it.
+func (m *Machine) chanSelect(cases []reflect.SelectCase, ip int, done <-chan struct{}) (chosen int, recv reflect.Value, recvOK bool, err error) {
+	if m.sthread != nil {
+		return m.schedSelect(cases, ip, done)
+	}
+	if d := m.deadlock; d != nil && !hasDefault(cases) {
+		// Try without blocking first, to keep the common path lock free.
+		var ok bool
+		if chosen, recv, recvOK, ok = trySelect(cases); ok {
+			return chosen, recv, recvOK, nil
+		}
+		if d.owns(cases) {
+			return m.blockSelect(d, cases, ip, done)
+		}
+	}
+	if done == nil {
+		chosen, recv, recvOK = reflect.Select(cases)
+		return chosen, recv, recvOK, nil
+	}
+	var live bool
+	if chosen, recv, recvOK, live = selectDone(cases, done); !live {
+		err = context.Cause(m.ctx)
+	}
+	return chosen, recv, recvOK, err
+}
+
+// blockSelect runs the blocking select of chanSelect, registered as blocked
+// in the deadlock detector d.
+func (m *Machine) blockSelect(d *deadlockDetector, cases []reflect.SelectCase, ip int, done <-chan struct{}) (chosen int, recv reflect.Value, recvOK bool, err error) {
+	n := len(cases)
+	sig := d.block(Blocked{Goroutine: m.goid, Op: m.code[ip].Op, Frame: Frame{IP: ip, Pos: m.code[ip].Pos}})
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sig.ch)})
+	if done != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+	}
+	chosen, recv, recvOK = reflect.Select(cases)
+	d.resume(m.goid)
+	switch chosen {
+	case n:
+		err = sig.err
+	case n + 1:
+		err = context.Cause(m.ctx)
+	}
+	return chosen, recv, recvOK, err
+}
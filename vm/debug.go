@@ -1,13 +1,11 @@
 package vm
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
 	"sort"
 	"strconv"
-	"strings"
 
 	"github.com/mvertes/parscan/scan"
 )
@@ -19,6 +17,22 @@ type DebugInfo struct {
 	Labels  map[int]string        // code address -> label/function name
 	Globals map[int]string        // data index -> symbol name
 	Locals  map[string][]LocalVar // function name -> local variable list
+	Ends    map[int]int           // function code address -> end code address
+	Inlined []InlinedCall         // function calls replaced by the function body
+	Funcs   map[int]FuncInfo      // function code address -> stack trace name
+}
+
+// FuncInfo describes a function as it appears in stack traces.
+type FuncInfo struct {
+	Name string // package qualified name, e.g. main.(*T).m or main.main.func1
+	Args bool   // true if the function has a receiver or parameters
+}
+
+// InlinedCall is a function call replaced by the function body.
+type InlinedCall struct {
+	Start, End int    // code addresses of the inlined body
+	Func       string // name of the inlined function
+	Pos        Pos    // source position of the call
 }
 
 // LocalVar describes a local variable within a function frame.
@@ -33,6 +47,8 @@ func NewDebugInfo() *DebugInfo {
 		Labels:  map[int]string{},
 		Globals: map[int]string{},
 		Locals:  map[string][]LocalVar{},
+		Ends:    map[int]int{},
+		Funcs:   map[int]FuncInfo{},
 	}
 }
 
@@ -45,6 +61,59 @@ func (d *DebugInfo) PosToLine(pos Pos) string {
 	return d.Sources.FormatPos(int(pos))
 }
 
+// FuncAt returns the name of the innermost function whose code contains ip,
+// or "" if there is none.
+func (d *DebugInfo) FuncAt(ip int) string {
+	if d == nil {
+		return ""
+	}
+	return d.Labels[d.funcAddr(ip)]
+}
+
+// funcAddr returns the code address of the innermost function whose code
+// contains ip, or -1 if there is none.
+func (d *DebugInfo) funcAddr(ip int) int {
+	start := -1
+	for addr := range d.Labels {
+		if end, ok := d.Ends[addr]; ok && addr <= ip && ip < end && addr > start {
+			start = addr
+		}
+	}
+	return start
+}
+
+// labelAddr returns the code address of the function labelled name, or -1.
+func (d *DebugInfo) labelAddr(name string) int {
+	for addr, l := range d.Labels {
+		if l == name {
+			return addr
+		}
+	}
+	return -1
+}
+
+// funcInfo returns the stack trace description of the function at code
+// address addr, defaulting to its label.
+func (d *DebugInfo) funcInfo(addr int) FuncInfo {
+	if fi, ok := d.Funcs[addr]; ok {
+		return fi
+	}
+	return FuncInfo{Name: d.Labels[addr]}
+}
+
+// InlinedAt returns the inlined call whose body contains ip, if any.
+func (d *DebugInfo) InlinedAt(ip int) (InlinedCall, bool) {
+	if d == nil {
+		return InlinedCall{}, false
+	}
+	for _, c := range d.Inlined {
+		if c.Start <= ip && ip < c.End {
+			return c, true
+		}
+	}
+	return InlinedCall{}, false
+}
+
 // LocalName returns the variable name for a local slot offset within func funcName.
 func (d *DebugInfo) LocalName(funcName string, offset int) string {
 	if d == nil {
@@ -66,8 +135,8 @@ func DumpFrame(w io.Writer, mem []Value, code Code, fp, sp, narg, nret int, di *
 		return
 	}
 
-	retIP := int(mem[fp-2].num)  //nolint:gosec
-	prevFP := int(mem[fp-1].num) //nolint:gosec
+	retIP := int(mem[fp-2].num)           //nolint:gosec
+	prevFP := int(mem[fp-1].num & fpMask) //nolint:gosec
 
 	funcAddr := max(fp-frameOverhead-narg-1, 0)
 
@@ -158,7 +227,7 @@ func (m *Machine) DumpCallStack(w io.Writer, di *DebugInfo) {
 			break
 		}
 		fpVal := mem[fp-1].num
-		fp = int(fpVal &^ (1 << 63)) //nolint:gosec // mask off envSavedFlag
+		fp = int(fpVal & fpMask) //nolint:gosec
 	}
 
 	// Print globals with names if available.
@@ -166,13 +235,13 @@ func (m *Machine) DumpCallStack(w io.Writer, di *DebugInfo) {
 		_, _ = fmt.Fprintln(w, "--- Globals ---")
 		indices := make([]int, 0, len(di.Globals))
 		for idx := range di.Globals {
-			if idx >= 0 && idx < len(mem) {
+			if idx >= 0 && idx < len(m.globals) {
 				indices = append(indices, idx)
 			}
 		}
 		sort.Ints(indices)
 		for _, idx := range indices {
-			printSlot(w, idx, "global", mem[idx], di.Globals[idx], "")
+			printSlot(w, idx, "global", m.globals[idx], di.Globals[idx], "")
 		}
 		_, _ = fmt.Fprintln(w)
 	}
@@ -241,53 +310,24 @@ func formatValue(v Value) string {
 	return s
 }
 
-// enterDebug runs an interactive debug session. The Machine state (mem, ip, fp)
-// must be synced before calling. On return, ip is set to resume execution.
-func (m *Machine) enterDebug() {
-	in := m.debugIn
-	if in == nil {
-		in = os.Stdin
-	}
-	out := m.debugOut
-	if out == nil {
-		out = os.Stderr
-	}
-
-	var di *DebugInfo
-	if m.debugInfoFn != nil {
-		di = m.debugInfoFn()
-	}
-
-	loc := ""
-	if di != nil && m.ip > 0 && m.ip-1 < len(m.code) {
-		loc = di.PosToLine(m.code[m.ip-1].Pos)
-	}
-	if loc != "" {
-		_, _ = fmt.Fprintf(out, "trap at ip=%d (%s)\n", m.ip-1, loc)
-	} else {
-		_, _ = fmt.Fprintf(out, "trap at ip=%d\n", m.ip-1)
+// enterDebug runs a debug session at a Trap instruction. The Machine state
+// (mem, ip, fp) must be synced before calling. On return, ip is set to resume
+// execution. Without an attached debugger, a temporary one is attached for as
+// long as breakpoints or steps are pending.
+func (m *Machine) enterDebug() error {
+	d, temp := m.debugger, m.debugger == nil
+	if temp {
+		d = NewDebugger(m.debugIn, m.debugOut)
+		m.SetDebugger(d)
 	}
-
-	scanner := bufio.NewScanner(in)
-	for {
-		_, _ = fmt.Fprint(out, "debug> ")
-		if !scanner.Scan() {
-			break
-		}
-		line := strings.TrimSpace(scanner.Text())
-		switch line {
-		case "h", "help":
-			_, _ = fmt.Fprintln(out, "  stack, bt  - dump call stack")
-			_, _ = fmt.Fprintln(out, "  cont, c    - continue execution")
-			_, _ = fmt.Fprintln(out, "  help, h    - show this help")
-		case "bt", "stack":
-			m.DumpCallStack(out, di)
-		case "c", "cont":
-			return
-		case "":
-			continue
-		default:
-			_, _ = fmt.Fprintf(out, "unknown command: %s (type 'help')\n", line)
-		}
+	d.gate.Lock()
+	defer d.gate.Unlock()
+	err := d.stop(&Stopped{Goroutine: m.goid, Reason: "trap", d: d, m: m, ip: m.ip - 1, fp: m.fp, mem: m.mem})
+	d.mu.Lock()
+	idle := len(d.bps) == 0 && m.dstate.mode == ResumeContinue
+	d.mu.Unlock()
+	if temp && idle {
+		m.SetDebugger(nil)
 	}
+	return err
 }
@@ -0,0 +1,825 @@
+package vm
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrDebugQuit is returned by Run when the program is aborted from the
+// debugger.
+var ErrDebugQuit = errors.New("debugger: quit")
+
+// Debugger is a source-level debugger. Once attached to a machine with
+// SetDebugger, the machine and its goroutines check it before each
+// instruction, and stop at breakpoints and at the end of steps. A stopped
+// goroutine is passed to the Handler, or reads commands from the debugger
+// input if there is none. Stops are serialized: while a goroutine is stopped,
+// the others block at their next instruction.
+type Debugger struct {
+	StopOnEntry bool                  // stop at the first source line executed
+	Handler     func(*Stopped) Resume // if set, handles stops instead of commands
+
+	gate    sync.Mutex // held by the stopped goroutine
+	mu      sync.Mutex
+	in      *bufio.Scanner
+	pending chan *string // line being read from in by a goroutine, if any
+	out     io.Writer
+	eof     bool // command input is exhausted: never stop again
+	bps     []*Breakpoint
+	lastID  int
+	di      *DebugInfo
+	codeLen int                // len(code) when di was built
+	lines   []lineRef          // source line by code address, built on demand
+	threads map[int64]*Machine // goroutines seen, by id
+}
+
+// Resume tells a stopped goroutine how to resume execution.
+type Resume int
+
+// Ways to resume a stopped goroutine.
+const (
+	ResumeContinue Resume = iota // run until the next breakpoint
+	ResumeStepIn                 // stop at the next source line, entering calls
+	ResumeStepOver               // stop at the next source line of the frame or its callers
+	ResumeStepOut                // stop once the current function has returned
+	ResumeQuit                   // abort the program with ErrDebugQuit
+)
+
+// Stopped is a goroutine stopped by a debugger. Its methods may be called,
+// concurrently with the Debugger ones, until the goroutine resumes.
+type Stopped struct {
+	Goroutine  int64       // id of the stopped goroutine
+	Reason     string      // "entry", "step", "breakpoint" or "trap"
+	Breakpoint *Breakpoint // breakpoint hit, if Reason is "breakpoint"
+
+	d   *Debugger
+	m   *Machine
+	ip  int
+	fp  int
+	mem []Value
+}
+
+// StackFrame is a frame of the stack of a stopped goroutine.
+type StackFrame struct {
+	Frame
+	fp int
+}
+
+// Variable is a variable of a stopped program.
+type Variable struct {
+	Name  string
+	Value reflect.Value // invalid for a nil interface
+}
+
+// Goroutine is an interpreted goroutine run under a debugger.
+type Goroutine struct {
+	ID    int64
+	Frame // last instruction checked by the debugger
+}
+
+// Breakpoint is a debugger breakpoint, either on a source line or on the
+// entry of a function.
+type Breakpoint struct {
+	ID   int
+	File string // source name or suffix of it ("" means any source)
+	Line int    // source line, 0 for a function breakpoint
+	Func string // function name, for a function breakpoint
+	Cond string // condition of the form "name", or "name op literal"
+	Hits int    // number of stops
+}
+
+func (b *Breakpoint) String() string {
+	loc := b.Func
+	if b.Line > 0 {
+		loc = b.File + ":" + strconv.Itoa(b.Line)
+		if b.File == "" {
+			loc = strconv.Itoa(b.Line)
+		}
+	}
+	if b.Cond != "" {
+		loc += " if " + b.Cond
+	}
+	return fmt.Sprintf("%d: %s (hits %d)", b.ID, loc, b.Hits)
+}
+
+// srcLine identifies a source line.
+type srcLine struct {
+	file string
+	line int // 0 if unknown
+}
+
+// lineRef caches the source line of the instruction at a code address.
+type lineRef struct {
+	pos  Pos
+	loc  srcLine
+	done bool
+}
+
+// debugState is the debugger state of a goroutine.
+type debugState struct {
+	mode   Resume      // step in progress, ResumeContinue if none
+	fp     int         // frame where the step started
+	entry  bool        // the step is the stop on entry
+	frames []frameLine // current line of each active frame, innermost last
+	seen   bool        // the goroutine is registered in the debugger
+	ip     int         // last checked instruction
+	ipFP   int         // frame of ip
+}
+
+// frameLine is the source line being executed in the frame at fp.
+type frameLine struct {
+	fp   int
+	line srcLine
+}
+
+// enter records that the frame at fp executes loc, and reports whether it
+// is a new line for this frame. Returning to a caller does not start a new
+// line, the remainder of the calling line is executed.
+func (st *debugState) enter(fp int, loc srcLine) bool {
+	n := len(st.frames)
+	for n > 0 && st.frames[n-1].fp > fp {
+		n-- // frames returned from
+	}
+	st.frames = st.frames[:n]
+	if n > 0 && st.frames[n-1].fp == fp {
+		f := &st.frames[n-1]
+		if loc.line == 0 || f.line == loc {
+			return false
+		}
+		f.line = loc
+		return true
+	}
+	st.frames = append(st.frames, frameLine{fp, loc})
+	return loc.line > 0
+}
+
+// NewDebugger returns a debugger reading commands from in and writing to out.
+// Nil streams default to os.Stdin and os.Stderr.
+func NewDebugger(in io.Reader, out io.Writer) *Debugger {
+	if in == nil {
+		in = os.Stdin
+	}
+	if out == nil {
+		out = os.Stderr
+	}
+	return &Debugger{in: bufio.NewScanner(in), out: out, threads: map[int64]*Machine{}}
+}
+
+// SetDebugger attaches the debugger d to the machine, or detaches the current
+// one if d is nil. The machine then runs in stepping mode, which is much
+// slower. It must be called before Run, not concurrently with it.
+func (m *Machine) SetDebugger(d *Debugger) {
+	m.debugger = d
+	m.stepping = d != nil
+	m.dstate = debugState{}
+	if d != nil && d.StopOnEntry {
+		m.dstate = debugState{mode: ResumeStepIn, entry: true}
+	}
+}
+
+// Break adds a breakpoint at loc, which is either "file:line", "line" or a
+// function name, stopping only if cond, if not empty, holds.
+func (d *Debugger) Break(loc, cond string) (*Breakpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.addBreak(loc, cond)
+}
+
+// addBreak adds a breakpoint. It must be called with d.mu held.
+func (d *Debugger) addBreak(loc, cond string) (*Breakpoint, error) {
+	b := &Breakpoint{Cond: cond}
+	if cond != "" {
+		if _, _, _, err := parseCond(cond); err != nil {
+			return nil, err
+		}
+	}
+	if i := strings.LastIndexByte(loc, ':'); i >= 0 {
+		b.File = loc[:i]
+		loc = loc[i+1:]
+	}
+	if n, err := strconv.Atoi(loc); err == nil {
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid line: %d", n)
+		}
+		b.Line = n
+	} else if b.File != "" || loc == "" {
+		return nil, fmt.Errorf("invalid location: %s", loc)
+	} else {
+		b.Func = strings.TrimPrefix(loc, "main.")
+	}
+	d.lastID++
+	b.ID = d.lastID
+	d.bps = append(d.bps, b)
+	return b, nil
+}
+
+// Clear removes the breakpoint with the given id.
+func (d *Debugger) Clear(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.clear(id)
+}
+
+// clear removes a breakpoint. It must be called with d.mu held.
+func (d *Debugger) clear(id int) bool {
+	for i, b := range d.bps {
+		if b.ID == id {
+			d.bps = append(d.bps[:i], d.bps[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// debugInfo returns the debug information of the code run by m. It must be
+// called with d.mu held.
+func (d *Debugger) debugInfo(m *Machine) *DebugInfo {
+	if m.debugInfoFn == nil {
+		return nil
+	}
+	if d.di == nil || d.codeLen != m.baseCodeLen {
+		d.di, d.codeLen = m.debugInfoFn(), m.baseCodeLen
+	}
+	return d.di
+}
+
+// lineAt returns the source line of the instruction at ip, or a zero srcLine
+// for instructions without source (function prologues, sentinels, NoPos).
+// It must be called with d.mu held.
+func (d *Debugger) lineAt(m *Machine, ip int) srcLine {
+	if ip >= m.baseCodeLen {
+		return srcLine{}
+	}
+	if ip >= len(d.lines) {
+		d.lines = append(d.lines, make([]lineRef, m.baseCodeLen-len(d.lines))...)
+	}
+	pos := m.code[ip].Pos
+	if r := &d.lines[ip]; r.done && r.pos == pos {
+		return r.loc
+	}
+	var loc srcLine
+	if di := d.debugInfo(m); di != nil && pos != NoPos {
+		_, entry := di.Ends[ip]
+		_, skip := di.Ends[ip+1] // jump over a function body
+		if !entry && !(skip && m.code[ip].Op == Jump) {
+			loc.file, loc.line, _ = di.Sources.Resolve(int(pos))
+		}
+	}
+	d.lines[ip] = lineRef{pos: pos, loc: loc, done: true}
+	return loc
+}
+
+// debugCheck is called by a machine in stepping mode before the instruction
+// at ip. It hands the goroutine to the debugger if it must stop there.
+func (m *Machine) debugCheck(ip, fp, sp int, mem []Value) error {
+	d := m.debugger
+	d.gate.Lock()
+	defer d.gate.Unlock()
+	if s := d.check(m, ip, fp, mem[:sp+1]); s != nil {
+		return d.stop(s)
+	}
+	return nil
+}
+
+// check returns the stop of m before the instruction at ip, or nil if it
+// must not stop there.
+func (d *Debugger) check(m *Machine, ip, fp int, mem []Value) *Stopped {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.eof {
+		return nil
+	}
+	st := &m.dstate
+	if !st.seen {
+		st.seen = true
+		d.threads[m.goid] = m
+	}
+	st.ip, st.ipFP = ip, fp
+	loc := d.lineAt(m, ip)
+	newLine := st.enter(fp, loc)
+
+	var stop bool
+	switch st.mode {
+	case ResumeStepIn:
+		stop = newLine
+	case ResumeStepOver:
+		stop = newLine && fp <= st.fp
+	case ResumeStepOut:
+		stop = fp < st.fp && loc.line > 0
+	}
+	s := &Stopped{Goroutine: m.goid, Reason: "step", d: d, m: m, ip: ip, fp: fp, mem: mem}
+	if st.entry {
+		s.Reason = "entry"
+	}
+	if !stop {
+		if s.Breakpoint = d.breakpointAt(m, ip, fp, mem, loc, newLine); s.Breakpoint == nil {
+			return nil
+		}
+		s.Breakpoint.Hits++
+		s.Reason = "breakpoint"
+	}
+	st.mode, st.entry = ResumeContinue, false
+	return s
+}
+
+// stop hands the stopped goroutine to the handler, or to a command session,
+// then sets how it resumes. It must be called with d.gate held.
+func (d *Debugger) stop(s *Stopped) error {
+	var r Resume
+	if d.Handler != nil {
+		r = d.Handler(s)
+	} else {
+		r = d.session(s)
+	}
+	if r == ResumeQuit {
+		return ErrDebugQuit
+	}
+	if ctx := s.m.ctx; ctx != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	st := &s.m.dstate
+	st.mode, st.fp = r, s.fp
+	return nil
+}
+
+// exit unregisters a goroutine which has returned.
+func (d *Debugger) exit(id int64) {
+	d.mu.Lock()
+	delete(d.threads, id)
+	d.mu.Unlock()
+}
+
+// Goroutines returns the goroutines run under the debugger, by increasing id.
+func (d *Debugger) Goroutines() []Goroutine {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	gs := make([]Goroutine, 0, len(d.threads))
+	for id, m := range d.threads {
+		ip := m.dstate.ip
+		f := d.debugInfo(m).ResolveFrame(Frame{IP: ip, Pos: m.code[ip].Pos})
+		gs = append(gs, Goroutine{ID: id, Frame: f})
+	}
+	slices.SortFunc(gs, func(a, b Goroutine) int { return cmp.Compare(a.ID, b.ID) })
+	return gs
+}
+
+// Frames returns the stack of the stopped goroutine, innermost frame first.
+func (s *Stopped) Frames() []StackFrame {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	di := s.d.debugInfo(s.m)
+	var frames []StackFrame
+	s.m.walkStack(s.ip, s.fp, s.mem, func(f Frame, fp int) {
+		frames = append(frames, StackFrame{Frame: di.ResolveFrame(f), fp: fp})
+	})
+	return frames
+}
+
+// Locals returns the local variables of the frame f of the stopped goroutine,
+// parameters first.
+func (s *Stopped) Locals(f StackFrame) []Variable {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	var vars []Variable
+	for _, lv := range s.d.debugInfo(s.m).frameLocals(f.IP) {
+		if v, ok := localValue(s.mem, f.fp, lv.Offset); ok {
+			vars = append(vars, Variable{Name: lv.Name, Value: debugValue(v)})
+		}
+	}
+	return vars
+}
+
+// Globals returns the global variables of the stopped program, by name.
+func (s *Stopped) Globals() []Variable {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	di := s.d.debugInfo(s.m)
+	if di == nil {
+		return nil
+	}
+	var vars []Variable
+	for idx, name := range di.Globals {
+		if idx < len(s.m.globals) {
+			vars = append(vars, Variable{Name: name, Value: debugValue(s.m.globals[idx])})
+		}
+	}
+	slices.SortFunc(vars, func(a, b Variable) int { return cmp.Compare(a.Name, b.Name) })
+	return vars
+}
+
+// breakpointAt returns the breakpoint at which the machine must stop before
+// the instruction at ip, if any. It must be called with d.mu held.
+func (d *Debugger) breakpointAt(m *Machine, ip, fp int, mem []Value, loc srcLine, newLine bool) *Breakpoint {
+	var fn string // name of the function entered at ip, if any
+	if di := d.debugInfo(m); di != nil {
+		if _, entry := di.Ends[ip]; entry {
+			fn = di.Labels[ip]
+		}
+	}
+	for _, b := range d.bps {
+		if b.Line > 0 {
+			if !newLine || b.Line != loc.line || !sameFile(loc.file, b.File) {
+				continue
+			}
+		} else if fn == "" || b.Func != fn {
+			continue
+		}
+		if b.Cond != "" {
+			if ok, err := d.cond(m, ip, fp, mem, b.Cond); err == nil && !ok {
+				continue
+			} else if err != nil {
+				_, _ = fmt.Fprintf(d.out, "breakpoint %d: %v\n", b.ID, err)
+			}
+		}
+		return b
+	}
+	return nil
+}
+
+// sameFile reports whether the source name matches the breakpoint file, which
+// may be a path suffix of it.
+func sameFile(name, file string) bool {
+	return file == "" || name == file || strings.HasSuffix(name, "/"+file)
+}
+
+// session reads and executes debugger commands until the stopped goroutine
+// resumes.
+func (d *Debugger) session(s *Stopped) Resume {
+	d.mu.Lock()
+	if s.Reason == "trap" {
+		header := fmt.Sprintf("trap at ip=%d", s.ip)
+		if loc := d.debugInfo(s.m).PosToLine(s.m.code[s.ip].Pos); loc != "" {
+			header += " (" + loc + ")"
+		}
+		_, _ = fmt.Fprintln(d.out, header)
+	}
+	if s.Breakpoint != nil {
+		_, _ = fmt.Fprintf(d.out, "breakpoint %d, ", s.Breakpoint.ID)
+	}
+	d.printLocation(s.m, s.ip)
+	d.mu.Unlock()
+	s.m.mem, s.m.fp = s.mem, s.fp // for stack dumps
+	done := ctxDone(s.m.ctx)
+	for {
+		_, _ = fmt.Fprint(d.out, "debug> ")
+		line, ok := d.readLine(done)
+		if !ok {
+			if !cancelled(done) {
+				d.mu.Lock()
+				d.eof = true
+				d.mu.Unlock()
+			}
+			_, _ = fmt.Fprintln(d.out)
+			return ResumeContinue
+		}
+		d.mu.Lock()
+		r, ok := d.command(s, line)
+		d.mu.Unlock()
+		if ok {
+			return r
+		}
+	}
+}
+
+// readLine returns the next command line, or false at the end of the input
+// or once done is closed. With done, the line is read by a goroutine, which
+// keeps waiting for it after done is closed, for the next session.
+func (d *Debugger) readLine(done <-chan struct{}) (string, bool) {
+	if done == nil && d.pending == nil {
+		if !d.in.Scan() {
+			return "", false
+		}
+		return d.in.Text(), true
+	}
+	if d.pending == nil {
+		d.pending = make(chan *string, 1)
+		go func(pending chan<- *string) {
+			var line *string
+			if d.in.Scan() {
+				text := d.in.Text()
+				line = &text
+			}
+			pending <- line
+		}(d.pending)
+	}
+	select {
+	case line := <-d.pending:
+		d.pending = nil
+		if line == nil {
+			return "", false
+		}
+		return *line, true
+	case <-done:
+		return "", false
+	}
+}
+
+// command executes a debugger command, and returns how to resume the stopped
+// goroutine if it must. It must be called with d.mu held.
+func (d *Debugger) command(s *Stopped, line string) (Resume, bool) {
+	m, ip, fp, mem, out := s.m, s.ip, s.fp, s.mem, d.out
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case "":
+	case "h", "help":
+		_, _ = fmt.Fprint(out, debugHelp)
+	case "bt", "stack":
+		m.DumpCallStack(out, d.debugInfo(m))
+	case "w", "where":
+		for _, f := range m.callers(ip, fp, mem) {
+			d.printFrame(m, f)
+		}
+	case "c", "cont", "continue":
+		return ResumeContinue, true
+	case "s", "step":
+		return ResumeStepIn, true
+	case "n", "next":
+		return ResumeStepOver, true
+	case "finish":
+		if fp == 0 {
+			_, _ = fmt.Fprintln(out, "not in a function")
+			break
+		}
+		return ResumeStepOut, true
+	case "b", "break":
+		loc, cond, _ := strings.Cut(arg, " if ")
+		if !strings.Contains(loc, ":") && d.lineAt(m, ip).file != "" {
+			if _, err := strconv.Atoi(loc); err == nil {
+				loc = d.lineAt(m, ip).file + ":" + loc
+			}
+		}
+		b, err := d.addBreak(strings.TrimSpace(loc), strings.TrimSpace(cond))
+		if err != nil {
+			_, _ = fmt.Fprintln(out, err)
+			break
+		}
+		_, _ = fmt.Fprintf(out, "breakpoint %v\n", b)
+	case "clear":
+		if id, err := strconv.Atoi(arg); err != nil || !d.clear(id) {
+			_, _ = fmt.Fprintf(out, "no breakpoint %s\n", arg)
+		} else {
+			_, _ = fmt.Fprintf(out, "deleted breakpoint %d\n", id)
+		}
+	case "bl", "breakpoints":
+		for _, b := range d.bps {
+			_, _ = fmt.Fprintln(out, b)
+		}
+	case "p", "print":
+		v, err := d.lookup(m, ip, fp, mem, arg)
+		if err != nil {
+			_, _ = fmt.Fprintln(out, err)
+			break
+		}
+		_, _ = fmt.Fprintf(out, "%s = %s\n", arg, formatAny(v))
+	case "locals":
+		for _, lv := range d.debugInfo(m).frameLocals(ip) {
+			if v, ok := localValue(mem, fp, lv.Offset); ok {
+				_, _ = fmt.Fprintf(out, "%s = %s\n", lv.Name, formatAny(debugValue(v)))
+			}
+		}
+	case "l", "list":
+		d.list(m, ip)
+	case "q", "quit":
+		return ResumeQuit, true
+	default:
+		_, _ = fmt.Fprintf(out, "unknown command: %s (type 'help')\n", cmd)
+	}
+	return ResumeContinue, false
+}
+
+const debugHelp = `  break, b <loc> [if <cond>]  - set a breakpoint at file:line, line or function
+  clear <id>                  - delete a breakpoint
+  breakpoints, bl             - list breakpoints
+  cont, c                     - continue execution
+  step, s                     - step to the next source line, entering calls
+  next, n                     - step to the next source line, over calls
+  finish                      - run until the current function returns
+  print, p <name>             - print a local or global variable, or a field of it
+  locals                      - print the local variables
+  list, l                     - show the source around the current line
+  where, w                    - show the goroutine backtrace
+  stack, bt                   - dump call stack
+  quit, q                     - abort the program
+  help, h                     - show this help
+`
+
+// printLocation prints the function, source position and line text of ip.
+func (d *Debugger) printLocation(m *Machine, ip int) {
+	f := d.debugInfo(m).ResolveFrame(Frame{IP: ip, Pos: m.code[ip].Pos})
+	name := f.Func
+	if name == "" {
+		name = "main"
+	}
+	if f.Line == 0 {
+		_, _ = fmt.Fprintf(d.out, "%s() ip=%d [goroutine %d]\n", name, ip, m.goid)
+		return
+	}
+	_, _ = fmt.Fprintf(d.out, "%s() %s:%d:%d [goroutine %d]\n", name, f.File, f.Line, f.Col, m.goid)
+	_, _ = fmt.Fprintf(d.out, "%d\t%s\n", f.Line, d.debugInfo(m).Sources.Line(f.File, f.Line))
+}
+
+// printFrame prints a backtrace entry.
+func (d *Debugger) printFrame(m *Machine, f Frame) {
+	var sb strings.Builder
+	writeFrame(&sb, d.debugInfo(m).ResolveFrame(f))
+	_, _ = fmt.Fprint(d.out, sb.String())
+}
+
+// list prints the source lines around ip.
+func (d *Debugger) list(m *Machine, ip int) {
+	loc := d.lineAt(m, ip)
+	if loc.line == 0 {
+		_, _ = fmt.Fprintln(d.out, "no source")
+		return
+	}
+	srcs := d.debugInfo(m).Sources
+	for l := max(loc.line-5, 1); l <= loc.line+5; l++ {
+		text := srcs.Line(loc.file, l)
+		if text == "" && l > loc.line {
+			break
+		}
+		mark := " "
+		if l == loc.line {
+			mark = "=>"
+		}
+		_, _ = fmt.Fprintf(d.out, "%2s %4d\t%s\n", mark, l, text)
+	}
+}
+
+// frameLocals returns the local variables of the function containing ip.
+func (d *DebugInfo) frameLocals(ip int) []LocalVar {
+	if d == nil {
+		return nil
+	}
+	return d.Locals[d.FuncAt(ip)]
+}
+
+// localValue returns the value of the local variable at offset in frame fp,
+// through its heap cell if captured by a closure.
+func localValue(mem []Value, fp, offset int) (Value, bool) {
+	i := fp - 1 + offset
+	if fp == 0 || i < 0 || i >= len(mem) {
+		return Value{}, false
+	}
+	v := mem[i]
+	if v.ref.IsValid() && v.ref.Type() == valuePtrRtype {
+		v = *v.ref.Interface().(*Value)
+	}
+	return v, true
+}
+
+var valuePtrRtype = reflect.TypeFor[*Value]()
+
+// lookup returns the value of a variable, local to the frame of ip or global,
+// optionally followed by field selectors, as in "p.X".
+func (d *Debugger) lookup(m *Machine, ip, fp int, mem []Value, expr string) (reflect.Value, error) {
+	name, path, _ := strings.Cut(expr, ".")
+	di := d.debugInfo(m)
+	if di == nil {
+		return reflect.Value{}, errors.New("no debug information")
+	}
+	var v Value
+	found := false
+	for _, lv := range di.frameLocals(ip) {
+		if lv.Name == name {
+			v, found = localValue(mem, fp, lv.Offset)
+			break
+		}
+	}
+	if !found {
+		for idx, g := range di.Globals {
+			if g == name && idx < len(m.globals) {
+				v, found = m.globals[idx], true
+				break
+			}
+		}
+	}
+	if !found {
+		return reflect.Value{}, fmt.Errorf("unknown variable: %s", name)
+	}
+	rv := debugValue(v)
+	for path != "" {
+		var field string
+		field, path, _ = strings.Cut(path, ".")
+		for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+			rv = rv.Elem()
+		}
+		if rv.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("%s is not a struct", expr)
+		}
+		if rv = rv.FieldByName(field); !rv.IsValid() {
+			return reflect.Value{}, fmt.Errorf("unknown field: %s", field)
+		}
+	}
+	return rv, nil
+}
+
+// debugValue returns v as a reflect value for display.
+func debugValue(v Value) reflect.Value {
+	if !v.ref.IsValid() {
+		return reflect.Value{}
+	}
+	return reflect.ValueOf(v.Interface())
+}
+
+// formatAny formats a value for display.
+func formatAny(rv reflect.Value) string {
+	if !rv.IsValid() {
+		return "nil"
+	}
+	if rv.Kind() == reflect.String {
+		return strconv.Quote(rv.String())
+	}
+	if rv.CanInterface() {
+		return fmt.Sprintf("%+v", rv.Interface())
+	}
+	return rv.String()
+}
+
+var condRE = regexp.MustCompile(`^([\w.]+)\s*(?:(==|!=|<=|>=|<|>)\s*(.+))?$`)
+
+// parseCond splits a breakpoint condition in its operands and operator.
+func parseCond(cond string) (name, op, lit string, err error) {
+	s := condRE.FindStringSubmatch(strings.TrimSpace(cond))
+	if s == nil {
+		return "", "", "", fmt.Errorf("invalid condition: %s", cond)
+	}
+	return s[1], s[2], strings.TrimSpace(s[3]), nil
+}
+
+// cond evaluates a breakpoint condition in the frame fp.
+func (d *Debugger) cond(m *Machine, ip, fp int, mem []Value, cond string) (bool, error) {
+	name, op, lit, err := parseCond(cond)
+	if err != nil {
+		return false, err
+	}
+	v, err := d.lookup(m, ip, fp, mem, name)
+	if err != nil {
+		return false, err
+	}
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if op == "" {
+		if v.Kind() != reflect.Bool {
+			return false, fmt.Errorf("%s is not a boolean", name)
+		}
+		return v.Bool(), nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		y, err := strconv.ParseInt(lit, 0, 64)
+		return compare(v.Int(), y, op), err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		y, err := strconv.ParseUint(lit, 0, 64)
+		return compare(v.Uint(), y, op), err
+	case reflect.Float32, reflect.Float64:
+		y, err := strconv.ParseFloat(lit, 64)
+		return compare(v.Float(), y, op), err
+	case reflect.String:
+		if s, err := strconv.Unquote(lit); err == nil {
+			lit = s
+		}
+		return compare(v.String(), lit, op), nil
+	case reflect.Bool:
+		y, err := strconv.ParseBool(lit)
+		if op != "==" && op != "!=" {
+			return false, fmt.Errorf("invalid operator for boolean: %s", op)
+		}
+		return (v.Bool() == y) == (op == "=="), err
+	}
+	if op != "==" && op != "!=" {
+		return false, fmt.Errorf("invalid operator for %v: %s", v.Kind(), op)
+	}
+	return (formatAny(v) == lit) == (op == "=="), nil
+}
+
+func compare[T cmp.Ordered](x, y T, op string) bool {
+	c := cmp.Compare(x, y)
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
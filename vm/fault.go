@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// RuntimeError is a run-time fault of the interpreted program, such as an
+// index out of range. It implements the runtime.Error interface and its
+// message is the one produced by Go for the same fault.
+type RuntimeError struct {
+	msg string
+}
+
+func (e *RuntimeError) Error() string { return "runtime error: " + e.msg }
+
+// RuntimeError marks the error as a runtime.Error.
+func (e *RuntimeError) RuntimeError() {}
+
+func runtimeErrorf(format string, args ...any) *RuntimeError {
+	return &RuntimeError{msg: fmt.Sprintf(format, args...)}
+}
+
+var errNilDeref = &RuntimeError{msg: "invalid memory address or nil pointer dereference"}
+
+// errGoNil is raised by a go statement of a nil func value, a fatal error in Go.
+var errGoNil = errors.New("go of nil func value")
+
+// TypeAssertionError is the run-time fault of a failed type assertion. Like
+// its Go counterpart, it implements the runtime.Error interface.
+type TypeAssertionError struct {
+	msg string
+}
+
+func (e *TypeAssertionError) Error() string { return e.msg }
+
+// RuntimeError marks the error as a runtime.Error.
+func (e *TypeAssertionError) RuntimeError() {}
+
+// hostFault returns the interpreted panic value for the host panic r raised
+// while executing instruction c on stack mem[:sp+1]. Go runtime errors are
+// kept as is. Panics from the reflect package, which do not carry Go's
+// messages, are converted to a RuntimeError when the operands show the
+// corresponding fault.
+func hostFault(r any, c Instruction, mem []Value, sp int) any {
+	if sp < 0 || sp >= len(mem) {
+		return r
+	}
+	switch c.Op {
+	case Index, IndexAddr:
+		if e := indexFault(mem[sp-1], mem[sp]); e != nil {
+			return e
+		}
+	case IndexSet:
+		if e := indexFault(mem[sp-2], mem[sp-1]); e != nil {
+			return e
+		}
+	case Slice:
+		if e := sliceFault(mem[sp-2], int(mem[sp-1].num), int(mem[sp].num), -1); e != nil { //nolint:gosec
+			return e
+		}
+	case Slice3:
+		if e := sliceFault(mem[sp-3], int(mem[sp-2].num), int(mem[sp-1].num), int(mem[sp].num)); e != nil { //nolint:gosec
+			return e
+		}
+	case DerefSet, FieldSet, FieldRefSet:
+		if isNilPtr(mem[sp-1]) {
+			return errNilDeref
+		}
+	case Deref, Field:
+		if isNilPtr(mem[sp]) {
+			return errNilDeref
+		}
+	case FieldFset:
+		if isNilPtr(mem[sp-2]) {
+			return errNilDeref
+		}
+	case IfaceCall:
+		if v := mem[sp]; !v.IsIface() && isNilIface(v.Reflect()) {
+			return errNilDeref
+		}
+	}
+	return r
+}
+
+// isNilIface reports whether rv is a nil interface value.
+func isNilIface(rv reflect.Value) bool {
+	return !rv.IsValid() || rv.Kind() == reflect.Interface && rv.IsNil()
+}
+
+// isNilFunc reports whether rv is a nil func value, possibly wrapped in an
+// interface as for the variables of interpreted func types.
+func isNilFunc(rv reflect.Value) bool {
+	rv = unwrapIface(rv)
+	return isNilIface(rv) || rv.Kind() == reflect.Func && rv.IsNil()
+}
+
+func isNilPtr(v Value) bool {
+	return v.ref.Kind() == reflect.Pointer && v.ref.IsNil() || !v.ref.IsValid()
+}
+
+// indexFault returns the runtime error for a[i], or nil if there is none.
+func indexFault(a, i Value) *RuntimeError {
+	if isNilPtr(a) {
+		return errNilDeref
+	}
+	rv := reflect.Indirect(a.ref)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+	default:
+		return nil
+	}
+	if idx, n := int(i.num), rv.Len(); idx < 0 || idx >= n { //nolint:gosec
+		return runtimeErrorf("index out of range [%d] with length %d", idx, n)
+	}
+	return nil
+}
+
+// sliceFault returns the runtime error for a[low:high] (hi < 0) or
+// a[low:high:hi], or nil if there is none.
+func sliceFault(a Value, low, high, hi int) *RuntimeError {
+	if isNilPtr(a) {
+		return errNilDeref
+	}
+	rv := derefArray(a.ref)
+	var n int
+	var what string
+	switch rv.Kind() {
+	case reflect.Slice:
+		n, what = rv.Cap(), "capacity"
+	case reflect.Array, reflect.String:
+		n, what = rv.Len(), "length"
+	default:
+		return nil
+	}
+	if hi >= 0 {
+		switch {
+		case hi > n:
+			return runtimeErrorf("slice bounds out of range [::%d] with %s %d", hi, what, n)
+		case high > hi:
+			return runtimeErrorf("slice bounds out of range [:%d:%d]", high, hi)
+		case low > high:
+			return runtimeErrorf("slice bounds out of range [%d:%d:]", low, high)
+		}
+		return nil
+	}
+	switch {
+	case high > n:
+		return runtimeErrorf("slice bounds out of range [:%d] with %s %d", high, what, n)
+	case low > high:
+		return runtimeErrorf("slice bounds out of range [%d:%d]", low, high)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// lastGoroutineID is the id of the last goroutine started by any machine.
+// The main goroutine of a machine has id 1, like in Go.
+var lastGoroutineID atomic.Int64
+
+func init() { lastGoroutineID.Store(1) }
+
+// errMainReturned is the cancellation cause of the goroutines still running
+// when main returns, if the machine exits on return.
+var errMainReturned = errors.New("main goroutine returned")
+
+// group is the state shared by the machines running the goroutines started
+// during a top-level Run. Its context is cancelled with the error of the
+// first goroutine which fails, which stops all the others.
+type group struct {
+	parent context.Context // machine context before the group was created
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup // interpreted goroutines
+}
+
+// SetExitOnReturn sets whether the end of a top-level Run ends the program,
+// as the return of main does in Go: the goroutines started during the Run
+// are then cancelled, and Run returns once the interpreted ones have
+// stopped. By default, they keep running after Run returns, which suits a
+// REPL or an embedding program calling Run several times.
+func (m *Machine) SetExitOnReturn(on bool) { m.exitOnReturn = on }
+
+// goroutineGroup returns the group of m, creating it if needed. The machine
+// context is then replaced by the group one, until the end of the Run which
+// created the group.
+func (m *Machine) goroutineGroup() *group {
+	if m.group == nil {
+		parent := m.ctx
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithCancelCause(parent)
+		m.group = &group{parent: m.ctx, ctx: ctx, cancel: cancel}
+		m.ctx = ctx
+	}
+	return m.group
+}
+
+// endGroup drops the group created during the current top-level Run. If
+// the machine exits on return, the goroutines of the group are stopped first.
+func (m *Machine) endGroup() {
+	if m.exitOnReturn {
+		m.group.cancel(errMainReturned)
+		m.group.wg.Wait()
+	}
+	m.ctx = m.group.parent
+	m.group = nil
+}
+
+// groupErr returns the error of a failed goroutine of the group, if any.
+func (m *Machine) groupErr() error {
+	if m.group == nil || m.group.ctx.Err() == nil {
+		return nil
+	}
+	if err := context.Cause(m.group.ctx); !isContextErr(err) {
+		return err
+	}
+	return nil
+}
+
+// nativeResult holds the results of a native call run by callNative.
+type nativeResult struct {
+	out []reflect.Value
+	p   any // recovered panic value
+}
+
+// callNative calls the native function rv in a separate goroutine, so that a
+// call blocking forever (e.g. sync.WaitGroup.Wait) can be abandoned once done
+// is closed, in which case ok is false. An abandoned call keeps its goroutine
+// until it returns, then undo, if not nil, reverts its effect, e.g. releases
+// a lock acquired too late. A panic in the call is propagated to the caller.
+// It is only used for the natives known to block, as other calls run faster,
+// and on the calling goroutine, when called directly.
+func callNative(rv reflect.Value, in []reflect.Value, spread bool, done <-chan struct{}, undo func()) (out []reflect.Value, ok bool) {
+	res := make(chan nativeResult, 1)
+	go func() {
+		var r nativeResult
+		defer func() {
+			r.p = recover()
+			res <- r
+		}()
+		if spread {
+			r.out = rv.CallSlice(in)
+		} else {
+			r.out = rv.Call(in)
+		}
+	}()
+	select {
+	case r := <-res:
+		if r.p != nil {
+			panic(r.p)
+		}
+		return r.out, true
+	case <-done:
+		if undo != nil {
+			go func() {
+				if r := <-res; r.p == nil {
+					undo()
+				}
+			}()
+		}
+		return nil, false
+	}
+}
+
+// blockingMethods are the methods of native types known to block until
+// another goroutine acts, by receiver type, with the function reverting
+// their effect on the receiver if they return once abandoned, or nil.
+var blockingMethods = map[reflect.Type]map[string]func(recv reflect.Value){
+	reflect.TypeFor[*sync.WaitGroup](): {"Wait": nil},
+	reflect.TypeFor[*sync.Mutex]():     {"Lock": func(r reflect.Value) { r.Interface().(*sync.Mutex).Unlock() }},
+	reflect.TypeFor[*sync.RWMutex](): {
+		"Lock":  func(r reflect.Value) { r.Interface().(*sync.RWMutex).Unlock() },
+		"RLock": func(r reflect.Value) { r.Interface().(*sync.RWMutex).RUnlock() },
+	},
+	reflect.TypeFor[*sync.Cond](): {"Wait": func(r reflect.Value) { r.Interface().(*sync.Cond).L.Unlock() }},
+}
+
+// interruptible returns fn, the method name of recv, made to be abandoned
+// with callNative once the machine context is done if it is known to block.
+// A lock acquired by an abandoned call is released, so that it is not held
+// forever by a machine which has stopped.
+func (m *Machine) interruptible(recv reflect.Value, name string, fn reflect.Value) reflect.Value {
+	if !fn.IsValid() || !recv.IsValid() {
+		return fn
+	}
+	t := recv.Type()
+	if t.Kind() != reflect.Pointer {
+		t = reflect.PointerTo(t)
+	}
+	revert, ok := blockingMethods[t][name]
+	if !ok {
+		return fn
+	}
+	var undo func()
+	switch {
+	case revert == nil:
+	case recv.Kind() == reflect.Pointer:
+		undo = func() { revert(recv) }
+	case recv.CanAddr():
+		p := recv.Addr()
+		undo = func() { revert(p) }
+	}
+	return reflect.MakeFunc(fn.Type(), func(in []reflect.Value) []reflect.Value {
+		done := ctxDone(m.ctx)
+		if done == nil {
+			return fn.Call(in)
+		}
+		out, ok := callNative(fn, in, false, done, undo)
+		if !ok {
+			// Stops the calling machine, with the context cause.
+			panic(m.ctx.Err())
+		}
+		return out
+	})
+}
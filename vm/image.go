@@ -0,0 +1,1022 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"unsafe"
+)
+
+// Bytecode image format: imageMagic, the version, the table of reflect
+// types, the number of parscan types, then the image content and the
+// parscan types. Numbers are varints, and types are referred to by index.
+const (
+	imageMagic   = "parscan\x00"
+	imageVersion = 5
+)
+
+// Image is a compiled program, with all a machine needs to run it without
+// the compiler.
+type Image struct {
+	Code        Code
+	Data        []Value
+	Natives     []NativeSym // native package symbols in Data, resolved when loaded
+	MethodNames []string
+	Start       []int // data indexes of the init functions and main, called in order
+	Entry       int   // code address of the top-level code, or -1
+	Debug       *DebugInfo
+}
+
+// NativeSym is a native package symbol, at Index in the data of an image.
+type NativeSym struct {
+	Index     int
+	Pkg, Name string
+}
+
+var (
+	valueRtype = reflect.TypeFor[Value]()
+	typeRtype  = reflect.TypeFor[*Type]()
+)
+
+// imageTypes are the named types which are not resolved in packages: the
+// predeclared ones and those of the vm, by typeKey.
+var imageTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, t := range []reflect.Type{
+		reflect.TypeFor[bool](), reflect.TypeFor[string](), reflect.TypeFor[error](),
+		reflect.TypeFor[int](), reflect.TypeFor[int8](), reflect.TypeFor[int16](), reflect.TypeFor[int32](), reflect.TypeFor[int64](),
+		reflect.TypeFor[uint](), reflect.TypeFor[uint8](), reflect.TypeFor[uint16](), reflect.TypeFor[uint32](), reflect.TypeFor[uint64](),
+		reflect.TypeFor[uintptr](), reflect.TypeFor[float32](), reflect.TypeFor[float64](),
+		reflect.TypeFor[complex64](), reflect.TypeFor[complex128](), reflect.TypeFor[unsafe.Pointer](),
+		valueRtype, typeRtype.Elem(), ifaceRtype, reflect.TypeFor[Closure](), reflect.TypeFor[ParscanFunc](),
+		reflect.TypeFor[SelectMeta](), reflect.TypeFor[SelectCaseInfo](), reflect.TypeFor[Method](),
+		reflect.TypeFor[EmbeddedField](), reflect.TypeFor[IfaceMethod](), reflect.TypeFor[TypeElem](),
+		reflect.TypeFor[StackState](),
+	} {
+		imageTypes[typeKey(t.PkgPath(), t.Name())] = t
+	}
+}
+
+func typeKey(pkgPath, name string) string {
+	if pkgPath == "" {
+		return name
+	}
+	return pkgPath + "." + name
+}
+
+// imageBuf is an image encoding buffer.
+type imageBuf []byte
+
+func (b *imageBuf) uint(x uint64) { *b = binary.AppendUvarint(*b, x) }
+func (b *imageBuf) int(x int64)   { *b = binary.AppendVarint(*b, x) }
+func (b *imageBuf) len(n int)     { b.uint(uint64(n)) } //nolint:gosec
+func (b *imageBuf) str(s string)  { b.len(len(s)); *b = append(*b, s...) }
+
+func (b *imageBuf) bool(x bool) {
+	if x {
+		b.uint(1)
+	} else {
+		b.uint(0)
+	}
+}
+
+// seq encodes the length of a sequence, 0 if nil or n+1, then calls f for
+// each of its elements.
+func (b *imageBuf) seq(isNil bool, n int, f func(int)) {
+	if isNil {
+		b.uint(0)
+		return
+	}
+	b.len(n + 1)
+	for i := range n {
+		f(i)
+	}
+}
+
+func (b *imageBuf) ints(xs []int) { b.seq(xs == nil, len(xs), func(i int) { b.int(int64(xs[i])) }) }
+
+// imageEncoder encodes an image.
+type imageEncoder struct {
+	body    imageBuf
+	rtypes  imageBuf // table of reflect types, children first
+	nrtypes int      // number of entries in rtypes
+	rids    map[reflect.Type]int
+	open    map[reflect.Type]bool // struct types being encoded
+	vids    map[*Type]int
+	vtypes  []*Type              // parscan types, in order of index
+	globals map[reflect.Type]int // struct types of parscan types in globals, by index (snapshots)
+	prefix  string               // of error messages
+	err     error
+}
+
+// Encode writes the image to w in the bytecode image format. Native
+// symbols are written by package path and name, and must not be referred to
+// elsewhere in data.
+func (img *Image) Encode(w io.Writer) error {
+	e := newImageEncoder("image")
+	natives := map[int]bool{}
+	for _, n := range img.Natives {
+		natives[n.Index] = true
+	}
+	b := &e.body
+	b.len(len(img.Data))
+	for i, v := range img.Data {
+		if natives[i] {
+			b.uint(0)
+			continue
+		}
+		e.value(v)
+	}
+	b.len(len(img.Natives))
+	for _, n := range img.Natives {
+		b.len(n.Index)
+		b.str(n.Pkg)
+		b.str(n.Name)
+	}
+	b.len(len(img.Code))
+	for _, in := range img.Code {
+		b.uint(uint64(in.Op)) //nolint:gosec
+		b.int(int64(in.A))
+		b.int(int64(in.B))
+		b.int(int64(in.Pos))
+	}
+	b.len(len(img.MethodNames))
+	for _, name := range img.MethodNames {
+		b.str(name)
+	}
+	b.ints(img.Start)
+	b.int(int64(img.Entry))
+	b.bool(img.Debug != nil)
+	if img.Debug != nil {
+		e.debugInfo(img.Debug)
+	}
+	// Parscan types, possibly referring to new ones.
+	var nodes imageBuf
+	for i := 0; i < len(e.vtypes); i++ {
+		e.typeNode(&nodes, e.vtypes[i])
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	var head imageBuf
+	head = append(head, imageMagic...)
+	head.uint(imageVersion)
+	head.len(e.nrtypes)
+	bw := bufio.NewWriter(w)
+	for _, p := range [][]byte{head, e.rtypes, binary.AppendUvarint(nil, uint64(len(e.vtypes))), e.body, nodes} {
+		if _, err := bw.Write(p); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func newImageEncoder(prefix string) *imageEncoder {
+	return &imageEncoder{rids: map[reflect.Type]int{}, open: map[reflect.Type]bool{}, vids: map[*Type]int{}, prefix: prefix + ": "}
+}
+
+func (e *imageEncoder) fail(format string, a ...any) {
+	if e.err == nil {
+		e.err = fmt.Errorf(e.prefix+format, a...)
+	}
+}
+
+// Entries of the table of reflect types.
+const (
+	rtypeUnnamed = iota // a type made of previous ones
+	rtypeNamed          // a named type, by package path and name
+	rtypeForward        // a recursive struct type, defined by a later rtypeFields
+	rtypeFields         // the fields of a previous rtypeForward
+	rtypeGlobal         // the type of a parscan type in globals, by index
+)
+
+// rtype returns the index of reflect type t, adding it to the table after
+// the types it is made of. A struct type referring to itself is added
+// first as a forward declaration, then completed.
+func (e *imageEncoder) rtype(t reflect.Type) int {
+	if id, ok := e.rids[t]; ok {
+		return id
+	}
+	var b imageBuf
+	if k, ok := e.globals[t]; ok {
+		b.uint(rtypeGlobal)
+		b.len(k)
+		return e.addRtype(t, b)
+	}
+	if t.Name() != "" {
+		b.uint(rtypeNamed)
+		b.str(t.PkgPath())
+		b.str(t.Name())
+		return e.addRtype(t, b)
+	}
+	if e.open[t] {
+		// Recursive struct type.
+		b.uint(rtypeForward)
+		return e.addRtype(t, b)
+	}
+	b.uint(rtypeUnnamed)
+	b.uint(uint64(t.Kind()))
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice:
+		b.len(e.rtype(t.Elem()))
+	case reflect.Array:
+		b.len(t.Len())
+		b.len(e.rtype(t.Elem()))
+	case reflect.Chan:
+		b.uint(uint64(t.ChanDir())) //nolint:gosec
+		b.len(e.rtype(t.Elem()))
+	case reflect.Map:
+		b.len(e.rtype(t.Key()))
+		b.len(e.rtype(t.Elem()))
+	case reflect.Func:
+		b.len(t.NumIn())
+		for i := range t.NumIn() {
+			b.len(e.rtype(t.In(i)))
+		}
+		b.len(t.NumOut())
+		for i := range t.NumOut() {
+			b.len(e.rtype(t.Out(i)))
+		}
+		b.bool(t.IsVariadic())
+	case reflect.Struct:
+		e.open[t] = true
+		var fields imageBuf
+		e.structFields(&fields, t)
+		delete(e.open, t)
+		if id, ok := e.rids[t]; ok {
+			// Forward declared while encoding the fields.
+			e.rtypes.uint(rtypeFields)
+			e.rtypes.len(id)
+			e.rtypes = append(e.rtypes, fields...)
+			e.nrtypes++
+			return id
+		}
+		b = append(b, fields...)
+	case reflect.Interface:
+		if t.NumMethod() > 0 {
+			e.fail("cannot encode type %v", t)
+		}
+	default:
+		e.fail("cannot encode type %v", t)
+	}
+	return e.addRtype(t, b)
+}
+
+func (e *imageEncoder) structFields(b *imageBuf, t reflect.Type) {
+	b.len(t.NumField())
+	for i := range t.NumField() {
+		f := t.Field(i)
+		b.str(f.Name)
+		b.str(f.PkgPath)
+		b.str(string(f.Tag))
+		b.bool(f.Anonymous)
+		b.len(e.rtype(f.Type))
+	}
+}
+
+// addRtype adds type t, of table entry b, unless already added while
+// encoding its children in a recursive type.
+func (e *imageEncoder) addRtype(t reflect.Type, b imageBuf) int {
+	if id, ok := e.rids[t]; ok {
+		return id
+	}
+	id := len(e.rids)
+	e.rids[t] = id
+	e.rtypes = append(e.rtypes, b...)
+	e.nrtypes++
+	return id
+}
+
+// typeRef encodes a reference to parscan type t.
+func (e *imageEncoder) typeRef(b *imageBuf, t *Type) {
+	if t == nil {
+		b.uint(0)
+		return
+	}
+	id, ok := e.vids[t]
+	if !ok {
+		id = len(e.vtypes)
+		e.vids[t] = id
+		e.vtypes = append(e.vtypes, t)
+	}
+	b.len(id + 1)
+}
+
+func (e *imageEncoder) rtypeRef(b *imageBuf, t reflect.Type) {
+	if t == nil {
+		b.uint(0)
+		return
+	}
+	b.len(e.rtype(t) + 1)
+}
+
+func (e *imageEncoder) typeRefs(b *imageBuf, ts []*Type) {
+	b.seq(ts == nil, len(ts), func(i int) { e.typeRef(b, ts[i]) })
+}
+
+// typeNode encodes the content of parscan type t.
+func (e *imageEncoder) typeNode(b *imageBuf, t *Type) {
+	b.str(t.PkgPath)
+	b.str(t.Name)
+	e.rtypeRef(b, t.Rtype)
+	b.bool(t.Placeholder)
+	b.seq(t.IfaceMethods == nil, len(t.IfaceMethods), func(i int) {
+		m := t.IfaceMethods[i]
+		b.str(m.Name)
+		b.int(int64(m.ID))
+		e.rtypeRef(b, m.Rtype)
+	})
+	b.seq(t.TypeElems == nil, len(t.TypeElems), func(i int) {
+		b.bool(t.TypeElems[i].Approx)
+		e.typeRef(b, t.TypeElems[i].Type)
+	})
+	b.seq(t.Methods == nil, len(t.Methods), func(i int) {
+		m := t.Methods[i]
+		b.int(int64(m.Index))
+		b.ints(m.Path)
+		b.bool(m.EmbedIface)
+		b.bool(m.PtrRecv)
+	})
+	b.seq(t.Embedded == nil, len(t.Embedded), func(i int) {
+		b.len(t.Embedded[i].FieldIdx)
+		e.typeRef(b, t.Embedded[i].Type)
+	})
+	e.typeRefs(b, t.Params)
+	e.typeRefs(b, t.Returns)
+	e.typeRefs(b, t.Fields)
+	e.typeRef(b, t.ElemType)
+	e.typeRef(b, t.KeyType)
+	e.typeRef(b, t.Base)
+}
+
+// value encodes v: its flags (valid, addressable), its type, its inline
+// number and its content if held by reference.
+func (e *imageEncoder) value(v Value) {
+	b := &e.body
+	if !v.ref.IsValid() {
+		b.uint(0)
+		return
+	}
+	addr := v.ref.CanAddr()
+	if addr {
+		b.uint(3)
+	} else {
+		b.uint(1)
+	}
+	b.len(e.rtype(v.ref.Type()))
+	b.uint(v.num)
+	if addr || !isNum(v.ref.Kind()) {
+		e.content(v.ref)
+	}
+}
+
+// content encodes the content of rv, which must not be read-only.
+func (e *imageEncoder) content(rv reflect.Value) {
+	b := &e.body
+	t := rv.Type()
+	if !rv.CanAddr() {
+		c := reflect.New(t).Elem()
+		c.Set(rv)
+		rv = c
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		b.bool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b.int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b.uint(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		b.uint(math.Float64bits(rv.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		b.uint(math.Float64bits(real(rv.Complex())))
+		b.uint(math.Float64bits(imag(rv.Complex())))
+	case reflect.String:
+		b.str(rv.String())
+	case reflect.Pointer:
+		switch {
+		case rv.IsNil():
+			b.uint(0)
+		case t == typeRtype:
+			e.typeRef(b, rv.Interface().(*Type))
+		default:
+			b.uint(1)
+			e.content(rv.Elem())
+		}
+	case reflect.Slice:
+		b.seq(rv.IsNil(), rv.Len(), func(i int) { e.content(rv.Index(i)) })
+	case reflect.Array:
+		for i := range rv.Len() {
+			e.content(rv.Index(i))
+		}
+	case reflect.Map:
+		b.seq(rv.IsNil(), rv.Len(), func(int) {})
+		for k, v := range rv.Seq2() {
+			e.content(k)
+			e.content(v)
+		}
+	case reflect.Struct:
+		if t == valueRtype {
+			e.value(*(*Value)(unsafe.Pointer(rv.UnsafeAddr())))
+			return
+		}
+		for i := range rv.NumField() {
+			f := rv.Field(i)
+			e.content(reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem())
+		}
+	case reflect.Interface:
+		if rv.IsNil() {
+			b.uint(0)
+			return
+		}
+		b.len(e.rtype(rv.Elem().Type()) + 1)
+		e.content(rv.Elem())
+	default:
+		// Functions, channels and unsafe pointers can only be nil.
+		if !rv.IsNil() {
+			e.fail("cannot encode value of type %v", t)
+		}
+		b.uint(0)
+	}
+}
+
+func (e *imageEncoder) debugInfo(di *DebugInfo) {
+	b := &e.body
+	b.len(len(di.Sources))
+	for i := range di.Sources {
+		b.str(di.Sources[i].Name)
+		b.str(di.Sources[i].Text())
+	}
+	intMap := func(m map[int]string) {
+		b.len(len(m))
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			b.int(int64(k))
+			b.str(m[k])
+		}
+	}
+	intMap(di.Labels)
+	intMap(di.Globals)
+	b.len(len(di.Locals))
+	for _, fn := range slices.Sorted(maps.Keys(di.Locals)) {
+		b.str(fn)
+		b.len(len(di.Locals[fn]))
+		for _, lv := range di.Locals[fn] {
+			b.int(int64(lv.Offset))
+			b.str(lv.Name)
+		}
+	}
+	b.len(len(di.Ends))
+	for _, k := range slices.Sorted(maps.Keys(di.Ends)) {
+		b.int(int64(k))
+		b.int(int64(di.Ends[k]))
+	}
+	b.len(len(di.Inlined))
+	for _, c := range di.Inlined {
+		b.int(int64(c.Start))
+		b.int(int64(c.End))
+		b.str(c.Func)
+		b.int(int64(c.Pos))
+	}
+}
+
+// imageDecoder decodes an image held in memory, which bounds the lengths
+// it reads.
+type imageDecoder struct {
+	buf     []byte
+	pkgs    map[string]map[string]Value
+	rtypes  []reflect.Type
+	vtypes  []*Type
+	named   map[string]reflect.Type // named types reachable from pkgs, built on demand
+	prefix  string                  // of error messages
+	globals []Value                 // of the machine, for rtypeGlobal (snapshots)
+	err     error
+}
+
+// DecodeImage reads an image in the bytecode image format from r. Native
+// symbols and named types are resolved in pkgs, the values of packages by
+// import path.
+func DecodeImage(r io.Reader, pkgs map[string]map[string]Value) (img *Image, err error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rest, ok := bytes.CutPrefix(buf, []byte(imageMagic))
+	if !ok {
+		return nil, errors.New("image: invalid format")
+	}
+	d := &imageDecoder{buf: rest, pkgs: pkgs, prefix: "image: "}
+	if v := d.uint(); v != imageVersion {
+		return nil, fmt.Errorf("image: unsupported version %d", v)
+	}
+	defer func() {
+		// Inconsistent content makes reflect panic.
+		if r := recover(); r != nil {
+			img, err = nil, fmt.Errorf("image: invalid content: %v", r)
+		}
+	}()
+
+	for range d.len() {
+		d.rtype()
+	}
+	d.vtypes = make([]*Type, d.len())
+	for i := range d.vtypes {
+		d.vtypes[i] = &Type{}
+	}
+	img = &Image{}
+	img.Data = make([]Value, d.len())
+	for i := range img.Data {
+		img.Data[i] = d.value()
+	}
+	img.Natives = make([]NativeSym, d.len())
+	for i := range img.Natives {
+		n := NativeSym{Index: d.index(), Pkg: d.str(), Name: d.str()}
+		v, ok := pkgs[n.Pkg][n.Name]
+		if d.err != nil {
+			break
+		}
+		if !ok {
+			return nil, fmt.Errorf("image: symbol not found: %s.%s", n.Pkg, n.Name)
+		}
+		if n.Index >= len(img.Data) {
+			return nil, fmt.Errorf("image: invalid symbol index %d", n.Index)
+		}
+		img.Data[n.Index] = v
+		img.Natives[i] = n
+	}
+	img.Code = make(Code, d.len())
+	for i := range img.Code {
+		img.Code[i] = Instruction{Op: Op(d.uint()), A: int32(d.int()), B: int32(d.int()), Pos: Pos(d.int())} //nolint:gosec
+	}
+	img.MethodNames = make([]string, d.len())
+	for i := range img.MethodNames {
+		img.MethodNames[i] = d.str()
+	}
+	img.Start = d.ints()
+	for _, i := range img.Start {
+		if i < 0 || i >= len(img.Data) || img.Data[i].Kind() != reflect.Int {
+			d.fail("invalid start function %d", i)
+		}
+	}
+	img.Entry = int(d.int())
+	if d.bool() {
+		img.Debug = d.debugInfo()
+	}
+	for _, t := range d.vtypes {
+		d.typeNode(t)
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail("trailing data")
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return img, nil
+}
+
+func (d *imageDecoder) fail(format string, a ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf(d.prefix+format, a...)
+	}
+}
+
+func (d *imageDecoder) uint() uint64 {
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail("truncated or invalid data")
+		d.buf = nil
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *imageDecoder) int() int64 {
+	x, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail("truncated or invalid data")
+		d.buf = nil
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+// len returns a length or an index. As each element takes at least a byte,
+// it cannot exceed the remaining data.
+func (d *imageDecoder) len() int {
+	n := d.uint()
+	if n > uint64(len(d.buf))+1 {
+		d.fail("invalid length %d", n)
+		d.buf = nil
+		return 0
+	}
+	return int(n)
+}
+
+// index returns an index or an array length, to be checked by the caller.
+func (d *imageDecoder) index() int {
+	n := d.uint()
+	if n > math.MaxInt32 {
+		d.fail("invalid index %d", n)
+		return 0
+	}
+	return int(n)
+}
+
+// nilIndex returns an index encoded after nil as 0, or -1 for nil.
+func (d *imageDecoder) nilIndex() int { return d.index() - 1 }
+
+// nilLen returns a length encoded by imageBuf.seq, or -1 for nil.
+func (d *imageDecoder) nilLen() int { return d.len() - 1 }
+
+func (d *imageDecoder) bool() bool { return d.uint() != 0 }
+
+func (d *imageDecoder) str() string {
+	n := d.len()
+	if n > len(d.buf) {
+		d.fail("truncated data")
+		d.buf = nil
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *imageDecoder) ints() []int {
+	n := d.nilLen()
+	if n < 0 {
+		return nil
+	}
+	xs := make([]int, n)
+	for i := range xs {
+		xs[i] = int(d.int())
+	}
+	return xs
+}
+
+func (d *imageDecoder) rtypeAt(i int) reflect.Type {
+	if i < 0 || i >= len(d.rtypes) {
+		panic(fmt.Sprintf("invalid type index %d", i))
+	}
+	return d.rtypes[i]
+}
+
+func (d *imageDecoder) rtypeRef() reflect.Type {
+	if i := d.nilIndex(); i >= 0 {
+		return d.rtypeAt(i)
+	}
+	return nil
+}
+
+func (d *imageDecoder) typeRef() *Type {
+	i := d.nilIndex()
+	if i < 0 {
+		return nil
+	}
+	if i >= len(d.vtypes) {
+		panic(fmt.Sprintf("invalid parscan type index %d", i))
+	}
+	return d.vtypes[i]
+}
+
+func (d *imageDecoder) typeRefs() []*Type {
+	n := d.nilLen()
+	if n < 0 {
+		return nil
+	}
+	ts := make([]*Type, n)
+	for i := range ts {
+		ts[i] = d.typeRef()
+	}
+	return ts
+}
+
+// rtype decodes an entry of the table of reflect types.
+func (d *imageDecoder) rtype() {
+	switch d.uint() {
+	case rtypeUnnamed:
+		d.rtypes = append(d.rtypes, d.unnamedType())
+	case rtypeNamed:
+		d.rtypes = append(d.rtypes, d.namedType(d.str(), d.str()))
+	case rtypeForward:
+		d.rtypes = append(d.rtypes, NewStructType().Rtype)
+	case rtypeFields:
+		t := d.rtypeAt(d.index())
+		if t.Kind() != reflect.Struct || t.NumField() != 1 {
+			panic("invalid forward type")
+		}
+		patchRtype(t, d.structType())
+	case rtypeGlobal:
+		k := d.index()
+		if k >= len(d.globals) || !d.globals[k].IsValid() || d.globals[k].ref.Type() != typeRtype {
+			panic(fmt.Sprintf("invalid global type %d", k))
+		}
+		d.rtypes = append(d.rtypes, d.globals[k].ref.Interface().(*Type).Rtype)
+	default:
+		d.fail("invalid type entry")
+	}
+}
+
+func (d *imageDecoder) unnamedType() reflect.Type {
+	switch k := reflect.Kind(d.uint()); k { //nolint:gosec
+	case reflect.Pointer:
+		return reflect.PointerTo(d.rtypeAt(d.index()))
+	case reflect.Slice:
+		return reflect.SliceOf(d.rtypeAt(d.index()))
+	case reflect.Array:
+		n := d.index()
+		return reflect.ArrayOf(n, d.rtypeAt(d.index()))
+	case reflect.Chan:
+		dir := reflect.ChanDir(d.uint()) //nolint:gosec
+		return reflect.ChanOf(dir, d.rtypeAt(d.index()))
+	case reflect.Map:
+		k := d.rtypeAt(d.index())
+		return reflect.MapOf(k, d.rtypeAt(d.index()))
+	case reflect.Func:
+		in := make([]reflect.Type, d.len())
+		for i := range in {
+			in[i] = d.rtypeAt(d.index())
+		}
+		out := make([]reflect.Type, d.len())
+		for i := range out {
+			out[i] = d.rtypeAt(d.index())
+		}
+		return reflect.FuncOf(in, out, d.bool())
+	case reflect.Struct:
+		return d.structType()
+	case reflect.Interface:
+		return AnyRtype
+	default:
+		if d.err == nil {
+			d.fail("invalid type kind %v", k)
+		}
+		return AnyRtype
+	}
+}
+
+func (d *imageDecoder) structType() reflect.Type {
+	fields := make([]reflect.StructField, d.len())
+	for i := range fields {
+		fields[i] = reflect.StructField{Name: d.str(), PkgPath: d.str(), Tag: reflect.StructTag(d.str()), Anonymous: d.bool()}
+		fields[i].Type = d.rtypeAt(d.index())
+	}
+	return reflect.StructOf(fields)
+}
+
+// namedType returns the named type pkgPath.name, predeclared, of the vm, or
+// found in the packages.
+func (d *imageDecoder) namedType(pkgPath, name string) reflect.Type {
+	if d.err != nil {
+		return AnyRtype
+	}
+	if t, ok := imageTypes[typeKey(pkgPath, name)]; ok {
+		return t
+	}
+	for _, v := range d.pkgs[pkgPath] {
+		if t, ok := v.UnwrapType(); ok && t.Name() == name && t.PkgPath() == pkgPath {
+			return t
+		}
+	}
+	if d.named == nil {
+		// Search the types reachable from the package values.
+		d.named = map[string]reflect.Type{}
+		seen := map[reflect.Type]bool{}
+		for _, pkg := range d.pkgs {
+			for _, v := range pkg {
+				if v.IsValid() {
+					d.addNamed(v.ref.Type(), seen)
+				}
+			}
+		}
+	}
+	if t, ok := d.named[typeKey(pkgPath, name)]; ok {
+		return t
+	}
+	d.fail("type not found: %s", typeKey(pkgPath, name))
+	return AnyRtype
+}
+
+func (d *imageDecoder) addNamed(t reflect.Type, seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	if t.Name() != "" {
+		d.named[typeKey(t.PkgPath(), t.Name())] = t
+	}
+	for i := range t.NumMethod() {
+		d.addNamed(t.Method(i).Type, seen)
+	}
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Chan:
+		d.addNamed(t.Elem(), seen)
+	case reflect.Map:
+		d.addNamed(t.Key(), seen)
+		d.addNamed(t.Elem(), seen)
+	case reflect.Func:
+		for i := range t.NumIn() {
+			d.addNamed(t.In(i), seen)
+		}
+		for i := range t.NumOut() {
+			d.addNamed(t.Out(i), seen)
+		}
+	case reflect.Struct:
+		for i := range t.NumField() {
+			d.addNamed(t.Field(i).Type, seen)
+		}
+	}
+}
+
+func (d *imageDecoder) typeNode(t *Type) {
+	t.PkgPath = d.str()
+	t.Name = d.str()
+	t.Rtype = d.rtypeRef()
+	t.Placeholder = d.bool()
+	if n := d.nilLen(); n >= 0 {
+		t.IfaceMethods = make([]IfaceMethod, n)
+		for i := range n {
+			t.IfaceMethods[i] = IfaceMethod{Name: d.str(), ID: int(d.int()), Rtype: d.rtypeRef()}
+		}
+	}
+	if n := d.nilLen(); n >= 0 {
+		t.TypeElems = make([]TypeElem, n)
+		for i := range n {
+			t.TypeElems[i] = TypeElem{Approx: d.bool(), Type: d.typeRef()}
+		}
+	}
+	if n := d.nilLen(); n >= 0 {
+		t.Methods = make([]Method, n)
+		for i := range n {
+			t.Methods[i] = Method{Index: int(d.int()), Path: d.ints(), EmbedIface: d.bool(), PtrRecv: d.bool()}
+		}
+	}
+	if n := d.nilLen(); n >= 0 {
+		t.Embedded = make([]EmbeddedField, n)
+		for i := range n {
+			t.Embedded[i] = EmbeddedField{FieldIdx: d.index(), Type: d.typeRef()}
+		}
+	}
+	t.Params = d.typeRefs()
+	t.Returns = d.typeRefs()
+	t.Fields = d.typeRefs()
+	t.ElemType = d.typeRef()
+	t.KeyType = d.typeRef()
+	t.Base = d.typeRef()
+}
+
+// value decodes a value encoded by imageEncoder.value.
+func (d *imageDecoder) value() Value {
+	flags := d.uint()
+	if flags == 0 || d.err != nil {
+		return Value{}
+	}
+	t := d.rtypeAt(d.index())
+	num := d.uint()
+	if flags&2 == 0 && isNum(t.Kind()) {
+		return Value{num: num, ref: reflect.Zero(t)}
+	}
+	rv := reflect.New(t).Elem()
+	d.content(rv)
+	if flags&2 == 0 {
+		rv = rv.Convert(t) // not addressable
+	}
+	return Value{num: num, ref: rv}
+}
+
+// content decodes the content of rv, which must be addressable.
+func (d *imageDecoder) content(rv reflect.Value) {
+	if d.err != nil {
+		return
+	}
+	t := rv.Type()
+	switch t.Kind() {
+	case reflect.Bool:
+		rv.SetBool(d.bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		rv.SetInt(d.int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		rv.SetUint(d.uint())
+	case reflect.Float32, reflect.Float64:
+		rv.SetFloat(math.Float64frombits(d.uint()))
+	case reflect.Complex64, reflect.Complex128:
+		re := math.Float64frombits(d.uint())
+		rv.SetComplex(complex(re, math.Float64frombits(d.uint())))
+	case reflect.String:
+		rv.SetString(d.str())
+	case reflect.Pointer:
+		switch {
+		case t == typeRtype:
+			if vt := d.typeRef(); vt != nil {
+				rv.Set(reflect.ValueOf(vt))
+			}
+		case d.bool():
+			p := reflect.New(t.Elem())
+			d.content(p.Elem())
+			rv.Set(p)
+		}
+	case reflect.Slice:
+		if n := d.nilLen(); n >= 0 {
+			rv.Set(reflect.MakeSlice(t, n, n))
+			for i := range n {
+				d.content(rv.Index(i))
+			}
+		}
+	case reflect.Array:
+		for i := range rv.Len() {
+			d.content(rv.Index(i))
+		}
+	case reflect.Map:
+		n := d.nilLen()
+		if n < 0 {
+			return
+		}
+		rv.Set(reflect.MakeMapWithSize(t, n))
+		for range n {
+			k := reflect.New(t.Key()).Elem()
+			d.content(k)
+			v := reflect.New(t.Elem()).Elem()
+			d.content(v)
+			rv.SetMapIndex(k, v)
+		}
+	case reflect.Struct:
+		if t == valueRtype {
+			*(*Value)(unsafe.Pointer(rv.UnsafeAddr())) = d.value()
+			return
+		}
+		for i := range rv.NumField() {
+			f := rv.Field(i)
+			d.content(reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem())
+		}
+	case reflect.Interface:
+		if i := d.nilIndex(); i >= 0 {
+			v := reflect.New(d.rtypeAt(i)).Elem()
+			d.content(v)
+			rv.Set(v)
+		}
+	default:
+		if d.uint() != 0 {
+			d.fail("invalid value of type %v", t)
+		}
+	}
+}
+
+func (d *imageDecoder) debugInfo() *DebugInfo {
+	di := NewDebugInfo()
+	for range d.len() {
+		if d.err != nil {
+			return di
+		}
+		name := d.str()
+		di.Sources.Add(name, d.str())
+	}
+	intMap := func(m map[int]string) {
+		for range d.len() {
+			if d.err != nil {
+				return
+			}
+			k := int(d.int())
+			m[k] = d.str()
+		}
+	}
+	intMap(di.Labels)
+	intMap(di.Globals)
+	for range d.len() {
+		if d.err != nil {
+			return di
+		}
+		fn := d.str()
+		lv := make([]LocalVar, d.len())
+		for i := range lv {
+			lv[i].Offset = int(d.int())
+			lv[i].Name = d.str()
+		}
+		di.Locals[fn] = lv
+	}
+	for range d.len() {
+		if d.err != nil {
+			return di
+		}
+		k := int(d.int())
+		di.Ends[k] = int(d.int())
+	}
+	for range d.len() {
+		if d.err != nil {
+			return di
+		}
+		var c InlinedCall
+		c.Start, c.End = int(d.int()), int(d.int())
+		c.Func, c.Pos = d.str(), Pos(d.int()) //nolint:gosec
+		di.Inlined = append(di.Inlined, c)
+	}
+	return di
+}
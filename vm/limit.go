@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// LimitKind identifies a machine resource limit.
+type LimitKind int
+
+// Resource limits enforced by the machine.
+const (
+	LimitInstructions LimitKind = iota // executed instructions
+	LimitStack                         // call stack size, in value slots
+	LimitGoroutines                    // live goroutines
+)
+
+func (k LimitKind) String() string {
+	switch k {
+	case LimitInstructions:
+		return "instruction"
+	case LimitStack:
+		return "stack"
+	case LimitGoroutines:
+		return "goroutine"
+	}
+	return fmt.Sprintf("LimitKind(%d)", int(k))
+}
+
+// Limits sets hard bounds on the resources used by a program. A zero field
+// means no limit. Instructions and goroutines are accounted for the machine
+// and all its goroutines and re-entrant runners together; the stack limit
+// applies to each goroutine stack. Instructions are counted at backward
+// jumps, by the length of the loop, and at calls, which bounds every loop
+// and recursion, but not each instruction of straight-line code.
+type Limits struct {
+	MaxInstructions int64 // total number of executed instructions
+	MaxStack        int   // stack size of a goroutine, in value slots
+	MaxGoroutines   int   // number of simultaneously live goroutines
+}
+
+// LimitError is the error returned when a program exceeds one of its Limits.
+// It is raised as a panic which unwinds the interpreted program but can not
+// be recovered. A limit hit again while unwinding aborts immediately; the
+// deferred calls run while unwinding from the instruction limit are given a
+// small grace budget.
+type LimitError struct {
+	Kind  LimitKind
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v limit exceeded (%d)", e.Kind, e.Limit)
+}
+
+// insnChunk is the number of instructions a machine takes at once from the
+// shared instruction budget, to avoid an atomic operation per instruction.
+const insnChunk = 1 << 12
+
+// limitGrace is the number of instructions given to the deferred calls run
+// while unwinding from the instruction limit, before aborting.
+const limitGrace = insnChunk
+
+// limiter holds the limits and the resource counters shared by a machine,
+// its goroutines and its runners.
+type limiter struct {
+	Limits
+	insns      atomic.Int64 // remaining instruction budget
+	goroutines atomic.Int64 // live goroutines
+}
+
+// SetLimits sets the resource limits of the machine and resets its counters.
+// It must be called before Run, not concurrently with it.
+func (m *Machine) SetLimits(l Limits) {
+	if l == (Limits{}) {
+		m.limits = nil
+		return
+	}
+	m.limits = &limiter{Limits: l}
+	m.limits.insns.Store(l.MaxInstructions)
+}
+
+// take removes up to insnChunk instructions from the shared budget and
+// returns how many were granted, 0 if the budget is exhausted.
+func (l *limiter) take() int64 {
+	for {
+		r := l.insns.Load()
+		if r <= 0 {
+			return 0
+		}
+		n := min(r, insnChunk)
+		if l.insns.CompareAndSwap(r, r-n) {
+			return n
+		}
+	}
+}
+
+// spawn accounts for a new goroutine, or returns a LimitError if too many
+// goroutines are already running.
+func (l *limiter) spawn() *LimitError {
+	if l == nil || l.MaxGoroutines == 0 {
+		return nil
+	}
+	if l.goroutines.Add(1) > int64(l.MaxGoroutines) {
+		l.goroutines.Add(-1)
+		return &LimitError{Kind: LimitGoroutines, Limit: int64(l.MaxGoroutines)}
+	}
+	return nil
+}
+
+// exit accounts for the end of a goroutine started after spawn.
+func (l *limiter) exit() {
+	if l != nil && l.MaxGoroutines != 0 {
+		l.goroutines.Add(-1)
+	}
+}
+
+// limitError returns the LimitError held by v, if any.
+func limitError(v Value) (*LimitError, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	e, ok := v.ref.Interface().(*LimitError)
+	return e, ok
+}
+
+// limitPanic starts unwinding the program with an unrecoverable panic for e.
+// It returns true if a limit panic is already unwinding, in which case the
+// caller must abort.
+func (m *Machine) limitPanic(e *LimitError, ip, fp int, mem []Value) (abort bool) {
+	if _, ok := limitError(m.panicVal); m.panicking && ok {
+		return true
+	}
+	m.startPanic(ValueOf(e), ip, fp, mem)
+	return false
+}
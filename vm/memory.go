@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+)
+
+// MemPageSize is the size in bytes of a linear memory page.
+const MemPageSize = 1 << 16
+
+// MemMaxPages is the maximum number of pages of a linear memory.
+const MemMaxPages = 1 << 16
+
+// Access kinds of Load and Store, in the low 4 bits of their B operand.
+// Values are loaded as int32 (sign-extended in num), int64, float32 or
+// float64. Store only uses the access width.
+const (
+	MemInt32      = iota // 4 bytes to int32
+	MemInt64             // 8 bytes to int64
+	MemFloat32           // 4 bytes to float32
+	MemFloat64           // 8 bytes to float64
+	MemInt8To32          // 1 byte, sign-extended to int32
+	MemUint8To32         // 1 byte, zero-extended to int32
+	MemInt16To32         // 2 bytes, sign-extended to int32
+	MemUint16To32        // 2 bytes, zero-extended to int32
+	MemInt8To64          // 1 byte, sign-extended to int64
+	MemUint8To64         // 1 byte, zero-extended to int64
+	MemInt16To64         // 2 bytes, sign-extended to int64
+	MemUint16To64        // 2 bytes, zero-extended to int64
+	MemInt32To64         // 4 bytes, sign-extended to int64
+	MemUint32To64        // 4 bytes, zero-extended to int64
+)
+
+// memWidth is the number of bytes accessed by each access kind.
+var memWidth = [...]uint64{4, 8, 4, 8, 1, 1, 2, 2, 1, 1, 2, 2, 4, 4}
+
+var errMemBounds = &RuntimeError{msg: "out of bounds memory access"}
+
+// MemOperand returns the B operand of Load and Store for an access of kind
+// at offset from the address, and false if offset is too large.
+func MemOperand(offset uint64, kind int) (int32, bool) {
+	if offset >= 1<<27 || kind < 0 || kind >= len(memWidth) {
+		return 0, false
+	}
+	return int32(offset<<4) | int32(kind), true //nolint:gosec
+}
+
+// memAt returns the bytes of memory accessed at the unsigned 32-bit address
+// addr by the Load or Store operand b, or panics if out of bounds.
+func memAt(mem []byte, addr uint64, b int32) []byte {
+	kind := b & 15
+	ea := uint64(uint32(addr)) + uint64(b>>4) //nolint:gosec
+	if int(kind) >= len(memWidth) || ea+memWidth[kind] > uint64(len(mem)) {
+		panic(errMemBounds)
+	}
+	return mem[ea : ea+memWidth[kind]]
+}
+
+// memLoad returns the value of the access kind b&15 stored in p.
+func memLoad(p []byte, b int32) Value {
+	switch b & 15 {
+	case MemInt32:
+		return Value{num: uint64(int32(binary.LittleEndian.Uint32(p))), ref: zint32} //nolint:gosec
+	case MemInt64:
+		return Value{num: binary.LittleEndian.Uint64(p), ref: zint64}
+	case MemFloat32:
+		return Value{num: putf32(math.Float32frombits(binary.LittleEndian.Uint32(p))), ref: zfloat32}
+	case MemFloat64:
+		return Value{num: binary.LittleEndian.Uint64(p), ref: zfloat64}
+	case MemInt8To32:
+		return Value{num: uint64(int8(p[0])), ref: zint32} //nolint:gosec
+	case MemUint8To32:
+		return Value{num: uint64(p[0]), ref: zint32}
+	case MemInt16To32:
+		return Value{num: uint64(int16(binary.LittleEndian.Uint16(p))), ref: zint32} //nolint:gosec
+	case MemUint16To32:
+		return Value{num: uint64(binary.LittleEndian.Uint16(p)), ref: zint32}
+	case MemInt8To64:
+		return Value{num: uint64(int8(p[0])), ref: zint64} //nolint:gosec
+	case MemUint8To64:
+		return Value{num: uint64(p[0]), ref: zint64}
+	case MemInt16To64:
+		return Value{num: uint64(int16(binary.LittleEndian.Uint16(p))), ref: zint64} //nolint:gosec
+	case MemUint16To64:
+		return Value{num: uint64(binary.LittleEndian.Uint16(p)), ref: zint64}
+	case MemInt32To64:
+		return Value{num: uint64(int32(binary.LittleEndian.Uint32(p))), ref: zint64} //nolint:gosec
+	}
+	return Value{num: uint64(binary.LittleEndian.Uint32(p)), ref: zint64}
+}
+
+// memStore stores v in p, with the access kind b&15.
+func memStore(p []byte, b int32, v Value) {
+	n := v.num
+	if b&15 == MemFloat32 {
+		n = uint64(math.Float32bits(getf32(n)))
+	}
+	switch len(p) {
+	case 1:
+		p[0] = byte(n)
+	case 2:
+		binary.LittleEndian.PutUint16(p, uint16(n)) //nolint:gosec
+	case 4:
+		binary.LittleEndian.PutUint32(p, uint32(n)) //nolint:gosec
+	default:
+		binary.LittleEndian.PutUint64(p, n)
+	}
+}
+
+// memGrow returns the memory mem grown by n pages, with at most maxPages
+// pages, and its previous number of pages, or -1 if it can not grow.
+func memGrow(mem []byte, n uint64, maxPages int) ([]byte, int) {
+	old := len(mem) / MemPageSize
+	if n > MemMaxPages || old+int(n) > maxPages { //nolint:gosec
+		return mem, -1
+	}
+	if n == 0 {
+		return mem, old
+	}
+	grown := make([]byte, len(mem)+int(n)*MemPageSize) //nolint:gosec
+	copy(grown, mem)
+	return grown, old
+}
+
+// bytesOf returns the bytes of the memory value v.
+func bytesOf(v Value) []byte {
+	if v.ref.Kind() != reflect.Slice {
+		return nil
+	}
+	return v.ref.Bytes()
+}
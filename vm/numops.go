@@ -1,6 +1,9 @@
 package vm
 
-import "math"
+import (
+	"math"
+	"reflect"
+)
 
 type integer interface {
 	~int | ~int8 | ~int16 | ~int32 | ~int64 |
@@ -41,3 +44,24 @@ func getf32(n uint64) float32 { return float32(math.Float64frombits(n)) }
 
 // putf32 stores a float32 into a Value's uint64 storage (float64-bits encoding).
 func putf32(f float32) uint64 { return math.Float64bits(float64(f)) }
+
+func cbinop[T ~complex64 | ~complex128](op Op, a, b T) T {
+	switch op {
+	case AddComplex:
+		return a + b
+	case SubComplex:
+		return a - b
+	case MulComplex:
+		return a * b
+	}
+	return a / b
+}
+
+// complexBinop returns the result of the complex operation op on a and b,
+// computed at the precision of a.
+func complexBinop(op Op, a, b reflect.Value) Value {
+	if a.Kind() == reflect.Complex64 {
+		return Value{ref: reflect.ValueOf(cbinop(op, complex64(a.Complex()), complex64(b.Complex())))}
+	}
+	return Value{ref: reflect.ValueOf(cbinop(op, a.Complex(), b.Complex()))}
+}
@@ -78,184 +78,202 @@ func _() {
 	_ = x[Slice3-67]
 	_ = x[Stop-68]
 	_ = x[Swap-69]
-	_ = x[Trap-70]
-	_ = x[TypeAssert-71]
-	_ = x[TypeBranch-72]
-	_ = x[WrapFunc-73]
-	_ = x[GoCall-74]
-	_ = x[GoCallImm-75]
-	_ = x[MkChan-76]
-	_ = x[ChanSend-77]
-	_ = x[ChanRecv-78]
-	_ = x[ChanClose-79]
-	_ = x[SelectExec-80]
-	_ = x[Print-81]
-	_ = x[Println-82]
-	_ = x[Min-83]
-	_ = x[Max-84]
-	_ = x[AddStr-85]
-	_ = x[GreaterStr-86]
-	_ = x[LowerStr-87]
-	_ = x[AddInt-88]
-	_ = x[AddInt8-89]
-	_ = x[AddInt16-90]
-	_ = x[AddInt32-91]
-	_ = x[AddInt64-92]
-	_ = x[AddUint-93]
-	_ = x[AddUint8-94]
-	_ = x[AddUint16-95]
-	_ = x[AddUint32-96]
-	_ = x[AddUint64-97]
-	_ = x[AddFloat32-98]
-	_ = x[AddFloat64-99]
-	_ = x[SubInt-100]
-	_ = x[SubInt8-101]
-	_ = x[SubInt16-102]
-	_ = x[SubInt32-103]
-	_ = x[SubInt64-104]
-	_ = x[SubUint-105]
-	_ = x[SubUint8-106]
-	_ = x[SubUint16-107]
-	_ = x[SubUint32-108]
-	_ = x[SubUint64-109]
-	_ = x[SubFloat32-110]
-	_ = x[SubFloat64-111]
-	_ = x[MulInt-112]
-	_ = x[MulInt8-113]
-	_ = x[MulInt16-114]
-	_ = x[MulInt32-115]
-	_ = x[MulInt64-116]
-	_ = x[MulUint-117]
-	_ = x[MulUint8-118]
-	_ = x[MulUint16-119]
-	_ = x[MulUint32-120]
-	_ = x[MulUint64-121]
-	_ = x[MulFloat32-122]
-	_ = x[MulFloat64-123]
-	_ = x[NegInt-124]
-	_ = x[NegInt8-125]
-	_ = x[NegInt16-126]
-	_ = x[NegInt32-127]
-	_ = x[NegInt64-128]
-	_ = x[NegUint-129]
-	_ = x[NegUint8-130]
-	_ = x[NegUint16-131]
-	_ = x[NegUint32-132]
-	_ = x[NegUint64-133]
-	_ = x[NegFloat32-134]
-	_ = x[NegFloat64-135]
-	_ = x[GreaterInt-136]
-	_ = x[GreaterInt8-137]
-	_ = x[GreaterInt16-138]
-	_ = x[GreaterInt32-139]
-	_ = x[GreaterInt64-140]
-	_ = x[GreaterUint-141]
-	_ = x[GreaterUint8-142]
-	_ = x[GreaterUint16-143]
-	_ = x[GreaterUint32-144]
-	_ = x[GreaterUint64-145]
-	_ = x[GreaterFloat32-146]
-	_ = x[GreaterFloat64-147]
-	_ = x[LowerInt-148]
-	_ = x[LowerInt8-149]
-	_ = x[LowerInt16-150]
-	_ = x[LowerInt32-151]
-	_ = x[LowerInt64-152]
-	_ = x[LowerUint-153]
-	_ = x[LowerUint8-154]
-	_ = x[LowerUint16-155]
-	_ = x[LowerUint32-156]
-	_ = x[LowerUint64-157]
-	_ = x[LowerFloat32-158]
-	_ = x[LowerFloat64-159]
-	_ = x[DivInt-160]
-	_ = x[DivInt8-161]
-	_ = x[DivInt16-162]
-	_ = x[DivInt32-163]
-	_ = x[DivInt64-164]
-	_ = x[DivUint-165]
-	_ = x[DivUint8-166]
-	_ = x[DivUint16-167]
-	_ = x[DivUint32-168]
-	_ = x[DivUint64-169]
-	_ = x[DivFloat32-170]
-	_ = x[DivFloat64-171]
-	_ = x[RemInt-172]
-	_ = x[RemInt8-173]
-	_ = x[RemInt16-174]
-	_ = x[RemInt32-175]
-	_ = x[RemInt64-176]
-	_ = x[RemUint-177]
-	_ = x[RemUint8-178]
-	_ = x[RemUint16-179]
-	_ = x[RemUint32-180]
-	_ = x[RemUint64-181]
-	_ = x[RemFloat32-182]
-	_ = x[RemFloat64-183]
-	_ = x[BitAnd-184]
-	_ = x[BitOr-185]
-	_ = x[BitXor-186]
-	_ = x[BitAndNot-187]
-	_ = x[BitShl-188]
-	_ = x[BitShr-189]
-	_ = x[BitComp-190]
-	_ = x[Clz32-191]
-	_ = x[Clz64-192]
-	_ = x[Ctz32-193]
-	_ = x[Ctz64-194]
-	_ = x[Popcnt32-195]
-	_ = x[Popcnt64-196]
-	_ = x[Rotl32-197]
-	_ = x[Rotl64-198]
-	_ = x[Rotr32-199]
-	_ = x[Rotr64-200]
-	_ = x[AbsFloat32-201]
-	_ = x[AbsFloat64-202]
-	_ = x[SqrtFloat32-203]
-	_ = x[SqrtFloat64-204]
-	_ = x[CeilFloat32-205]
-	_ = x[CeilFloat64-206]
-	_ = x[FloorFloat32-207]
-	_ = x[FloorFloat64-208]
-	_ = x[TruncFloat32-209]
-	_ = x[TruncFloat64-210]
-	_ = x[NearestFloat32-211]
-	_ = x[NearestFloat64-212]
-	_ = x[MinFloat32-213]
-	_ = x[MinFloat64-214]
-	_ = x[MaxFloat32-215]
-	_ = x[MaxFloat64-216]
-	_ = x[CopysignFloat32-217]
-	_ = x[CopysignFloat64-218]
-	_ = x[AddIntImm-219]
-	_ = x[SubIntImm-220]
-	_ = x[MulIntImm-221]
-	_ = x[GreaterIntImm-222]
-	_ = x[GreaterUintImm-223]
-	_ = x[LowerIntImm-224]
-	_ = x[LowerUintImm-225]
-	_ = x[GetGlobal-226]
-	_ = x[GetLocal-227]
-	_ = x[NextLocal-228]
-	_ = x[Next2Local-229]
-	_ = x[GetLocal2-230]
-	_ = x[GetLocalAddIntImm-231]
-	_ = x[GetLocalSubIntImm-232]
-	_ = x[GetLocalMulIntImm-233]
-	_ = x[GetLocalLowerIntImm-234]
-	_ = x[GetLocalLowerUintImm-235]
-	_ = x[GetLocalGreaterIntImm-236]
-	_ = x[GetLocalGreaterUintImm-237]
-	_ = x[GetLocalReturn-238]
-	_ = x[LowerIntImmJumpFalse-239]
-	_ = x[LowerIntImmJumpTrue-240]
-	_ = x[GetLocalLowerIntImmJumpFalse-241]
-	_ = x[GetLocalLowerIntImmJumpTrue-242]
+	_ = x[TailCall-70]
+	_ = x[Trap-71]
+	_ = x[TypeAssert-72]
+	_ = x[TypeBranch-73]
+	_ = x[WrapFunc-74]
+	_ = x[GoCall-75]
+	_ = x[GoCallImm-76]
+	_ = x[MkChan-77]
+	_ = x[ChanSend-78]
+	_ = x[ChanRecv-79]
+	_ = x[ChanClose-80]
+	_ = x[SelectExec-81]
+	_ = x[Print-82]
+	_ = x[Println-83]
+	_ = x[Min-84]
+	_ = x[Max-85]
+	_ = x[AddComplex-86]
+	_ = x[SubComplex-87]
+	_ = x[MulComplex-88]
+	_ = x[DivComplex-89]
+	_ = x[NegComplex-90]
+	_ = x[Complex-91]
+	_ = x[Real-92]
+	_ = x[Imag-93]
+	_ = x[Load-94]
+	_ = x[Store-95]
+	_ = x[MemSize-96]
+	_ = x[MemGrow-97]
+	_ = x[Float32Bits-98]
+	_ = x[Float32FromBits-99]
+	_ = x[Float64Bits-100]
+	_ = x[Float64FromBits-101]
+	_ = x[AddStr-102]
+	_ = x[GreaterStr-103]
+	_ = x[LowerStr-104]
+	_ = x[AddInt-105]
+	_ = x[AddInt8-106]
+	_ = x[AddInt16-107]
+	_ = x[AddInt32-108]
+	_ = x[AddInt64-109]
+	_ = x[AddUint-110]
+	_ = x[AddUint8-111]
+	_ = x[AddUint16-112]
+	_ = x[AddUint32-113]
+	_ = x[AddUint64-114]
+	_ = x[AddFloat32-115]
+	_ = x[AddFloat64-116]
+	_ = x[SubInt-117]
+	_ = x[SubInt8-118]
+	_ = x[SubInt16-119]
+	_ = x[SubInt32-120]
+	_ = x[SubInt64-121]
+	_ = x[SubUint-122]
+	_ = x[SubUint8-123]
+	_ = x[SubUint16-124]
+	_ = x[SubUint32-125]
+	_ = x[SubUint64-126]
+	_ = x[SubFloat32-127]
+	_ = x[SubFloat64-128]
+	_ = x[MulInt-129]
+	_ = x[MulInt8-130]
+	_ = x[MulInt16-131]
+	_ = x[MulInt32-132]
+	_ = x[MulInt64-133]
+	_ = x[MulUint-134]
+	_ = x[MulUint8-135]
+	_ = x[MulUint16-136]
+	_ = x[MulUint32-137]
+	_ = x[MulUint64-138]
+	_ = x[MulFloat32-139]
+	_ = x[MulFloat64-140]
+	_ = x[NegInt-141]
+	_ = x[NegInt8-142]
+	_ = x[NegInt16-143]
+	_ = x[NegInt32-144]
+	_ = x[NegInt64-145]
+	_ = x[NegUint-146]
+	_ = x[NegUint8-147]
+	_ = x[NegUint16-148]
+	_ = x[NegUint32-149]
+	_ = x[NegUint64-150]
+	_ = x[NegFloat32-151]
+	_ = x[NegFloat64-152]
+	_ = x[GreaterInt-153]
+	_ = x[GreaterInt8-154]
+	_ = x[GreaterInt16-155]
+	_ = x[GreaterInt32-156]
+	_ = x[GreaterInt64-157]
+	_ = x[GreaterUint-158]
+	_ = x[GreaterUint8-159]
+	_ = x[GreaterUint16-160]
+	_ = x[GreaterUint32-161]
+	_ = x[GreaterUint64-162]
+	_ = x[GreaterFloat32-163]
+	_ = x[GreaterFloat64-164]
+	_ = x[LowerInt-165]
+	_ = x[LowerInt8-166]
+	_ = x[LowerInt16-167]
+	_ = x[LowerInt32-168]
+	_ = x[LowerInt64-169]
+	_ = x[LowerUint-170]
+	_ = x[LowerUint8-171]
+	_ = x[LowerUint16-172]
+	_ = x[LowerUint32-173]
+	_ = x[LowerUint64-174]
+	_ = x[LowerFloat32-175]
+	_ = x[LowerFloat64-176]
+	_ = x[DivInt-177]
+	_ = x[DivInt8-178]
+	_ = x[DivInt16-179]
+	_ = x[DivInt32-180]
+	_ = x[DivInt64-181]
+	_ = x[DivUint-182]
+	_ = x[DivUint8-183]
+	_ = x[DivUint16-184]
+	_ = x[DivUint32-185]
+	_ = x[DivUint64-186]
+	_ = x[DivFloat32-187]
+	_ = x[DivFloat64-188]
+	_ = x[RemInt-189]
+	_ = x[RemInt8-190]
+	_ = x[RemInt16-191]
+	_ = x[RemInt32-192]
+	_ = x[RemInt64-193]
+	_ = x[RemUint-194]
+	_ = x[RemUint8-195]
+	_ = x[RemUint16-196]
+	_ = x[RemUint32-197]
+	_ = x[RemUint64-198]
+	_ = x[RemFloat32-199]
+	_ = x[RemFloat64-200]
+	_ = x[BitAnd-201]
+	_ = x[BitOr-202]
+	_ = x[BitXor-203]
+	_ = x[BitAndNot-204]
+	_ = x[BitShl-205]
+	_ = x[BitShr-206]
+	_ = x[BitComp-207]
+	_ = x[Clz32-208]
+	_ = x[Clz64-209]
+	_ = x[Ctz32-210]
+	_ = x[Ctz64-211]
+	_ = x[Popcnt32-212]
+	_ = x[Popcnt64-213]
+	_ = x[Rotl32-214]
+	_ = x[Rotl64-215]
+	_ = x[Rotr32-216]
+	_ = x[Rotr64-217]
+	_ = x[AbsFloat32-218]
+	_ = x[AbsFloat64-219]
+	_ = x[SqrtFloat32-220]
+	_ = x[SqrtFloat64-221]
+	_ = x[CeilFloat32-222]
+	_ = x[CeilFloat64-223]
+	_ = x[FloorFloat32-224]
+	_ = x[FloorFloat64-225]
+	_ = x[TruncFloat32-226]
+	_ = x[TruncFloat64-227]
+	_ = x[NearestFloat32-228]
+	_ = x[NearestFloat64-229]
+	_ = x[MinFloat32-230]
+	_ = x[MinFloat64-231]
+	_ = x[MaxFloat32-232]
+	_ = x[MaxFloat64-233]
+	_ = x[CopysignFloat32-234]
+	_ = x[CopysignFloat64-235]
+	_ = x[AddIntImm-236]
+	_ = x[SubIntImm-237]
+	_ = x[MulIntImm-238]
+	_ = x[GreaterIntImm-239]
+	_ = x[GreaterUintImm-240]
+	_ = x[LowerIntImm-241]
+	_ = x[LowerUintImm-242]
+	_ = x[GetGlobal-243]
+	_ = x[GetLocal-244]
+	_ = x[NextLocal-245]
+	_ = x[Next2Local-246]
+	_ = x[GetLocal2-247]
+	_ = x[GetLocalAddIntImm-248]
+	_ = x[GetLocalSubIntImm-249]
+	_ = x[GetLocalMulIntImm-250]
+	_ = x[GetLocalLowerIntImm-251]
+	_ = x[GetLocalLowerUintImm-252]
+	_ = x[GetLocalGreaterIntImm-253]
+	_ = x[GetLocalGreaterUintImm-254]
+	_ = x[GetLocalReturn-255]
+	_ = x[LowerIntImmJumpFalse-256]
+	_ = x[LowerIntImmJumpTrue-257]
+	_ = x[GetLocalLowerIntImmJumpFalse-258]
+	_ = x[GetLocalLowerIntImmJumpTrue-259]
+	_ = x[Hook-260]
 }
 
-const _Op_name = "NopAddrAddrLocalAppendAppendSliceCallCallImmCapConvertCopySliceDeferPushDeferRetDeleteMapDerefDerefSetEqualEqualSetExitFieldFieldFsetFieldRefSetFieldSetFnewFnewEGetGrowHeapAllocHeapGetHeapPtrHeapSetCellGetCellSetIfaceCallIfaceWrapIndexIndexAddrIndexSetJumpJumpFalseJumpSetFalseJumpSetTrueJumpTrueLenMapIndexMapIndexOkMapSetMkClosureMkMapMkSliceNewNextNext0Next2NotPanicPanicUnwindPopPtrNewPullPull2PushRecoverReturnSetGlobalSetLocalSetSSliceSlice3StopSwapTrapTypeAssertTypeBranchWrapFuncGoCallGoCallImmMkChanChanSendChanRecvChanCloseSelectExecPrintPrintlnMinMaxAddStrGreaterStrLowerStrAddIntAddInt8AddInt16AddInt32AddInt64AddUintAddUint8AddUint16AddUint32AddUint64AddFloat32AddFloat64SubIntSubInt8SubInt16SubInt32SubInt64SubUintSubUint8SubUint16SubUint32SubUint64SubFloat32SubFloat64MulIntMulInt8MulInt16MulInt32MulInt64MulUintMulUint8MulUint16MulUint32MulUint64MulFloat32MulFloat64NegIntNegInt8NegInt16NegInt32NegInt64NegUintNegUint8NegUint16NegUint32NegUint64NegFloat32NegFloat64GreaterIntGreaterInt8GreaterInt16GreaterInt32GreaterInt64GreaterUintGreaterUint8GreaterUint16GreaterUint32GreaterUint64GreaterFloat32GreaterFloat64LowerIntLowerInt8LowerInt16LowerInt32LowerInt64LowerUintLowerUint8LowerUint16LowerUint32LowerUint64LowerFloat32LowerFloat64DivIntDivInt8DivInt16DivInt32DivInt64DivUintDivUint8DivUint16DivUint32DivUint64DivFloat32DivFloat64RemIntRemInt8RemInt16RemInt32RemInt64RemUintRemUint8RemUint16RemUint32RemUint64RemFloat32RemFloat64BitAndBitOrBitXorBitAndNotBitShlBitShrBitCompClz32Clz64Ctz32Ctz64Popcnt32Popcnt64Rotl32Rotl64Rotr32Rotr64AbsFloat32AbsFloat64SqrtFloat32SqrtFloat64CeilFloat32CeilFloat64FloorFloat32FloorFloat64TruncFloat32TruncFloat64NearestFloat32NearestFloat64MinFloat32MinFloat64MaxFloat32MaxFloat64CopysignFloat32CopysignFloat64AddIntImmSubIntImmMulIntImmGreaterIntImmGreaterUintImmLowerIntImmLowerUintImmGetGlobalGetLocalNextLocalNext2LocalGetLocal2GetLocalAddIntImmGetLocalSubIntImmGetLocalMulIntImmGetLocalLowerIntImmGetLocalLowerUintImmGetLocalGreaterIntImmGetLocalGreaterUintImmGetLocalReturnLowerIntImmJumpFalseLowerIntImmJumpTrueGetLocalLowerIntImmJumpFalseGetLocalLowerIntImmJumpTrue"
+const _Op_name = "NopAddrAddrLocalAppendAppendSliceCallCallImmCapConvertCopySliceDeferPushDeferRetDeleteMapDerefDerefSetEqualEqualSetExitFieldFieldFsetFieldRefSetFieldSetFnewFnewEGetGrowHeapAllocHeapGetHeapPtrHeapSetCellGetCellSetIfaceCallIfaceWrapIndexIndexAddrIndexSetJumpJumpFalseJumpSetFalseJumpSetTrueJumpTrueLenMapIndexMapIndexOkMapSetMkClosureMkMapMkSliceNewNextNext0Next2NotPanicPanicUnwindPopPtrNewPullPull2PushRecoverReturnSetGlobalSetLocalSetSSliceSlice3StopSwapTailCallTrapTypeAssertTypeBranchWrapFuncGoCallGoCallImmMkChanChanSendChanRecvChanCloseSelectExecPrintPrintlnMinMaxAddComplexSubComplexMulComplexDivComplexNegComplexComplexRealImagLoadStoreMemSizeMemGrowFloat32BitsFloat32FromBitsFloat64BitsFloat64FromBitsAddStrGreaterStrLowerStrAddIntAddInt8AddInt16AddInt32AddInt64AddUintAddUint8AddUint16AddUint32AddUint64AddFloat32AddFloat64SubIntSubInt8SubInt16SubInt32SubInt64SubUintSubUint8SubUint16SubUint32SubUint64SubFloat32SubFloat64MulIntMulInt8MulInt16MulInt32MulInt64MulUintMulUint8MulUint16MulUint32MulUint64MulFloat32MulFloat64NegIntNegInt8NegInt16NegInt32NegInt64NegUintNegUint8NegUint16NegUint32NegUint64NegFloat32NegFloat64GreaterIntGreaterInt8GreaterInt16GreaterInt32GreaterInt64GreaterUintGreaterUint8GreaterUint16GreaterUint32GreaterUint64GreaterFloat32GreaterFloat64LowerIntLowerInt8LowerInt16LowerInt32LowerInt64LowerUintLowerUint8LowerUint16LowerUint32LowerUint64LowerFloat32LowerFloat64DivIntDivInt8DivInt16DivInt32DivInt64DivUintDivUint8DivUint16DivUint32DivUint64DivFloat32DivFloat64RemIntRemInt8RemInt16RemInt32RemInt64RemUintRemUint8RemUint16RemUint32RemUint64RemFloat32RemFloat64BitAndBitOrBitXorBitAndNotBitShlBitShrBitCompClz32Clz64Ctz32Ctz64Popcnt32Popcnt64Rotl32Rotl64Rotr32Rotr64AbsFloat32AbsFloat64SqrtFloat32SqrtFloat64CeilFloat32CeilFloat64FloorFloat32FloorFloat64TruncFloat32TruncFloat64NearestFloat32NearestFloat64MinFloat32MinFloat64MaxFloat32MaxFloat64CopysignFloat32CopysignFloat64AddIntImmSubIntImmMulIntImmGreaterIntImmGreaterUintImmLowerIntImmLowerUintImmGetGlobalGetLocalNextLocalNext2LocalGetLocal2GetLocalAddIntImmGetLocalSubIntImmGetLocalMulIntImmGetLocalLowerIntImmGetLocalLowerUintImmGetLocalGreaterIntImmGetLocalGreaterUintImmGetLocalReturnLowerIntImmJumpFalseLowerIntImmJumpTrueGetLocalLowerIntImmJumpFalseGetLocalLowerIntImmJumpTrueHook"
 
-var _Op_index = [...]uint16{0, 3, 7, 16, 22, 33, 37, 44, 47, 54, 63, 72, 80, 89, 94, 102, 107, 115, 119, 124, 133, 144, 152, 156, 161, 164, 168, 177, 184, 191, 198, 205, 212, 221, 230, 235, 244, 252, 256, 265, 277, 288, 296, 299, 307, 317, 323, 332, 337, 344, 347, 351, 356, 361, 364, 369, 380, 383, 389, 393, 398, 402, 409, 415, 424, 432, 436, 441, 447, 451, 455, 459, 469, 479, 487, 493, 502, 508, 516, 524, 533, 543, 548, 555, 558, 561, 567, 577, 585, 591, 598, 606, 614, 622, 629, 637, 646, 655, 664, 674, 684, 690, 697, 705, 713, 721, 728, 736, 745, 754, 763, 773, 783, 789, 796, 804, 812, 820, 827, 835, 844, 853, 862, 872, 882, 888, 895, 903, 911, 919, 926, 934, 943, 952, 961, 971, 981, 991, 1002, 1014, 1026, 1038, 1049, 1061, 1074, 1087, 1100, 1114, 1128, 1136, 1145, 1155, 1165, 1175, 1184, 1194, 1205, 1216, 1227, 1239, 1251, 1257, 1264, 1272, 1280, 1288, 1295, 1303, 1312, 1321, 1330, 1340, 1350, 1356, 1363, 1371, 1379, 1387, 1394, 1402, 1411, 1420, 1429, 1439, 1449, 1455, 1460, 1466, 1475, 1481, 1487, 1494, 1499, 1504, 1509, 1514, 1522, 1530, 1536, 1542, 1548, 1554, 1564, 1574, 1585, 1596, 1607, 1618, 1630, 1642, 1654, 1666, 1680, 1694, 1704, 1714, 1724, 1734, 1749, 1764, 1773, 1782, 1791, 1804, 1818, 1829, 1841, 1850, 1858, 1867, 1877, 1886, 1903, 1920, 1937, 1956, 1976, 1997, 2019, 2033, 2053, 2072, 2100, 2127}
+var _Op_index = [...]uint16{0, 3, 7, 16, 22, 33, 37, 44, 47, 54, 63, 72, 80, 89, 94, 102, 107, 115, 119, 124, 133, 144, 152, 156, 161, 164, 168, 177, 184, 191, 198, 205, 212, 221, 230, 235, 244, 252, 256, 265, 277, 288, 296, 299, 307, 317, 323, 332, 337, 344, 347, 351, 356, 361, 364, 369, 380, 383, 389, 393, 398, 402, 409, 415, 424, 432, 436, 441, 447, 451, 455, 463, 467, 477, 487, 495, 501, 510, 516, 524, 532, 541, 551, 556, 563, 566, 569, 579, 589, 599, 609, 619, 626, 630, 634, 638, 643, 650, 657, 668, 683, 694, 709, 715, 725, 733, 739, 746, 754, 762, 770, 777, 785, 794, 803, 812, 822, 832, 838, 845, 853, 861, 869, 876, 884, 893, 902, 911, 921, 931, 937, 944, 952, 960, 968, 975, 983, 992, 1001, 1010, 1020, 1030, 1036, 1043, 1051, 1059, 1067, 1074, 1082, 1091, 1100, 1109, 1119, 1129, 1139, 1150, 1162, 1174, 1186, 1197, 1209, 1222, 1235, 1248, 1262, 1276, 1284, 1293, 1303, 1313, 1323, 1332, 1342, 1353, 1364, 1375, 1387, 1399, 1405, 1412, 1420, 1428, 1436, 1443, 1451, 1460, 1469, 1478, 1488, 1498, 1504, 1511, 1519, 1527, 1535, 1542, 1550, 1559, 1568, 1577, 1587, 1597, 1603, 1608, 1614, 1623, 1629, 1635, 1642, 1647, 1652, 1657, 1662, 1670, 1678, 1684, 1690, 1696, 1702, 1712, 1722, 1733, 1744, 1755, 1766, 1778, 1790, 1802, 1814, 1828, 1842, 1852, 1862, 1872, 1882, 1897, 1912, 1921, 1930, 1939, 1952, 1966, 1977, 1989, 1998, 2006, 2015, 2025, 2034, 2051, 2068, 2085, 2104, 2124, 2145, 2167, 2181, 2201, 2220, 2248, 2275, 2279}
 
 func (i Op) String() string {
 	idx := int(i) - 0
@@ -0,0 +1,263 @@
+package vm
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// profilePeriod is the sampling period of the CPU profiler.
+const profilePeriod = 10 * time.Millisecond
+
+// profChunk is the number of instructions a profiled machine executes
+// between checks for a pending sample.
+const profChunk = 1 << 12
+
+// profiler samples the interpreted call stacks of a machine and of its
+// goroutines. Each machine checks the clock every profChunk instructions,
+// and records its stack once per sampling period elapsed while executing.
+// A longer gap between two checks means that the machine was blocked or
+// running native code, which is not sampled, like in a Go CPU profile.
+type profiler struct {
+	w     io.Writer
+	start time.Time
+
+	mu      sync.Mutex
+	samples map[string]*profSample // by stack key
+}
+
+// profClock is the sampling clock of a machine, in durations since the
+// start of the profile.
+type profClock struct {
+	last time.Duration // time of the last check
+	next time.Duration // time of the next sample
+}
+
+// profSample is a distinct interpreted stack and its number of samples.
+type profSample struct {
+	stack []int // code addresses, innermost first
+	count int64
+}
+
+// StartProfile enables CPU profiling of the interpreted program, until
+// StopProfile writes the profile to w, in the gzipped protocol buffer format
+// read by go tool pprof. It must be called before Run, not concurrently with
+// it.
+func (m *Machine) StartProfile(w io.Writer) error {
+	if m.prof != nil {
+		return errors.New("profiling already enabled")
+	}
+	m.prof = &profiler{w: w, start: time.Now(), samples: map[string]*profSample{}}
+	return nil
+}
+
+// StopProfile stops the profiling started by StartProfile and writes the
+// profile. Function names and source lines are resolved with the debug
+// information of the machine, if any.
+func (m *Machine) StopProfile() error {
+	p := m.prof
+	if p == nil {
+		return errors.New("profiling not enabled")
+	}
+	m.prof = nil
+
+	var di *DebugInfo
+	if m.debugInfoFn != nil {
+		di = m.debugInfoFn()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	gz := gzip.NewWriter(p.w)
+	if _, err := gz.Write(p.encode(m.code, di)); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// sample records the stack of m for each sampling period elapsed since its
+// last sample.
+func (p *profiler) sample(m *Machine, ip, fp int, mem []Value) {
+	c := &m.profClock
+	now := time.Since(p.start)
+	last := c.last
+	c.last = now
+	switch {
+	case last == 0 || now-last > profilePeriod:
+		// First check, or not executing since the last one: restart the clock.
+		c.next = now + profilePeriod
+		return
+	case now < c.next:
+		return
+	}
+	n := 1 + int64((now-c.next)/profilePeriod)
+	c.next += time.Duration(n) * profilePeriod
+	var stack []int
+	var key strings.Builder
+	m.walkStack(ip, fp, mem, func(f Frame, _ int) {
+		stack = append(stack, f.IP)
+		key.WriteString(strconv.Itoa(f.IP))
+		key.WriteByte(',')
+	})
+	p.mu.Lock()
+	s := p.samples[key.String()]
+	if s == nil {
+		s = &profSample{stack: stack}
+		p.samples[key.String()] = s
+	}
+	s.count += n
+	p.mu.Unlock()
+}
+
+// encode returns the profile as a profile.proto message. Locations are code
+// addresses, grouped in functions by DebugInfo. It must be called with p.mu
+// held.
+func (p *profiler) encode(code []Instruction, di *DebugInfo) []byte {
+	strs := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		i, ok := strs[s]
+		if !ok {
+			i = int64(len(strs))
+			strs[s] = i
+		}
+		return i
+	}
+
+	// Start lines of functions, from their entry addresses.
+	starts := map[string]int64{}
+	if di != nil {
+		for ip, name := range di.Labels {
+			if _, ok := di.Ends[ip]; ok && ip < len(code) {
+				_, line, _ := di.Sources.Resolve(int(code[ip].Pos))
+				starts[name] = int64(line)
+			}
+		}
+	}
+
+	var b protobuf
+	valueType := func(tag int, typ, unit string) {
+		var vt protobuf
+		vt.int64(1, str(typ))
+		vt.int64(2, str(unit))
+		b.bytes(tag, vt.buf)
+	}
+	valueType(1, "samples", "count")
+	valueType(1, "cpu", "nanoseconds")
+
+	locs := map[int]uint64{}     // location id by code address
+	funcs := map[string]uint64{} // function id by name and file
+	var locBufs, funcBufs [][]byte
+	location := func(ip int) uint64 {
+		if id, ok := locs[ip]; ok {
+			return id
+		}
+		f := di.ResolveFrame(Frame{IP: ip, Pos: code[ip].Pos})
+		name := f.Func
+		if name == "" {
+			name = "toplevel"
+		}
+		fkey := name + "\x00" + f.File
+		fid, ok := funcs[fkey]
+		if !ok {
+			fid = uint64(len(funcs) + 1)
+			funcs[fkey] = fid
+			var fb protobuf
+			fb.uint64(1, fid)
+			fb.int64(2, str(name))
+			fb.int64(3, str(name))
+			fb.int64(4, str(f.File))
+			fb.int64(5, starts[f.Func])
+			funcBufs = append(funcBufs, fb.buf)
+		}
+		id := uint64(len(locs) + 1)
+		locs[ip] = id
+		var line, lb protobuf
+		line.uint64(1, fid)
+		line.int64(2, int64(f.Line))
+		lb.uint64(1, id)
+		lb.uint64(2, 1)
+		lb.uint64(3, uint64(ip)) //nolint:gosec
+		lb.bytes(4, line.buf)
+		locBufs = append(locBufs, lb.buf)
+		return id
+	}
+
+	period := int64(profilePeriod)
+	for _, s := range p.samples {
+		ids := make([]uint64, len(s.stack))
+		for i, ip := range s.stack {
+			ids[i] = location(ip)
+		}
+		var sb protobuf
+		sb.packed(1, ids)
+		sb.packed(2, []uint64{uint64(s.count), uint64(s.count * period)}) //nolint:gosec
+		b.bytes(2, sb.buf)
+	}
+	// A single mapping for the code, already symbolized.
+	var mb protobuf
+	mb.uint64(1, 1)
+	mb.uint64(3, uint64(len(code))) //nolint:gosec
+	mb.int64(5, str("parscan"))
+	for tag := 7; tag <= 9; tag++ {
+		mb.uint64(tag, 1) // has functions, file names and line numbers
+	}
+	b.bytes(3, mb.buf)
+	for _, lb := range locBufs {
+		b.bytes(4, lb)
+	}
+	for _, fb := range funcBufs {
+		b.bytes(5, fb)
+	}
+	table := make([]string, len(strs))
+	for s, i := range strs {
+		table[i] = s
+	}
+	for _, s := range table {
+		b.bytes(6, []byte(s))
+	}
+	b.int64(9, p.start.UnixNano())
+	b.int64(10, int64(time.Since(p.start)))
+	var pt protobuf
+	pt.int64(1, str("cpu"))
+	pt.int64(2, str("nanoseconds"))
+	b.bytes(11, pt.buf)
+	b.int64(12, period)
+	return b.buf
+}
+
+// protobuf is a minimal protocol buffer encoder.
+type protobuf struct {
+	buf []byte
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.buf = append(b.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	b.buf = append(b.buf, byte(x))
+}
+
+func (b *protobuf) uint64(tag int, x uint64) {
+	b.varint(uint64(tag) << 3) //nolint:gosec
+	b.varint(x)
+}
+
+func (b *protobuf) int64(tag int, x int64) { b.uint64(tag, uint64(x)) } //nolint:gosec
+
+func (b *protobuf) bytes(tag int, p []byte) {
+	b.varint(uint64(tag)<<3 | 2) //nolint:gosec
+	b.varint(uint64(len(p)))
+	b.buf = append(b.buf, p...)
+}
+
+func (b *protobuf) packed(tag int, xs []uint64) {
+	var p protobuf
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(tag, p.buf)
+}
@@ -0,0 +1,490 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// raceDetector reports the data races of the goroutines of a machine: the
+// accesses to a same location, one of them a write, not ordered by a
+// happens-before relation. Each goroutine has a vector clock, advanced when
+// it releases a synchronization object, and joined with the clock of the
+// object when it acquires it. An access is ordered after a previous one if
+// the clock of its goroutine has reached the time of the previous access.
+// The detector is shared by the goroutines and runners of the machine.
+type raceDetector struct {
+	out io.Writer
+
+	mu       sync.Mutex
+	threads  int                         // number of goroutines, the next thread id
+	vars     map[unsafe.Pointer]*raceVar // access history by location
+	syncs    map[unsafe.Pointer]vclock   // released clocks by synchronization object
+	natives  map[uintptr]bool            // whether a native function is from sync/atomic
+	reported map[[2]Pos]bool             // source positions of the reported races
+	count    int                         // number of reported races
+	lvalues  []bool                      // instructions pushing an assignment destination
+}
+
+// vclock is a vector clock, indexed by thread id.
+type vclock []uint64
+
+// raceThread is the race detection state of a goroutine.
+type raceThread struct {
+	tid   int
+	clock vclock
+
+	// Synchronization to complete at the next instruction, once the
+	// current one is done: the objects to acquire, by select case if
+	// selected, and the sync method to wrap.
+	acquire  []unsafe.Pointer
+	selected bool
+	wrap     unsafe.Pointer
+	method   string
+}
+
+// raceVar is the access history of a location: the last write, and the
+// reads since which are not ordered between them.
+type raceVar struct {
+	write raceAccess
+	reads []raceAccess
+}
+
+// raceAccess is a memory access, at the time epoch of thread tid.
+type raceAccess struct {
+	tid   int
+	epoch uint64
+	goid  int64
+	write bool
+	stack []Frame
+}
+
+// StartRaceDetector enables the detection of data races between the
+// goroutines of the program, reported to w as found. Reads and writes of
+// global variables, closure variables, struct fields, slice and array
+// elements, maps and pointed values are checked, and ordered by channel
+// operations, goroutine creation, and sync and sync/atomic calls. It must
+// be called before Run, not concurrently with it.
+func (m *Machine) StartRaceDetector(w io.Writer) error {
+	if m.race != nil {
+		return errors.New("race detector already enabled")
+	}
+	m.race = &raceDetector{
+		out:      w,
+		vars:     map[unsafe.Pointer]*raceVar{},
+		syncs:    map[unsafe.Pointer]vclock{},
+		natives:  map[uintptr]bool{},
+		reported: map[[2]Pos]bool{},
+	}
+	m.rthread = m.race.newThread(nil)
+	return nil
+}
+
+// Races returns the number of data races reported since StartRaceDetector.
+func (m *Machine) Races() int {
+	if m.race == nil {
+		return 0
+	}
+	m.race.mu.Lock()
+	defer m.race.mu.Unlock()
+	return m.race.count
+}
+
+// newThread returns the state of a new goroutine started by parent, or of
+// the first one if parent is nil.
+func (rd *raceDetector) newThread(parent *raceThread) *raceThread {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	t := &raceThread{tid: rd.threads}
+	rd.threads++
+	t.clock = make(vclock, t.tid+1)
+	if parent != nil {
+		copy(t.clock, parent.clock)
+		parent.clock[parent.tid]++
+	}
+	t.clock[t.tid]++
+	return t
+}
+
+// join sets c to the maximum of c and o.
+func (c *vclock) join(o vclock) {
+	if len(*c) < len(o) {
+		*c = append(*c, make(vclock, len(o)-len(*c))...)
+	}
+	for i, x := range o {
+		(*c)[i] = max((*c)[i], x)
+	}
+}
+
+// release makes the past accesses of t ordered before the next acquire of
+// object p.
+func (rd *raceDetector) release(t *raceThread, p unsafe.Pointer) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	c := rd.syncs[p]
+	c.join(t.clock)
+	rd.syncs[p] = c
+	t.clock[t.tid]++
+}
+
+// acquire orders the next accesses of t after the releases of object p.
+func (rd *raceDetector) acquire(t *raceThread, p unsafe.Pointer) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	t.clock.join(rd.syncs[p])
+}
+
+// ordered reports whether access a happens before the current time of t.
+func (t *raceThread) ordered(a raceAccess) bool {
+	return a.tid < len(t.clock) && a.epoch <= t.clock[a.tid]
+}
+
+// raceAccess records the access to location p by the instruction at ip,
+// and reports the previous accesses it races with.
+func (m *Machine) raceAccess(p unsafe.Pointer, write bool, ip, fp int, mem []Value) {
+	if p == nil {
+		return
+	}
+	rd, t := m.race, m.rthread
+	a := raceAccess{tid: t.tid, goid: m.goid, write: write, stack: m.callers(ip, fp, mem)}
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	a.epoch = t.clock[t.tid]
+	v := rd.vars[p]
+	if v == nil {
+		v = &raceVar{}
+		rd.vars[p] = v
+	}
+	if v.write.stack != nil && !t.ordered(v.write) {
+		m.raceReport(v.write, a)
+	}
+	if write {
+		for _, r := range v.reads {
+			if !t.ordered(r) {
+				m.raceReport(r, a)
+			}
+		}
+		v.write, v.reads = a, v.reads[:0]
+		return
+	}
+	// The reads ordered before this one need not be checked anymore.
+	reads := v.reads[:0]
+	for _, r := range v.reads {
+		if !t.ordered(r) {
+			reads = append(reads, r)
+		}
+	}
+	v.reads = append(reads, a)
+}
+
+// raceReport reports the race of the access a with the previous access
+// prev, once per pair of source positions.
+func (m *Machine) raceReport(prev, a raceAccess) {
+	rd := m.race
+	key := [2]Pos{prev.stack[0].Pos, a.stack[0].Pos}
+	if rd.reported[key] {
+		return
+	}
+	rd.reported[key] = true
+	rd.count++
+	var di *DebugInfo
+	if m.debugInfoFn != nil {
+		di = m.debugInfoFn()
+	}
+	var sb strings.Builder
+	sb.WriteString("==================\nWARNING: DATA RACE\n")
+	writeAccess(&sb, "", a, di)
+	sb.WriteString("\n")
+	writeAccess(&sb, "Previous ", prev, di)
+	sb.WriteString("==================\n")
+	_, _ = io.WriteString(rd.out, sb.String())
+}
+
+// writeAccess writes the kind, goroutine and stack trace of access a to sb.
+func writeAccess(sb *strings.Builder, prefix string, a raceAccess, di *DebugInfo) {
+	kind := "read"
+	if a.write {
+		kind = "write"
+	}
+	if prefix == "" {
+		kind = strings.ToUpper(kind[:1]) + kind[1:]
+	}
+	_, _ = fmt.Fprintf(sb, "%s%s by goroutine %d:\n", prefix, kind, a.goid)
+	for _, f := range di.resolveFrames(a.stack) {
+		writeFrame(sb, f)
+	}
+}
+
+// raceCheck records the memory accesses and synchronizations of the
+// instruction at ip, before it is executed, and completes those of the
+// previous instruction.
+func (m *Machine) raceCheck(ip, fp, sp int, mem []Value) {
+	rd, t := m.race, m.rthread
+	if t.acquire != nil {
+		if t.selected {
+			if i := int(mem[sp].num); i < len(t.acquire) && t.acquire[i] != nil { //nolint:gosec
+				rd.acquire(t, t.acquire[i])
+			}
+		} else {
+			for _, p := range t.acquire {
+				rd.acquire(t, p)
+			}
+		}
+		t.acquire, t.selected = nil, false
+	}
+	if t.wrap != nil {
+		if mem[sp].ref.Kind() == reflect.Func {
+			mem[sp] = Value{ref: m.raceSyncMethod(mem[sp].ref, t.wrap, t.method)}
+		}
+		t.wrap = nil
+	}
+
+	c := m.code[ip]
+	switch c.Op {
+	case GetGlobal, SetGlobal:
+		g := &m.globals[int(c.A)]
+		if k := g.ref.Kind(); c.Op == GetGlobal && (k == reflect.Struct || k == reflect.Array || rd.lvalue(m, ip)) {
+			// Fields and elements are checked when accessed, and
+			// destinations when assigned.
+			break
+		}
+		p := addrOf(g.ref)
+		if p == nil {
+			p = unsafe.Pointer(g)
+		}
+		m.raceAccess(p, c.Op == SetGlobal, ip, fp, mem)
+	case HeapGet, HeapSet:
+		m.raceAccess(unsafe.Pointer(m.heap[int(c.A)]), c.Op == HeapSet, ip, fp, mem)
+	case CellGet, CellSet:
+		m.raceAccess(mem[int(c.A)+fp-1].ref.UnsafePointer(), c.Op == CellSet, ip, fp, mem)
+	case Field:
+		if !rd.lvalue(m, ip) {
+			m.raceAccess(fieldAddr(mem[sp].ref, int(c.A), int(c.B)), false, ip, fp, mem)
+		}
+	case FieldSet:
+		m.raceAccess(fieldAddr(mem[sp-1].ref, int(c.A), int(c.B)), true, ip, fp, mem)
+	case FieldFset:
+		m.raceAccess(fieldAddr(mem[sp-2].ref, int(mem[sp-1].num), -1), true, ip, fp, mem) //nolint:gosec
+	case FieldRefSet:
+		m.raceAccess(addrOf(mem[sp-1].ref), true, ip, fp, mem)
+	case Index:
+		m.raceAccess(elemAddr(mem[sp-1].ref, mem[sp].num), false, ip, fp, mem)
+	case IndexSet:
+		m.raceAccess(elemAddr(mem[sp-2].ref, mem[sp-1].num), true, ip, fp, mem)
+	case MapIndex, MapIndexOk:
+		m.raceAccess(refPointer(mem[sp-1].ref, reflect.Map), false, ip, fp, mem)
+	case MapSet:
+		m.raceAccess(refPointer(mem[sp-2].ref, reflect.Map), true, ip, fp, mem)
+	case DeleteMap:
+		m.raceAccess(refPointer(mem[sp-1].ref, reflect.Map), true, ip, fp, mem)
+	case Deref:
+		m.raceAccess(refPointer(mem[sp].ref, reflect.Pointer), false, ip, fp, mem)
+	case DerefSet:
+		m.raceAccess(refPointer(mem[sp-1].ref, reflect.Pointer), true, ip, fp, mem)
+	case SetS:
+		n := int(c.A)
+		for i := range n {
+			m.raceAccess(addrOf(mem[sp-2*n+1+i].ref), true, ip, fp, mem)
+		}
+
+	case ChanSend, ChanRecv, ChanClose:
+		v := mem[sp]
+		if c.Op == ChanSend {
+			v = mem[sp-1]
+		}
+		if p := refPointer(v.ref, reflect.Chan); p != nil {
+			rd.release(t, p)
+			t.acquire = []unsafe.Pointer{p}
+		}
+	case SelectExec:
+		meta := m.globals[int(c.A)].ref.Interface().(*SelectMeta)
+		t.acquire, t.selected = make([]unsafe.Pointer, len(meta.Cases)), true
+		idx := sp - int(c.B>>16) + 1
+		for i, ci := range meta.Cases {
+			if ci.Dir == reflect.SelectDefault {
+				continue
+			}
+			if p := refPointer(mem[idx].ref, reflect.Chan); p != nil {
+				rd.release(t, p)
+				t.acquire[i] = p
+			}
+			idx++
+			if ci.Dir == reflect.SelectSend {
+				idx++
+			}
+		}
+	case IfaceCall:
+		// The method value is wrapped once resolved, by the next instruction.
+		if v := mem[sp]; !v.IsIface() {
+			if p := syncObject(v.Reflect()); p != nil {
+				t.wrap, t.method = p, m.MethodNames[int(c.A)]
+			}
+		}
+	case Call:
+		narg := int(c.A)
+		f := mem[sp-narg].ref
+		if narg > 0 && f.Kind() == reflect.Func && !f.IsNil() && rd.atomicFunc(f.Pointer()) {
+			if p := refPointer(mem[sp-narg+1].ref, reflect.Pointer); p != nil {
+				mem[sp-narg] = Value{ref: m.raceSyncMethod(f, p, "")}
+			}
+		}
+	}
+}
+
+// lvalue reports whether the instruction at ip of the code of m pushes the
+// destination of an assignment, which it does not read.
+func (rd *raceDetector) lvalue(m *Machine, ip int) bool {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if len(rd.lvalues) != m.baseCodeLen {
+		rd.lvalues = lvalues(m.code[:m.baseCodeLen], len(m.globals))
+	}
+	return ip < len(rd.lvalues) && rd.lvalues[ip]
+}
+
+// lvalues returns the instructions of code pushing the destination of an
+// assignment: the last instruction leaving the destination on the stack,
+// at its depth, before the assignment.
+func lvalues(code Code, dataLen int) []bool {
+	depth, _, _ := Depths(code, dataLen)
+	depth = append(depth, -1)
+	lv := make([]bool, len(code))
+	for ip, c := range code {
+		var dst []int
+		switch d := depth[ip]; c.Op {
+		case SetS:
+			for i := range int(c.A) {
+				dst = append(dst, d-2*int(c.A)+i)
+			}
+		case FieldRefSet:
+			dst = []int{d - 2}
+		}
+		for _, k := range dst {
+			for j := ip - 1; j >= 0 && depth[j] >= k; j-- {
+				if op := code[j].Op; depth[j+1] == k+1 && (op == GetGlobal || op == Field) {
+					lv[j] = true
+					break
+				}
+			}
+		}
+	}
+	return lv
+}
+
+// raceSyncMethod returns fn, a method of the synchronization object at p,
+// or a function of sync/atomic on p, synchronizing the current goroutine
+// with the object like it does.
+func (m *Machine) raceSyncMethod(fn reflect.Value, p unsafe.Pointer, name string) reflect.Value {
+	rd, t := m.race, m.rthread
+	return reflect.MakeFunc(fn.Type(), func(in []reflect.Value) []reflect.Value {
+		switch name {
+		case "Unlock", "RUnlock", "Done":
+			rd.release(t, p)
+			return fn.Call(in)
+		case "Lock", "RLock":
+			out := fn.Call(in)
+			rd.acquire(t, p)
+			return out
+		case "TryLock", "TryRLock":
+			out := fn.Call(in)
+			if out[0].Bool() {
+				rd.acquire(t, p)
+			}
+			return out
+		case "Do":
+			// Once.Do: the first call of f happens before the return of all calls.
+			if f := in[0]; f.Kind() == reflect.Func && !f.IsNil() {
+				in[0] = reflect.MakeFunc(f.Type(), func(args []reflect.Value) []reflect.Value {
+					out := f.Call(args)
+					rd.release(t, p)
+					return out
+				})
+			}
+			out := fn.Call(in)
+			rd.acquire(t, p)
+			return out
+		}
+		rd.release(t, p)
+		out := fn.Call(in)
+		rd.acquire(t, p)
+		return out
+	})
+}
+
+// atomicFunc reports whether the native function at code pointer pc is
+// from package sync/atomic.
+func (rd *raceDetector) atomicFunc(pc uintptr) bool {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	ok, found := rd.natives[pc]
+	if !found {
+		f := runtime.FuncForPC(pc)
+		ok = f != nil && strings.HasPrefix(f.Name(), "sync/atomic.")
+		rd.natives[pc] = ok
+	}
+	return ok
+}
+
+// syncObject returns the address of v if it is a value of package sync or
+// sync/atomic, or a pointer to one, or nil.
+func syncObject(v reflect.Value) unsafe.Pointer {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	t, p := v.Type(), addrOf(v)
+	if v.Kind() == reflect.Pointer {
+		t, p = t.Elem(), refPointer(v, reflect.Pointer)
+	}
+	if pkg := t.PkgPath(); pkg != "sync" && pkg != "sync/atomic" {
+		return nil
+	}
+	return p
+}
+
+// addrOf returns the address of v, or nil if it is not addressable.
+func addrOf(v reflect.Value) unsafe.Pointer {
+	if !v.CanAddr() {
+		return nil
+	}
+	return v.Addr().UnsafePointer()
+}
+
+// refPointer returns the pointer held by v, of kind k, or nil.
+func refPointer(v reflect.Value, k reflect.Kind) unsafe.Pointer {
+	if v.Kind() != k || v.IsNil() {
+		return nil
+	}
+	return v.UnsafePointer()
+}
+
+// fieldAddr returns the address of the field of struct v, or pointed by v,
+// at the index path a, b as in fieldByAB, or nil.
+func fieldAddr(v reflect.Value, a, b int) unsafe.Pointer {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct || a >= v.NumField() {
+		return nil
+	}
+	if b < 0 {
+		return addrOf(v.Field(a))
+	}
+	f, err := v.FieldByIndexErr([]int{a, b})
+	if err != nil {
+		return nil
+	}
+	return addrOf(f)
+}
+
+// elemAddr returns the address of element i of the slice or array v, or
+// pointed by v, or nil.
+func elemAddr(v reflect.Value, i uint64) unsafe.Pointer {
+	v = reflect.Indirect(v)
+	if k := v.Kind(); k != reflect.Slice && k != reflect.Array || i >= uint64(v.Len()) { //nolint:gosec
+		return nil
+	}
+	return addrOf(v.Index(int(i))) //nolint:gosec
+}
@@ -0,0 +1,392 @@
+package vm
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// schedPollDelay is how long the scheduler waits for native code, such as
+// timers, when all the goroutines are blocked on operations it may complete.
+const schedPollDelay = time.Millisecond
+
+// sleepPC is the code pointer of time.Sleep, run on the virtual clock of
+// the scheduler.
+var sleepPC = reflect.ValueOf(time.Sleep).Pointer()
+
+// schedState is the state of a goroutine for the scheduler.
+type schedState uint8
+
+const (
+	schedReady    schedState = iota // runnable
+	schedBlocked                    // blocked on a channel or sync operation
+	schedSleeping                   // in time.Sleep
+)
+
+// schedThread is the scheduling state of an interpreted goroutine.
+type schedThread struct {
+	goid    int64
+	state   schedState
+	stuck   uint64        // scheduler epoch when last found blocked
+	owned   bool          // blocked on objects only the program can operate
+	blocked Blocked       // blocking operation, when blocked
+	until   time.Duration // virtual wake up time, when sleeping
+	wake    chan struct{} // signaled when the goroutine is picked
+	err     *DeadlockError
+}
+
+// scheduler runs the interpreted goroutines of a program one at a time,
+// like green threads on a single OS thread. Each goroutine still runs on
+// its own Go goroutine, but waits for its turn, passed by the running one
+// at the switch points: channel operations and select, time.Sleep,
+// blocking sync methods, goroutine exit, and every quantum instructions.
+// The next goroutine is drawn by a pseudo random generator, so that a
+// seed replays the same interleaving.
+type scheduler struct {
+	mu          sync.Mutex
+	rand        *rand.Rand
+	quantum     int64         // instructions between preemptions (0 = none)
+	now         time.Duration // virtual clock
+	epoch       uint64        // incremented when a goroutine may have progressed
+	threads     []*schedThread
+	main        *schedThread // main goroutine, during a top-level Run
+	running     *schedThread // goroutine allowed to run, or nil
+	debugInfoFn func() *DebugInfo
+}
+
+// StartScheduler makes the interpreted goroutines of the program run one
+// at a time, switching at channel operations, select, time.Sleep, blocking
+// sync methods, and every quantum instructions if quantum is positive. The
+// switches are driven by seed, so that a run, and the interleaving of its
+// goroutines, can be replayed exactly. Sleeping advances a virtual clock
+// instead of waiting. It must be called before Run, not concurrently with
+// it.
+func (m *Machine) StartScheduler(seed int64, quantum int) error {
+	if m.sched != nil {
+		return errors.New("scheduler already started")
+	}
+	m.sched = &scheduler{
+		rand:    rand.New(rand.NewPCG(uint64(seed), 0)), //nolint:gosec
+		quantum: int64(max(quantum, 0)),
+	}
+	return nil
+}
+
+// add registers a new goroutine, ready to run once picked.
+func (s *scheduler) add(goid int64) *schedThread {
+	t := &schedThread{goid: goid, wake: make(chan struct{}, 1)}
+	s.mu.Lock()
+	s.threads = append(s.threads, t)
+	s.mu.Unlock()
+	return t
+}
+
+// enter registers the main goroutine m of a top-level Run, and returns
+// once it is its turn to run.
+func (s *scheduler) enter(m *Machine) *schedThread {
+	t := s.add(m.goid)
+	s.mu.Lock()
+	s.main, s.debugInfoFn = t, m.debugInfoFn
+	if s.running == nil {
+		s.running = t
+		s.mu.Unlock()
+		return t
+	}
+	s.mu.Unlock()
+	t.wait(ctxDone(m.ctx))
+	return t
+}
+
+// exit unregisters t at the end of its goroutine, and passes its turn.
+func (s *scheduler) exit(t *schedThread) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.threads = slices.DeleteFunc(s.threads, func(u *schedThread) bool { return u == t })
+	if s.main == t {
+		s.main = nil
+	}
+	s.epoch++
+	if s.running == t {
+		s.running = s.pick()
+		s.running.signal()
+	}
+}
+
+// yield passes the turn of t, running since d on the virtual clock.
+func (s *scheduler) yield(t *schedThread, d time.Duration, done <-chan struct{}) {
+	s.mu.Lock()
+	s.now += d
+	s.epoch++
+	t.state = schedReady
+	s.switchLocked(t, done)
+}
+
+// sleep passes the turn of t for d on the virtual clock.
+func (s *scheduler) sleep(t *schedThread, d time.Duration, done <-chan struct{}) {
+	s.mu.Lock()
+	s.epoch++
+	t.state, t.until = schedSleeping, s.now+d
+	s.switchLocked(t, done)
+}
+
+// block passes the turn of t, blocked on operation b, and waits for one
+// of cases to be completed by another goroutine, or for the turn of t to
+// retry. In the former case, chosen is the index of the completed case,
+// and the turn of t has come. It returns a DeadlockError if no goroutine
+// can proceed.
+func (s *scheduler) block(t *schedThread, b Blocked, owned bool, cases []reflect.SelectCase, done <-chan struct{}) (chosen int, recv reflect.Value, recvOK bool, err *DeadlockError) {
+	s.mu.Lock()
+	if t.state != schedBlocked {
+		// t ran since its last turn.
+		s.epoch++
+	}
+	t.state, t.stuck, t.owned, t.blocked = schedBlocked, s.epoch, owned, b
+	next := s.pick()
+	s.running = next
+	if next == t {
+		err, t.err = t.err, nil
+		s.mu.Unlock()
+		return -1, recv, false, err
+	}
+	next.signal()
+	s.mu.Unlock()
+
+	// Wait in the channel operation, so that other goroutines can complete it.
+	n := len(cases)
+	cases = append(cases[:n:n], reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.wake)})
+	if done != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+	}
+	switch chosen, recv, recvOK = reflect.Select(cases); {
+	case chosen < n:
+		if t.wait(done) {
+			s.mu.Lock()
+			t.state = schedReady
+			s.mu.Unlock()
+		}
+		return chosen, recv, recvOK, nil
+	case chosen == n:
+		s.mu.Lock()
+		err, t.err = t.err, nil
+		s.mu.Unlock()
+	}
+	return -1, reflect.Value{}, false, err
+}
+
+// switchLocked passes the turn to the next goroutine, possibly t itself,
+// then waits for the turn of t. It must be called with s.mu held, which
+// it releases.
+func (s *scheduler) switchLocked(t *schedThread, done <-chan struct{}) {
+	next := s.pick()
+	s.running = next
+	s.mu.Unlock()
+	if next != t {
+		next.signal()
+		t.wait(done)
+	}
+}
+
+// pick draws the next goroutine to run among the ready ones, and the
+// blocked ones which may now proceed. If there are none, the virtual clock
+// advances to the next wake up, or, if all goroutines are blocked, a
+// deadlock is reported to the main one. It returns nil if there is no
+// goroutine left to run. It must be called with s.mu held.
+func (s *scheduler) pick() *schedThread {
+	for {
+		var ready []*schedThread
+		next, sleeping, owned := time.Duration(-1), false, true
+		for _, t := range s.threads {
+			if t.state == schedSleeping && t.until <= s.now {
+				t.state = schedReady
+			}
+			switch {
+			case t.state == schedReady || t.state == schedBlocked && t.stuck != s.epoch:
+				ready = append(ready, t)
+			case t.state == schedSleeping:
+				if !sleeping || t.until < next {
+					next = t.until
+				}
+				sleeping = true
+			default:
+				owned = owned && t.owned
+			}
+		}
+		switch {
+		case len(ready) > 0:
+			return ready[s.rand.IntN(len(ready))]
+		case sleeping:
+			s.now = next
+			continue
+		case len(s.threads) == 0:
+			return nil
+		case owned && s.main != nil:
+			s.main.err = s.deadlockError()
+			return s.main
+		case owned:
+			// The goroutines left by a previous Run wait for the next one.
+			return nil
+		}
+		// Native code may complete the blocked operations: poll them.
+		time.Sleep(schedPollDelay)
+		s.epoch++
+	}
+}
+
+// perm returns the order in which to try the n cases of a select.
+func (s *scheduler) perm(n int) []int {
+	if n == 1 {
+		return []int{0}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Perm(n)
+}
+
+// deadlockError returns the error reporting the blocked goroutines. It must
+// be called with s.mu held.
+func (s *scheduler) deadlockError() *DeadlockError {
+	gs := make([]Blocked, 0, len(s.threads))
+	for _, t := range s.threads {
+		gs = append(gs, t.blocked)
+	}
+	slices.SortFunc(gs, func(a, b Blocked) int { return cmp.Compare(a.Goroutine, b.Goroutine) })
+	return &DeadlockError{Goroutines: gs, debugInfoFn: s.debugInfoFn}
+}
+
+// signal wakes up t, if not nil, to run.
+func (t *schedThread) signal() {
+	if t == nil {
+		return
+	}
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for the turn of t. It returns false if done is closed first.
+func (t *schedThread) wait(done <-chan struct{}) bool {
+	select {
+	case <-t.wake:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// ctxDone returns the done channel of ctx, or nil if ctx is nil.
+func ctxDone(ctx context.Context) <-chan struct{} {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Done()
+}
+
+// schedSelect is chanSelect under the scheduler. The cases are tried
+// without blocking, in an order drawn by the scheduler, and the goroutine
+// lets the others run until one of them can proceed.
+func (m *Machine) schedSelect(cases []reflect.SelectCase, ip int, done <-chan struct{}) (chosen int, recv reflect.Value, recvOK bool, err error) {
+	s, t := m.sched, m.sthread
+	def := slices.IndexFunc(cases, func(c reflect.SelectCase) bool { return c.Dir == reflect.SelectDefault })
+	for {
+		for _, i := range s.perm(len(cases)) {
+			if i == def {
+				continue
+			}
+			if c, v, ok := reflect.Select([]reflect.SelectCase{cases[i], {Dir: reflect.SelectDefault}}); c == 0 {
+				s.yield(t, 0, done)
+				return i, v, ok, nil
+			}
+		}
+		if def >= 0 {
+			s.yield(t, 0, done)
+			return def, reflect.Value{}, false, nil
+		}
+		b := Blocked{Goroutine: m.goid, Op: m.code[ip].Op, Frame: Frame{IP: ip, Pos: m.code[ip].Pos}}
+		owned := m.deadlock != nil && m.deadlock.owns(cases)
+		var derr *DeadlockError
+		if chosen, recv, recvOK, derr = s.block(t, b, owned, cases, done); derr != nil {
+			return chosen, recv, recvOK, derr
+		}
+		if cancelled(done) {
+			return chosen, recv, recvOK, context.Cause(m.ctx)
+		}
+		if chosen >= 0 {
+			return chosen, recv, recvOK, nil
+		}
+	}
+}
+
+// schedMethod returns fn, the method name of recv, made to wait for its
+// turn instead of blocking the scheduler if it is a blocking method of
+// package sync, called at ip.
+func (m *Machine) schedMethod(recv reflect.Value, name string, fn reflect.Value, ip int) reflect.Value {
+	if recv.Kind() == reflect.Interface {
+		recv = recv.Elem()
+	}
+	if recv.Kind() != reflect.Pointer && recv.CanAddr() {
+		recv = recv.Addr()
+	}
+	if !fn.IsValid() || recv.Kind() != reflect.Pointer || recv.IsNil() || !recv.CanInterface() {
+		return fn
+	}
+	var try func() bool
+	switch p := recv.Interface().(type) {
+	case *sync.Mutex:
+		if name == "Lock" {
+			try = p.TryLock
+		}
+	case *sync.RWMutex:
+		switch name {
+		case "Lock":
+			try = p.TryLock
+		case "RLock":
+			try = p.TryRLock
+		}
+	case *sync.WaitGroup:
+		if name == "Wait" {
+			try = waitGroupIdle(p)
+		}
+	}
+	if try == nil {
+		return fn
+	}
+	return reflect.MakeFunc(fn.Type(), func([]reflect.Value) []reflect.Value {
+		m.schedPoll(try, ip)
+		return nil
+	})
+}
+
+// schedPoll calls try until it succeeds, letting the other goroutines run
+// meanwhile. It panics with a DeadlockError if none can make it succeed.
+func (m *Machine) schedPoll(try func() bool, ip int) {
+	s, t, done := m.sched, m.sthread, ctxDone(m.ctx)
+	b := Blocked{Goroutine: m.goid, Op: Call, Frame: Frame{IP: ip, Pos: m.code[ip].Pos}}
+	owned := m.deadlock != nil && !m.deadlock.callbacks.Load()
+	for !try() {
+		if _, _, _, err := s.block(t, b, owned, nil, done); err != nil {
+			panic(err)
+		}
+		if cancelled(done) {
+			return
+		}
+	}
+	s.yield(t, 0, done)
+}
+
+// waitGroupIdle returns a function reporting whether the counter of wg is
+// zero, so that Wait would not block, or nil if its layout is unknown.
+func waitGroupIdle(wg *sync.WaitGroup) func() bool {
+	f := reflect.ValueOf(wg).Elem().FieldByName("state")
+	if !f.IsValid() || f.Type() != reflect.TypeFor[atomic.Uint64]() {
+		return nil
+	}
+	state := (*atomic.Uint64)(f.Addr().UnsafePointer())
+	return func() bool { return state.Load()>>32 == 0 }
+}
@@ -0,0 +1,978 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"unsafe"
+)
+
+// Snapshot format: snapshotMagic, the version, the checksum of the code, the
+// number of globals, the table of reflect types, the parscan types held in
+// globals, then the memory regions, the maps, their contents, the roots and
+// the other parscan types. Values sharing memory refer to the same region,
+// at some offset, so that pointer aliasing survives a round trip.
+const (
+	snapshotMagic   = "parscan-snapshot\x00"
+	snapshotVersion = 1
+)
+
+// Snapshot is the state of a machine: its globals and, if taken from a
+// paused run, its stack. It shares memory with the machine until encoded.
+type Snapshot struct {
+	Globals []Value
+	Stack   *StackState // nil if not taken from a paused run
+	Code    uint64      // checksum of the code, which must be the same to restore
+
+	funcs  map[uintptr]Value // parscan funcs by native wrapper
+	fields map[uintptr]Value // parscan funcs by func field address
+}
+
+// StackState is the execution state of a paused run.
+type StackState struct {
+	Mem        []Value
+	IP, FP     int
+	Heap       []*Value
+	HeapFrames [][]*Value
+}
+
+// snapshotRoots is the encoded content of a snapshot.
+type snapshotRoots struct {
+	Globals []Value
+	Stack   *StackState
+}
+
+var (
+	errSnapshotProgram = errors.New("snapshot: not taken from the same program")
+
+	parscanFuncRtype  = reflect.TypeFor[ParscanFunc]()
+	reflectValueRtype = reflect.TypeFor[reflect.Value]()
+)
+
+// Snapshot returns the state of the globals of m, which must not be running.
+func (m *Machine) Snapshot() *Snapshot {
+	return &Snapshot{Globals: slices.Clone(m.globals), Code: codeSum(m.code), funcs: m.funcFieldsByFuncPtr, fields: m.funcFields}
+}
+
+// Snapshot returns the state of the program at the stop, with the stack of
+// the stopped goroutine. Restored, it resumes before the current instruction.
+func (s *Stopped) Snapshot() *Snapshot {
+	m := s.m
+	return &Snapshot{
+		Globals: slices.Clone(m.globals),
+		Stack:   &StackState{Mem: slices.Clone(s.mem), IP: s.ip, FP: s.fp, Heap: m.heap, HeapFrames: slices.Clone(m.heapFrames)},
+		Code:    codeSum(m.code[:m.baseCodeLen]),
+		funcs:   m.funcFieldsByFuncPtr,
+		fields:  m.funcFields,
+	}
+}
+
+// Restore sets the globals of m, except types, and its stack if any, from
+// snapshot s of the same program. A restored stack is resumed by Run.
+func (m *Machine) Restore(s *Snapshot) error {
+	if len(s.Globals) != len(m.globals) || s.Code != codeSum(m.code) {
+		return errSnapshotProgram
+	}
+	for k, v := range s.Globals {
+		if _, ok := globalType(m.globals[k]); !ok {
+			m.globals[k] = v
+		}
+	}
+	if st := s.Stack; st != nil {
+		m.mem, m.ip, m.fp = st.Mem, st.IP, st.FP
+		m.heap, m.heapFrames = st.Heap, st.HeapFrames
+	}
+	return nil
+}
+
+// codeSum returns a checksum of the instructions of code, without their
+// source positions.
+func codeSum(code Code) uint64 {
+	h := fnv.New64a()
+	var b []byte
+	for _, in := range code {
+		b = binary.AppendUvarint(b[:0], uint64(in.Op)) //nolint:gosec
+		b = binary.AppendVarint(b, int64(in.A))
+		b = binary.AppendVarint(b, int64(in.B))
+		_, _ = h.Write(b)
+	}
+	return h.Sum64()
+}
+
+// globalType returns the parscan type held by v, a global, if any.
+func globalType(v Value) (*Type, bool) {
+	if !v.ref.IsValid() || v.ref.Type() != typeRtype || v.ref.IsNil() {
+		return nil, false
+	}
+	return (*Type)(v.ref.UnsafePointer()), true
+}
+
+// Tags of references in snapshot contents.
+const (
+	refNil    = iota
+	refNative // a native package symbol, by package path and name
+	refRegion // a memory region, and an offset in it
+	refEmpty  // memory of zero size, or a slice of zero capacity
+	refMap    // a map, by index
+	refType   // a parscan type
+	refFunc   // a parscan func value
+)
+
+// nativeSym is a native package symbol.
+type nativeSym struct{ pkg, name string }
+
+// nativeKey identifies an object by address and type.
+type nativeKey struct {
+	p uintptr
+	t reflect.Type
+}
+
+// region is a memory region of a snapshot, of type typ, or the variable of
+// a native package symbol.
+type region struct {
+	start  unsafe.Pointer
+	size   uintptr
+	typ    reflect.Type
+	native *nativeSym
+}
+
+func (r *region) end() uintptr { return uintptr(r.start) + r.size }
+
+// snapshotEncoder encodes a snapshot.
+type snapshotEncoder struct {
+	*imageEncoder
+	s       *Snapshot
+	vars    map[nativeKey]nativeSym // native variables, by address
+	natives map[nativeKey]nativeSym // native pointers, maps, channels and funcs, by value
+	seen    map[nativeKey]bool
+	cands   []region // candidate regions, possibly overlapping
+	regions []region // disjoint, by address
+	mapIDs  map[uintptr]int
+	maps    []reflect.Value
+	nocode  bool // reject parscan funcs, for EncodeValues
+}
+
+// Encode writes the snapshot to w. Values of native package symbols, found
+// in pkgs, the values of packages by import path, are written by package
+// path and name. Channels, and funcs which are neither parscan funcs nor
+// native symbols, can not be encoded, except nil.
+func (s *Snapshot) Encode(w io.Writer, pkgs map[string]map[string]Value) error {
+	return s.encode(w, pkgs, false)
+}
+
+// EncodeValues writes vals to w in the snapshot format, without the code
+// checksum, so that DecodeValues can read them in another program. Types
+// and parscan funcs refer to the program, thus can not be encoded.
+func EncodeValues(w io.Writer, vals []Value, pkgs map[string]map[string]Value) error {
+	for _, v := range vals {
+		if _, ok := globalType(v); ok {
+			return errors.New("snapshot: cannot encode a type")
+		}
+	}
+	return (&Snapshot{Globals: vals}).encode(w, pkgs, true)
+}
+
+func (s *Snapshot) encode(w io.Writer, pkgs map[string]map[string]Value, nocode bool) error {
+	e := &snapshotEncoder{
+		imageEncoder: newImageEncoder("snapshot"),
+		s:            s,
+		seen:         map[nativeKey]bool{},
+		mapIDs:       map[uintptr]int{},
+		nocode:       nocode,
+	}
+	e.indexNatives(pkgs)
+	gtypes := map[*Type]int{}
+	e.globals = map[reflect.Type]int{}
+	for k, v := range s.Globals {
+		t, ok := globalType(v)
+		if !ok {
+			continue
+		}
+		if _, ok := gtypes[t]; !ok {
+			gtypes[t] = k
+		}
+		// Parscan struct types may be unique (recursive), thus referred to.
+		if rt := t.Rtype; rt != nil && rt.Kind() == reflect.Struct && rt.Name() == "" {
+			if _, ok := e.globals[rt]; !ok {
+				e.globals[rt] = k
+			}
+		}
+	}
+	roots := reflect.ValueOf(&snapshotRoots{Globals: s.Globals, Stack: s.Stack}).Elem()
+	e.collect(roots)
+	e.merge()
+
+	b := &e.body
+	b.len(len(e.regions))
+	for _, r := range e.regions {
+		if r.native != nil {
+			b.uint(refNative)
+			b.str(r.native.pkg)
+			b.str(r.native.name)
+			continue
+		}
+		b.uint(refRegion)
+		b.len(e.rtype(r.typ))
+	}
+	b.len(len(e.maps))
+	for _, mv := range e.maps {
+		b.len(e.rtype(mv.Type()))
+	}
+	for _, r := range e.regions {
+		if r.native == nil {
+			e.content(reflect.NewAt(r.typ, r.start).Elem())
+		}
+	}
+	for _, mv := range e.maps {
+		b.len(mv.Len())
+		for k, v := range mv.Seq2() {
+			e.content(addressable(k))
+			e.content(addressable(v))
+		}
+	}
+	e.content(roots)
+	// Parscan types: those held by globals by index, the others by content.
+	var vkinds, nodes imageBuf
+	for i := 0; i < len(e.vtypes); i++ {
+		if k, ok := gtypes[e.vtypes[i]]; ok {
+			vkinds.len(k + 1)
+			continue
+		}
+		vkinds.uint(0)
+		e.typeNode(&nodes, e.vtypes[i])
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	var head imageBuf
+	head = append(head, snapshotMagic...)
+	head.uint(snapshotVersion)
+	head.uint(s.Code)
+	head.len(len(s.Globals))
+	head.len(e.nrtypes)
+	bw := bufio.NewWriter(w)
+	for _, p := range [][]byte{head, e.rtypes, binary.AppendUvarint(nil, uint64(len(e.vtypes))), vkinds, e.body, nodes} {
+		if _, err := bw.Write(p); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// indexNatives indexes the symbols of pkgs, by address for variables and by
+// value for the others. The first in order of path and name is kept.
+func (e *snapshotEncoder) indexNatives(pkgs map[string]map[string]Value) {
+	e.vars, e.natives = map[nativeKey]nativeSym{}, map[nativeKey]nativeSym{}
+	for _, path := range slices.Sorted(maps.Keys(pkgs)) {
+		for _, name := range slices.Sorted(maps.Keys(pkgs[path])) {
+			rv := pkgs[path][name].ref
+			if !rv.IsValid() {
+				continue
+			}
+			sym := nativeSym{path, name}
+			if rv.CanAddr() {
+				if k := (nativeKey{uintptr(rv.Addr().UnsafePointer()), rv.Type()}); !hasKey(e.vars, k) {
+					e.vars[k] = sym
+				}
+			}
+			if k, ok := refKey(rv); ok && !hasKey(e.natives, k) {
+				e.natives[k] = sym
+			}
+		}
+	}
+}
+
+func hasKey(m map[nativeKey]nativeSym, k nativeKey) bool {
+	_, ok := m[k]
+	return ok
+}
+
+// refKey returns the key of the object referred to by rv, if any.
+func refKey(rv reflect.Value) (nativeKey, bool) {
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Chan, reflect.UnsafePointer:
+		if !rv.IsNil() {
+			return nativeKey{uintptr(rv.UnsafePointer()), rv.Type()}, true
+		}
+	case reflect.Func:
+		if !rv.IsNil() {
+			return nativeKey{funcValuePtr(addressable(rv)), rv.Type()}, true
+		}
+	}
+	return nativeKey{}, false
+}
+
+// addressable returns rv, or an addressable copy of it.
+func addressable(rv reflect.Value) reflect.Value {
+	if rv.CanAddr() {
+		return rv
+	}
+	c := reflect.New(rv.Type()).Elem()
+	c.Set(rv)
+	return c
+}
+
+// nativeOf returns the native symbol which is the value of rv, if any.
+func (e *snapshotEncoder) nativeOf(rv reflect.Value) (nativeSym, bool) {
+	k, ok := refKey(rv)
+	if !ok {
+		return nativeSym{}, false
+	}
+	sym, ok := e.natives[k]
+	return sym, ok
+}
+
+// parscanFunc returns the parscan func held by rv, a func, if any.
+func (e *snapshotEncoder) parscanFunc(rv reflect.Value) (Value, bool) {
+	if v, ok := e.s.fields[rv.Addr().Pointer()]; ok {
+		return v, true
+	}
+	if rv.IsNil() {
+		return Value{}, false
+	}
+	v, ok := e.s.funcs[funcValuePtr(rv)]
+	return v, ok
+}
+
+// collect records the memory regions and the maps referred to by rv, which
+// must be addressable.
+func (e *snapshotEncoder) collect(rv reflect.Value) {
+	t := rv.Type()
+	switch t.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() || t == typeRtype || t.Elem().Size() == 0 {
+			return
+		}
+		if _, ok := e.nativeOf(rv); !ok {
+			e.candidate(rv.UnsafePointer(), t.Elem())
+		}
+	case reflect.Slice:
+		if !rv.IsNil() && rv.Cap() > 0 && t.Elem().Size() > 0 {
+			e.candidate(rv.UnsafePointer(), reflect.ArrayOf(rv.Cap(), t.Elem()))
+		}
+	case reflect.Array:
+		if !isScalar(t.Elem()) {
+			for i := range rv.Len() {
+				e.collect(rv.Index(i))
+			}
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			return
+		}
+		if _, ok := e.nativeOf(rv); ok {
+			return
+		}
+		p := uintptr(rv.UnsafePointer())
+		if _, ok := e.mapIDs[p]; ok {
+			return
+		}
+		e.mapIDs[p] = len(e.maps)
+		e.maps = append(e.maps, rv)
+		for k, v := range rv.Seq2() {
+			e.collect(addressable(k))
+			e.collect(addressable(v))
+		}
+	case reflect.Struct:
+		switch t {
+		case valueRtype:
+			e.collectValue(*(*Value)(rv.Addr().UnsafePointer()))
+		case parscanFuncRtype:
+			e.collectValue((*ParscanFunc)(rv.Addr().UnsafePointer()).Val)
+		case reflectValueRtype:
+		default:
+			for i := range rv.NumField() {
+				f := rv.Field(i)
+				e.collect(reflect.NewAt(f.Type(), f.Addr().UnsafePointer()).Elem())
+			}
+		}
+	case reflect.Interface:
+		if !rv.IsNil() {
+			e.collect(addressable(rv.Elem()))
+		}
+	case reflect.Func:
+		if v, ok := e.parscanFunc(rv); ok {
+			e.collectValue(v)
+		}
+	}
+}
+
+func (e *snapshotEncoder) collectValue(v Value) {
+	switch {
+	case !v.ref.IsValid():
+	case v.ref.CanAddr():
+		if v.ref.Type().Size() > 0 {
+			e.candidate(v.ref.Addr().UnsafePointer(), v.ref.Type())
+		}
+	case !isNum(v.ref.Kind()):
+		e.collect(addressable(v.ref))
+	}
+}
+
+// isScalar reports whether values of type t refer to no other memory.
+func isScalar(t reflect.Type) bool {
+	k := t.Kind()
+	return isNum(k) || isComplex(k) || k == reflect.String
+}
+
+// candidate records the memory at p of type t, then what it refers to.
+func (e *snapshotEncoder) candidate(p unsafe.Pointer, t reflect.Type) {
+	k := nativeKey{uintptr(p), t}
+	if e.seen[k] {
+		return
+	}
+	e.seen[k] = true
+	r := region{start: p, size: t.Size(), typ: t}
+	if sym, ok := e.vars[k]; ok {
+		r.native = &sym
+		e.cands = append(e.cands, r)
+		return
+	}
+	e.cands = append(e.cands, r)
+	e.collect(reflect.NewAt(t, p).Elem())
+}
+
+// merge turns the candidate regions into disjoint regions: a region within
+// another is part of it, and overlapping arrays of the same element type
+// are joined.
+func (e *snapshotEncoder) merge() {
+	slices.SortFunc(e.cands, func(a, b region) int {
+		if c := cmp.Compare(uintptr(a.start), uintptr(b.start)); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.size, a.size); c != 0 {
+			return c
+		}
+		return cmp.Compare(nativeRank(b), nativeRank(a))
+	})
+	for _, c := range e.cands {
+		n := len(e.regions)
+		if n == 0 || uintptr(c.start) >= e.regions[n-1].end() {
+			e.regions = append(e.regions, c)
+			continue
+		}
+		r := &e.regions[n-1]
+		if c.end() <= r.end() {
+			continue
+		}
+		et := elemRtype(r.typ)
+		if r.native != nil || c.native != nil || et != elemRtype(c.typ) || (uintptr(c.start)-uintptr(r.start))%et.Size() != 0 {
+			e.fail("overlapping values of types %v and %v", r.typ, c.typ)
+			return
+		}
+		r.size = c.end() - uintptr(r.start)
+		r.typ = reflect.ArrayOf(int(r.size/et.Size()), et) //nolint:gosec
+	}
+}
+
+func nativeRank(r region) int {
+	if r.native != nil {
+		return 1
+	}
+	return 0
+}
+
+// elemRtype returns the element type of t if an array, or t.
+func elemRtype(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Array {
+		return t.Elem()
+	}
+	return t
+}
+
+// ref encodes the region holding address p, and the offset of p in it.
+func (e *snapshotEncoder) ref(p unsafe.Pointer) {
+	a := uintptr(p)
+	i, found := slices.BinarySearchFunc(e.regions, a, func(r region, a uintptr) int { return cmp.Compare(uintptr(r.start), a) })
+	if !found {
+		i--
+	}
+	if i < 0 || a >= e.regions[i].end() {
+		e.fail("no region at address %#x", a)
+		return
+	}
+	e.body.len(i)
+	e.body.uint(uint64(a - uintptr(e.regions[i].start)))
+}
+
+func (e *snapshotEncoder) native(sym nativeSym) {
+	e.body.uint(refNative)
+	e.body.str(sym.pkg)
+	e.body.str(sym.name)
+}
+
+// value encodes v: its kind (invalid, by content, addressable of zero size
+// or addressable), its type, its inline number and its content, or the
+// region of its content if addressable.
+func (e *snapshotEncoder) value(v Value) {
+	b := &e.body
+	if !v.ref.IsValid() {
+		b.uint(0)
+		b.uint(v.num) // frame data on the stack
+		return
+	}
+	t := v.ref.Type()
+	switch {
+	case !v.ref.CanAddr():
+		b.uint(1)
+	case t.Size() == 0:
+		b.uint(2)
+	default:
+		b.uint(3)
+	}
+	b.len(e.rtype(t))
+	b.uint(v.num)
+	switch {
+	case !v.ref.CanAddr():
+		if !isNum(t.Kind()) {
+			e.content(addressable(v.ref))
+		}
+	case t.Size() > 0:
+		e.ref(v.ref.Addr().UnsafePointer())
+	}
+}
+
+// content encodes the content of rv, which must be addressable.
+func (e *snapshotEncoder) content(rv reflect.Value) {
+	b := &e.body
+	t := rv.Type()
+	switch t.Kind() {
+	case reflect.Pointer:
+		switch sym, native := e.nativeOf(rv); {
+		case rv.IsNil():
+			b.uint(refNil)
+		case t == typeRtype:
+			b.uint(refType)
+			e.typeRef(b, (*Type)(rv.UnsafePointer()))
+		case native:
+			e.native(sym)
+		case t.Elem().Size() == 0:
+			b.uint(refEmpty)
+		default:
+			b.uint(refRegion)
+			e.ref(rv.UnsafePointer())
+		}
+	case reflect.Slice:
+		switch {
+		case rv.IsNil():
+			b.uint(refNil)
+		case rv.Cap() == 0 || t.Elem().Size() == 0:
+			b.uint(refEmpty)
+			b.len(rv.Len())
+			b.len(rv.Cap())
+		default:
+			b.uint(refRegion)
+			b.len(rv.Len())
+			b.len(rv.Cap())
+			e.ref(rv.UnsafePointer())
+		}
+	case reflect.Array:
+		for i := range rv.Len() {
+			e.content(rv.Index(i))
+		}
+	case reflect.Map:
+		switch sym, native := e.nativeOf(rv); {
+		case rv.IsNil():
+			b.uint(refNil)
+		case native:
+			e.native(sym)
+		default:
+			b.uint(refMap)
+			b.len(e.mapIDs[uintptr(rv.UnsafePointer())])
+		}
+	case reflect.Struct:
+		switch t {
+		case valueRtype:
+			e.value(*(*Value)(rv.Addr().UnsafePointer()))
+		case parscanFuncRtype:
+			if e.nocode {
+				e.fail("cannot encode value of type %v", t)
+				return
+			}
+			pf := (*ParscanFunc)(rv.Addr().UnsafePointer())
+			e.value(pf.Val)
+			var gt reflect.Type
+			if pf.GF.IsValid() {
+				gt = pf.GF.Type()
+			}
+			e.rtypeRef(b, gt)
+		case reflectValueRtype:
+			e.fail("cannot encode value of type %v", t)
+		default:
+			for i := range rv.NumField() {
+				f := rv.Field(i)
+				e.content(reflect.NewAt(f.Type(), f.Addr().UnsafePointer()).Elem())
+			}
+		}
+	case reflect.Interface:
+		if rv.IsNil() {
+			b.uint(0)
+			return
+		}
+		b.len(e.rtype(rv.Elem().Type()) + 1)
+		e.content(addressable(rv.Elem()))
+	case reflect.Func:
+		if v, ok := e.parscanFunc(rv); ok {
+			b.uint(refFunc)
+			e.value(v)
+			return
+		}
+		fallthrough
+	case reflect.Chan, reflect.UnsafePointer:
+		switch sym, native := e.nativeOf(rv); {
+		case rv.IsNil():
+			b.uint(refNil)
+		case native:
+			e.native(sym)
+		default:
+			e.fail("cannot encode value of type %v", t)
+		}
+	default:
+		e.imageEncoder.content(rv)
+	}
+}
+
+// snapshotDecoder decodes a snapshot for a machine.
+type snapshotDecoder struct {
+	*imageDecoder
+	m      *Machine
+	bases  []unsafe.Pointer // regions
+	types  []reflect.Type   // of regions
+	rtypes []reflect.Type   // of regions, nil if native
+	maps   []reflect.Value
+}
+
+// DecodeSnapshot reads a snapshot written by Snapshot.Encode, which must be
+// of the program of m. Native symbols and named types are resolved in pkgs,
+// the values of packages by import path.
+func (m *Machine) DecodeSnapshot(r io.Reader, pkgs map[string]map[string]Value) (*Snapshot, error) {
+	return decodeSnapshot(r, pkgs, m)
+}
+
+// DecodeValues reads values written by EncodeValues, in any program.
+// Native symbols and named types are resolved in pkgs.
+func DecodeValues(r io.Reader, pkgs map[string]map[string]Value) ([]Value, error) {
+	s, err := decodeSnapshot(r, pkgs, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.Globals, nil
+}
+
+// decodeSnapshot decodes a snapshot of the program of m, or values if m is nil.
+func decodeSnapshot(r io.Reader, pkgs map[string]map[string]Value, m *Machine) (s *Snapshot, err error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rest, ok := bytes.CutPrefix(buf, []byte(snapshotMagic))
+	if !ok {
+		return nil, errors.New("snapshot: invalid format")
+	}
+	var globals []Value
+	if m != nil {
+		globals = m.globals
+	}
+	d := &snapshotDecoder{imageDecoder: &imageDecoder{buf: rest, pkgs: pkgs, prefix: "snapshot: ", globals: globals}, m: m}
+	if v := d.uint(); v != snapshotVersion {
+		return nil, fmt.Errorf("snapshot: unsupported version %d", v)
+	}
+	code, nglobals := d.uint(), d.index()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if m != nil && (code != codeSum(m.code) || nglobals != len(m.globals)) {
+		return nil, errSnapshotProgram
+	}
+	defer func() {
+		// Inconsistent content makes reflect panic.
+		if r := recover(); r != nil {
+			s, err = nil, fmt.Errorf("snapshot: invalid content: %v", r)
+		}
+	}()
+
+	for range d.len() {
+		d.rtype()
+	}
+	d.vtypes = make([]*Type, d.len())
+	nodes := make([]bool, len(d.vtypes))
+	for i := range d.vtypes {
+		k := d.nilIndex()
+		if k < 0 {
+			d.vtypes[i], nodes[i] = &Type{}, true
+			continue
+		}
+		if k >= len(globals) {
+			panic(fmt.Sprintf("invalid global type %d", k))
+		}
+		t, ok := globalType(globals[k])
+		if !ok {
+			panic(fmt.Sprintf("invalid global type %d", k))
+		}
+		d.vtypes[i] = t
+	}
+	n := d.len()
+	d.bases, d.types, d.rtypes = make([]unsafe.Pointer, n), make([]reflect.Type, n), make([]reflect.Type, n)
+	for i := range n {
+		switch d.uint() {
+		case refNative:
+			rv := d.native()
+			if !rv.CanAddr() {
+				d.fail("not a variable")
+				return nil, d.err
+			}
+			d.bases[i], d.types[i] = rv.Addr().UnsafePointer(), rv.Type()
+		case refRegion:
+			t := d.rtypeAt(d.index())
+			d.bases[i], d.types[i], d.rtypes[i] = reflect.New(t).UnsafePointer(), t, t
+		default:
+			d.fail("invalid region")
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+	d.maps = make([]reflect.Value, d.len())
+	for i := range d.maps {
+		d.maps[i] = reflect.MakeMap(d.rtypeAt(d.index()))
+	}
+	for i, t := range d.rtypes {
+		if t != nil {
+			d.content(reflect.NewAt(t, d.bases[i]).Elem())
+		}
+	}
+	for _, mv := range d.maps {
+		t := mv.Type()
+		for range d.len() {
+			k := reflect.New(t.Key()).Elem()
+			d.content(k)
+			v := reflect.New(t.Elem()).Elem()
+			d.content(v)
+			mv.SetMapIndex(k, v)
+		}
+	}
+	var roots snapshotRoots
+	d.content(reflect.ValueOf(&roots).Elem())
+	for i, t := range d.vtypes {
+		if nodes[i] {
+			d.typeNode(t)
+		}
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail("trailing data")
+	}
+	if d.err == nil && len(roots.Globals) != nglobals {
+		d.fail("invalid globals")
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &Snapshot{Globals: roots.Globals, Stack: roots.Stack, Code: code}, nil
+}
+
+// native returns the value of a native symbol.
+func (d *snapshotDecoder) native() reflect.Value {
+	pkg, name := d.str(), d.str()
+	if v, ok := d.pkgs[pkg][name]; ok && v.ref.IsValid() {
+		return v.ref
+	}
+	d.fail("symbol not found: %s.%s", pkg, name)
+	return reflect.Value{}
+}
+
+// ref returns the address in a region of an object of type t.
+func (d *snapshotDecoder) ref(t reflect.Type) unsafe.Pointer {
+	i, off := d.index(), d.uint()
+	if i >= len(d.bases) || off > uint64(d.types[i].Size()) || !holds(d.types[i], uintptr(off), t) {
+		panic("invalid region reference")
+	}
+	return unsafe.Add(d.bases[i], off)
+}
+
+// holds reports whether an object of type rt has an object of type t at
+// offset off, not beyond its size: itself, one of its fields or elements,
+// or a run of elements.
+func holds(rt reflect.Type, off uintptr, t reflect.Type) bool {
+	switch {
+	case t.Size() == 0:
+		return off <= rt.Size()
+	case t.Size() > rt.Size()-off:
+		return false
+	case off == 0 && sameLayout(rt, t):
+		return true
+	}
+	et, n := rt, uintptr(1)
+	switch rt.Kind() {
+	case reflect.Struct:
+		for i := range rt.NumField() {
+			f := rt.Field(i)
+			if off >= f.Offset && off-f.Offset < f.Type.Size() && holds(f.Type, off-f.Offset, t) {
+				return true
+			}
+		}
+	case reflect.Array:
+		et, n = rt.Elem(), uintptr(rt.Len())
+		if i := off / et.Size(); i < n && holds(et, off%et.Size(), t) {
+			return true
+		}
+	}
+	// Merged regions and slices share arrays of their element type.
+	return t.Kind() == reflect.Array && sameLayout(et, t.Elem()) && off%et.Size() == 0 &&
+		off/et.Size()+uintptr(t.Len()) <= n
+}
+
+// sameLayout reports whether a pointer to a may be converted to a pointer to b.
+func sameLayout(a, b reflect.Type) bool {
+	return a == b || reflect.PointerTo(a).ConvertibleTo(reflect.PointerTo(b))
+}
+
+// set sets rv to x, converted to the type of rv if needed.
+func set(rv, x reflect.Value) {
+	if !x.IsValid() {
+		return
+	}
+	if x.Type() != rv.Type() {
+		x = x.Convert(rv.Type())
+	}
+	rv.Set(x)
+}
+
+// value decodes a value encoded by snapshotEncoder.value.
+func (d *snapshotDecoder) value() Value {
+	flags := d.uint()
+	if flags == 0 {
+		return Value{num: d.uint()}
+	}
+	if d.err != nil {
+		return Value{}
+	}
+	t := d.rtypeAt(d.index())
+	num := d.uint()
+	switch flags {
+	case 1:
+		if isNum(t.Kind()) {
+			return Value{num: num, ref: reflect.Zero(t)}
+		}
+		rv := reflect.New(t).Elem()
+		d.content(rv)
+		return Value{num: num, ref: rv.Convert(t)} // not addressable
+	case 2:
+		return Value{num: num, ref: reflect.New(t).Elem()}
+	case 3:
+		return Value{num: num, ref: reflect.NewAt(t, d.ref(t)).Elem()}
+	}
+	d.fail("invalid value")
+	return Value{}
+}
+
+// content decodes the content of rv, which must be addressable.
+func (d *snapshotDecoder) content(rv reflect.Value) {
+	if d.err != nil {
+		return
+	}
+	t := rv.Type()
+	switch t.Kind() {
+	case reflect.Pointer:
+		switch d.uint() {
+		case refNil:
+		case refType:
+			if vt := d.typeRef(); vt != nil {
+				set(rv, reflect.ValueOf(vt))
+			}
+		case refNative:
+			set(rv, d.native())
+		case refEmpty:
+			set(rv, reflect.New(t.Elem()))
+		case refRegion:
+			set(rv, reflect.NewAt(t.Elem(), d.ref(t.Elem())))
+		default:
+			d.fail("invalid pointer")
+		}
+	case reflect.Slice:
+		switch d.uint() {
+		case refNil:
+		case refEmpty:
+			n, c := d.index(), d.index()
+			if n > c || c > 0 && t.Elem().Size() > 0 {
+				panic("invalid slice")
+			}
+			set(rv, reflect.MakeSlice(t, n, c))
+		case refRegion:
+			n, c := d.index(), d.index()
+			if n > c {
+				panic("invalid slice")
+			}
+			at := reflect.ArrayOf(c, t.Elem())
+			set(rv, reflect.NewAt(at, d.ref(at)).Elem().Slice3(0, n, c))
+		default:
+			d.fail("invalid slice")
+		}
+	case reflect.Array:
+		for i := range rv.Len() {
+			d.content(rv.Index(i))
+		}
+	case reflect.Map:
+		switch d.uint() {
+		case refNil:
+		case refNative:
+			set(rv, d.native())
+		case refMap:
+			i := d.index()
+			if i >= len(d.maps) {
+				panic("invalid map")
+			}
+			set(rv, d.maps[i])
+		default:
+			d.fail("invalid map")
+		}
+	case reflect.Struct:
+		switch t {
+		case valueRtype:
+			*(*Value)(rv.Addr().UnsafePointer()) = d.value()
+		case parscanFuncRtype:
+			pf := (*ParscanFunc)(rv.Addr().UnsafePointer())
+			pf.Val = d.value()
+			if gt := d.rtypeRef(); gt != nil {
+				if d.m == nil {
+					panic("invalid func")
+				}
+				pf.GF = d.m.wrapForFunc(pf.Val, gt)
+			}
+		default:
+			for i := range rv.NumField() {
+				f := rv.Field(i)
+				d.content(reflect.NewAt(f.Type(), f.Addr().UnsafePointer()).Elem())
+			}
+		}
+	case reflect.Interface:
+		if i := d.nilIndex(); i >= 0 {
+			v := reflect.New(d.rtypeAt(i)).Elem()
+			d.content(v)
+			rv.Set(v)
+		}
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		switch d.uint() {
+		case refNil:
+		case refNative:
+			set(rv, d.native())
+		case refFunc:
+			if t.Kind() != reflect.Func || d.m == nil {
+				panic("invalid func")
+			}
+			d.m.setFuncField(rv, d.value())
+		default:
+			d.fail("invalid value of type %v", t)
+		}
+	default:
+		d.imageDecoder.content(rv)
+	}
+}
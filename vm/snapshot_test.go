@@ -0,0 +1,152 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// variable returns an addressable value holding x, like a global variable.
+func variable[T any](x T) Value {
+	v := reflect.New(reflect.TypeFor[T]()).Elem()
+	v.Set(reflect.ValueOf(x))
+	return FromReflect(v)
+}
+
+func TestSnapshotAliasing(t *testing.T) {
+	var native, native2 string
+	pkgs := map[string]map[string]Value{"p": {"V": FromReflect(reflect.ValueOf(&native).Elem())}}
+	pkgs2 := map[string]map[string]Value{"p": {"V": FromReflect(reflect.ValueOf(&native2).Elem())}}
+
+	arr := make([]int, 4, 6)
+	cell := &Value{num: 1, ref: zint}
+	cyclic := []any{nil}
+	cyclic[0] = cyclic
+	typ := &Type{Name: "T", Rtype: reflect.TypeFor[int]()}
+	globals := []Value{
+		variable(arr),
+		variable(arr[2:5]),
+		variable(&arr[1]),
+		variable(map[string]*int{"a": &arr[3]}),
+		variable(Closure{Code: 7, Heap: []*Value{cell}}),
+		variable(Closure{Code: 9, Heap: []*Value{cell}}),
+		ValueOf(typ),
+		variable[any](Iface{Typ: typ, Val: ValueOf(3)}),
+		variable(cyclic),
+		variable(&native),
+	}
+
+	m := NewMachine()
+	m.Push(globals...)
+	var buf bytes.Buffer
+	if err := m.Snapshot().Encode(&buf, pkgs); err != nil {
+		t.Fatal(err)
+	}
+	m2 := NewMachine()
+	typ2 := &Type{Name: "T", Rtype: reflect.TypeFor[int]()}
+	m2.Push(make([]Value, len(globals))...)
+	m2.globals[6] = ValueOf(typ2)
+	s, err := m2.DecodeSnapshot(&buf, pkgs2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+
+	g := func(i int) any { return m2.globals[i].ref.Interface() }
+	arr2, tail2 := g(0).([]int), g(1).([]int)
+	*g(2).(*int) = 1
+	tail2[0] = 2
+	*g(3).(map[string]*int)["a"] = 3
+	if !reflect.DeepEqual(arr2, []int{0, 1, 2, 3}) || cap(arr2) != 6 || cap(tail2) != 4 {
+		t.Errorf("slices and pointers not aliased: %v, cap %d, %d", arr2, cap(arr2), cap(tail2))
+	}
+	c1, c2 := g(4).(Closure), g(5).(Closure)
+	if c1.Code != 7 || c2.Code != 9 || c1.Heap[0] != c2.Heap[0] || c1.Heap[0].num != 1 {
+		t.Errorf("closure cells not shared: %v, %v", c1, c2)
+	}
+	if ifc := g(7).(Iface); ifc.Typ != typ2 || ifc.Val.Int() != 3 {
+		t.Errorf("got interface %v, want type %p", ifc, typ2)
+	}
+	if c := g(8).([]any); &c[0] != &c[0].([]any)[0] {
+		t.Error("cycle not preserved")
+	}
+	if p := g(9).(*string); p != &native2 {
+		t.Errorf("got pointer %p, want native %p", p, &native2)
+	}
+
+	m2.Push(Value{})
+	if _, err := m2.DecodeSnapshot(bytes.NewReader(nil), pkgs2); err == nil {
+		t.Error("invalid snapshot decoded")
+	}
+	if err := m2.Restore(s); err == nil {
+		t.Error("snapshot of another program restored")
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	encode := func(globals ...Value) []byte {
+		m := NewMachine()
+		m.Push(globals...)
+		var buf bytes.Buffer
+		if err := m.Snapshot().Encode(&buf, nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	decode := func(b []byte, n int) error {
+		m := NewMachine()
+		m.Push(make([]Value, n)...)
+		_, err := m.DecodeSnapshot(bytes.NewReader(b), nil)
+		return err
+	}
+
+	arr := &[3]int{0, 1 << 40, 5}
+	p := &struct {
+		A int
+		S []int
+	}{S: make([]int, 2, 4)}
+	valid := encode(variable(arr), variable(&arr[1]), variable(arr[1:]), variable(p), variable(&p.S), variable(p.S[1:]))
+	if err := decode(valid, 6); err != nil {
+		t.Fatal(err)
+	}
+	for n := range len(valid) {
+		if err := decode(valid[:n], 6); err == nil {
+			t.Errorf("snapshot truncated to %d bytes decoded", n)
+		}
+	}
+
+	// A string forged in the memory of integers, its address being 1<<40.
+	forged := encode(variable(arr), variable((*string)(unsafe.Pointer(&arr[1]))))
+	if err := decode(forged, 2); err == nil || !strings.Contains(err.Error(), "invalid region reference") {
+		t.Errorf("got error %v, want invalid region reference", err)
+	}
+}
+
+func TestEncodeValues(t *testing.T) {
+	arr := []int{1, 2, 3}
+	vals := []Value{ValueOf(arr), ValueOf(&arr[1]), ValueOf("s"), {}}
+	var buf bytes.Buffer
+	if err := EncodeValues(&buf, vals, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Values do not depend on the code of a program.
+	got, err := DecodeValues(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arr2, p := got[0].ref.Interface().([]int), got[1].ref.Interface().(*int)
+	if *p = 5; !reflect.DeepEqual(arr2, []int{1, 5, 3}) || got[2].ref.Interface() != "s" || got[3].IsValid() {
+		t.Errorf("got %v", got)
+	}
+
+	if err := EncodeValues(&bytes.Buffer{}, []Value{ValueOf(&Type{Rtype: reflect.TypeFor[int]()})}, nil); err == nil {
+		t.Error("type encoded")
+	}
+	if err := EncodeValues(&bytes.Buffer{}, []Value{variable(ParscanFunc{Val: ValueOf(3)})}, nil); err == nil {
+		t.Error("parscan func encoded")
+	}
+}
@@ -0,0 +1,161 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NoPos is the position of instructions which do not come from the source,
+// such as the calls to init and main functions added by the interpreter.
+// Their frames are omitted from stack traces.
+const NoPos Pos = -1
+
+// Frame is an entry of an interpreted stack trace. The symbolic fields are
+// set only once resolved with DebugInfo.
+type Frame struct {
+	IP   int    // code address of the current instruction in the frame
+	Pos  Pos    // source position of the instruction at IP
+	Func string // qualified name of the function containing IP, "" if top level
+	Args bool   // true if the function has a receiver or parameters
+	File string // source name
+	Line int    // source line, 0 if unknown
+	Col  int    // source column
+
+	Elided int // number of calling frames replaced by tail calls
+}
+
+// ResolveFrame returns f with its function name and source location set.
+func (d *DebugInfo) ResolveFrame(f Frame) Frame {
+	if d == nil {
+		return f
+	}
+	fi := d.funcInfo(d.funcAddr(f.IP))
+	f.Func, f.Args = fi.Name, fi.Args
+	f.File, f.Line, f.Col = d.Sources.Resolve(int(f.Pos))
+	return f
+}
+
+// PanicError is the error returned by Run for a panic that the interpreted
+// program did not recover. It carries the panic value and the stack trace of
+// the panicking goroutine at the point of the panic.
+type PanicError struct {
+	Value     any     // value passed to panic
+	Goroutine int64   // id of the panicking goroutine (1 is the main one)
+	Stack     []Frame // innermost frame first
+
+	debugInfoFn func() *DebugInfo
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic: %v", e.Value) }
+
+// Frames returns the stack trace of the panicking goroutine, innermost frame
+// first, resolved with the debug information of the program if available.
+// A frame in the body of an inlined call is reported as the frame of the
+// inlined function, followed by the frame of the call.
+func (e *PanicError) Frames() []Frame {
+	var di *DebugInfo
+	if e.debugInfoFn != nil {
+		di = e.debugInfoFn()
+	}
+	return di.resolveFrames(e.Stack)
+}
+
+// resolveFrames returns the frames of stack resolved with d, a frame in the
+// body of an inlined call followed by the frame of the call.
+func (d *DebugInfo) resolveFrames(stack []Frame) []Frame {
+	frames := make([]Frame, 0, len(stack))
+	for _, f := range stack {
+		if c, ok := d.InlinedAt(f.IP); ok {
+			r := d.ResolveFrame(f)
+			r.Func, r.Args, r.Elided = c.Func, false, 0
+			if addr := d.labelAddr(c.Func); addr >= 0 {
+				fi := d.funcInfo(addr)
+				r.Func, r.Args = fi.Name, fi.Args
+			}
+			frames = append(frames, r)
+			f.Pos = c.Pos
+		}
+		frames = append(frames, d.ResolveFrame(f))
+	}
+	return frames
+}
+
+// Trace returns the stack trace of the panicking goroutine, formatted like
+// Go tracebacks, with function names and source positions when debug
+// information is available.
+func (e *PanicError) Trace() string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "goroutine %d [running]:\n", e.Goroutine)
+	for _, f := range e.Frames() {
+		writeFrame(&sb, f)
+	}
+	return sb.String()
+}
+
+// writeFrame writes the function name and source location of the resolved
+// frame f to sb.
+func writeFrame(sb *strings.Builder, f Frame) {
+	name, args := f.Func, ""
+	if name == "" {
+		name = fmt.Sprintf("ip:%d", f.IP)
+	}
+	if f.Args {
+		args = "..."
+	}
+	_, _ = fmt.Fprintf(sb, "%s(%s)\n", name, args)
+	if f.Line > 0 {
+		_, _ = fmt.Fprintf(sb, "\t%s:%d:%d\n", f.File, f.Line, f.Col)
+	}
+	if f.Elided > 0 {
+		_, _ = fmt.Fprintf(sb, "...%d frames elided by tail calls...\n", f.Elided)
+	}
+}
+
+// callers returns the interpreted stack at ip for the frame chain starting at
+// fp, innermost first. Frames returning to the sentinel instructions past
+// baseCodeLen (goroutine exit, deferred call return) are not call sites and
+// are skipped, as well as the calls at NoPos.
+func (m *Machine) callers(ip, fp int, mem []Value) []Frame {
+	var frames []Frame
+	m.walkStack(ip, fp, mem, func(f Frame, _ int) { frames = append(frames, f) })
+	return frames
+}
+
+// walkStack calls fn for each frame of the stack returned by callers, with
+// the frame pointer of the function executing it.
+func (m *Machine) walkStack(ip, fp int, mem []Value, fn func(f Frame, fp int)) {
+	code := m.code
+	fn(Frame{IP: ip, Pos: code[ip].Pos, Elided: elided(mem, fp)}, fp)
+	for fp >= frameOverhead && fp <= len(mem) {
+		ret := int(int32(mem[fp-2].num)) - 1 //nolint:gosec
+		prev := int(mem[fp-1].num & fpMask)  //nolint:gosec
+		if ret >= 0 && ret < m.baseCodeLen && code[ret].Pos != NoPos {
+			fn(Frame{IP: ret, Pos: code[ret].Pos, Elided: elided(mem, prev)}, prev)
+		}
+		fp = prev
+	}
+}
+
+// startPanic starts unwinding the program with panic value v, raised by the
+// instruction at ip in the frame fp.
+func (m *Machine) startPanic(v Value, ip, fp int, mem []Value) {
+	m.panicking = true
+	m.panicVal = v
+	m.panicStack = m.callers(ip, fp, mem)
+	if m.tracer != nil {
+		m.tracer.Panic(m.goid, v.Interface())
+	}
+}
+
+// panicError returns the error reported by Run for an unrecovered panic.
+func (m *Machine) panicError() error {
+	if e, ok := limitError(m.panicVal); ok {
+		return e
+	}
+	return &PanicError{
+		Value:       m.panicVal.Interface(),
+		Goroutine:   m.goid,
+		Stack:       m.panicStack,
+		debugInfoFn: m.debugInfoFn,
+	}
+}
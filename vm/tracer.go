@@ -0,0 +1,166 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Tracer receives the execution events of a machine, of its goroutines and
+// of its re-entrant runners, when installed with SetTracer. Events are
+// reported synchronously by the goroutine concerned, identified by goid, so
+// the methods must be safe for concurrent use and should return quickly.
+type Tracer interface {
+	// Call and Return report the entry and exit of an interpreted function,
+	// including deferred calls and frames unwound by a panic.
+	Call(goid int64, fn string)
+	Return(goid int64, fn string)
+
+	// NativeCall and NativeReturn surround a call to a native Go function.
+	NativeCall(goid int64, fn string)
+	NativeReturn(goid int64, fn string)
+
+	// GoStart reports the spawning by goid of goroutine child, running fn.
+	// GoExit reports the end of a goroutine.
+	GoStart(goid, child int64, fn string)
+	GoExit(goid int64)
+
+	// Panic reports a panic, and Recover the recovery of a panic value.
+	Panic(goid int64, v any)
+	Recover(goid int64, v any)
+
+	// Chan reports a channel operation, once done: op is ChanSend,
+	// ChanRecv, ChanClose or SelectExec, and blocked is the time spent in
+	// the operation.
+	Chan(goid int64, op Op, blocked time.Duration)
+}
+
+// tracing is the tracer of a machine, shared with its goroutines and
+// runners, with the function names resolved for it.
+type tracing struct {
+	Tracer
+
+	mu      sync.Mutex
+	funcs   map[int]string     // interpreted function names by code address
+	natives map[uintptr]string // native function names by code pointer
+}
+
+// SetTracer installs t to receive the execution events of the program, or
+// removes the tracer if t is nil. Without a tracer, execution is not
+// slowed down. It must be called before Run, not concurrently with it.
+func (m *Machine) SetTracer(t Tracer) {
+	if t == nil {
+		m.tracer = nil
+		return
+	}
+	m.tracer = &tracing{Tracer: t, funcs: map[int]string{}, natives: map[uintptr]string{}}
+}
+
+// funcName returns the name of the interpreted function at code address ip.
+func (t *tracing) funcName(m *Machine, ip int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if name, ok := t.funcs[ip]; ok {
+		return name
+	}
+	var name string
+	if m.debugInfoFn != nil {
+		// Resolve all the functions at once, the debug information being
+		// built on demand.
+		di := m.debugInfoFn()
+		for addr := range di.Ends {
+			if _, ok := t.funcs[addr]; !ok {
+				t.funcs[addr] = di.Labels[addr]
+			}
+		}
+		name = t.funcs[ip]
+	}
+	if name == "" {
+		name = fmt.Sprintf("func@%d", ip)
+	}
+	t.funcs[ip] = name
+	return name
+}
+
+// nativeName returns the name of the native function rv.
+func (t *tracing) nativeName(rv reflect.Value) string {
+	p := rv.Pointer()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	name, ok := t.natives[p]
+	if !ok {
+		name = rv.Type().String()
+		if f := runtime.FuncForPC(p); f != nil {
+			name = f.Name()
+		}
+		t.natives[p] = name
+	}
+	return name
+}
+
+// traceCall reports the call of the interpreted function at ip.
+func (m *Machine) traceCall(ip int) {
+	name := m.tracer.funcName(m, ip)
+	m.traceStack = append(m.traceStack, name)
+	m.tracer.Call(m.goid, name)
+}
+
+// traceReturn reports the return from the current interpreted function.
+func (m *Machine) traceReturn() {
+	n := len(m.traceStack) - 1
+	if n < 0 {
+		return
+	}
+	name := m.traceStack[n]
+	m.traceStack = m.traceStack[:n]
+	m.tracer.Return(m.goid, name)
+}
+
+// traceHook reports the interpreted calls and returns, from the Hook
+// instruction before op at ip. A call is reported once the call instruction
+// has jumped elsewhere than to the next address or the panic sentinel.
+func (m *Machine) traceHook(op Op, ip, fp int, mem []Value, panicAddr int) {
+	if at := m.traceCallAt - 1; at >= 0 && ip != at && ip != at+1 && ip != panicAddr {
+		if m.traceTail {
+			m.traceReturn()
+		}
+		m.traceCall(ip)
+	}
+	m.traceCallAt, m.traceTail = 0, false
+	switch op {
+	case Call, CallImm:
+		m.traceCallAt = ip + 1
+	case TailCall:
+		m.traceCallAt, m.traceTail = ip+1, mem[fp-3].num == 0 && mem[fp-2].num>>48 != 0
+	case Return:
+		if dh := int(mem[fp-3].num); dh == 0 { //nolint:gosec
+			m.traceReturn()
+		} else if mem[dh-2].num&3 == 0 {
+			m.traceCallAt = ip + 1 // deferred interpreted function
+		}
+	case GetLocalReturn:
+		m.traceReturn()
+	}
+}
+
+// traceNativeCall reports the call of the native function rv, until
+// traceNativeReturn.
+func (m *Machine) traceNativeCall(rv reflect.Value) {
+	m.traceNative = m.tracer.nativeName(rv)
+	m.tracer.NativeCall(m.goid, m.traceNative)
+}
+
+// traceNativeReturn reports the return from the current native call, if any.
+func (m *Machine) traceNativeReturn() {
+	if name := m.traceNative; name != "" {
+		m.traceNative = ""
+		m.tracer.NativeReturn(m.goid, name)
+	}
+}
+
+// traceChan reports the channel operation op, started at start.
+func (m *Machine) traceChan(op Op, start time.Time) {
+	m.tracer.Chan(m.goid, op, time.Since(start))
+}
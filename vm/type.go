@@ -285,6 +285,8 @@ func uintOrUintptr(ref reflect.Value) reflect.Value {
 
 func isFloat(k reflect.Kind) bool { return k == reflect.Float32 || k == reflect.Float64 }
 
+func isComplex(k reflect.Kind) bool { return k == reflect.Complex64 || k == reflect.Complex128 }
+
 func numBits(rv reflect.Value) uint64 {
 	switch rv.Kind() {
 	case reflect.Bool:
@@ -548,6 +550,10 @@ func (v Value) Equal(u Value) bool {
 		return v.IfaceVal().Val.Equal(u)
 	}
 	if isNum(v.ref.Kind()) && isNum(u.ref.Kind()) {
+		if isFloat(v.ref.Kind()) && isFloat(u.ref.Kind()) {
+			// NaN is not equal to itself, and -0 equals +0.
+			return v.Float() == u.Float()
+		}
 		return v.num == u.num
 	}
 	// Untyped nil is stored as an invalid ref.
@@ -0,0 +1,563 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// maxVerifyErrors is the number of problems reported by Verify.
+const maxVerifyErrors = 10
+
+// VerifyError is a problem found by Verify in an instruction, or in a global.
+type VerifyError struct {
+	IP     int         // index of the instruction in code, or -1
+	In     Instruction // the faulty instruction
+	Global int         // index of the faulty global, if IP is -1
+	Msg    string
+}
+
+func (e *VerifyError) Error() string {
+	if e.IP < 0 {
+		return fmt.Sprintf("verify: global %d: %s", e.Global, e.Msg)
+	}
+	return fmt.Sprintf("verify: %d: %v: %s", e.IP, e.In.Op, e.Msg)
+}
+
+// Verify checks that code, executed with data in globals, only refers to
+// the machine memory it owns: opcodes and operands are valid, jumps stay in
+// code, global indexes are below len(data), local indexes stay out of the
+// frame bookkeeping slots and below the locals reserved by Grow, or address
+// a value on stack, and the stack depth is the same on all paths to an
+// instruction, never negative and never above the depth reserved by Grow.
+// The functions called by CallImm, TailCall and GoCallImm must be in code,
+// and those of the closures and method tables in data must start with Grow.
+// Trap, which waits for debugger commands, is rejected.
+//
+// Execution starts at instruction 0, and a function at each Grow, both
+// with an empty stack. Other instructions not reached from there are dead
+// code, or functions without Grow, checked as part of the function which
+// precedes them. Verify returns nil or the problems found, as VerifyError
+// values.
+func Verify(code Code, data []Value) error {
+	v := verify(code, len(data))
+	v.data = data
+	v.untrusted()
+	return errors.Join(v.errs...)
+}
+
+// Depths verifies code like Verify, and also returns for each instruction
+// the stack depth at its entry, above the locals of its function, and the
+// index of the instruction from which it is reached: the Grow of its
+// function in a function body. Both are -1 if the instruction was not
+// checked, after errors.
+func Depths(code Code, dataLen int) (depth, entry []int, err error) {
+	v := verify(code, dataLen)
+	for ip, d := range v.depth {
+		if d < 0 {
+			v.from[ip] = -1
+		}
+	}
+	return v.depth, v.from, errors.Join(v.errs...)
+}
+
+func verify(code Code, dataLen int) *verifier {
+	v := &verifier{code: code, dataLen: dataLen, depth: make([]int, len(code)), from: make([]int, len(code)), fn: make([]*vfunc, len(code))}
+	for ip := range code {
+		v.depth[ip] = -1
+	}
+	for ip := range code {
+		if v.depth[ip] >= 0 || len(v.errs) >= maxVerifyErrors {
+			continue
+		}
+		f := v.fn[max(ip-1, 0)]
+		if f == nil || code[ip].Op == Grow {
+			f = &vfunc{entry: ip, reserve: -1}
+			if c := code[ip]; c.Op == Grow {
+				f.nlocals, f.reserve = int(c.A), int(c.B)
+			}
+			v.funcs = append(v.funcs, f)
+		}
+		v.walk(f, ip)
+	}
+	for _, f := range v.funcs {
+		if f.reserve >= 0 && f.max > f.reserve {
+			v.fail(f.entry, "stack depth %d exceeds the %d reserved", f.max, f.reserve)
+		}
+	}
+	return v
+}
+
+type verifier struct {
+	code    Code
+	dataLen int
+	data    []Value  // nil if only dataLen is known
+	depth   []int    // stack depth at instruction entry, -1 if not reached
+	from    []int    // instruction from which instruction is reached
+	fn      []*vfunc // function of instruction
+	funcs   []*vfunc
+	errs    []error
+	f       *vfunc // function being verified
+}
+
+// vfunc is a function being verified.
+type vfunc struct {
+	entry   int // index of the first instruction
+	nlocals int // number of locals, from Grow
+	reserve int // stack depth reserved by Grow, or -1
+	max     int // maximum stack depth reached
+}
+
+func (v *verifier) fail(ip int, format string, a ...any) {
+	if len(v.errs) < maxVerifyErrors {
+		v.errs = append(v.errs, &VerifyError{IP: ip, In: v.code[ip], Msg: fmt.Sprintf(format, a...)})
+	}
+}
+
+// walk verifies the instructions of function f reached from ip, entered
+// with an empty stack, by propagating the stack depth along all paths.
+func (v *verifier) walk(f *vfunc, ip int) {
+	v.f = f
+	from := ip
+	v.depth[ip], v.fn[ip], v.from[ip] = 0, f, from
+	work := []int{ip}
+	for len(work) > 0 && len(v.errs) < maxVerifyErrors {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, s := range v.step(ip, v.depth[ip]) {
+			switch {
+			case s.ip < 0 || s.ip >= len(v.code):
+				v.fail(ip, "jump to %d out of code", s.ip)
+			case v.depth[s.ip] < 0:
+				v.depth[s.ip], v.fn[s.ip], v.from[s.ip] = s.depth, f, from
+				work = append(work, s.ip)
+			case v.fn[s.ip] != f:
+				v.fail(ip, "jump to %d in function at %d", s.ip, v.fn[s.ip].entry)
+			case v.depth[s.ip] != s.depth && v.code[s.ip].Op != Exit:
+				// Exit ends execution whatever the values left on stack.
+				v.fail(ip, "stack depth %d at %d, want %d", s.depth, s.ip, v.depth[s.ip])
+			}
+		}
+	}
+}
+
+// succ is a successor of an instruction, with the stack depth at its entry.
+type succ struct{ ip, depth int }
+
+// step checks the instruction at ip, entered with stack depth d, and
+// returns its successors.
+func (v *verifier) step(ip, d int) []succ {
+	c := v.code[ip]
+	a, b := int(c.A), int(c.B)
+	pop, push := 0, 0
+	next := true // execution continues at ip+1
+	jump := -1   // stack depth at jump target ip+a, if any
+
+	switch c.Op {
+	case Nop, Trap:
+	case Exit:
+		next = false
+	case Grow:
+		if ip != v.f.entry {
+			v.fail(ip, "not at function entry")
+		}
+		v.count(ip, a, "locals")
+		v.count(ip, b, "stack depth")
+
+	// Stack and memory.
+	case Push, Recover:
+		push = 1
+	case Pop:
+		v.count(ip, a, "values")
+		pop = a
+	case Swap:
+		v.count(ip, a, "index")
+		v.count(ip, b, "index")
+		pop, push = max(a, b)+1, max(a, b)+1
+	case GetGlobal:
+		v.global(ip, a)
+		push = 1
+	case SetGlobal:
+		v.global(ip, a)
+		pop = 1
+	case GetLocal, AddrLocal, CellGet:
+		v.local(ip, a)
+		push = 1
+	case SetLocal, CellSet:
+		v.local(ip, a)
+		pop = 1
+	case Get:
+		switch a {
+		case Global:
+			v.global(ip, b)
+		case Local:
+			v.local(ip, b)
+		default:
+			v.fail(ip, "invalid scope %d", a)
+		}
+		push = 1
+	case New:
+		v.local(ip, a)
+		v.global(ip, b)
+	case GetLocal2:
+		v.local(ip, a)
+		v.local(ip, b)
+		push = 2
+	case GetLocalAddIntImm, GetLocalSubIntImm, GetLocalMulIntImm,
+		GetLocalLowerIntImm, GetLocalLowerUintImm, GetLocalGreaterIntImm, GetLocalGreaterUintImm:
+		v.local(ip, a)
+		push = 1
+	case HeapGet, HeapPtr:
+		v.count(ip, a, "heap index")
+		push = 1
+	case HeapSet:
+		v.count(ip, a, "heap index")
+		pop = 1
+	case SetS:
+		v.count(ip, a, "values")
+		pop = 2 * a
+	case Load, Store:
+		v.global(ip, a)
+		if k := int(b & 15); k >= len(memWidth) {
+			v.fail(ip, "invalid access kind %d", k)
+		}
+		pop, push = 1, 1
+		if c.Op == Store {
+			pop, push = 2, 0
+		}
+	case MemSize:
+		v.global(ip, a)
+		push = 1
+	case MemGrow:
+		v.global(ip, a)
+		v.count(ip, b, "pages")
+		pop, push = 1, 1
+
+	// Unary operations.
+	case Addr, Deref, Not, HeapAlloc, Field, BitComp,
+		AddIntImm, SubIntImm, MulIntImm, GreaterIntImm, GreaterUintImm, LowerIntImm, LowerUintImm,
+		Clz32, Clz64, Ctz32, Ctz64, Popcnt32, Popcnt64,
+		AbsFloat32, AbsFloat64, SqrtFloat32, SqrtFloat64, CeilFloat32, CeilFloat64,
+		FloorFloat32, FloorFloat64, TruncFloat32, TruncFloat64, NearestFloat32, NearestFloat64,
+		NegComplex, Real, Imag, Float32Bits, Float32FromBits, Float64Bits, Float64FromBits:
+		pop, push = 1, 1
+	case Convert, IfaceWrap, WrapFunc:
+		v.global(ip, a)
+		v.count(ip, b, "depth")
+		pop, push = b+1, b+1
+	case IfaceCall:
+		v.count(ip, a, "method")
+		if b != 0 {
+			v.global(ip, b-1)
+		}
+		pop, push = 1, 1
+	case TypeAssert:
+		v.global(ip, a)
+		pop, push = 1, 1
+		if b == 1 {
+			push = 2
+		}
+
+	// Binary operations.
+	case Equal, AddStr, GreaterStr, LowerStr, Index, IndexAddr, MapIndex, CopySlice,
+		AddComplex, SubComplex, MulComplex, DivComplex, Complex,
+		BitAnd, BitOr, BitXor, BitAndNot, BitShl, BitShr, Rotl32, Rotl64, Rotr32, Rotr64,
+		MinFloat32, MinFloat64, MaxFloat32, MaxFloat64, CopysignFloat32, CopysignFloat64:
+		pop, push = 2, 1
+	case MapIndexOk:
+		pop, push = 2, 2
+	case DeleteMap:
+		pop, push = 2, 1
+	case DerefSet, FieldRefSet, ChanSend:
+		pop = 2
+	case FieldSet:
+		pop, push = 2, 1
+	case FieldFset, IndexSet, MapSet, Slice:
+		pop, push = 3, 1
+	case Slice3:
+		pop, push = 4, 1
+	case EqualSet:
+		// The operands are replaced by true, or the right one by false:
+		// only a following JumpFalse makes the depth known.
+		if ip+1 >= len(v.code) || v.code[ip+1].Op != JumpFalse {
+			v.fail(ip, "not followed by JumpFalse")
+			return nil
+		}
+		if !v.need(ip, d, 2) {
+			return nil
+		}
+		if v.depth[ip+1] < 0 {
+			v.depth[ip+1], v.fn[ip+1] = d-1, v.f
+		}
+		return []succ{{ip + 2, d - 2}, {ip + 1 + int(v.code[ip+1].A), d - 1}}
+
+	// Composite values.
+	case Fnew, FnewE, PtrNew:
+		v.global(ip, a)
+		push = 1
+	case MkMap:
+		v.global(ip, a)
+		v.global(ip, b)
+		push = 1
+	case MkSlice:
+		v.global(ip, b)
+		switch {
+		case a < -2:
+			v.fail(ip, "invalid size arguments %d", -a)
+		case a < 0:
+			pop, push = -a, 1
+		default:
+			pop, push = a, 1
+		}
+	case Append:
+		v.count(ip, a, "values")
+		pop, push = a+1, 1
+	case AppendSlice:
+		v.count(ip, a, "values")
+		pop, push = max(a, 1)+1, 1
+	case Len, Cap:
+		v.count(ip, a, "depth")
+		pop, push = a+1, a+2
+	case MkClosure:
+		v.count(ip, a, "cells")
+		pop, push = a+1, 1
+
+	// Arithmetic.
+	case Min, Max:
+		if a < 1 {
+			v.fail(ip, "invalid number of values %d", a)
+		}
+		pop, push = a, 1
+	case Print, Println:
+		v.count(ip, a, "values")
+		pop = a
+
+	// Control flow.
+	case Jump:
+		return []succ{{ip + a, d}}
+	case JumpTrue, JumpFalse, LowerIntImmJumpFalse, LowerIntImmJumpTrue:
+		pop, jump = 1, d-1
+	case JumpSetTrue, JumpSetFalse:
+		// The condition is kept if the jump is taken.
+		pop, jump = 1, d
+	case GetLocalLowerIntImmJumpFalse, GetLocalLowerIntImmJumpTrue:
+		v.local(ip, b>>16)
+		jump = d
+	case TypeBranch:
+		if b != -1 {
+			v.global(ip, b)
+		}
+		pop, jump = 1, d-1
+	case Call:
+		narg, nret := a, int(c.B&^CallSpreadFlag)
+		v.count(ip, narg, "arguments")
+		v.count(ip, nret, "results")
+		pop, push = narg+1, nret
+	case CallImm, TailCall:
+		v.global(ip, a)
+		if c.Op == TailCall && (ip+1 >= len(v.code) || v.code[ip+1].Op != Return) {
+			v.fail(ip, "tail call not followed by return")
+		}
+		pop, push = b>>16, b&0xFFFF
+	case Return:
+		next = false
+	case GetLocalReturn:
+		v.local(ip, a)
+		next = false
+	case Panic:
+		pop, next = 1, false
+	case DeferPush:
+		// Function and arguments are kept below the stack until return.
+		v.count(ip, a, "arguments")
+		if b < 0 || b > 2 {
+			v.fail(ip, "invalid function kind %d", b)
+		}
+		pop = a + 1
+
+	// Range loops.
+	case Pull, Pull2:
+		if b != 0 {
+			v.global(ip, b-1)
+		}
+		pop, push = 1, 3
+	case Next0:
+		pop, push, jump = 2, 2, d
+	case Next, NextLocal:
+		if c.Op == Next {
+			v.global(ip, b)
+		} else {
+			v.local(ip, b)
+		}
+		pop, push, jump = 2, 2, d
+	case Next2, Next2Local:
+		k, val := int(int16(b)), int(int16(b>>16)) //nolint:gosec
+		if c.Op == Next2 {
+			v.global(ip, k)
+			v.global(ip, val)
+		} else {
+			v.local(ip, k)
+			v.local(ip, val)
+		}
+		pop, push, jump = 2, 2, d
+	case Stop:
+		v.count(ip, a, "values")
+		pop = a + 3
+
+	// Goroutines and channels.
+	case GoCall:
+		v.count(ip, a, "arguments")
+		pop = a + 1
+	case GoCallImm:
+		v.global(ip, a)
+		v.count(ip, b, "arguments")
+		pop = b
+	case MkChan:
+		v.global(ip, a)
+		if b < 0 {
+			pop = 1
+		}
+		push = 1
+	case ChanRecv:
+		pop, push = 1, 1+a
+		if a != 0 && a != 1 {
+			v.fail(ip, "invalid receive form %d", a)
+		}
+	case ChanClose:
+		pop = 1
+	case SelectExec:
+		v.global(ip, a)
+		pop, push = b>>16, 1
+
+	default:
+		switch {
+		case c.Op >= NegInt && c.Op <= NegFloat64:
+			pop, push = 1, 1
+		case c.Op >= AddInt && c.Op <= RemFloat64:
+			pop, push = 2, 1
+		case c.Op == DeferRet || c.Op == PanicUnwind || c.Op == Hook:
+			v.fail(ip, "reserved opcode")
+			return nil
+		default:
+			v.fail(ip, "invalid opcode %d", int(c.Op))
+			return nil
+		}
+	}
+
+	if !v.need(ip, d, pop) {
+		pop = d
+	}
+	d += push - pop
+	v.f.max = max(v.f.max, d)
+	var s []succ
+	if jump >= 0 {
+		s = append(s, succ{ip + a, jump})
+	}
+	if next {
+		if ip+1 >= len(v.code) {
+			v.fail(ip, "execution continues past the end of code")
+			return s
+		}
+		s = append(s, succ{ip + 1, d})
+	}
+	return s
+}
+
+// untrusted checks what only matters for code from outside of the
+// compiler: the call targets in code and data, and the absence of Trap.
+func (v *verifier) untrusted() {
+	for ip, c := range v.code {
+		switch c.Op {
+		case CallImm, TailCall, GoCallImm:
+			if a := int(c.A); v.depth[ip] >= 0 && a >= 0 && a < len(v.data) {
+				// Only GoCallImm resolves a closure, the others jump to num.
+				addr, ok := v.codeAddr(v.data[a])
+				if !ok || addr >= uint64(len(v.code)) || c.Op != GoCallImm && !isNum(v.data[a].ref.Kind()) {
+					v.fail(ip, "global %d is not a code address", a)
+				}
+			}
+		case Trap:
+			v.fail(ip, "debugger trap")
+		}
+	}
+	for i, d := range v.data {
+		if len(v.errs) >= maxVerifyErrors || !d.ref.IsValid() {
+			continue
+		}
+		switch x := d.ref.Interface().(type) {
+		case Closure:
+			if !v.entry(d) {
+				v.failData(i, "closure code %d is not a function entry", x.Code)
+			}
+		case *Type:
+			if x == nil {
+				continue
+			}
+			for _, m := range x.Methods {
+				if m.Index >= 0 && (m.Index >= len(v.data) || !v.entry(v.data[m.Index])) {
+					v.failData(i, "method of %s at global %d is not a function entry", x.Name, m.Index)
+				}
+			}
+		}
+	}
+}
+
+// codeAddr returns the code address of the function value f, a code
+// address or a closure, and whether it is one.
+func (v *verifier) codeAddr(f Value) (uint64, bool) {
+	switch {
+	case isNum(f.ref.Kind()):
+		return f.num, true
+	case f.ref.Kind() == reflect.Struct && f.ref.Type() == reflect.TypeFor[Closure]():
+		return uint64(f.ref.Interface().(Closure).Code), true //nolint:gosec
+	}
+	return 0, false
+}
+
+// entry reports whether the function value f is the address of a Grow.
+func (v *verifier) entry(f Value) bool {
+	ip, ok := v.codeAddr(f)
+	return ok && ip < uint64(len(v.code)) && v.code[ip].Op == Grow
+}
+
+// failData records a problem in the global at index i.
+func (v *verifier) failData(i int, format string, a ...any) {
+	if len(v.errs) < maxVerifyErrors {
+		v.errs = append(v.errs, &VerifyError{IP: -1, Global: i, Msg: fmt.Sprintf(format, a...)})
+	}
+}
+
+// need checks that the stack depth d holds the n values used by the
+// instruction at ip.
+func (v *verifier) need(ip, d, n int) bool {
+	if d < n {
+		v.fail(ip, "needs %d values on stack, has %d", n, d)
+		return false
+	}
+	return true
+}
+
+// count checks that the operand n of the instruction at ip is not negative.
+func (v *verifier) count(ip, n int, what string) {
+	if n < 0 {
+		v.fail(ip, "invalid %s %d", what, n)
+	}
+}
+
+// global checks that the operand i of the instruction at ip is a global index.
+func (v *verifier) global(ip, i int) {
+	if i < 0 || i >= v.dataLen {
+		v.fail(ip, "global %d out of range [0, %d)", i, v.dataLen)
+	}
+}
+
+// local checks that the operand i of the instruction at ip is a local index:
+// an argument below the frame bookkeeping slots, or a local reserved by Grow.
+func (v *verifier) local(ip, i int) {
+	switch {
+	case i > -frameOverhead && i <= 0:
+		v.fail(ip, "local %d is a frame slot", i)
+	case i > v.f.nlocals+v.depth[ip]:
+		// Inlined functions address their arguments on stack as locals.
+		v.fail(ip, "local %d out of range, function has %d and %d on stack", i, v.f.nlocals, v.depth[ip])
+	}
+}
@@ -0,0 +1,123 @@
+package vm
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	for i, test := range tests {
+		switch i {
+		case 6, 7, 10:
+			continue // EqualSet alone, locals without frame
+		}
+		if err := Verify(test.code, test.sym); err != nil {
+			t.Errorf("tests[%d]: %v", i, err)
+		}
+	}
+	if err := Verify(fibTypedCode, nil); err != nil {
+		t.Errorf("fibTypedCode: %v", err)
+	}
+	if err := Verify(fibImmCode, []Value{ValueOf(1)}); err != nil {
+		t.Errorf("fibImmCode: %v", err)
+	}
+}
+
+func TestDepths(t *testing.T) {
+	code := Code{
+		{Op: Jump, A: 6},
+		{Op: Grow, A: 1, B: 3},
+		{Op: Push, A: 1},
+		{Op: Push, A: 2},
+		{Op: GetLocal, A: 3}, // the value pushed first
+		{Op: Return},
+		{Op: Exit},
+		{Op: Nop}, // dead code, reached from itself
+		{Op: Exit},
+	}
+	depth, entry, err := Depths(code, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 0, 0, 1, 2, 3, 0, 0, 0}; !slices.Equal(depth, want) {
+		t.Errorf("got depth %v, want %v", depth, want)
+	}
+	if want := []int{0, 1, 1, 1, 1, 1, 0, 7, 7}; !slices.Equal(entry, want) {
+		t.Errorf("got entry %v, want %v", entry, want)
+	}
+}
+
+func TestVerifyError(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		code Code
+		ip   int
+		msg  string
+	}{
+		{"jump out", Code{{Op: Jump, A: 5}, {Op: Exit}}, 0, "jump to 5 out of code"},
+		{"underflow", Code{{Op: Push, A: 1}, {Op: AddInt}, {Op: Exit}}, 1, "needs 2 values on stack, has 1"},
+		{"global", Code{{Op: GetGlobal, A: 2}, {Op: Exit}}, 0, "global 2 out of range [0, 2)"},
+		{"local", Code{{Op: Grow, A: 1, B: 1}, {Op: GetLocal, A: 2}, {Op: Return}}, 1, "local 2 out of range, function has 1"},
+		{"stack local", Code{{Op: Grow, A: 1, B: 2}, {Op: Push}, {Op: GetLocal, A: 3}, {Op: Return}}, 2, "local 3 out of range, function has 1 and 1 on stack"},
+		{"frame slot", Code{{Op: Grow, A: 1, B: 1}, {Op: SetLocal, A: -1}, {Op: Return}}, 1, "local -1 is a frame slot"},
+		{"packed local", Code{
+			{Op: Grow, A: 1},
+			{Op: GetLocalLowerIntImmJumpFalse, A: 1, B: 3<<16 | 10},
+			{Op: Return},
+		}, 1, "local 3 out of range, function has 1"},
+		{"pop", Code{{Op: Push}, {Op: Pop, A: 2}, {Op: Exit}}, 1, "needs 2 values on stack, has 1"},
+		{"merge", Code{
+			{Op: Grow, B: 1},
+			{Op: Push, A: 1},
+			{Op: JumpTrue, A: 2},
+			{Op: Push, A: 2},
+			{Op: Return},
+		}, 3, "stack depth 1 at 4, want 0"},
+		{"reserve", Code{{Op: Grow, B: 1}, {Op: Push}, {Op: Push}, {Op: Return}}, 0, "stack depth 2 exceeds the 1 reserved"},
+		{"grow", Code{{Op: Push}, {Op: Grow}, {Op: Exit}}, 1, "not at function entry"},
+		{"end", Code{{Op: Push, A: 1}}, 0, "execution continues past the end of code"},
+		{"opcode", Code{{Op: opCount}, {Op: Exit}}, 0, "invalid opcode"},
+		{"reserved", Code{{Op: DeferRet}}, 0, "reserved opcode"},
+		{"hook", Code{{Op: Hook}, {Op: Exit}}, 0, "reserved opcode"},
+		{"equal set", Code{{Op: Push}, {Op: Push}, {Op: EqualSet}, {Op: Exit}}, 2, "not followed by JumpFalse"},
+		{"access kind", Code{{Op: Push}, {Op: Load, A: 0, B: 15}, {Op: Exit}}, 1, "invalid access kind 15"},
+		{"tail call", Code{{Op: Grow}, {Op: TailCall, A: 0}, {Op: Exit}}, 1, "tail call not followed by return"},
+		{"call target", Code{{Op: Push}, {Op: CallImm, A: 1, B: 1 << 16}, {Op: Exit}}, 1, "global 1 is not a code address"},
+		{"go target", Code{{Op: Grow}, {Op: GoCallImm, A: 1}, {Op: Exit}}, 1, "global 1 is not a code address"},
+		{"trap", Code{{Op: Trap}, {Op: Exit}}, 0, "debugger trap"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := Verify(test.code, []Value{ValueOf(0), ValueOf(5)})
+			var verr *VerifyError
+			if !errors.As(err, &verr) {
+				t.Fatalf("got %v, want a VerifyError", err)
+			}
+			if verr.IP != test.ip || !strings.Contains(verr.Msg, test.msg) {
+				t.Errorf("got %v, want %d: %s", err, test.ip, test.msg)
+			}
+		})
+	}
+}
+
+func TestVerifyData(t *testing.T) {
+	code := Code{{Op: Exit}, {Op: Grow}, {Op: Return}}
+	typ := &Type{Name: "T", Methods: []Method{{Index: 0}, {Index: -1}, {Index: 2}}}
+	data := []Value{ValueOf(1), ValueOf(Closure{Code: 2}), ValueOf(typ)}
+	err := Verify(code, data)
+	var verrs []*VerifyError
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var verr *VerifyError
+		if !errors.As(e, &verr) || verr.IP != -1 {
+			t.Fatalf("got %v, want a VerifyError in a global", e)
+		}
+		verrs = append(verrs, verr)
+	}
+	if len(verrs) != 2 || verrs[0].Global != 1 || verrs[1].Global != 2 {
+		t.Fatalf("got %v, want errors in globals 1 and 2", err)
+	}
+	if want := "verify: global 2: method of T at global 2 is not a function entry"; verrs[1].Error() != want {
+		t.Errorf("got %q, want %q", verrs[1].Error(), want)
+	}
+}
@@ -2,6 +2,8 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt" // for tracing only
 	"io"
 	"iter"
@@ -11,6 +13,8 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync/atomic"
+	"time"
 	"unsafe" // to allow setting unexported struct fields //nolint:depguard
 )
 
@@ -21,6 +25,35 @@ type Op int32
 
 //go:generate stringer -type=Op
 
+var cellRtype = reflect.TypeFor[*Value]()
+
+// detach returns v with a ref which does not alias the memory of a frame
+// slot, for a copy of v to be stored in a heap cell. Numeric values may
+// share the memory of their source slot via their ref field.
+func detach(v Value) Value {
+	if isNum(v.ref.Kind()) {
+		return fresh(v)
+	}
+	return v
+}
+
+// fresh returns a copy of v which does not alias the memory of a variable.
+// A fresh reflect.Value (not reflect.Zero) is allocated, so that Reflect()
+// returns the copied value.
+func fresh(v Value) Value {
+	if !v.ref.CanAddr() {
+		return v
+	}
+	rv := reflect.New(v.ref.Type()).Elem()
+	if isNum(rv.Kind()) {
+		setNumReflect(rv, v.num)
+	} else {
+		rv.Set(v.ref)
+	}
+	v.ref = rv
+	return v
+}
+
 // Closure bundles a function code address with its captured variables.
 type Closure struct {
 	Code int      // code address (same as the plain-int function value)
@@ -38,7 +71,7 @@ type SelectCaseInfo struct {
 // SelectMeta holds metadata for a select statement, stored in the data section.
 type SelectMeta struct {
 	Cases    []SelectCaseInfo
-	TotalPop int // precomputed number of stack slots consumed by channel/value entries
+	TotalPop int // number of stack slots consumed by channel/value entries, packed in the instruction
 }
 
 // Byte-code instruction set.
@@ -90,7 +123,7 @@ const (
 	MapIndex               // a i -- a[i]
 	MapIndexOk             // a i -- v ok ; v, ok = a[i]
 	MapSet                 // a i v -- a; a[i] = v
-	MkClosure              // code [&c0..&cn-1] -- clo ; clo = Closure{code, heap}
+	MkClosure              // code [c0..cn-1] -- clo ; clo = Closure{code, heap}, ci a cell pointer or a value copied
 	MkMap                  // -- map ; create map[K]V, key type at mem[$0], val type at mem[$1]
 	MkSlice                // [v0..vn-1] -- slice ; collect $0 values into []T, elem type at mem[$1]
 	New                    // -- x; mem[fp+$1] = new mem[$2]
@@ -108,12 +141,13 @@ const (
 	Recover                // -- v ; push recovered value (or nil if not panicking in a deferred call)
 	Return                 // [r1 .. ri] -- ; exit frame, nret and frameBase from frames
 	SetGlobal              // v -- ; mem[$1] = v (globals)
-	SetLocal               // v -- ; mem[fp-1+$1] = v
+	SetLocal               // v -- ; mem[fp-1+$1] = v, or a copy replacing the slot if $2 != 0
 	SetS                   // dest val -- ; dest.Set(val)
 	Slice                  // a l h -- a; a = a [l:h]
 	Slice3                 // a l h m -- a; a = a[l:h:m]
 	Stop                   // -- iterator stop; sp -= 3 + $1
 	Swap                   // --
+	TailCall               // [a1 .. ai] -- [r1 .. rj] ; as CallImm, reusing the current frame if it has no pending defer; followed by Return
 	Trap                   // -- ; pause VM execution and enter debug mode
 	TypeAssert             // iface -- v [ok] ; assert iface holds type at mem[$1]; $2=0 panics, $2=1 ok form
 	TypeBranch             // iface -- ; pop iface; if iface doesn't hold type at mem[$2] (or $2==-1 for nil), ip += $1
@@ -126,7 +160,7 @@ const (
 	ChanSend   // ch v -- ; send to channel
 	ChanRecv   // ch -- v [ok] ; receive from channel; $0=1 for ok-form
 	ChanClose  // ch -- ; close channel
-	SelectExec // ch0 [v0] .. chN [vN] -- chosenIdx ; $0=metaIdx, $1=ncase; calls reflect.Select
+	SelectExec // ch0 [v0] .. chN [vN] -- chosenIdx ; $0=metaIdx, $1=npop<<16|ncase; calls reflect.Select
 
 	Print   // [v0..vn-1] -- ; print $0 values to m.out
 	Println // [v0..vn-1] -- ; println $0 values to m.out, space-separated, trailing newline
@@ -134,6 +168,29 @@ const (
 	Min // [v0..vn-1] -- min ; find min of $0 values; $1 = reflect.Kind for dispatch
 	Max // [v0..vn-1] -- max ; find max of $0 values; $1 = reflect.Kind for dispatch
 
+	// Complex opcodes. Complex values are held in ref, as they do not fit in num.
+	AddComplex // c1 c2 -- c ; c = c1 + c2
+	SubComplex // c1 c2 -- c ; c = c1 - c2
+	MulComplex // c1 c2 -- c ; c = c1 * c2
+	DivComplex // c1 c2 -- c ; c = c1 / c2
+	NegComplex // c -- -c
+	Complex    // re im -- c ; c = complex(re, im), complex64 if re is float32
+	Real       // c -- re ; re = real(c)
+	Imag       // c -- im ; im = imag(c)
+
+	// Linear memory opcodes. The memory is a []byte in global $1, accessed
+	// at address + $2>>4 in little endian, with access kind $2&15 (MemInt32...).
+	Load    // addr -- v ; v = memory[addr+offset:]
+	Store   // addr v -- ; memory[addr+offset:] = v
+	MemSize // -- n ; n = len(memory) / MemPageSize
+	MemGrow // n -- old ; grow memory by n pages, up to $2 pages; old = previous size, or -1 on failure
+
+	// Float reinterpret opcodes.
+	Float32Bits     // f -- n ; n = math.Float32bits(f)
+	Float32FromBits // n -- f ; f = math.Float32frombits(n)
+	Float64Bits     // f -- n ; n = math.Float64bits(f)
+	Float64FromBits // n -- f ; f = math.Float64frombits(n)
+
 	// Per-type numeric opcodes. Each block of NumTypes (12) opcodes follows the
 	// order: Int, Int8, Int16, Int32, Int64, Uint, Uint8, Uint16, Uint32, Uint64, Float32, Float64.
 	// The compiler computes: baseOp + Op(NumKindOffset[kind]).
@@ -321,6 +378,10 @@ const (
 	LowerIntImmJumpTrue          // n -- ; if n < $2 { ip += $1 } ; sp--
 	GetLocalLowerIntImmJumpFalse // -- ; if local >= imm { ip += $1 } ; $2 = localOff<<16 | imm&0xFFFF
 	GetLocalLowerIntImmJumpTrue  // -- ; if local < imm { ip += $1 } ; $2 = localOff<<16 | imm&0xFFFF
+
+	Hook // -- ; internal: run the per-instruction hooks, then the instruction at ip
+
+	opCount // number of opcodes, must be last
 )
 
 // Memory attributes.
@@ -367,8 +428,9 @@ type Machine struct {
 	heap       []*Value   // active closure's captured cells (nil for plain functions)
 	heapFrames [][]*Value // saved caller heaps (only for closure calls where heap != nil)
 
-	panicking bool  // true while unwinding due to panic
-	panicVal  Value // value passed to panic()
+	panicking  bool    // true while unwinding due to panic
+	panicVal   Value   // value passed to panic()
+	panicStack []Frame // stack trace at the panic point
 
 	baseCodeLen int // len(code) before Run() appends sentinel instructions
 
@@ -383,12 +445,40 @@ type Machine struct {
 	debugInfoFn func() *DebugInfo // builds DebugInfo on demand (breaks vm->comp cycle)
 	debugIn     io.Reader         // debug command input (nil = os.Stdin)
 	debugOut    io.Writer         // debug output (nil = os.Stderr)
-	stepping    bool              //nolint:unused // when true, trap after every instruction (planned)
+	stepping    bool              // when true, check the debugger before every instruction
 	trapOrig    int               // ip to resume after Trap
+	debugger    *Debugger         // source-level debugger (nil = none)
+	dstate      debugState        // debugger state of the goroutine
+
+	ctx    context.Context // cancellation context (nil = never cancelled)
+	limits *limiter        // resource limits (nil = unlimited)
+	goid   int64           // goroutine id
+	group  *group          // goroutines of the program (nil = none started)
+
+	deadlock     *deadlockDetector // goroutine states of the program (nil = no detection)
+	exitOnReturn bool              // stop goroutines at the end of a top-level Run
+
+	prof      *profiler // CPU profiler (nil = not profiling)
+	profClock profClock // sampling clock of the machine
+	cover     *coverage // coverage counters (nil = no coverage)
+
+	tracer      *tracing // execution tracer (nil = not tracing)
+	traceStack  []string // names of the traced interpreted calls
+	traceNative string   // name of the traced native call in progress
+	traceCallAt int      // address+1 of the last call seen by traceHook, or 0
+	traceTail   bool     // the last call replaces its caller frame
+
+	race    *raceDetector // data race detector (nil = no detection)
+	rthread *raceThread   // race detection state of the goroutine
+
+	sched   *scheduler   // deterministic scheduler (nil = Go scheduler)
+	sthread *schedThread // scheduling state of the goroutine
 }
 
 // NewMachine returns a pointer on a new Machine.
-func NewMachine() *Machine { return &Machine{in: os.Stdin, out: os.Stdout, err: os.Stderr} }
+func NewMachine() *Machine {
+	return &Machine{in: os.Stdin, out: os.Stdout, err: os.Stderr, goid: 1, deadlock: newDeadlockDetector()}
+}
 
 // SetIO sets the I/O streams for the machine.
 func (m *Machine) SetIO(in io.Reader, out, err io.Writer) { m.in = in; m.out = out; m.err = err }
@@ -419,6 +509,24 @@ func (m *Machine) posPrefix(pos Pos) string {
 
 const heapSavedFlag = uint64(1) << 63
 
+// The prevFP slot of a frame holds the caller frame pointer in its low
+// fpBits bits, then the number of calling frames replaced by tail calls,
+// saturated at elidedMax, then heapSavedFlag.
+const (
+	fpBits    = 48
+	fpMask    = uint64(1)<<fpBits - 1
+	elidedMax = 1<<15 - 1
+)
+
+// elided returns the number of calling frames replaced by tail calls in
+// the frame at fp.
+func elided(mem []Value, fp int) int {
+	if fp < frameOverhead || fp > len(mem) {
+		return 0
+	}
+	return int(mem[fp-1].num >> fpBits & elidedMax) //nolint:gosec
+}
+
 // CallSpreadFlag is set in the B operand of Call to indicate a spread call
 // (f(s...)), so the VM uses reflect.CallSlice instead of reflect.Call for
 // native variadic functions.
@@ -435,12 +543,81 @@ func growStack(mem []Value, sp, need int) []Value {
 	return newMem
 }
 
+// RunContext runs a program like Run, but stops and returns ctx.Err() once ctx
+// is cancelled. Cancellation is polled on backward jumps, calls and blocking
+// channel operations, and is inherited by goroutines and re-entrant runners.
+func (m *Machine) RunContext(ctx context.Context) error {
+	saved := m.ctx
+	m.ctx = ctx
+	defer func() { m.ctx = saved }()
+	return m.Run()
+}
+
+// cancelled reports whether done is closed, without blocking.
+func cancelled(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// isContextErr reports whether err results from a context cancellation.
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// selectDone is reflect.Select with an extra receive case on done. It returns
+// live == false if done was selected.
+func selectDone(cases []reflect.SelectCase, done <-chan struct{}) (chosen int, recv reflect.Value, recvOK, live bool) {
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+	chosen, recv, recvOK = reflect.Select(cases)
+	return chosen, recv, recvOK, chosen < len(cases)-1
+}
+
 // Run runs a program.
 func (m *Machine) Run() (err error) {
 	// Append sentinel instructions so negative-IP handlers become normal opcodes.
 	sentBase := len(m.code)
 	m.baseCodeLen = sentBase
 	m.code = append(m.code, Instruction{Op: DeferRet}, Instruction{Op: PanicUnwind}, Instruction{Op: Exit})
+	owner := m.group == nil // goroutines started from now belong to this Run
+	if owner && m.deadlock != nil {
+		m.deadlock.enter(m)
+		defer m.deadlock.leave()
+	}
+	if owner && m.sched != nil && m.sthread == nil {
+		m.sthread = m.sched.enter(m)
+		defer func() {
+			m.sched.exit(m.sthread)
+			m.sthread = nil
+		}()
+	}
+	defer func() {
+		m.code = m.code[:sentBase]
+		if owner && m.group != nil {
+			m.endGroup()
+		}
+	}()
+
+	for {
+		// A host panic in an opcode is turned into an interpreted panic:
+		// resume execution at the PanicUnwind sentinel.
+		if faulted, err := m.run(sentBase); !faulted {
+			if err == nil && owner {
+				// A goroutine may have failed while main was exiting.
+				err = m.groupErr()
+			}
+			return err
+		}
+	}
+}
+
+// run executes the code from m.ip until Exit or an unrecovered panic. It
+// returns faulted == true if an instruction raised a host panic, after
+// setting up the machine to unwind it as an interpreted panic.
+func (m *Machine) run(sentBase int) (faulted bool, err error) {
 	deferRetAddr := sentBase
 	panicAddr := sentBase + 1
 	deferRetBits := uint64(deferRetAddr) //nolint:gosec
@@ -450,17 +627,114 @@ func (m *Machine) Run() (err error) {
 	// Extend mem to full capacity so all writes up to cap are in bounds.
 	mem = mem[:cap(mem)]
 
+	// done is nil when there is no cancellable context: polling is then a
+	// single nil check on backward jumps and calls.
+	var done <-chan struct{}
+	if m.ctx != nil {
+		done = m.ctx.Done()
+	}
+	// stop abandons the current execution on cancellation or limit abort.
+	stop := func(err error) error {
+		sp, fp = -1, 0
+		return err
+	}
+
+	// budget is the number of instructions left before polling the context,
+	// the shared limiter, the profiler and the scheduler. It is only counted
+	// down if polled, at backward jumps, by the length of the loop, and at
+	// calls, by one. granted is the last budget and, under the scheduler,
+	// slice the number of instructions left before preemption. hooked is
+	// set when each instruction must be checked by the debugger, counted for
+	// coverage, checked by the race detector or traced.
+	var budget, granted, slice int64
+	maxStack, limited, stepping, prof := 0, false, m.stepping, m.prof
+	if l := m.limits; l != nil {
+		limited = l.MaxInstructions > 0
+		maxStack = l.MaxStack
+	}
+	tr, race := m.tracer, m.race != nil
+	var counts []uint32
+	if m.cover != nil {
+		counts = m.cover.counters(len(m.code))
+	}
+	preempt := m.sched != nil && m.sthread != nil && m.sched.quantum > 0
+	if preempt {
+		slice = m.sched.quantum
+	}
+	polled := done != nil || limited || prof != nil || preempt
+	hooked := stepping || counts != nil || race || tr != nil
+
+	// code is the code fetched by the dispatch loop: m.code, or if hooked
+	// Hook instructions which run the hooks, then the instruction of m.code.
+	code := m.hookedCode(hooked)
+	m.traceCallAt = 0
+
 	defer func() {
-		m.mem, m.ip, m.fp = mem[:sp+1], ip, fp
-		m.code = m.code[:sentBase]
+		if r := recover(); r != nil {
+			if m.tracer != nil {
+				m.traceNativeReturn()
+			}
+			switch e := r.(type) {
+			case *LimitError:
+				// Limit exceeded in a re-entrant runner (see makeCallFunc).
+				if m.limitPanic(e, ip, fp, mem) {
+					err = stop(e)
+					break
+				}
+				ip, faulted = panicAddr, true
+			case *DeadlockError:
+				// Deadlock found by the scheduler in a blocking sync method.
+				err = stop(e)
+			case *PanicError:
+				// Unrecovered panic in a re-entrant runner: propagate it.
+				m.startPanic(ValueOf(e.Value), ip, fp, mem)
+				ip, faulted = panicAddr, true
+			case error:
+				if done != nil && isContextErr(e) {
+					// A re-entrant runner cancelled inside a native callback.
+					err = stop(context.Cause(m.ctx))
+					break
+				}
+				m.startPanic(ValueOf(hostFault(r, m.code[ip], mem, sp)), ip, fp, mem)
+				ip, faulted = panicAddr, true
+			default:
+				m.startPanic(ValueOf(hostFault(r, m.code[ip], mem, sp)), ip, fp, mem)
+				ip, faulted = panicAddr, true
+			}
+		}
+		if budget > 0 && limited {
+			m.limits.insns.Add(budget) // give back unused instructions
+		}
+		m.mem, m.ip, m.fp = mem[:min(sp+1, len(mem))], ip, fp
 	}()
 
 	for {
-		c := m.code[ip] // current instruction
+		c := code[ip] // current instruction
 		if debug {
 			log.Printf("ip:%-3d sp:%-3d fp:%-3d op:[%-20v] mem:%v\n", ip, sp, fp, c, Vstring(mem[:sp+1]))
 		}
+	dispatch:
 		switch c.Op {
+		case Hook:
+			if counts != nil {
+				m.cover.hit(counts, ip)
+			}
+			if race {
+				m.raceCheck(ip, fp, sp, mem)
+			}
+			if stepping {
+				if err := m.debugCheck(ip, fp, sp, mem); err != nil {
+					return false, stop(err)
+				}
+				if !m.stepping {
+					stepping, code = false, m.hookedCode(counts != nil || race || tr != nil)
+				}
+			}
+			c = m.code[ip]
+			if tr != nil {
+				m.traceHook(c.Op, ip, fp, mem, panicAddr)
+			}
+			goto dispatch
 		case Addr:
 			v := mem[sp]
 			switch {
@@ -485,12 +759,29 @@ func (m *Machine) Run() (err error) {
 				mem[sp] = Value{ref: r}
 			}
 		case SetLocal:
-			m.assignSlot(&mem[fp-1+int(c.A)], mem[sp])
+			if c.B != 0 {
+				mem[fp-1+int(c.A)] = fresh(m.resolveFuncField(mem[sp]))
+			} else {
+				m.assignSlot(&mem[fp-1+int(c.A)], mem[sp])
+			}
 			sp--
 		case SetGlobal:
 			m.assignSlot(&m.globals[int(c.A)], mem[sp])
 			sp--
 		case Call:
+			if polled {
+				if budget--; budget < 0 {
+					goto poll // and run the call again
+				}
+			}
+			if maxStack > 0 && sp > maxStack {
+				e := &LimitError{Kind: LimitStack, Limit: int64(maxStack)}
+				if m.limitPanic(e, ip, fp, mem) {
+					return false, stop(e)
+				}
+				ip = panicAddr
+				continue
+			}
 			narg := int(c.A)
 			fval := mem[sp-narg]
 			// Inline fast path: only call resolveFuncField for addressable Func fields.
@@ -527,6 +818,16 @@ func (m *Machine) Run() (err error) {
 				if rv.Kind() == reflect.Interface && !rv.IsNil() {
 					rv = rv.Elem()
 				}
+				if isNilFunc(rv) {
+					panic(errNilDeref) // call of a nil func value
+				}
+				if rv.Kind() == reflect.Func && m.sthread != nil && rv.Pointer() == sleepPC {
+					// Sleep on the virtual clock of the scheduler.
+					d := time.Duration(mem[sp].Int())
+					sp -= narg + 1
+					m.sched.sleep(m.sthread, d, done)
+					break
+				}
 				if rv.Kind() == reflect.Func {
 					funcType := rv.Type()
 					in := make([]reflect.Value, narg)
@@ -536,10 +837,16 @@ func (m *Machine) Run() (err error) {
 					m.bridgeArgs(in, funcType, rv.Pointer(), proxyRecvType, proxyMethod)
 					coerceInterfaceArgs(in, funcType)
 					m.wrapFuncArgs(in, mem[sp-narg+1:sp+1], funcType)
+					if m.deadlock != nil {
+						m.deadlock.escape(in)
+					}
 					sp -= narg + 1
 					// For spread calls (f(s...)), unwrap Iface values inside
 					// the variadic slice and use CallSlice.
 					var out []reflect.Value
+					if tr != nil {
+						m.traceNativeCall(rv)
+					}
 					if c.B&CallSpreadFlag != 0 {
 						last := in[narg-1]
 						if last.Kind() == reflect.Interface && !last.IsNil() {
@@ -554,10 +861,21 @@ func (m *Machine) Run() (err error) {
 							}
 						}
 						in[narg-1] = last
+					}
+					switch spread := c.B&CallSpreadFlag != 0; {
+					case done != nil && rv.Pointer() == sleepPC:
+						var ok bool
+						if out, ok = callNative(rv, in, spread, done, nil); !ok {
+							return false, stop(context.Cause(m.ctx))
+						}
+					case spread:
 						out = rv.CallSlice(in)
-					} else {
+					default:
 						out = rv.Call(in)
 					}
+					if tr != nil {
+						m.traceNativeReturn()
+					}
 					for _, v := range out {
 						if sp+1 >= len(mem) {
 							mem = growStack(mem, sp, 1)
@@ -586,9 +904,42 @@ func (m *Machine) Run() (err error) {
 			ip = nip
 			fp = sp + 1
 			continue
-		case CallImm:
+		case CallImm, TailCall:
+			if polled {
+				if budget--; budget < 0 {
+					goto poll // and run the call again
+				}
+			}
+			if maxStack > 0 && sp > maxStack {
+				e := &LimitError{Kind: LimitStack, Limit: int64(maxStack)}
+				if m.limitPanic(e, ip, fp, mem) {
+					return false, stop(e)
+				}
+				ip = panicAddr
+				continue
+			}
 			narg := int(c.B) >> 16
 			nret := int(c.B) & 0xFFFF
+			// A tail call replaces the current frame by the callee one, unless
+			// deferred calls are pending or the frame is of a deferred call
+			// (no frame base), in which case the following Return is executed.
+			if c.Op == TailCall && mem[fp-3].num == 0 && mem[fp-2].num>>48 != 0 {
+				info, fpVal := mem[fp-2].num, mem[fp-1].num
+				if fpVal>>fpBits&elidedMax < elidedMax {
+					fpVal += 1 << fpBits
+				}
+				base, top := fp-int(info>>48), sp
+				copy(mem[base:], mem[sp-narg+1:sp+1])
+				sp = base + narg + 2
+				mem[sp-2] = Value{}
+				mem[sp-1] = Value{num: packRetIP(int(int32(info)), int(info>>32&0xFFFF), narg+3)} //nolint:gosec
+				mem[sp] = Value{num: fpVal}
+				clear(mem[sp+1 : top+1])
+				fp = sp + 1
+				m.heap = nil
+				ip = int(m.globals[int(c.A)].num) //nolint:gosec
+				continue
+			}
 			fpVal := uint64(fp) //nolint:gosec
 			if m.heap != nil {
 				// preserve caller closure context
@@ -608,6 +959,11 @@ func (m *Machine) Run() (err error) {
 			continue
 		case Deref:
 			r := mem[sp].ref.Elem()
+			if !r.IsValid() {
+				m.startPanic(ValueOf(errNilDeref), ip, fp, mem)
+				ip = panicAddr
+				continue
+			}
 			v := Value{ref: r}
 			if isNum(r.Kind()) {
 				v.num = numBits(r)
@@ -702,13 +1058,13 @@ func (m *Machine) Run() (err error) {
 			ofp := fp
 			fpVal := mem[fp-1].num
 			if fpVal&heapSavedFlag != 0 {
-				fp = int(fpVal &^ heapSavedFlag) //nolint:gosec
+				fp = int(fpVal & fpMask) //nolint:gosec
 				top := len(m.heapFrames) - 1
 				m.heap = m.heapFrames[top]
 				m.heapFrames[top] = nil // clear for GC
 				m.heapFrames = m.heapFrames[:top]
 			} else {
-				fp = int(fpVal) //nolint:gosec
+				fp = int(fpVal & fpMask) //nolint:gosec
 				m.heap = nil
 			}
 			newBase := ofp - frameBase
@@ -726,22 +1082,42 @@ func (m *Machine) Run() (err error) {
 			sp--
 			if int(mem[sp+1].num) >= int(c.B) { //nolint:gosec
 				ip += int(c.A)
+				if c.A <= 0 && polled {
+					if budget += int64(c.A) - 1; budget < 0 {
+						goto poll
+					}
+				}
 				continue
 			}
 		case LowerIntImmJumpTrue:
 			sp--
 			if int(mem[sp+1].num) < int(c.B) { //nolint:gosec
 				ip += int(c.A)
+				if c.A <= 0 && polled {
+					if budget += int64(c.A) - 1; budget < 0 {
+						goto poll
+					}
+				}
 				continue
 			}
 		case GetLocalLowerIntImmJumpFalse:
 			if int(mem[int(c.B>>16)+fp-1].num) >= int(int16(c.B)) { //nolint:gosec
 				ip += int(c.A)
+				if c.A <= 0 && polled {
+					if budget += int64(c.A) - 1; budget < 0 {
+						goto poll
+					}
+				}
 				continue
 			}
 		case GetLocalLowerIntImmJumpTrue:
 			if int(mem[int(c.B>>16)+fp-1].num) < int(int16(c.B)) { //nolint:gosec
 				ip += int(c.A)
+				if c.A <= 0 && polled {
+					if budget += int64(c.A) - 1; budget < 0 {
+						goto poll
+					}
+				}
 				continue
 			}
 		case GetGlobal:
@@ -802,6 +1178,10 @@ func (m *Machine) Run() (err error) {
 				break
 			}
 			srcKind := v.ref.Type().Kind()
+			if isComplex(srcKind) && isNum(dstKind) {
+				// Complex constant with a zero imaginary part -> int/float.
+				v, srcKind = Value{num: math.Float64bits(real(v.ref.Complex()))}, reflect.Float64
+			}
 
 			switch {
 			case isNum(srcKind) && isNum(dstKind):
@@ -818,7 +1198,18 @@ func (m *Machine) Run() (err error) {
 				case isFloat(srcKind):
 					// float -> int: truncate.
 					f := math.Float64frombits(bits)
-					bits = uint64(int64(f)) //nolint:gosec
+					if dstKind >= reflect.Uint && dstKind <= reflect.Uintptr && f >= 0 {
+						bits = uint64(f)
+					} else {
+						bits = uint64(int64(f)) //nolint:gosec
+					}
+				case dstKind == reflect.Float32:
+					// int -> float32, rounded once.
+					if srcKind >= reflect.Uint && srcKind <= reflect.Uintptr {
+						bits = putf32(float32(bits))
+					} else {
+						bits = putf32(float32(int64(bits))) //nolint:gosec
+					}
 				case isFloat(dstKind):
 					// int -> float.
 					if srcKind >= reflect.Uint && srcKind <= reflect.Uintptr {
@@ -855,6 +1246,16 @@ func (m *Machine) Run() (err error) {
 					mem[idx] = Value{num: bits, ref: zfloat64}
 				}
 
+			case isNum(srcKind) && isComplex(dstKind):
+				// int/float constant -> complex.
+				f := math.Float64frombits(v.num)
+				if srcKind >= reflect.Uint && srcKind <= reflect.Uintptr {
+					f = float64(v.num)
+				} else if !isFloat(srcKind) {
+					f = float64(int64(v.num)) //nolint:gosec
+				}
+				mem[idx] = Value{ref: reflect.ValueOf(complex(f, 0)).Convert(dstType)}
+
 			case isNum(srcKind) && dstKind == reflect.String:
 				// int/rune -> string (e.g. string(65) -> "A").
 				mem[idx] = Value{ref: reflect.ValueOf(string(rune(int64(v.num))))} //nolint:gosec
@@ -920,6 +1321,11 @@ func (m *Machine) Run() (err error) {
 					mem[sp] = Value{ref: reflect.ValueOf(boundProxyCall{Fn: rv, RecvType: recvRV.Type(), Method: methodName})}
 					break
 				}
+				if m.sthread != nil {
+					rv = m.schedMethod(recvRV, methodName, rv, ip)
+				} else {
+					rv = m.interruptible(recvRV, methodName, rv)
+				}
 				mem[sp] = Value{ref: rv}
 				break
 			}
@@ -1022,8 +1428,7 @@ func (m *Machine) Run() (err error) {
 					default:
 						msg = fmt.Sprintf("interface conversion: %s is %s, not %s", ifaceTyp, rv.Type(), dstTyp)
 					}
-					m.panicking = true
-					m.panicVal = Value{ref: reflect.ValueOf(m.posPrefix(c.Pos) + msg)}
+					m.startPanic(ValueOf(&TypeAssertionError{msg: msg}), ip, fp, mem)
 					sp--
 					ip = panicAddr
 					continue
@@ -1069,8 +1474,7 @@ func (m *Machine) Run() (err error) {
 					} else {
 						msg = fmt.Sprintf("interface conversion: %s is %s, not %s", AnyRtype, concrete.Typ, dstTyp)
 					}
-					m.panicking = true
-					m.panicVal = Value{ref: reflect.ValueOf(m.posPrefix(c.Pos) + msg)}
+					m.startPanic(ValueOf(&TypeAssertionError{msg: msg}), ip, fp, mem)
 					sp--
 					ip = panicAddr
 					continue
@@ -1119,7 +1523,7 @@ func (m *Machine) Run() (err error) {
 			}
 
 		case Exit:
-			return err
+			return false, err
 		case Fnew:
 			if sp+1 >= len(mem) {
 				mem = growStack(mem, sp, 1)
@@ -1156,12 +1560,22 @@ func (m *Machine) Run() (err error) {
 			sp -= 2
 		case Jump:
 			ip += int(c.A)
+			if c.A <= 0 && polled {
+				if budget += int64(c.A) - 1; budget < 0 {
+					goto poll
+				}
+			}
 			continue
 		case JumpTrue:
 			cond := mem[sp].num != 0
 			sp--
 			if cond {
 				ip += int(c.A)
+				if c.A <= 0 && polled {
+					if budget += int64(c.A) - 1; budget < 0 {
+						goto poll
+					}
+				}
 				continue
 			}
 		case JumpFalse:
@@ -1169,6 +1583,11 @@ func (m *Machine) Run() (err error) {
 			sp--
 			if !cond {
 				ip += int(c.A)
+				if c.A <= 0 && polled {
+					if budget += int64(c.A) - 1; budget < 0 {
+						goto poll
+					}
+				}
 				continue
 			}
 		case JumpSetTrue:
@@ -1194,21 +1613,33 @@ func (m *Machine) Run() (err error) {
 			sp++
 			mem[sp] = ValueOf(mem[sp-1-int(c.A)].ref.Len())
 		case Next:
-			if k, ok := mem[sp-1].ref.Interface().(func() (reflect.Value, bool))(); ok {
+			k, ok, err := m.next(mem[sp-1].ref, ip, done)
+			if err != nil {
+				return false, stop(err)
+			}
+			if ok {
 				m.assignSlot(&m.globals[int(c.B)], FromReflect(k))
 			} else {
 				ip += int(c.A)
 				continue
 			}
 		case NextLocal:
-			if k, ok := mem[sp-1].ref.Interface().(func() (reflect.Value, bool))(); ok {
+			k, ok, err := m.next(mem[sp-1].ref, ip, done)
+			if err != nil {
+				return false, stop(err)
+			}
+			if ok {
 				m.assignSlot(&mem[fp-1+int(c.B)], FromReflect(k))
 			} else {
 				ip += int(c.A)
 				continue
 			}
 		case Next0:
-			if _, ok := mem[sp-1].ref.Interface().(func() (reflect.Value, bool))(); !ok {
+			_, ok, err := m.next(mem[sp-1].ref, ip, done)
+			if err != nil {
+				return false, stop(err)
+			}
+			if !ok {
 				ip += int(c.A)
 				continue
 			}
@@ -1255,7 +1686,13 @@ func (m *Machine) Run() (err error) {
 				funcType := m.globals[int(c.B)-1].ref.Type()
 				v = Value{ref: m.wrapForFunc(v, funcType)}
 			}
-			next, stop := iter.Pull(v.Seq())
+			var next, stop any = nil, func() {}
+			if v.ref.Kind() == reflect.Chan {
+				// Received from by Next, like ChanRecv.
+				next = v.ref.Interface()
+			} else {
+				next, stop = iter.Pull(v.Seq())
+			}
 			if sp+2 >= len(mem) {
 				mem = growStack(mem, sp, 2)
 			}
@@ -1302,8 +1739,16 @@ func (m *Machine) Run() (err error) {
 			}
 			sp -= narg + 1
 			m.mem = mem[:sp+1]
-			m.newGoroutine(fval, args)
+			gerr := m.newGoroutine(fval, args)
 			mem = m.mem[:cap(m.mem)]
+			if gerr != nil {
+				if m.limitPanic(gerr, ip, fp, mem) {
+					return false, stop(gerr)
+				}
+				ip = panicAddr
+				continue
+			}
+			done, polled = m.ctx.Done(), true // the goroutine group context
 
 		case GoCallImm:
 			narg := int(c.B)
@@ -1314,15 +1759,25 @@ func (m *Machine) Run() (err error) {
 			}
 			sp -= narg
 			m.mem = mem[:sp+1]
-			m.newGoroutine(fval, args)
+			gerr := m.newGoroutine(fval, args)
 			mem = m.mem[:cap(m.mem)]
+			if gerr != nil {
+				if m.limitPanic(gerr, ip, fp, mem) {
+					return false, stop(gerr)
+				}
+				ip = panicAddr
+				continue
+			}
+			done, polled = m.ctx.Done(), true // the goroutine group context
 
 		case MkChan:
 			elemType := m.globals[int(c.A)].ref.Type()
 			chanType := reflect.ChanOf(reflect.BothDir, elemType)
 			bufSize := int(c.B)
 			if bufSize < 0 {
-				bufSize = int(mem[sp].num) //nolint:gosec
+				if bufSize = int(mem[sp].num); bufSize < 0 { //nolint:gosec
+					panic(runtimeErrorf("makechan: size out of range"))
+				}
 				sp--
 			}
 			if sp+1 >= len(mem) {
@@ -1330,15 +1785,36 @@ func (m *Machine) Run() (err error) {
 			}
 			sp++
 			mem[sp] = Value{ref: reflect.MakeChan(chanType, bufSize)}
+			if m.deadlock != nil {
+				m.deadlock.addChan(mem[sp].ref)
+			}
 
 		case ChanSend:
+			var start time.Time
+			if tr != nil {
+				start = time.Now()
+			}
 			ch := mem[sp-1].ref
-			ch.Send(m.reflectForSend(mem[sp], ch.Type().Elem()))
+			v := m.reflectForSend(mem[sp], ch.Type().Elem())
+			if !m.chanDirect(done) || !ch.IsValid() || !ch.TrySend(v) {
+				if _, _, _, err := m.chanSelect([]reflect.SelectCase{{Dir: reflect.SelectSend, Chan: ch, Send: v}}, ip, done); err != nil {
+					return false, stop(err)
+				}
+			}
 			sp -= 2
+			if tr != nil {
+				m.traceChan(ChanSend, start)
+			}
 
 		case ChanRecv:
-			ch := mem[sp]
-			v, ok := ch.ref.Recv()
+			var start time.Time
+			if tr != nil {
+				start = time.Now()
+			}
+			v, ok, err := m.chanRecv(mem[sp].ref, ip, done)
+			if err != nil {
+				return false, stop(err)
+			}
 			mem[sp] = FromReflect(v)
 			if int(c.A) == 1 {
 				if sp+1 >= len(mem) {
@@ -1347,15 +1823,25 @@ func (m *Machine) Run() (err error) {
 				sp++
 				mem[sp] = boolVal(ok)
 			}
+			if tr != nil {
+				m.traceChan(ChanRecv, start)
+			}
 
 		case ChanClose:
 			mem[sp].ref.Close()
 			sp--
+			if tr != nil {
+				m.traceChan(ChanClose, time.Now())
+			}
 
 		case SelectExec:
+			var start time.Time
+			if tr != nil {
+				start = time.Now()
+			}
 			meta := m.globals[int(c.A)].ref.Interface().(*SelectMeta)
-			ncase := int(c.B)
-			base := sp - meta.TotalPop + 1
+			ncase := int(c.B) & 0xFFFF
+			base := sp - int(c.B>>16) + 1
 			cases := make([]reflect.SelectCase, ncase)
 			idx := base
 			for i, ci := range meta.Cases {
@@ -1371,7 +1857,17 @@ func (m *Machine) Run() (err error) {
 					cases[i] = reflect.SelectCase{Dir: reflect.SelectDefault}
 				}
 			}
-			chosen, recv, recvOK := reflect.Select(cases)
+			var chosen int
+			var recv reflect.Value
+			var recvOK bool
+			if m.chanDirect(done) && (m.deadlock == nil || hasDefault(cases)) {
+				chosen, recv, recvOK = reflect.Select(cases)
+			} else {
+				var err error
+				if chosen, recv, recvOK, err = m.chanSelect(cases, ip, done); err != nil {
+					return false, stop(err)
+				}
+			}
 			sp = base
 			ci := meta.Cases[chosen]
 			if ci.Dir == reflect.SelectRecv {
@@ -1393,6 +1889,9 @@ func (m *Machine) Run() (err error) {
 				}
 			}
 			mem[sp] = Value{num: uint64(chosen), ref: zint} //nolint:gosec
+			if tr != nil {
+				m.traceChan(SelectExec, start)
+			}
 
 		case Print:
 			n := int(c.A)
@@ -1431,23 +1930,30 @@ func (m *Machine) Run() (err error) {
 			m.trapOrig = ip + 1 // resume ip after Trap instruction
 			mem = mem[:sp+1]
 			m.mem, m.ip, m.fp = mem, m.trapOrig, fp
-			m.enterDebug()
+			derr := m.enterDebug()
 			mem, ip, fp = m.mem, m.ip, m.fp
 			sp = len(mem) - 1
 			mem = mem[:cap(mem)]
+			if derr != nil {
+				return false, stop(derr)
+			}
+			stepping = m.stepping
+			code = m.hookedCode(stepping || counts != nil || race || tr != nil)
 			continue
 
 		case Panic:
-			m.panicking = true
-			m.panicVal = mem[sp]
+			m.startPanic(mem[sp], ip, fp, mem)
 			sp-- // pop the panic argument
 			ip = panicAddr
 			continue
 
 		case Recover:
-			if m.panicking && int(int32(mem[fp-2].num)) == deferRetAddr { //nolint:gosec
+			if _, limit := limitError(m.panicVal); m.panicking && !limit && int(int32(mem[fp-2].num)) == deferRetAddr { //nolint:gosec
 				m.panicking = false
 				pv := m.panicVal
+				if tr != nil {
+					tr.Recover(m.goid, pv.Interface())
+				}
 				// Wrap in Iface so type assertions on the recovered value work.
 				if pv.IsValid() && !pv.IsIface() {
 					rt := pv.Reflect().Type()
@@ -1483,14 +1989,16 @@ func (m *Machine) Run() (err error) {
 				funcVal := mem[dh-narg-3]
 				retBase := dh - narg - 3
 				if isX == 2 {
+					// Unlinked first, so that a panicking call is not run again.
+					mem[fp-3].num = uint64(prevHead)                             //nolint:gosec
 					m.execBuiltinDeferred(Op(funcVal.num), dh-narg-2, narg, mem) //nolint:gosec
 					clear(mem[retBase+nret : sp+1])
 					sp = retBase + nret - 1
-					mem[fp-3].num = uint64(prevHead) //nolint:gosec
 					continue
 				}
 				if isX == 1 {
 					// Native function: call via reflect, discard results.
+					mem[fp-3].num = uint64(prevHead) //nolint:gosec
 					rv := unwrapIface(funcVal.ref)
 					rin := make([]reflect.Value, narg)
 					for i := range rin {
@@ -1498,15 +2006,20 @@ func (m *Machine) Run() (err error) {
 					}
 					coerceInterfaceArgs(rin, rv.Type())
 					m.wrapFuncArgs(rin, mem[dh-narg-2:dh-2], rv.Type())
+					if tr != nil {
+						m.traceNativeCall(rv)
+					}
 					rv.Call(rin)
+					if tr != nil {
+						m.traceNativeReturn()
+					}
 					// Move return values (at dh+1..dh+nret) down over the defer entry.
 					for i := 0; i < nret; i++ {
 						mem[retBase+i] = mem[dh+1+i]
 					}
 					clear(mem[retBase+nret : sp+1])
 					sp = retBase + nret - 1
-					mem[fp-3].num = uint64(prevHead) //nolint:gosec
-					continue                         // re-check for more defers
+					continue // re-check for more defers
 				}
 				// VM function: pack ip and nret into the returnIP slot, then call.
 				mem[dh].num = uint64(ip) | uint64(nret)<<32 //nolint:gosec
@@ -1548,13 +2061,13 @@ func (m *Machine) Run() (err error) {
 			ofp := fp
 			fpVal := mem[fp-1].num
 			if fpVal&heapSavedFlag != 0 {
-				fp = int(fpVal &^ heapSavedFlag) //nolint:gosec
+				fp = int(fpVal & fpMask) //nolint:gosec
 				top := len(m.heapFrames) - 1
 				m.heap = m.heapFrames[top]
 				m.heapFrames[top] = nil // clear for GC
 				m.heapFrames = m.heapFrames[:top]
 			} else {
-				fp = int(fpVal) //nolint:gosec
+				fp = int(fpVal & fpMask) //nolint:gosec
 				m.heap = nil
 			}
 			newBase := ofp - frameBase
@@ -1726,16 +2239,7 @@ func (m *Machine) Run() (err error) {
 			mem[a], mem[b] = mem[b], mem[a]
 		case HeapAlloc:
 			cell := new(Value)
-			*cell = mem[sp] // initialise cell with top-of-stack value
-			// Detach addressable refs to prevent aliasing: numeric values may share
-			// the underlying memory of the source frame slot via their ref field.
-			// Allocate a fresh reflect.Value (not reflect.Zero) so that Reflect() returns
-			// the correct captured value via cell.ref.
-			if isNum(cell.ref.Kind()) && cell.ref.CanAddr() {
-				rv := reflect.New(cell.ref.Type()).Elem()
-				setNumReflect(rv, cell.num)
-				cell.ref = rv
-			}
+			*cell = detach(mem[sp]) // initialise cell with top-of-stack value
 			mem[sp] = ValueOf(cell) // replace value with cell pointer
 		case HeapGet:
 			if sp+1 >= len(mem) {
@@ -1762,8 +2266,18 @@ func (m *Machine) Run() (err error) {
 			n := int(c.A)
 			codeAddr := int(mem[sp-n].num) //nolint:gosec
 			heap := make([]*Value, n)
+			var vals []Value // values captured by copy, in a single block
 			for i := range n {
-				heap[i] = mem[sp-n+1+i].ref.Interface().(*Value)
+				v := mem[sp-n+1+i]
+				if v.ref.IsValid() && v.ref.Type() == cellRtype {
+					heap[i] = v.ref.Interface().(*Value)
+					continue
+				}
+				if vals == nil {
+					vals = make([]Value, n)
+				}
+				vals[i] = detach(v)
+				heap[i] = &vals[i]
 			}
 			clo := ValueOf(Closure{Code: codeAddr, Heap: heap})
 			clear(mem[sp-n : sp+1]) // clear code addr + cell ptr slots
@@ -1782,6 +2296,12 @@ func (m *Machine) Run() (err error) {
 				if nSizeArgs == 2 {
 					sCap = int(mem[sp].num) //nolint:gosec
 				}
+				if sLen < 0 {
+					panic(runtimeErrorf("makeslice: len out of range"))
+				}
+				if sCap < sLen {
+					panic(runtimeErrorf("makeslice: cap out of range"))
+				}
 				sp -= nSizeArgs - 1
 				mem[sp] = Value{ref: reflect.MakeSlice(sliceType, sLen, sCap)}
 			case n == 0:
@@ -1898,6 +2418,58 @@ func (m *Machine) Run() (err error) {
 			sp -= 2 * n
 
 		// Per-type Add.
+		case AddComplex, SubComplex, MulComplex, DivComplex:
+			mem[sp-1] = complexBinop(c.Op, mem[sp-1].ref, mem[sp].ref)
+			sp--
+		case NegComplex:
+			if v := mem[sp].ref; v.Kind() == reflect.Complex64 {
+				mem[sp] = Value{ref: reflect.ValueOf(-complex64(v.Complex()))}
+			} else {
+				mem[sp] = Value{ref: reflect.ValueOf(-v.Complex())}
+			}
+		case Complex:
+			if mem[sp-1].ref.Kind() == reflect.Float32 {
+				mem[sp-1] = Value{ref: reflect.ValueOf(complex(getf32(mem[sp-1].num), getf32(mem[sp].num)))}
+			} else {
+				mem[sp-1] = Value{ref: reflect.ValueOf(complex(mem[sp-1].Float(), mem[sp].Float()))}
+			}
+			sp--
+		case Real, Imag:
+			v := mem[sp].ref.Complex()
+			f := real(v)
+			if c.Op == Imag {
+				f = imag(v)
+			}
+			if mem[sp].ref.Kind() == reflect.Complex64 {
+				mem[sp] = Value{num: putf32(float32(f)), ref: zfloat32}
+			} else {
+				mem[sp] = Value{num: math.Float64bits(f), ref: zfloat64}
+			}
+		case Load:
+			mem[sp] = memLoad(memAt(bytesOf(m.globals[int(c.A)]), mem[sp].num, c.B), c.B)
+		case Store:
+			memStore(memAt(bytesOf(m.globals[int(c.A)]), mem[sp-1].num, c.B), c.B, mem[sp])
+			sp -= 2
+		case MemSize:
+			if sp+1 >= len(mem) {
+				mem = growStack(mem, sp, 1)
+			}
+			sp++
+			mem[sp] = Value{num: uint64(len(bytesOf(m.globals[int(c.A)])) / MemPageSize), ref: zint32} //nolint:gosec
+		case MemGrow:
+			b, old := memGrow(bytesOf(m.globals[int(c.A)]), uint64(uint32(mem[sp].num)), int(c.B)) //nolint:gosec
+			if old >= 0 {
+				m.globals[int(c.A)] = Value{ref: reflect.ValueOf(b)}
+			}
+			mem[sp] = Value{num: uint64(old), ref: zint32} //nolint:gosec
+		case Float32Bits:
+			mem[sp] = Value{num: uint64(math.Float32bits(getf32(mem[sp].num))), ref: zuint32}
+		case Float32FromBits:
+			mem[sp] = Value{num: putf32(math.Float32frombits(uint32(mem[sp].num))), ref: zfloat32} //nolint:gosec
+		case Float64Bits:
+			mem[sp].ref = zuint64
+		case Float64FromBits:
+			mem[sp].ref = zfloat64
 		case AddStr:
 			mem[sp-1] = Value{ref: reflect.ValueOf(mem[sp-1].ref.String() + mem[sp].ref.String())}
 			sp--
@@ -2235,17 +2807,97 @@ func (m *Machine) Run() (err error) {
 
 		case PanicUnwind:
 			if done, err := m.panicUnwind(&mem, &fp, &sp, &ip, panicAddr); done {
-				return err
+				return false, err
 			}
 			continue
 		}
 		ip++
+		continue
+
+	poll:
+		// The budget is spent, at a backward jump or a call.
+		if done != nil && cancelled(done) {
+			return false, stop(context.Cause(m.ctx))
+		}
+		if prof != nil {
+			prof.sample(m, ip, fp, mem)
+		}
+		if preempt {
+			if slice -= granted - budget; slice <= 0 {
+				m.sched.yield(m.sthread, time.Duration(m.sched.quantum), done)
+				slice = m.sched.quantum
+			}
+		}
+		if limited {
+			if budget < 0 {
+				m.limits.insns.Add(budget) // overdrawn by the last loop
+			}
+			if budget = m.limits.take(); budget == 0 {
+				e := &LimitError{Kind: LimitInstructions, Limit: m.limits.MaxInstructions}
+				if m.limitPanic(e, ip, fp, mem) {
+					return false, stop(e)
+				}
+				// Let deferred calls run while unwinding, up to a grace budget.
+				m.limits.insns.Store(limitGrace)
+				ip = panicAddr
+			}
+		} else {
+			budget = insnChunk
+		}
+		if prof != nil {
+			budget = min(budget, profChunk)
+		}
+		if preempt {
+			budget = min(budget, slice)
+		}
+		granted = budget
+	}
+}
+
+// next returns the next value of the range iterator it, for the Next
+// instruction at ip. A channel is received from like by ChanRecv, so that
+// the scheduler, the deadlock detector and the context apply.
+func (m *Machine) next(it reflect.Value, ip int, done <-chan struct{}) (reflect.Value, bool, error) {
+	if it.Kind() != reflect.Chan {
+		k, ok := it.Interface().(func() (reflect.Value, bool))()
+		return k, ok, nil
+	}
+	var start time.Time
+	if m.tracer != nil {
+		start = time.Now()
+	}
+	v, ok, err := m.chanRecv(it, ip, done)
+	if m.tracer != nil && err == nil {
+		m.traceChan(ChanRecv, start)
 	}
+	return v, ok, err
+}
+
+// hooks holds Hook instructions, shared read-only by the machines running
+// with per-instruction hooks.
+var hooks atomic.Pointer[[]Instruction]
+
+// hookedCode returns the code fetched by run: m.code, or as many Hook
+// instructions if hooked.
+func (m *Machine) hookedCode(hooked bool) []Instruction {
+	n := len(m.code)
+	if !hooked {
+		return m.code
+	}
+	if h := hooks.Load(); h != nil && len(*h) >= n {
+		return (*h)[:n]
+	}
+	h := make([]Instruction, n+n/2)
+	for i := range h {
+		h[i].Op = Hook
+	}
+	hooks.Store(&h)
+	return h[:n]
 }
 
 func (m *Machine) restoreFP(fpVal uint64) int {
 	if fpVal&heapSavedFlag != 0 {
-		fp := int(fpVal &^ heapSavedFlag) //nolint:gosec
+		fp := int(fpVal & fpMask) //nolint:gosec
 		top := len(m.heapFrames) - 1
 		m.heap = m.heapFrames[top]
 		m.heapFrames[top] = nil // clear for GC
@@ -2253,7 +2905,7 @@ func (m *Machine) restoreFP(fpVal uint64) int {
 		return fp
 	}
 	m.heap = nil
-	return int(fpVal) //nolint:gosec
+	return int(fpVal & fpMask) //nolint:gosec
 }
 
 // unwrapIface returns the element of an interface reflect.Value, or rv
@@ -2297,6 +2949,10 @@ func (m *Machine) deferPush(c Instruction, mem []Value, fp, sp int) ([]Value, in
 		funcVal := mem[sp]
 		copy(mem[sp-narg+1:sp+1], mem[sp-narg:sp])
 		mem[sp-narg] = funcVal
+	} else if isX == 0 && isNilFunc(mem[sp-narg].ref) {
+		// A nil func value panics when called: defer the Call builtin,
+		// which raises the fault.
+		mem[sp-narg], isX = Value{num: uint64(Call)}, 2
 	} else if isX == 0 && isNativeFunc(mem[sp-narg].ref) {
 		// Compile-time couldn't tell a variable holding a native Go func from
 		// one holding a VM func; detect native at runtime so Return dispatches
@@ -2344,7 +3000,7 @@ func (m *Machine) panicUnwind(mem *[]Value, fp, sp, ip *int, panicAddr int) (boo
 	if *fp == 0 {
 		// Top-level panic: no call frame to unwind.
 		m.mem, m.ip, m.fp = *mem, 0, 0
-		return true, fmt.Errorf("panic: %v", m.panicVal.Interface())
+		return true, m.panicError()
 	}
 	dh := int((*mem)[*fp-3].num) //nolint:gosec
 	if dh != 0 {
@@ -2362,6 +3018,10 @@ func (m *Machine) panicUnwind(mem *[]Value, fp, sp, ip *int, panicAddr int) (boo
 			*mem = (*mem)[:cap(*mem)]
 			return false, nil
 		}
+		if isX != 0 {
+			// Unlinked first, so that a panicking call is not run again.
+			(*mem)[*fp-3].num = uint64(prevHead) //nolint:gosec
+		}
 		if isX == 2 {
 			m.execBuiltinDeferred(Op(funcVal.num), dh-narg-2, narg, *mem) //nolint:gosec
 			return popDefer()
@@ -2375,7 +3035,13 @@ func (m *Machine) panicUnwind(mem *[]Value, fp, sp, ip *int, panicAddr int) (boo
 			}
 			coerceInterfaceArgs(rin, rv.Type())
 			m.wrapFuncArgs(rin, (*mem)[dh-narg-2:dh-2], rv.Type())
+			if m.tracer != nil {
+				m.traceNativeCall(rv)
+			}
 			rv.Call(rin)
+			if m.tracer != nil {
+				m.traceNativeReturn()
+			}
 			return popDefer()
 		}
 		// VM defer: store panicAddr as return address, push frame.
@@ -2397,9 +3063,15 @@ func (m *Machine) panicUnwind(mem *[]Value, fp, sp, ip *int, panicAddr int) (boo
 		*ip = nip
 		*sp = len(*mem) - 1
 		*mem = (*mem)[:cap(*mem)]
+		if m.tracer != nil {
+			m.traceCall(nip)
+		}
 		return false, nil
 	}
 	// No more defers in this frame.
+	if m.tracer != nil {
+		m.traceReturn()
+	}
 	if !m.panicking {
 		// Recovered: tear down frame, return zero values to caller.
 		retIPInfo := (*mem)[*fp-2].num
@@ -2424,7 +3096,7 @@ func (m *Machine) panicUnwind(mem *[]Value, fp, sp, ip *int, panicAddr int) (boo
 	if *fp == 0 {
 		// Top of stack: return panic as error.
 		m.mem, m.ip, m.fp = *mem, 0, 0
-		return true, fmt.Errorf("panic: %v", m.panicVal.Interface())
+		return true, m.panicError()
 	}
 	newBase := ofp - frameBase
 	clear((*mem)[newBase:])
@@ -2633,9 +3305,26 @@ type runnerState struct {
 	baseCodeLen int
 	out, err    io.Writer
 	methodNames []string
+	ctx         context.Context
+	limits      *limiter
+	goid        int64
+	group       *group
+	debugger    *Debugger
+	prof        *profiler
+	cover       *coverage
+	tracer      *tracing
+	race        *raceDetector
+	rthread     *raceThread
+	sched       *scheduler
+	sthread     *schedThread
 }
 
 func (m *Machine) captureRunnerState() runnerState {
+	if m.deadlock != nil {
+		// Native code may call the runners from goroutines unknown to the
+		// deadlock detector.
+		m.deadlock.callbacks.Store(true)
+	}
 	return runnerState{
 		globals:     m.globals,
 		code:        m.code[:m.baseCodeLen:m.baseCodeLen],
@@ -2643,6 +3332,18 @@ func (m *Machine) captureRunnerState() runnerState {
 		out:         m.out,
 		err:         m.err,
 		methodNames: m.MethodNames,
+		ctx:         m.ctx,
+		limits:      m.limits,
+		goid:        m.goid,
+		group:       m.group,
+		debugger:    m.debugger,
+		prof:        m.prof,
+		cover:       m.cover,
+		tracer:      m.tracer,
+		race:        m.race,
+		rthread:     m.rthread,
+		sched:       m.sched,
+		sthread:     m.sthread,
 	}
 }
 
@@ -2654,6 +3355,19 @@ func (rs *runnerState) newRunner() *Machine {
 		out:         rs.out,
 		err:         rs.err,
 		MethodNames: rs.methodNames,
+		ctx:         rs.ctx,
+		limits:      rs.limits,
+		goid:        rs.goid,
+		group:       rs.group,
+		debugger:    rs.debugger,
+		stepping:    rs.debugger != nil,
+		prof:        rs.prof,
+		cover:       rs.cover,
+		tracer:      rs.tracer,
+		race:        rs.race,
+		rthread:     rs.rthread,
+		sched:       rs.sched,
+		sthread:     rs.sthread,
 	}
 }
 
@@ -2759,7 +3473,49 @@ func (m *Machine) CallFunc(fval Value, funcType reflect.Type, args []reflect.Val
 	return out, nil
 }
 
-func (m *Machine) newGoroutine(fval Value, args []Value) {
+// Invoke executes the function at code address addr with the given
+// arguments and returns its nret results. Unlike CallFunc, writes to
+// globals are kept. As CallFunc, it can be called while Run is in progress.
+func (m *Machine) Invoke(addr, nret int, args ...Value) ([]Value, error) {
+	savedMem, savedIP, savedFP := m.mem, m.ip, m.fp
+	savedHeap, savedFrames := m.heap, m.heapFrames
+	savedPanicking, savedPanicVal := m.panicking, m.panicVal
+	savedCodeLen := len(m.code)
+	defer func() {
+		m.mem, m.ip, m.fp = savedMem, savedIP, savedFP
+		m.heap, m.heapFrames = savedHeap, savedFrames
+		m.panicking, m.panicVal = savedPanicking, savedPanicVal
+		m.code = m.code[:savedCodeLen]
+	}()
+	m.heap, m.heapFrames = nil, nil
+	m.panicking, m.panicVal = false, Value{}
+
+	m.mem = append([]Value{{num: uint64(addr), ref: zint}}, args...) //nolint:gosec
+	m.ip = len(m.code)
+	m.fp = 0
+	m.code = append(m.code, Instruction{Op: Call, A: int32(len(args)), B: int32(nret)}, Instruction{Op: Exit}) //nolint:gosec
+	if err := m.Run(); err != nil {
+		return nil, err
+	}
+	return append([]Value(nil), m.mem[:nret]...), nil
+}
+
+// Global returns the value of global i.
+func (m *Machine) Global(i int) Value { return m.globals[i] }
+
+// SetGlobal sets the value of global i.
+func (m *Machine) SetGlobal(i int, v Value) { m.globals[i] = v }
+
+// newGoroutine starts fval(args...) in a new goroutine. It returns a
+// LimitError if the goroutine limit is reached.
+func (m *Machine) newGoroutine(fval Value, args []Value) *LimitError {
+	if isNilFunc(fval.ref) {
+		panic(errGoNil)
+	}
+	if err := m.limits.spawn(); err != nil {
+		return err
+	}
+	g := m.goroutineGroup()
 	// Inline fast path: resolve addressable struct func fields (mirrors Call opcode).
 	if fval.ref.Kind() == reflect.Func && fval.ref.CanAddr() {
 		fval = m.resolveFuncField(fval)
@@ -2776,8 +3532,18 @@ func (m *Machine) newGoroutine(fval Value, args []Value) {
 		}
 		coerceInterfaceArgs(in, rv.Type())
 		m.wrapFuncArgs(in, args, rv.Type())
-		go func() { rv.Call(in) }()
-		return
+		if d := m.deadlock; d != nil {
+			d.escape(in)
+			d.spawn()
+		}
+		go func() {
+			defer m.limits.exit()
+			if m.deadlock != nil {
+				defer m.deadlock.exit()
+			}
+			rv.Call(in)
+		}()
+		return nil
 	}
 
 	// Resolve VM function address and closure heap.
@@ -2818,9 +3584,58 @@ func (m *Machine) newGoroutine(fval Value, args []Value) {
 		err:         m.err,
 		debugIn:     m.debugIn,
 		debugOut:    m.debugOut,
+		debugInfoFn: m.debugInfoFn,
 		MethodNames: m.MethodNames,
+		ctx:         g.ctx,
+		limits:      m.limits,
+		goid:        lastGoroutineID.Add(1),
+		group:       g,
+		deadlock:    m.deadlock,
+		debugger:    m.debugger,
+		stepping:    m.debugger != nil,
+		prof:        m.prof,
+		cover:       m.cover,
+		tracer:      m.tracer,
+		race:        m.race,
+	}
+	if m.race != nil {
+		child.rthread = m.race.newThread(m.rthread)
+	}
+	if m.sthread != nil {
+		child.sched, child.sthread = m.sched, m.sched.add(child.goid)
+	}
+	if m.deadlock != nil {
+		m.deadlock.spawn()
 	}
-	go func() { _ = child.Run() }()
+	if m.tracer != nil {
+		m.tracer.GoStart(m.goid, child.goid, m.tracer.funcName(m, nip))
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer m.limits.exit()
+		if child.deadlock != nil {
+			defer child.deadlock.exit()
+		}
+		if child.debugger != nil {
+			defer child.debugger.exit(child.goid)
+		}
+		if child.sthread != nil {
+			defer child.sched.exit(child.sthread)
+			if !child.sthread.wait(g.ctx.Done()) {
+				return
+			}
+		}
+		if child.tracer != nil {
+			defer child.tracer.GoExit(child.goid)
+			child.traceCall(nip)
+		}
+		if err := child.Run(); err != nil {
+			// Like in Go, a goroutine failure terminates the program.
+			g.cancel(err)
+		}
+	}()
+	return nil
 }
 
 func (m *Machine) execBuiltinDeferred(op Op, base, narg int, mem []Value) {
@@ -2836,11 +3651,18 @@ func (m *Machine) execBuiltinDeferred(op Op, base, narg int, mem []Value) {
 			_, _ = fmt.Fprint(m.out, args...)
 		}
 	case ChanClose:
+		if m.race != nil {
+			if p := refPointer(mem[base].ref, reflect.Chan); p != nil {
+				m.race.release(m.rthread, p)
+			}
+		}
 		mem[base].ref.Close()
 	case DeleteMap:
 		mem[base].ref.SetMapIndex(mem[base+1].Reflect(), reflect.Value{})
 	case CopySlice:
 		reflect.Copy(mem[base].ref, mem[base+1].ref)
+	case Call:
+		panic(errNilDeref) // deferred call of a nil func value
 	default:
 		panic(fmt.Sprintf("unsupported deferred builtin opcode: %v", op))
 	}
@@ -3,6 +3,7 @@ package vm
 import (
 	"fmt"
 	"log"
+	"reflect"
 	"testing"
 )
 
@@ -30,6 +31,36 @@ func TestVM(t *testing.T) {
 	}
 }
 
+func TestDeadlockEscape(t *testing.T) {
+	type node struct {
+		C    chan int
+		Next *node
+	}
+	chans := make([]chan int, 5)
+	d := newDeadlockDetector()
+	for i := range chans {
+		chans[i] = make(chan int)
+		d.addChan(reflect.ValueOf(chans[i]))
+	}
+	cyclic := &node{C: chans[0]}
+	cyclic.Next = cyclic
+	list := []any{nil, [1]chan int{chans[1]}}
+	list[0] = list
+	d.escape([]reflect.Value{
+		reflect.ValueOf(cyclic),
+		reflect.ValueOf(list),
+		reflect.ValueOf(map[string]any{"c": chans[2]}),
+		reflect.ValueOf(struct{ c chan int }{chans[3]}),
+		reflect.ValueOf([]byte("no channel")),
+	})
+	for i, c := range chans {
+		_, owned := d.chans[reflect.ValueOf(c).Pointer()]
+		if owned != (i == 4) {
+			t.Errorf("channel %d: got owned %v, want %v", i, owned, i == 4)
+		}
+	}
+}
+
 func BenchmarkVM(b *testing.B) {
 	for _, test := range tests {
 		test := test
@@ -426,4 +457,25 @@ var tests = []struct {
 		{Op: Exit},
 	},
 	start: 0, end: 1, mem: "[-3]",
+}, { // #34 -- store int32 -2 at 4, load it back as uint8 and int16.
+	sym: []Value{ValueOf(make([]byte, 8))},
+	code: []Instruction{
+		{Op: Push, A: 4},
+		{Op: Push, A: -2},
+		{Op: Store, A: 0, B: MemInt32},
+		{Op: Push, A: 0},
+		{Op: Load, A: 0, B: 4<<4 | MemUint8To32},
+		{Op: Push, A: 4},
+		{Op: Load, A: 0, B: MemInt16To64},
+		{Op: Exit},
+	},
+	start: 0, end: 2, mem: "[254 -2]",
+}, { // #35 -- float64Bits: bits of 1.0.
+	sym: []Value{ValueOf(1.0)},
+	code: []Instruction{
+		{Op: GetGlobal, A: 0},
+		{Op: Float64Bits},
+		{Op: Exit},
+	},
+	start: 0, end: 1, mem: "[4607182418800017408]",
 }}
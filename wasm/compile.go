@@ -0,0 +1,1504 @@
+package wasm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+
+	"github.com/mvertes/parscan/vm"
+)
+
+// Func is a function of a parscan program, to compile to WebAssembly.
+type Func struct {
+	Name   string
+	Addr   int          // code address of the function
+	Type   reflect.Type // Go function type
+	Export bool         // export the function by name
+}
+
+// CompileError is an instruction outside of the subset compiled to
+// WebAssembly.
+type CompileError struct {
+	Func string // name of the function
+	IP   int    // code address of the instruction
+	Op   vm.Op
+	Pos  string // source position, if known
+	Msg  string
+}
+
+func (e *CompileError) Error() string {
+	pos := ""
+	if e.Pos != "" {
+		pos = " (" + e.Pos + ")"
+	}
+	return fmt.Sprintf("wasm: %s%s: %v: %s", e.Func, pos, e.Op, e.Msg)
+}
+
+// maxCompileErrors is the maximum number of errors reported by Compile.
+const maxCompileErrors = 10
+
+// unsupported names the features of the opcodes outside of the compiled
+// subset.
+var unsupported = map[vm.Op]string{}
+
+func init() {
+	for feature, ops := range map[string][]vm.Op{
+		"maps":                      {vm.MapIndex, vm.MapIndexOk, vm.MapSet, vm.MkMap, vm.DeleteMap},
+		"interfaces":                {vm.IfaceWrap, vm.IfaceCall, vm.TypeAssert, vm.TypeBranch},
+		"native and indirect calls": {vm.Call, vm.WrapFunc},
+		"closures":                  {vm.HeapAlloc, vm.HeapGet, vm.HeapPtr, vm.HeapSet, vm.CellGet, vm.CellSet, vm.MkClosure},
+		"pointers":                  {vm.Addr, vm.AddrLocal, vm.Deref, vm.DerefSet, vm.PtrNew, vm.Get, vm.FieldRefSet},
+		"strings, arrays and slices": {
+			vm.Index, vm.IndexAddr, vm.IndexSet, vm.Slice, vm.Slice3, vm.Append, vm.AppendSlice, vm.CopySlice,
+			vm.MkSlice, vm.Len, vm.Cap, vm.AddStr, vm.GreaterStr, vm.LowerStr,
+		},
+		"structs":                  {vm.Field, vm.FieldSet, vm.FieldFset, vm.FnewE},
+		"goroutines and channels":  {vm.GoCall, vm.GoCallImm, vm.MkChan, vm.ChanSend, vm.ChanRecv, vm.ChanClose, vm.SelectExec},
+		"defer and recover":        {vm.DeferPush, vm.DeferRet, vm.Recover, vm.PanicUnwind},
+		"print builtins":           {vm.Print, vm.Println},
+		"range over functions":     {vm.Next, vm.Next0, vm.Next2, vm.NextLocal, vm.Next2Local, vm.Pull, vm.Pull2, vm.Stop},
+		"complex numbers":          {vm.AddComplex, vm.SubComplex, vm.MulComplex, vm.DivComplex, vm.NegComplex, vm.Complex, vm.Real, vm.Imag},
+		"linear memory operations": {vm.Load, vm.Store, vm.MemSize, vm.MemGrow},
+		"debug traps":              {vm.Trap},
+		"exits":                    {vm.Exit},
+	} {
+		for _, o := range ops {
+			unsupported[o] = feature
+		}
+	}
+}
+
+// kindValType returns the value type holding values of kind k. Integers
+// of at most 32 bits and bools are held in i32 values, sign-extended for
+// signed kinds and zero-extended otherwise.
+func kindValType(k reflect.Kind) (ValType, bool) {
+	switch k {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return I32, true
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		return I64, true
+	case reflect.Float32:
+		return F32, true
+	case reflect.Float64:
+		return F64, true
+	}
+	return 0, false
+}
+
+func isSigned(k reflect.Kind) bool   { return k >= reflect.Int && k <= reflect.Int64 }
+func isUnsigned(k reflect.Kind) bool { return k >= reflect.Uint && k <= reflect.Uintptr }
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// FuncTypeOf returns the WebAssembly type of functions of Go type t, and
+// false if t is not a function of numbers and bools.
+func FuncTypeOf(t reflect.Type) (FuncType, bool) {
+	if t == nil || t.Kind() != reflect.Func || t.IsVariadic() {
+		return FuncType{}, false
+	}
+	var ft FuncType
+	for i := range t.NumIn() {
+		vt, ok := kindValType(t.In(i).Kind())
+		if !ok {
+			return FuncType{}, false
+		}
+		ft.Params = append(ft.Params, vt)
+	}
+	for i := range t.NumOut() {
+		vt, ok := kindValType(t.Out(i).Kind())
+		if !ok {
+			return FuncType{}, false
+		}
+		ft.Results = append(ft.Results, vt)
+	}
+	return ft, true
+}
+
+// cfunc is a function being compiled.
+type cfunc struct {
+	Func
+	typ             FuncType
+	params, results []reflect.Kind
+	index           uint32 // function index
+	inits           []*cfunc
+}
+
+// compiler compiles VM code to a module.
+type compiler struct {
+	img     *vm.Image
+	byAddr  map[int]*Func
+	funcs   map[int]*cfunc // compiled functions, by code address
+	queue   []*cfunc
+	mod     *Module
+	globals map[int]uint32 // global index, by data index
+	gdata   []int          // data index, by global index
+	written map[int]bool   // data indexes written by compiled code
+	errs    []error
+}
+
+// Compile returns a WebAssembly module with the functions of funcs marked
+// as exported, and the functions they call, compiled from the code of img.
+// Global variables used by this code are module globals, initialized by a
+// start function running the top-level code of img and its init
+// functions, the Start functions which are not named main.
+//
+// Only numbers, bools, their local and global variables, calls of known
+// functions and control flow are supported. Other instructions are
+// reported as CompileError values.
+func Compile(img *vm.Image, funcs []Func) (*Module, error) {
+	c := &compiler{
+		img:     img,
+		byAddr:  map[int]*Func{},
+		funcs:   map[int]*cfunc{},
+		mod:     &Module{Start: -1},
+		globals: map[int]uint32{},
+		written: map[int]bool{},
+	}
+	for i := range funcs {
+		c.byAddr[funcs[i].Addr] = &funcs[i]
+	}
+	for i := range funcs {
+		if funcs[i].Export {
+			c.function(funcs[i].Addr)
+		}
+	}
+	start := &cfunc{Func: Func{Name: "top-level code", Addr: max(0, img.Entry)}}
+	for _, idx := range img.Start {
+		if idx < 0 || idx >= len(img.Data) {
+			continue
+		}
+		addr := int(img.Data[idx].Int())
+		if f := c.byAddr[addr]; f != nil && f.Name != "main" {
+			if init := c.function(addr); init != nil {
+				start.inits = append(start.inits, init)
+			}
+		}
+	}
+	if start.Addr >= 0 || len(start.inits) > 0 {
+		start.index = uint32(len(c.mod.Funcs)) //nolint:gosec
+		c.mod.Start = int(start.index)
+		c.mod.Funcs = append(c.mod.Funcs, c.typeIndex(FuncType{}))
+		c.mod.Bodies = append(c.mod.Bodies, Body{})
+		c.queue = append(c.queue, start)
+	}
+	for len(c.queue) > 0 && len(c.errs) < maxCompileErrors {
+		f := c.queue[0]
+		c.queue = c.queue[1:]
+		c.compile(f)
+	}
+	if len(c.errs) > 0 {
+		return nil, errors.Join(c.errs...)
+	}
+	for i, idx := range c.gdata {
+		c.mod.Globals[i].Type.Mutable = c.written[idx]
+	}
+	for _, f := range funcs {
+		if f.Export {
+			c.mod.Exports = append(c.mod.Exports, Export{Name: f.Name, Kind: ExternFunc, Index: c.funcs[f.Addr].index})
+		}
+	}
+	return c.mod, nil
+}
+
+// fail records an error of instruction ip of function f.
+func (c *compiler) fail(f *cfunc, ip int, format string, a ...any) {
+	e := &CompileError{Func: f.Name, IP: ip, Op: vm.Exit, Msg: fmt.Sprintf(format, a...)}
+	if ip >= 0 && ip < len(c.img.Code) {
+		e.Op = c.img.Code[ip].Op
+		e.Pos = c.img.Debug.PosToLine(c.img.Code[ip].Pos)
+	}
+	c.errs = append(c.errs, e)
+}
+
+// function returns the function at code address addr, queued for
+// compilation, or nil if the function is unknown or not compilable.
+func (c *compiler) function(addr int) *cfunc {
+	if f, ok := c.funcs[addr]; ok {
+		return f
+	}
+	fn := c.byAddr[addr]
+	if fn == nil {
+		return nil
+	}
+	f := &cfunc{Func: *fn}
+	ft, ok := FuncTypeOf(fn.Type)
+	if !ok {
+		c.fail(f, addr, "function type %v is not supported", fn.Type)
+		return nil
+	}
+	f.typ = ft
+	for i := range fn.Type.NumIn() {
+		f.params = append(f.params, fn.Type.In(i).Kind())
+	}
+	for i := range fn.Type.NumOut() {
+		f.results = append(f.results, fn.Type.Out(i).Kind())
+	}
+	f.index = uint32(len(c.mod.Funcs)) //nolint:gosec
+	c.mod.Funcs = append(c.mod.Funcs, c.typeIndex(ft))
+	c.mod.Bodies = append(c.mod.Bodies, Body{})
+	c.funcs[addr] = f
+	c.queue = append(c.queue, f)
+	return f
+}
+
+// typeIndex returns the index of the function type ft, added if needed.
+func (c *compiler) typeIndex(ft FuncType) uint32 {
+	for i, t := range c.mod.Types {
+		if t.equal(ft) {
+			return uint32(i) //nolint:gosec
+		}
+	}
+	c.mod.Types = append(c.mod.Types, ft)
+	return uint32(len(c.mod.Types) - 1) //nolint:gosec
+}
+
+// global returns the global holding the numeric data at index idx.
+func (c *compiler) global(idx int) uint32 {
+	if g, ok := c.globals[idx]; ok {
+		return g
+	}
+	rv := c.img.Data[idx].Reflect()
+	vt, _ := kindValType(rv.Kind())
+	var init writer
+	switch {
+	case rv.Kind() == reflect.Bool:
+		init.byte(opI32Const)
+		if rv.Bool() {
+			init.sleb(1)
+		} else {
+			init.sleb(0)
+		}
+	case isSigned(rv.Kind()):
+		init.byte(byte(opI32Const + vt.index()))
+		init.sleb(rv.Int())
+	case isUnsigned(rv.Kind()):
+		init.byte(byte(opI32Const + vt.index()))
+		if vt == I32 {
+			init.sleb(int64(int32(rv.Uint()))) //nolint:gosec
+		} else {
+			init.sleb(int64(rv.Uint())) //nolint:gosec
+		}
+	case vt == F32:
+		init.byte(opF32Const)
+		init.u32le(math.Float32bits(float32(rv.Float())))
+	default:
+		init.byte(opF64Const)
+		init.u64le(math.Float64bits(rv.Float()))
+	}
+	init.byte(opEnd)
+	g := uint32(len(c.mod.Globals)) //nolint:gosec
+	c.mod.Globals = append(c.mod.Globals, Global{Type: GlobalType{Type: vt}, Init: init})
+	c.globals[idx] = g
+	c.gdata = append(c.gdata, idx)
+	return g
+}
+
+// dataKind returns the kind of the data at index idx.
+func (c *compiler) dataKind(idx int32) reflect.Kind {
+	if idx < 0 || int(idx) >= len(c.img.Data) {
+		return reflect.Invalid
+	}
+	return c.img.Data[idx].Kind()
+}
+
+// index returns the offset of value type t in the sequence i32, i64, f32,
+// f64 of the const instructions and of the numeric instruction groups.
+func (t ValType) index() int { return int(I32 - t) }
+
+func (w *writer) u32le(n uint32) { w.byte(byte(n), byte(n>>8), byte(n>>16), byte(n>>24)) }
+func (w *writer) u64le(n uint64) { w.u32le(uint32(n)); w.u32le(uint32(n >> 32)) } //nolint:gosec
+
+// mixed is the kind of a local holding values of different types,
+// depending on the path to the instruction.
+const mixed = reflect.Kind(255)
+
+// slot is the abstract value of a VM stack slot.
+type slot struct {
+	kind   reflect.Kind // reflect.Invalid for a zero Value
+	global int          // data index of the global it was read from, or -1
+}
+
+// state is the abstract state of a frame at the entry of an instruction.
+type state struct {
+	stack  []slot
+	locals []reflect.Kind // parameters, then locals
+}
+
+func (s *state) clone() *state {
+	return &state{stack: slices.Clone(s.stack), locals: slices.Clone(s.locals)}
+}
+
+// merge merges state t in s and reports if s changed, or returns an error
+// if their stacks differ. A zero value read from an unset local, before a
+// loop sets it, takes the kind of the value it merges with.
+func (s *state) merge(t *state) (bool, error) {
+	if len(s.stack) != len(t.stack) {
+		return false, fmt.Errorf("stack depth %d, want %d", len(t.stack), len(s.stack))
+	}
+	changed := false
+	for i, v := range t.stack {
+		switch sk := s.stack[i].kind; {
+		case v.kind == sk || v.kind == reflect.Invalid:
+		case sk == reflect.Invalid:
+			s.stack[i].kind, changed = v.kind, true
+		default:
+			return false, fmt.Errorf("stack value %d of kind %v, want %v", i, v.kind, s.stack[i].kind)
+		}
+		if v.global != s.stack[i].global && s.stack[i].global >= 0 {
+			s.stack[i].global = -1
+			changed = true
+		}
+	}
+	for i, k := range t.locals {
+		switch sk := s.locals[i]; {
+		case k == sk || k == reflect.Invalid || sk == mixed:
+		case sk == reflect.Invalid:
+			s.locals[i], changed = k, true
+		default:
+			s.locals[i], changed = mixed, true
+		}
+	}
+	return changed, nil
+}
+
+// localKey identifies a local of a compiled function: the VM local or
+// stack slot i, holding values of type t.
+type localKey struct {
+	stack bool
+	i     int
+	t     ValType
+}
+
+// fcompiler compiles a function.
+type fcompiler struct {
+	*compiler
+	f        *cfunc
+	entry    int // code address of the first instruction
+	np       int // number of parameters
+	nlocals  int // number of VM locals
+	states   map[int]*state
+	segs     map[int]int // dispatch segment, by code address of jump targets
+	locals   map[localKey]uint32
+	body     Body
+	w        writer
+	cur      int // current segment
+	nest     int // blocks open in the current instruction
+	nsegs    int
+	dispatch bool // the function has jumps
+}
+
+// succ is a successor of an instruction, with its state at entry.
+type succ struct {
+	ip int
+	st *state
+}
+
+// compile compiles function f: an abstract interpretation computes the
+// kinds of the values on stack and in locals at each instruction, then the
+// reachable instructions are emitted in order. VM locals and stack slots
+// are wasm locals, one per value type, so values are kept across jumps.
+// Jumps set the segment to run next and branch to a dispatch loop.
+func (c *compiler) compile(f *cfunc) {
+	fc := &fcompiler{compiler: c, f: f, entry: f.Addr, np: len(f.params), states: map[int]*state{}, segs: map[int]int{}, locals: map[localKey]uint32{}}
+	if fc.entry < len(c.img.Code) && c.img.Code[fc.entry].Op == vm.Grow {
+		fc.nlocals = int(c.img.Code[fc.entry].A)
+	} else if f.inits == nil && f.Addr != max(0, c.img.Entry) {
+		c.fail(f, fc.entry, "function does not start with Grow")
+		return
+	}
+	st := &state{locals: make([]reflect.Kind, fc.np+fc.nlocals)}
+	copy(st.locals, f.params)
+	fc.states[fc.entry] = st
+	fc.segs[fc.entry] = 0
+
+	// Compute the states at each reachable instruction.
+	work := []int{fc.entry}
+	for len(work) > 0 {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		succs, err := fc.instr(ip, fc.states[ip].clone())
+		fc.w = fc.w[:0]
+		if err != nil {
+			c.fail(f, ip, "%v", err)
+			return
+		}
+		for _, s := range succs {
+			if s.ip < 0 || s.ip > len(c.img.Code) || s.ip == len(c.img.Code) && f.Addr != max(0, c.img.Entry) && f.inits == nil {
+				c.fail(f, ip, "jump out of code")
+				return
+			}
+			old, ok := fc.states[s.ip]
+			if !ok {
+				fc.states[s.ip] = s.st
+				work = append(work, s.ip)
+				continue
+			}
+			changed, err := old.merge(s.st)
+			if err != nil {
+				c.fail(f, s.ip, "%v", err)
+				return
+			}
+			if changed {
+				work = append(work, s.ip)
+			}
+		}
+	}
+
+	// Emit the reachable instructions, in order.
+	ips := make([]int, 0, len(fc.states))
+	for ip := range fc.states {
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+	targets := make([]int, 0, len(fc.segs))
+	for ip := range fc.segs {
+		targets = append(targets, ip)
+	}
+	slices.Sort(targets)
+	for i, ip := range targets {
+		fc.segs[ip] = i
+	}
+	fc.nsegs = len(targets)
+	pc := fc.local(localKey{i: -1, t: I32})
+	for i, k := range f.params {
+		if fc.normalize(k, true) {
+			fc.w.byte(opLocalGet)
+			fc.w.u32(uint32(i)) //nolint:gosec
+			fc.normalize(k, false)
+			fc.w.byte(opLocalSet)
+			fc.w.u32(uint32(i)) //nolint:gosec
+		}
+	}
+	if fc.dispatch {
+		if s := fc.segs[fc.entry]; s != 0 {
+			fc.w.byte(opI32Const)
+			fc.w.sleb(int64(s))
+			fc.w.byte(opLocalSet)
+			fc.w.u32(pc)
+		}
+		fc.w.byte(opLoop, 0x40)
+		for range fc.nsegs {
+			fc.w.byte(opBlock, 0x40)
+		}
+		fc.w.byte(opLocalGet)
+		fc.w.u32(pc)
+		fc.w.byte(opBrTable)
+		fc.w.len(fc.nsegs - 1)
+		for i := range fc.nsegs {
+			fc.w.len(i)
+		}
+	}
+	for _, ip := range ips {
+		if s, ok := fc.segs[ip]; ok && fc.dispatch {
+			fc.w.byte(opEnd)
+			fc.cur = s
+		}
+		if _, err := fc.instr(ip, fc.states[ip].clone()); err != nil {
+			c.fail(f, ip, "%v", err)
+			return
+		}
+	}
+	if fc.dispatch {
+		fc.w.byte(opEnd)
+	}
+	fc.w.byte(opUnreachable, opEnd)
+	fc.body.Code = fc.w
+	c.mod.Bodies[f.index] = fc.body
+}
+
+// local returns the wasm local of key k, declared if needed.
+func (fc *fcompiler) local(k localKey) uint32 {
+	if !k.stack && k.i >= 0 && k.i < fc.np && k.t == fc.f.typ.Params[k.i] {
+		return uint32(k.i) //nolint:gosec
+	}
+	if l, ok := fc.locals[k]; ok {
+		return l
+	}
+	l := uint32(fc.np + len(fc.body.Locals)) //nolint:gosec
+	fc.body.Locals = append(fc.body.Locals, k.t)
+	fc.locals[k] = l
+	return l
+}
+
+// varIndex returns the index in state locals of the VM local at offset a.
+func (fc *fcompiler) varIndex(a int) (int, error) {
+	switch {
+	case a < 0 && a+fc.np+2 >= 0:
+		return a + fc.np + 2, nil
+	case a >= 1 && a <= fc.nlocals:
+		return fc.np + a - 1, nil
+	}
+	return 0, fmt.Errorf("invalid local %d", a)
+}
+
+// zero emits the zero value of type t.
+func (fc *fcompiler) zero(t ValType) {
+	switch t {
+	case F32:
+		fc.w.byte(opF32Const)
+		fc.w.u32le(0)
+	case F64:
+		fc.w.byte(opF64Const)
+		fc.w.u64le(0)
+	default:
+		fc.w.byte(byte(opI32Const + t.index()))
+		fc.w.sleb(0)
+	}
+}
+
+// constant emits the integer n of type t.
+func (fc *fcompiler) constant(t ValType, n int64) {
+	fc.w.byte(byte(opI32Const + t.index()))
+	fc.w.sleb(n)
+}
+
+// coerce converts the value of kind k on top of the wasm stack to type t,
+// as the VM does with the 64 bits of its numbers.
+func (fc *fcompiler) coerce(k reflect.Kind, t ValType) error {
+	vt, _ := kindValType(k)
+	switch {
+	case vt == t:
+	case vt == I32 && t == I64 && isSigned(k):
+		fc.w.byte(0xac) // i64.extend_i32_s
+	case vt == I32 && t == I64:
+		fc.w.byte(0xad) // i64.extend_i32_u
+	case vt == I64 && t == I32:
+		fc.w.byte(0xa7) // i32.wrap_i64
+	default:
+		return fmt.Errorf("%v value where %v is expected", k, t)
+	}
+	return nil
+}
+
+// get emits the value of stack slot d as type t.
+func (fc *fcompiler) get(st *state, d int, t ValType) error {
+	s := st.stack[d]
+	if s.kind == reflect.Invalid {
+		fc.zero(t)
+		return nil
+	}
+	vt, ok := kindValType(s.kind)
+	if !ok {
+		return fmt.Errorf("values of kind %v are not supported", s.kind)
+	}
+	fc.w.byte(opLocalGet)
+	fc.w.u32(fc.local(localKey{stack: true, i: d, t: vt}))
+	return fc.coerce(s.kind, t)
+}
+
+// getKind emits the value of stack slot d as a value of kind k.
+func (fc *fcompiler) getKind(st *state, d int, k reflect.Kind) error {
+	t, _ := kindValType(k)
+	return fc.get(st, d, t)
+}
+
+// push pops the value of kind k from the wasm stack to a new stack slot.
+func (fc *fcompiler) push(st *state, k reflect.Kind) {
+	t, _ := kindValType(k)
+	fc.w.byte(opLocalSet)
+	fc.w.u32(fc.local(localKey{stack: true, i: len(st.stack), t: t}))
+	st.stack = append(st.stack, slot{kind: k, global: -1})
+}
+
+// normalize emits the truncation of an i32 value to the width of kind k,
+// and reports if there is one. If check is set, nothing is emitted.
+func (fc *fcompiler) normalize(k reflect.Kind, check bool) bool {
+	var code []byte
+	switch k {
+	case reflect.Int8:
+		code = []byte{0xc0} // i32.extend8_s
+	case reflect.Int16:
+		code = []byte{0xc1} // i32.extend16_s
+	case reflect.Uint8:
+		code = []byte{opI32Const, 0xff, 0x01, 0x71}
+	case reflect.Uint16:
+		code = []byte{opI32Const, 0xff, 0xff, 0x03, 0x71}
+	}
+	if !check {
+		fc.w.byte(code...)
+	}
+	return code != nil
+}
+
+// jump emits a jump to the instruction at ip.
+func (fc *fcompiler) jump(ip int) {
+	fc.dispatch = true
+	s, ok := fc.segs[ip]
+	if !ok {
+		fc.segs[ip] = len(fc.segs)
+	}
+	fc.w.byte(opI32Const)
+	fc.w.sleb(int64(s))
+	fc.w.byte(opLocalSet)
+	fc.w.u32(fc.local(localKey{i: -1, t: I32}))
+	fc.w.byte(opBr)
+	fc.w.len(fc.nsegs - 1 - fc.cur + fc.nest)
+}
+
+// branch emits a jump to ip if the i32 on the wasm stack is not zero.
+func (fc *fcompiler) branch(ip int) {
+	fc.w.byte(opIf, 0x40)
+	fc.nest++
+	fc.jump(ip)
+	fc.nest--
+	fc.w.byte(opEnd)
+}
+
+// Numeric instructions of each value type and signedness: add, sub, mul,
+// div, rem, lt, gt, eq.
+type numCodes struct{ add, sub, mul, div, rem, lt, gt, eq byte }
+
+var (
+	i32s = numCodes{0x6a, 0x6b, 0x6c, 0x6d, 0x6f, 0x48, 0x4a, 0x46}
+	i32u = numCodes{0x6a, 0x6b, 0x6c, 0x6e, 0x70, 0x49, 0x4b, 0x46}
+	i64s = numCodes{0x7c, 0x7d, 0x7e, 0x7f, 0x81, 0x53, 0x55, 0x51}
+	i64u = numCodes{0x7c, 0x7d, 0x7e, 0x80, 0x82, 0x54, 0x56, 0x51}
+	f32c = numCodes{0x92, 0x93, 0x94, 0x95, 0, 0x5d, 0x5e, 0x5b}
+	f64c = numCodes{0xa0, 0xa1, 0xa2, 0xa3, 0, 0x63, 0x64, 0x61}
+)
+
+func codesOf(k reflect.Kind) numCodes {
+	switch k {
+	case reflect.Float32:
+		return f32c
+	case reflect.Float64:
+		return f64c
+	}
+	t, _ := kindValType(k)
+	switch {
+	case t == I32 && isSigned(k):
+		return i32s
+	case t == I32:
+		return i32u
+	case isSigned(k):
+		return i64s
+	}
+	return i64u
+}
+
+// numKinds are the kinds of the per-type numeric opcodes, in order.
+var numKinds = [...]reflect.Kind{
+	reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+	reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+	reflect.Float32, reflect.Float64,
+}
+
+// Float math opcodes, with the f32 instruction, the f64 one being at
+// offset 14.
+var floatCodes = map[vm.Op]byte{
+	vm.AbsFloat32: 0x8b, vm.CeilFloat32: 0x8d, vm.FloorFloat32: 0x8e, vm.TruncFloat32: 0x8f,
+	vm.NearestFloat32: 0x90, vm.SqrtFloat32: 0x91, vm.MinFloat32: 0x96, vm.MaxFloat32: 0x97,
+	vm.CopysignFloat32: 0x98,
+}
+
+// intCodes are the 32-bit bit manipulation instructions, the 64-bit ones
+// being at offset 18.
+var intCodes = map[vm.Op]byte{
+	vm.Clz32: 0x67, vm.Ctz32: 0x68, vm.Popcnt32: 0x69, vm.Rotl32: 0x77, vm.Rotr32: 0x78,
+}
+
+// instr emits instruction ip, with st the state at its entry, and returns
+// its successors.
+func (fc *fcompiler) instr(ip int, st *state) ([]succ, error) {
+	code := fc.img.Code
+	if ip == len(code) {
+		// End of the top-level code: run the init functions.
+		for _, init := range fc.f.inits {
+			fc.w.byte(opCall)
+			fc.w.u32(init.index)
+		}
+		fc.w.byte(opReturn)
+		return nil, nil
+	}
+	c := code[ip]
+	next := []succ{{ip + 1, st}}
+	d := len(st.stack)
+	need := func(n int) error {
+		if d < n {
+			return fmt.Errorf("stack underflow")
+		}
+		return nil
+	}
+	if o := c.Op; o >= vm.AddInt && o <= vm.RemFloat64 {
+		return next, fc.numOp(st, o)
+	}
+	switch c.Op {
+	case vm.Nop:
+	case vm.Grow:
+		if ip != fc.entry {
+			return nil, fmt.Errorf("Grow not at function entry")
+		}
+	case vm.Pop:
+		if err := need(int(c.A)); err != nil {
+			return nil, err
+		}
+		st.stack = st.stack[:d-int(c.A)]
+	case vm.Push:
+		fc.constant(I64, int64(c.A))
+		fc.push(st, reflect.Int)
+	case vm.Swap:
+		a, b := d-1-int(c.A), d-1-int(c.B)
+		if a < 0 || b < 0 {
+			return nil, fmt.Errorf("stack underflow")
+		}
+		sa, sb := st.stack[a], st.stack[b]
+		ta, oka := kindValType(sa.kind)
+		tb, okb := kindValType(sb.kind)
+		if oka {
+			fc.w.byte(opLocalGet)
+			fc.w.u32(fc.local(localKey{stack: true, i: a, t: ta}))
+		}
+		if okb {
+			fc.w.byte(opLocalGet)
+			fc.w.u32(fc.local(localKey{stack: true, i: b, t: tb}))
+			fc.w.byte(opLocalSet)
+			fc.w.u32(fc.local(localKey{stack: true, i: a, t: tb}))
+		}
+		if oka {
+			fc.w.byte(opLocalSet)
+			fc.w.u32(fc.local(localKey{stack: true, i: b, t: ta}))
+		}
+		st.stack[a], st.stack[b] = sb, sa
+	case vm.Jump:
+		fc.jump(ip + int(c.A))
+		return []succ{{ip + int(c.A), st}}, nil
+	case vm.JumpTrue, vm.JumpFalse, vm.JumpSetTrue, vm.JumpSetFalse:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if err := fc.get(st, d-1, I32); err != nil {
+			return nil, err
+		}
+		if c.Op == vm.JumpFalse || c.Op == vm.JumpSetFalse {
+			fc.w.byte(0x45) // i32.eqz
+		}
+		fc.branch(ip + int(c.A))
+		jst := st
+		if c.Op == vm.JumpTrue || c.Op == vm.JumpFalse {
+			st.stack = st.stack[:d-1]
+		} else {
+			jst = st.clone()
+			st.stack = st.stack[:d-1]
+		}
+		return []succ{{ip + 1, st}, {ip + int(c.A), jst}}, nil
+	case vm.LowerIntImmJumpFalse, vm.LowerIntImmJumpTrue:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if err := fc.get(st, d-1, I64); err != nil {
+			return nil, err
+		}
+		st.stack = st.stack[:d-1]
+		return fc.immJump(ip, st, int64(c.B), c.Op == vm.LowerIntImmJumpFalse)
+	case vm.GetLocalLowerIntImmJumpFalse, vm.GetLocalLowerIntImmJumpTrue:
+		if err := fc.getLocal(st, int(c.B>>16)); err != nil {
+			return nil, err
+		}
+		if err := fc.get(st, d, I64); err != nil {
+			return nil, err
+		}
+		st.stack = st.stack[:d]
+		return fc.immJump(ip, st, int64(int16(c.B)), c.Op == vm.GetLocalLowerIntImmJumpFalse) //nolint:gosec
+	case vm.Equal, vm.EqualSet:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		if err := fc.equal(st, d-2, d-1); err != nil {
+			return nil, err
+		}
+		if c.Op == vm.Equal {
+			st.stack = st.stack[:d-2]
+			fc.push(st, reflect.Bool)
+			break
+		}
+		// EqualSet and the following JumpFalse: if not equal, jump with the
+		// left operand kept on stack.
+		if ip+1 >= len(code) || code[ip+1].Op != vm.JumpFalse {
+			return nil, fmt.Errorf("EqualSet not followed by JumpFalse")
+		}
+		target := ip + 1 + int(code[ip+1].A)
+		fc.w.byte(0x45) // i32.eqz
+		fc.branch(target)
+		jst := st.clone()
+		jst.stack = jst.stack[:d-1]
+		st.stack = st.stack[:d-2]
+		return []succ{{ip + 2, st}, {target, jst}}, nil
+	case vm.Not:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if err := fc.get(st, d-1, I32); err != nil {
+			return nil, err
+		}
+		fc.w.byte(0x45) // i32.eqz
+		st.stack = st.stack[:d-1]
+		fc.push(st, reflect.Bool)
+	case vm.GetLocal:
+		return next, fc.getLocal(st, int(c.A))
+	case vm.GetLocal2:
+		if err := fc.getLocal(st, int(c.A)); err != nil {
+			return nil, err
+		}
+		return next, fc.getLocal(st, int(c.B))
+	case vm.SetLocal:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		return next, fc.setLocal(st, int(c.A))
+	case vm.New:
+		k := fc.dataKind(c.B)
+		t, ok := kindValType(k)
+		if !ok {
+			return nil, fmt.Errorf("variables of kind %v are not supported", k)
+		}
+		li, err := fc.varIndex(int(c.A))
+		if err != nil {
+			return nil, err
+		}
+		fc.zero(t)
+		fc.w.byte(opLocalSet)
+		fc.w.u32(fc.local(localKey{i: li, t: t}))
+		st.locals[li] = k
+	case vm.Fnew:
+		k := fc.dataKind(c.A)
+		t, ok := kindValType(k)
+		if !ok {
+			return nil, fmt.Errorf("values of kind %v are not supported", k)
+		}
+		fc.zero(t)
+		fc.push(st, k)
+	case vm.GetGlobal:
+		k := fc.dataKind(c.A)
+		if _, ok := kindValType(k); !ok {
+			// Only valid for Pop and Panic.
+			st.stack = append(st.stack, slot{kind: k, global: int(c.A)})
+			if k == reflect.Invalid {
+				st.stack[d].kind = reflect.UnsafePointer
+			}
+			break
+		}
+		fc.w.byte(opGlobalGet)
+		fc.w.u32(fc.global(int(c.A)))
+		fc.push(st, k)
+		st.stack[d].global = int(c.A)
+	case vm.SetGlobal:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if err := fc.setGlobal(st, d-1, int(c.A)); err != nil {
+			return nil, err
+		}
+		st.stack = st.stack[:d-1]
+	case vm.SetS:
+		n := int(c.A)
+		if err := need(2 * n); err != nil {
+			return nil, err
+		}
+		for i := range n {
+			g := st.stack[d-2*n+i].global
+			if g < 0 {
+				return nil, fmt.Errorf("assignments through pointers are not supported")
+			}
+			if err := fc.setGlobal(st, d-n+i, g); err != nil {
+				return nil, err
+			}
+		}
+		st.stack = st.stack[:d-2*n]
+	case vm.Convert:
+		i := d - 1 - int(c.B)
+		if i < 0 {
+			return nil, fmt.Errorf("stack underflow")
+		}
+		return next, fc.convert(st, i, fc.dataKind(c.A))
+	case vm.CallImm, vm.TailCall:
+		return next, fc.call(st, int(c.A), int(c.B>>16), int(c.B&0xffff))
+	case vm.GetLocalReturn:
+		if err := fc.getLocal(st, int(c.A)); err != nil {
+			return nil, err
+		}
+		return nil, fc.ret(st)
+	case vm.Return:
+		return nil, fc.ret(st)
+	case vm.Panic:
+		fc.w.byte(opUnreachable)
+		return nil, nil
+	case vm.Min, vm.Max:
+		return next, fc.minMax(st, int(c.A), reflect.Kind(c.B), c.Op == vm.Max) //nolint:gosec
+	case vm.AddIntImm, vm.SubIntImm, vm.MulIntImm, vm.GreaterIntImm, vm.GreaterUintImm, vm.LowerIntImm, vm.LowerUintImm:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		return next, fc.immOp(st, c.Op, int64(c.A))
+	case vm.GetLocalAddIntImm, vm.GetLocalSubIntImm, vm.GetLocalMulIntImm,
+		vm.GetLocalLowerIntImm, vm.GetLocalLowerUintImm, vm.GetLocalGreaterIntImm, vm.GetLocalGreaterUintImm:
+		if err := fc.getLocal(st, int(c.A)); err != nil {
+			return nil, err
+		}
+		o := map[vm.Op]vm.Op{
+			vm.GetLocalAddIntImm: vm.AddIntImm, vm.GetLocalSubIntImm: vm.SubIntImm, vm.GetLocalMulIntImm: vm.MulIntImm,
+			vm.GetLocalLowerIntImm: vm.LowerIntImm, vm.GetLocalLowerUintImm: vm.LowerUintImm,
+			vm.GetLocalGreaterIntImm: vm.GreaterIntImm, vm.GetLocalGreaterUintImm: vm.GreaterUintImm,
+		}[c.Op]
+		return next, fc.immOp(st, o, int64(c.B))
+	case vm.BitAnd, vm.BitOr, vm.BitXor, vm.BitAndNot, vm.BitShl, vm.BitShr:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		return next, fc.bitOp(st, c.Op)
+	case vm.BitComp:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		k := st.stack[d-1].kind
+		t, ok := kindValType(k)
+		if !ok || isFloatKind(k) {
+			return nil, fmt.Errorf("values of kind %v are not supported", k)
+		}
+		if err := fc.get(st, d-1, t); err != nil {
+			return nil, err
+		}
+		fc.constant(t, -1)
+		fc.w.byte(0x73 + byte(0x12*t.index())) // xor
+		fc.normalize(k, false)
+		st.stack = st.stack[:d-1]
+		fc.push(st, k)
+	case vm.Clz32, vm.Ctz32, vm.Popcnt32, vm.Clz64, vm.Ctz64, vm.Popcnt64:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		t, b := I32, intCodes[c.Op]
+		if c.Op == vm.Clz64 || c.Op == vm.Ctz64 || c.Op == vm.Popcnt64 {
+			t, b = I64, intCodes[c.Op-1]+0x12
+		}
+		if err := fc.get(st, d-1, t); err != nil {
+			return nil, err
+		}
+		fc.w.byte(b)
+		if t == I32 {
+			fc.w.byte(0xad) // i64.extend_i32_u
+		}
+		st.stack = st.stack[:d-1]
+		fc.push(st, reflect.Int)
+	case vm.Rotl32, vm.Rotr32, vm.Rotl64, vm.Rotr64:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		t, b := I32, intCodes[c.Op]
+		if c.Op == vm.Rotl64 || c.Op == vm.Rotr64 {
+			t, b = I64, intCodes[c.Op-1]+0x12
+		}
+		k := st.stack[d-2].kind
+		if err := fc.get(st, d-2, t); err != nil {
+			return nil, err
+		}
+		if err := fc.get(st, d-1, t); err != nil {
+			return nil, err
+		}
+		fc.w.byte(b)
+		if vt, _ := kindValType(k); vt != t {
+			k = reflect.Uint32
+			if t == I64 {
+				k = reflect.Uint64
+			}
+		}
+		st.stack = st.stack[:d-2]
+		fc.push(st, k)
+	case vm.AbsFloat32, vm.AbsFloat64, vm.SqrtFloat32, vm.SqrtFloat64, vm.CeilFloat32, vm.CeilFloat64,
+		vm.FloorFloat32, vm.FloorFloat64, vm.TruncFloat32, vm.TruncFloat64, vm.NearestFloat32, vm.NearestFloat64,
+		vm.MinFloat32, vm.MinFloat64, vm.MaxFloat32, vm.MaxFloat64, vm.CopysignFloat32, vm.CopysignFloat64:
+		// Opcodes alternate between Float32 and Float64 variants.
+		k, b := reflect.Float32, floatCodes[c.Op]
+		if b == 0 {
+			k, b = reflect.Float64, floatCodes[c.Op-1]+0x0e
+		}
+		n := 1
+		if c.Op >= vm.MinFloat32 {
+			n = 2
+		}
+		if err := need(n); err != nil {
+			return nil, err
+		}
+		for i := d - n; i < d; i++ {
+			if err := fc.getKind(st, i, k); err != nil {
+				return nil, err
+			}
+		}
+		fc.w.byte(b)
+		st.stack = st.stack[:d-n]
+		fc.push(st, k)
+	case vm.Float32Bits, vm.Float32FromBits, vm.Float64Bits, vm.Float64FromBits:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		in, out, b := F32, reflect.Uint32, byte(0xbc)
+		switch c.Op {
+		case vm.Float32FromBits:
+			in, out, b = I32, reflect.Float32, 0xbe
+		case vm.Float64Bits:
+			in, out, b = F64, reflect.Uint64, 0xbd
+		case vm.Float64FromBits:
+			in, out, b = I64, reflect.Float64, 0xbf
+		}
+		if err := fc.get(st, d-1, in); err != nil {
+			return nil, err
+		}
+		fc.w.byte(b)
+		st.stack = st.stack[:d-1]
+		fc.push(st, out)
+	default:
+		if feature, ok := unsupported[c.Op]; ok {
+			return nil, fmt.Errorf("%s are not supported", feature)
+		}
+		return nil, fmt.Errorf("opcode not supported")
+	}
+	return next, nil
+}
+
+// immJump emits the conditional jump of an int64 on the wasm stack lower
+// than imm, or not lower if jumpFalse.
+func (fc *fcompiler) immJump(ip int, st *state, imm int64, jumpFalse bool) ([]succ, error) {
+	fc.constant(I64, imm)
+	if jumpFalse {
+		fc.w.byte(0x59) // i64.ge_s
+	} else {
+		fc.w.byte(0x53) // i64.lt_s
+	}
+	target := ip + int(fc.img.Code[ip].A)
+	fc.branch(target)
+	return []succ{{ip + 1, st}, {target, st.clone()}}, nil
+}
+
+// getLocal pushes the VM local at offset a.
+func (fc *fcompiler) getLocal(st *state, a int) error {
+	li, err := fc.varIndex(a)
+	if err != nil {
+		return err
+	}
+	k := st.locals[li]
+	t, ok := kindValType(k)
+	switch {
+	case k == reflect.Invalid:
+		st.stack = append(st.stack, slot{global: -1})
+		return nil
+	case k == mixed:
+		return fmt.Errorf("local %d holds values of different types", a)
+	case !ok:
+		return fmt.Errorf("values of kind %v are not supported", k)
+	}
+	fc.w.byte(opLocalGet)
+	fc.w.u32(fc.local(localKey{i: li, t: t}))
+	fc.push(st, k)
+	return nil
+}
+
+// setLocal pops the top of stack to the VM local at offset a.
+func (fc *fcompiler) setLocal(st *state, a int) error {
+	li, err := fc.varIndex(a)
+	if err != nil {
+		return err
+	}
+	d := len(st.stack)
+	k := st.stack[d-1].kind
+	if k != reflect.Invalid {
+		t, ok := kindValType(k)
+		if !ok {
+			return fmt.Errorf("values of kind %v are not supported", k)
+		}
+		if err := fc.get(st, d-1, t); err != nil {
+			return err
+		}
+		fc.w.byte(opLocalSet)
+		fc.w.u32(fc.local(localKey{i: li, t: t}))
+	}
+	st.locals[li] = k
+	st.stack = st.stack[:d-1]
+	return nil
+}
+
+// setGlobal stores stack slot d in the global of data index idx.
+func (fc *fcompiler) setGlobal(st *state, d, idx int) error {
+	k := fc.dataKind(int32(idx)) //nolint:gosec
+	t, ok := kindValType(k)
+	if !ok {
+		return fmt.Errorf("globals of kind %v are not supported", k)
+	}
+	if err := fc.get(st, d, t); err != nil {
+		return err
+	}
+	fc.w.byte(opGlobalSet)
+	fc.w.u32(fc.global(idx))
+	fc.written[idx] = true
+	return nil
+}
+
+// equal emits the comparison of the stack slots a and b.
+func (fc *fcompiler) equal(st *state, a, b int) error {
+	ka, kb := st.stack[a].kind, st.stack[b].kind
+	t, _ := kindValType(ka)
+	if tb, _ := kindValType(kb); ka == reflect.Invalid || tb != t && !isFloatKind(ka) && !isFloatKind(kb) {
+		t = I64
+		if ka == reflect.Invalid {
+			t = tb
+		}
+	}
+	if err := fc.get(st, a, t); err != nil {
+		return err
+	}
+	if err := fc.get(st, b, t); err != nil {
+		return err
+	}
+	fc.w.byte([...]byte{0x46, 0x51, 0x5b, 0x61}[t.index()])
+	return nil
+}
+
+// numOp emits the per-type numeric opcode o.
+func (fc *fcompiler) numOp(st *state, o vm.Op) error {
+	n := int(o - vm.AddInt)
+	family, k := vm.AddInt+vm.Op(n/len(numKinds)*len(numKinds)), numKinds[n%len(numKinds)]
+	t, _ := kindValType(k)
+	codes := codesOf(k)
+	d := len(st.stack)
+	if family == vm.NegInt {
+		if d < 1 {
+			return fmt.Errorf("stack underflow")
+		}
+		if isFloatKind(k) {
+			if err := fc.get(st, d-1, t); err != nil {
+				return err
+			}
+			fc.w.byte([...]byte{0x8c, 0x9a}[t.index()-2])
+		} else {
+			fc.constant(t, 0)
+			if err := fc.get(st, d-1, t); err != nil {
+				return err
+			}
+			fc.w.byte(codes.sub)
+			fc.normalize(k, false)
+		}
+		st.stack = st.stack[:d-1]
+		fc.push(st, k)
+		return nil
+	}
+	if d < 2 {
+		return fmt.Errorf("stack underflow")
+	}
+	res := k
+	if family == vm.DivInt && (k == reflect.Int || k == reflect.Int64 || k == reflect.Int32) {
+		// The quotient of the lowest integer by -1 overflows in Go, and
+		// traps in WebAssembly.
+		if err := fc.get(st, d-1, t); err != nil {
+			return err
+		}
+		fc.constant(t, -1)
+		fc.w.byte(codes.eq, opIf, byte(t))
+		fc.constant(t, 0)
+		if err := fc.get(st, d-2, t); err != nil {
+			return err
+		}
+		fc.w.byte(codes.sub, opElse)
+	}
+	if err := fc.get(st, d-2, t); err != nil {
+		return err
+	}
+	if err := fc.get(st, d-1, t); err != nil {
+		return err
+	}
+	switch family {
+	case vm.AddInt:
+		fc.w.byte(codes.add)
+	case vm.SubInt:
+		fc.w.byte(codes.sub)
+	case vm.MulInt:
+		fc.w.byte(codes.mul)
+	case vm.DivInt:
+		fc.w.byte(codes.div)
+		if codes.rem != 0 && (k == reflect.Int || k == reflect.Int64 || k == reflect.Int32) {
+			fc.w.byte(opEnd)
+		}
+	case vm.RemInt:
+		if codes.rem == 0 {
+			return fmt.Errorf("opcode not supported")
+		}
+		fc.w.byte(codes.rem)
+	case vm.GreaterInt:
+		fc.w.byte(codes.gt)
+		res = reflect.Bool
+	case vm.LowerInt:
+		fc.w.byte(codes.lt)
+		res = reflect.Bool
+	}
+	if res == k {
+		fc.normalize(k, false)
+	}
+	st.stack = st.stack[:d-2]
+	fc.push(st, res)
+	return nil
+}
+
+// immOp emits the immediate operand opcode o.
+func (fc *fcompiler) immOp(st *state, o vm.Op, imm int64) error {
+	d := len(st.stack)
+	if err := fc.get(st, d-1, I64); err != nil {
+		return err
+	}
+	fc.constant(I64, imm)
+	res := reflect.Bool
+	switch o {
+	case vm.AddIntImm:
+		fc.w.byte(i64s.add)
+		res = reflect.Int
+	case vm.SubIntImm:
+		fc.w.byte(i64s.sub)
+		res = reflect.Int
+	case vm.MulIntImm:
+		fc.w.byte(i64s.mul)
+		res = reflect.Int
+	case vm.GreaterIntImm:
+		fc.w.byte(i64s.gt)
+	case vm.GreaterUintImm:
+		fc.w.byte(i64u.gt)
+	case vm.LowerIntImm:
+		fc.w.byte(i64s.lt)
+	case vm.LowerUintImm:
+		fc.w.byte(i64u.lt)
+	}
+	st.stack = st.stack[:d-1]
+	fc.push(st, res)
+	return nil
+}
+
+// bitOp emits the bitwise opcode o. As in the VM, the result has the kind
+// of the left operand. Shifts follow Go: counts above the width shift all
+// bits out.
+func (fc *fcompiler) bitOp(st *state, o vm.Op) error {
+	d := len(st.stack)
+	k := st.stack[d-2].kind
+	t, ok := kindValType(k)
+	if !ok || isFloatKind(k) {
+		return fmt.Errorf("values of kind %v are not supported", k)
+	}
+	off := byte(0x12 * t.index()) // offset of i64 instructions
+	if err := fc.get(st, d-2, t); err != nil {
+		return err
+	}
+	if err := fc.get(st, d-1, t); err != nil {
+		return err
+	}
+	width := int64(32 << t.index())
+	// count emits the shift count as an i64.
+	count := func() error { return fc.get(st, d-1, I64) }
+	switch o {
+	case vm.BitAnd:
+		fc.w.byte(0x71 + off)
+	case vm.BitOr:
+		fc.w.byte(0x72 + off)
+	case vm.BitXor:
+		fc.w.byte(0x73 + off)
+	case vm.BitAndNot:
+		fc.constant(t, -1)
+		fc.w.byte(0x73+off, 0x71+off)
+	case vm.BitShl, vm.BitShr:
+		if o == vm.BitShr && isSigned(k) {
+			// Arithmetic shift by at most width-1.
+			fc.constant(t, width-1)
+			if err := count(); err != nil {
+				return err
+			}
+			fc.constant(I64, width-1)
+			fc.w.byte(i64u.lt, opSelect, 0x75+off)
+			break
+		}
+		if o == vm.BitShl {
+			fc.w.byte(0x74 + off)
+		} else {
+			fc.w.byte(0x76 + off)
+		}
+		fc.constant(t, 0)
+		if err := count(); err != nil {
+			return err
+		}
+		fc.constant(I64, width)
+		fc.w.byte(i64u.lt, opSelect)
+		fc.normalize(k, false)
+	}
+	st.stack = st.stack[:d-2]
+	fc.push(st, k)
+	return nil
+}
+
+// convert converts stack slot i to kind k.
+func (fc *fcompiler) convert(st *state, i int, k reflect.Kind) error {
+	t, ok := kindValType(k)
+	if !ok {
+		return fmt.Errorf("conversions to kind %v are not supported", k)
+	}
+	src := st.stack[i].kind
+	switch s, _ := kindValType(src); {
+	case src == reflect.Invalid:
+		fc.zero(t)
+	case src == k:
+		return nil
+	case isFloatKind(src) && isFloatKind(k):
+		if err := fc.get(st, i, s); err != nil {
+			return err
+		}
+		if k == reflect.Float32 {
+			fc.w.byte(0xb6) // f32.demote_f64
+		} else {
+			fc.w.byte(0xbb) // f64.promote_f32
+		}
+	case isFloatKind(src):
+		// Truncate to int64, or to uint64 if positive and k is unsigned,
+		// saturating as the VM conversion does not trap.
+		trunc := byte(4 + 2*(s.index()-2)) // i64.trunc_sat_f32_s or i64.trunc_sat_f64_s
+		if err := fc.get(st, i, s); err != nil {
+			return err
+		}
+		if isUnsigned(k) {
+			fc.zero(s)
+			fc.w.byte([...]byte{0x60, 0x66}[s.index()-2], opIf, byte(I64)) // ge
+			_ = fc.get(st, i, s)
+			fc.w.byte(opPrefixFC, trunc+1, opElse)
+			_ = fc.get(st, i, s)
+			fc.w.byte(opPrefixFC, trunc, opEnd)
+		} else {
+			fc.w.byte(opPrefixFC, trunc)
+		}
+		if t == I32 {
+			fc.w.byte(0xa7) // i32.wrap_i64
+			fc.normalize(k, false)
+		}
+	case isFloatKind(k):
+		if err := fc.get(st, i, s); err != nil {
+			return err
+		}
+		b := byte(0xb2) // f32.convert_i32_s
+		if t == F64 {
+			b = 0xb7
+		}
+		b += byte(2 * s.index())
+		if isUnsigned(src) || src == reflect.Bool {
+			b++
+		}
+		fc.w.byte(b)
+	default:
+		if err := fc.get(st, i, s); err != nil {
+			return err
+		}
+		if err := fc.coerce(src, t); err != nil {
+			return err
+		}
+		fc.normalize(k, false)
+	}
+	fc.w.byte(opLocalSet)
+	fc.w.u32(fc.local(localKey{stack: true, i: i, t: t}))
+	st.stack[i] = slot{kind: k, global: -1}
+	return nil
+}
+
+// call emits the call of the function at the code address in data at
+// index idx.
+func (fc *fcompiler) call(st *state, idx, narg, nret int) error {
+	if idx < 0 || idx >= len(fc.img.Data) {
+		return fmt.Errorf("invalid function %d", idx)
+	}
+	addr := int(fc.img.Data[idx].Int())
+	if _, ok := fc.byAddr[addr]; !ok {
+		return fmt.Errorf("call of an unknown function at %d", addr)
+	}
+	f := fc.function(addr)
+	if f == nil {
+		return fmt.Errorf("call of a function not supported")
+	}
+	if narg != len(f.params) || nret != len(f.results) {
+		return fmt.Errorf("call of %s with %d arguments and %d results", f.Name, narg, nret)
+	}
+	d := len(st.stack)
+	if d < narg {
+		return fmt.Errorf("stack underflow")
+	}
+	for i, k := range f.params {
+		if err := fc.getKind(st, d-narg+i, k); err != nil {
+			return err
+		}
+	}
+	fc.w.byte(opCall)
+	fc.w.u32(f.index)
+	st.stack = st.stack[:d-narg]
+	for i := len(f.results) - 1; i >= 0; i-- {
+		t, _ := kindValType(f.results[i])
+		fc.w.byte(opLocalSet)
+		fc.w.u32(fc.local(localKey{stack: true, i: d - narg + i, t: t}))
+	}
+	for _, k := range f.results {
+		st.stack = append(st.stack, slot{kind: k, global: -1})
+	}
+	return nil
+}
+
+// ret emits the return of the function results, on top of stack.
+func (fc *fcompiler) ret(st *state) error {
+	d, n := len(st.stack), len(fc.f.results)
+	if d < n {
+		return fmt.Errorf("stack underflow")
+	}
+	for i, k := range fc.f.results {
+		if err := fc.getKind(st, d-n+i, k); err != nil {
+			return err
+		}
+	}
+	fc.w.byte(opReturn)
+	return nil
+}
+
+// minMax emits the min or max builtin of n values of kind k.
+func (fc *fcompiler) minMax(st *state, n int, k reflect.Kind, isMax bool) error {
+	t, ok := kindValType(k)
+	d := len(st.stack)
+	if !ok || n < 1 || d < n {
+		return fmt.Errorf("min and max of kind %v are not supported", k)
+	}
+	codes := codesOf(k)
+	if err := fc.get(st, d-n, t); err != nil {
+		return err
+	}
+	for i := d - n + 1; i < d; i++ {
+		if isFloatKind(k) {
+			if err := fc.get(st, i, t); err != nil {
+				return err
+			}
+			b := [...]byte{0x96, 0xa4}[t.index()-2] // min
+			if isMax {
+				b++
+			}
+			fc.w.byte(b)
+			continue
+		}
+		// Keep the result in the first slot, to select it.
+		acc := fc.local(localKey{stack: true, i: d - n, t: t})
+		fc.w.byte(opLocalSet)
+		fc.w.u32(acc)
+		fc.w.byte(opLocalGet)
+		fc.w.u32(acc)
+		if err := fc.get(st, i, t); err != nil {
+			return err
+		}
+		fc.w.byte(opLocalGet)
+		fc.w.u32(acc)
+		if err := fc.get(st, i, t); err != nil {
+			return err
+		}
+		if isMax {
+			fc.w.byte(codes.gt)
+		} else {
+			fc.w.byte(codes.lt)
+		}
+		fc.w.byte(opSelect)
+	}
+	st.stack = st.stack[:d-n]
+	fc.push(st, k)
+	return nil
+}
@@ -0,0 +1,221 @@
+package wasm_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/mvertes/parscan/interp"
+	"github.com/mvertes/parscan/lang/golang"
+	"github.com/mvertes/parscan/stdlib"
+	"github.com/mvertes/parscan/wasm"
+)
+
+// compile returns the instance of the WebAssembly module compiled from
+// the Go source src.
+func compile(t *testing.T, src string) *wasm.Instance {
+	t.Helper()
+	i := interp.NewInterpreter(golang.GoSpec)
+	i.ImportPackageValues(stdlib.Values)
+	var buf bytes.Buffer
+	if err := i.WriteWasm(&buf, "m:test", src); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := wasm.Decode(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := wasm.Instantiate(mod, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+func TestCompile(t *testing.T) {
+	for _, test := range []struct {
+		n, src string
+		calls  []ctest
+	}{
+		{n: "recursion", src: `
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}`, calls: []ctest{
+			{"fib", []any{20}, int64(6765)},
+		}},
+		{n: "loops", src: `
+func prime(n int) int {
+	c := 0
+outer:
+	for i := 2; i <= n; i++ {
+		for j := 2; j*j <= i; j++ {
+			if i%j == 0 {
+				continue outer
+			}
+		}
+		c++
+	}
+	return c
+}
+
+func collatz(n uint32) (steps uint32) {
+	for n != 1 {
+		if n&1 == 0 {
+			n /= 2
+		} else {
+			n = 3*n + 1
+		}
+		steps++
+	}
+	return
+}`, calls: []ctest{
+			{"prime", []any{100}, int64(25)},
+			{"collatz", []any{27}, int32(111)},
+		}},
+		{n: "sized integers", src: `
+func add8(a, b int8) int8 { return a + b }
+func mulu16(a, b uint16) uint16 { return a * b }
+func div8(a, b int8) int8 { return a / b }
+func div(a, b int) int { return a / b }
+func rem(a, b int) int { return a % b }
+func neg(a uint8) uint8 { return -a }`, calls: []ctest{
+			{"add8", []any{100, 100}, int32(-56)},
+			{"mulu16", []any{30000, 3}, int32(24464)},
+			{"div8", []any{-128, -1}, int32(-128)},
+			{"div", []any{-1 << 63, -1}, int64(-1 << 63)},
+			{"div", []any{1, 0}, "integer divide by zero"},
+			{"rem", []any{-7, 2}, int64(-1)},
+			{"neg", []any{1}, int32(255)},
+		}},
+		{n: "bits", src: `
+import "math/bits"
+
+func shl(x int64, n uint) int64 { return x << n }
+func shr(x int64, n uint) int64 { return x >> n }
+func shru(x uint32, n uint) uint32 { return x >> n }
+func andnot(x, y uint8) uint8 { return x &^ y }
+func comp(x uint16) uint16 { return ^x }
+func lz(x uint64) int { return bits.LeadingZeros64(x) }`, calls: []ctest{
+			{"shl", []any{-100, 3}, int64(-800)},
+			{"shl", []any{1, 64}, int64(0)},
+			{"shr", []any{-100, 70}, int64(-1)},
+			{"shru", []any{-1, 31}, int32(1)},
+			{"shru", []any{-1, 32}, int32(0)},
+			{"andnot", []any{0xff, 0x0f}, int32(0xf0)},
+			{"comp", []any{1}, int32(0xfffe)},
+			{"lz", []any{12345}, int64(50)},
+		}},
+		{n: "floats", src: `
+import "math"
+
+func conv(f float64) int32 { return int32(f) }
+func convu(f float64) uint8 { return uint8(f) }
+func toint(f float64) int { return int(f) }
+func third(f float64) float32 { return float32(f) / 3 }
+func fl(x, y float64) float64 { return math.Sqrt(x) + math.Floor(x) + max(x, y) }
+func itof(n uint64) float64 { return float64(n) }`, calls: []ctest{
+			{"conv", []any{-2.5}, int32(-2)},
+			{"convu", []any{200.7}, int32(200)},
+			{"toint", []any{1e30}, int64(math.MaxInt64)},
+			{"toint", []any{math.NaN()}, int64(0)},
+			{"third", []any{1.5}, float32(0.5)},
+			{"fl", []any{2.25, 1}, 5.75},
+			{"itof", []any{-1}, float64(1 << 64)},
+		}},
+		{n: "globals", src: `
+var counter int
+var scale = 1.5
+
+func init() { counter = 10 }
+
+func bump() int { counter++; return counter }
+func scaled(x float64) float64 { return x * scale }`, calls: []ctest{
+			{"bump", nil, int64(11)},
+			{"bump", nil, int64(12)},
+			{"scaled", []any{2}, 3.0},
+		}},
+		{n: "switch and logic", src: `
+func sw(n int) int {
+	switch n {
+	case 1:
+		return 10
+	case 2, 3:
+		return 20
+	}
+	return -1
+}
+
+func logic(a, b int) bool { return a > 0 && b > 0 || a == b }
+
+func mm(a, b, c int) int { return min(a, b, c) * max(a, b, c) }`, calls: []ctest{
+			{"sw", []any{1}, int64(10)},
+			{"sw", []any{3}, int64(20)},
+			{"sw", []any{5}, int64(-1)},
+			{"logic", []any{1, 1}, int32(1)},
+			{"logic", []any{-1, -1}, int32(1)},
+			{"logic", []any{-1, 2}, int32(0)},
+			{"mm", []any{3, -1, 2}, int64(-3)},
+		}},
+	} {
+		t.Run(test.n, func(t *testing.T) {
+			check(t, compile(t, "package main\n"+test.src+"\nfunc main() {}\n"), test.calls)
+		})
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, test := range []struct{ n, src, err string }{
+		{n: "map", src: "var m = map[int]int{}\nfunc get(k int) int { return m[k] }", err: "get (test:3:31): MapIndex: maps are not supported"},
+		{n: "print", src: "func show(x int) { println(x) }", err: "show (test:2:27): Println: print builtins are not supported"},
+		{n: "string", src: "func str() string { return \"\" }\nfunc size() int { return len(str()) }", err: "str (test:2:1): Grow: function type func() string is not supported"},
+	} {
+		t.Run(test.n, func(t *testing.T) {
+			i := interp.NewInterpreter(golang.GoSpec)
+			err := i.WriteWasm(&bytes.Buffer{}, "m:test", "package main\n"+test.src+"\nfunc main() {}\n")
+			var ce *wasm.CompileError
+			if !errors.As(err, &ce) || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestNoExport(t *testing.T) {
+	for _, src := range []string{
+		"type T struct{ n int }\nfunc (t T) Get() int { return t.n }",
+		"func name() string { return \"\" }",
+	} {
+		i := interp.NewInterpreter(golang.GoSpec)
+		err := i.WriteWasm(&bytes.Buffer{}, "m:test", "package main\n"+src+"\nfunc main() {}\n")
+		if err == nil || err.Error() != "no exportable functions" {
+			t.Errorf("got error %v, want no exportable functions", err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	b := mod{
+		imports: []imp{{"env", "log", "i:"}},
+		funcs: []fn{
+			{sig: "ii:i", code: cat(get(0), get(1), []byte{0x6a}), export: "add"},
+			{sig: ":", locals: "iF", code: []byte{0x01}},
+		},
+		memory:  []byte{0, 1},
+		globals: [][]byte{cat([]byte{0x7e, 1}, i64(-5), []byte{0x0b})},
+		table:   []int{1, 2},
+		data:    []byte("hello"),
+		start:   3,
+	}.bytes()
+	m, err := wasm.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Encode(); !bytes.Equal(got, b) {
+		t.Errorf("got %x, want %x", got, b)
+	}
+}
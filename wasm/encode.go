@@ -0,0 +1,168 @@
+package wasm
+
+// writer is a buffer of the WebAssembly binary format.
+type writer []byte
+
+func (w *writer) byte(b ...byte) { *w = append(*w, b...) }
+
+func (w *writer) uleb(n uint64) {
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			*w = append(*w, b)
+			return
+		}
+		*w = append(*w, b|0x80)
+	}
+}
+
+func (w *writer) sleb(n int64) {
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 && b&0x40 == 0 || n == -1 && b&0x40 != 0 {
+			*w = append(*w, b)
+			return
+		}
+		*w = append(*w, b|0x80)
+	}
+}
+
+func (w *writer) u32(n uint32) { w.uleb(uint64(n)) }
+func (w *writer) len(n int)    { w.uleb(uint64(n)) } //nolint:gosec
+func (w *writer) name(s string) {
+	w.len(len(s))
+	*w = append(*w, s...)
+}
+
+func (w *writer) valTypes(ts []ValType) {
+	w.len(len(ts))
+	for _, t := range ts {
+		w.byte(byte(t))
+	}
+}
+
+func (w *writer) limits(l Limits) {
+	if l.HasMax {
+		w.byte(1)
+		w.u32(l.Min)
+		w.u32(l.Max)
+		return
+	}
+	w.byte(0)
+	w.u32(l.Min)
+}
+
+func (w *writer) globalType(t GlobalType) {
+	w.byte(byte(t.Type))
+	if t.Mutable {
+		w.byte(1)
+	} else {
+		w.byte(0)
+	}
+}
+
+// section appends section id of n items, each written by f, if n > 0.
+func (w *writer) section(id byte, n int, f func(w *writer, i int)) {
+	if n == 0 {
+		return
+	}
+	var s writer
+	s.len(n)
+	for i := range n {
+		f(&s, i)
+	}
+	w.byte(id)
+	w.len(len(s))
+	*w = append(*w, s...)
+}
+
+// Encode returns the module in the WebAssembly binary format.
+func (mod *Module) Encode() []byte {
+	w := writer("\x00asm\x01\x00\x00\x00")
+	w.section(1, len(mod.Types), func(w *writer, i int) {
+		w.byte(0x60)
+		w.valTypes(mod.Types[i].Params)
+		w.valTypes(mod.Types[i].Results)
+	})
+	w.section(2, len(mod.Imports), func(w *writer, i int) {
+		im := mod.Imports[i]
+		w.name(im.Module)
+		w.name(im.Name)
+		w.byte(byte(im.Kind))
+		switch im.Kind {
+		case ExternFunc:
+			w.u32(im.Type)
+		case ExternTable:
+			w.byte(0x70)
+			w.limits(im.Limits)
+		case ExternMemory:
+			w.limits(im.Limits)
+		case ExternGlobal:
+			w.globalType(im.Global)
+		}
+	})
+	w.section(3, len(mod.Funcs), func(w *writer, i int) { w.u32(mod.Funcs[i]) })
+	w.section(4, len(mod.Tables), func(w *writer, i int) {
+		w.byte(0x70)
+		w.limits(mod.Tables[i])
+	})
+	w.section(5, len(mod.Memories), func(w *writer, i int) { w.limits(mod.Memories[i]) })
+	w.section(6, len(mod.Globals), func(w *writer, i int) {
+		w.globalType(mod.Globals[i].Type)
+		w.byte(mod.Globals[i].Init...)
+	})
+	w.section(7, len(mod.Exports), func(w *writer, i int) {
+		e := mod.Exports[i]
+		w.name(e.Name)
+		w.byte(byte(e.Kind))
+		w.u32(e.Index)
+	})
+	if mod.Start >= 0 {
+		var s writer
+		s.len(mod.Start)
+		w.byte(8)
+		w.len(len(s))
+		w.byte(s...)
+	}
+	w.section(9, len(mod.Elems), func(w *writer, i int) {
+		w.byte(0)
+		w.byte(mod.Elems[i].Offset...)
+		w.len(len(mod.Elems[i].Funcs))
+		for _, f := range mod.Elems[i].Funcs {
+			w.u32(f)
+		}
+	})
+	w.section(10, len(mod.Bodies), func(w *writer, i int) {
+		var f writer
+		b := mod.Bodies[i]
+		// Locals are declared in runs of the same type.
+		var runs int
+		for j := range b.Locals {
+			if j == 0 || b.Locals[j] != b.Locals[j-1] {
+				runs++
+			}
+		}
+		f.len(runs)
+		for j := 0; j < len(b.Locals); {
+			k := j
+			for k < len(b.Locals) && b.Locals[k] == b.Locals[j] {
+				k++
+			}
+			f.len(k - j)
+			f.byte(byte(b.Locals[j]))
+			j = k
+		}
+		f.byte(b.Code...)
+		w.len(len(f))
+		w.byte(f...)
+	})
+	w.section(11, len(mod.Datas), func(w *writer, i int) {
+		w.byte(0)
+		w.byte(mod.Datas[i].Offset...)
+		w.len(len(mod.Datas[i].Init))
+		w.byte(mod.Datas[i].Init...)
+	})
+	return w
+}
@@ -0,0 +1,462 @@
+package wasm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/mvertes/parscan/vm"
+)
+
+// Imports are the values satisfying the imports of a module, by module and
+// name: Go functions for functions, numbers for globals, and a []byte for
+// a memory. A function may take the calling *Instance as first parameter,
+// before the parameters of its WebAssembly type.
+type Imports map[string]map[string]any
+
+// Instance is an instantiated module, its functions translated to VM code.
+type Instance struct {
+	mod     *Module
+	m       *vm.Machine
+	funcs   []int // code address of each function
+	globals []int // machine global of each global
+	memory  int   // machine global of the memory, or -1
+	exports map[string]Export
+}
+
+// Trap is a run-time fault raised by WebAssembly code.
+type Trap struct {
+	Err *vm.PanicError
+}
+
+func (e *Trap) Error() string { return fmt.Sprintf("wasm: trap: %v", e.Err.Value) }
+
+func (e *Trap) Unwrap() error { return e.Err }
+
+var instanceType = reflect.TypeFor[*Instance]()
+
+// maxStack is the default stack size limit of an instance, in value slots,
+// beyond which a call traps.
+const maxStack = 1 << 20
+
+// Instantiate translates the functions of mod to VM code, resolves its
+// imports, initializes its globals, tables and memory, then runs its start
+// function.
+func Instantiate(mod *Module, imports Imports) (*Instance, error) {
+	in := &Instance{mod: mod, m: vm.NewMachine(), memory: -1, exports: map[string]Export{}}
+	in.m.SetLimits(vm.Limits{MaxStack: maxStack})
+	t := &translator{mod: mod, memory: -1, table: -1, types: -1, slots: map[any]int{}}
+	t.canon = make([]int, len(mod.Types))
+	for i, ft := range mod.Types {
+		t.canon[i] = i
+		for j := range i {
+			if ft.equal(mod.Types[j]) {
+				t.canon[i] = j
+				break
+			}
+		}
+	}
+
+	// Resolve imports.
+	var hosts []reflect.Value
+	var memory []byte
+	var hasMemory bool
+	var globals []vm.Value
+	for _, im := range mod.Imports {
+		v, ok := imports[im.Module][im.Name]
+		if !ok {
+			return nil, fmt.Errorf("wasm: unresolved import %s.%s", im.Module, im.Name)
+		}
+		switch im.Kind {
+		case ExternFunc:
+			ft, ok := mod.typeAt(im.Type)
+			if !ok {
+				return nil, fmt.Errorf("wasm: import %s.%s: invalid type %d", im.Module, im.Name, im.Type)
+			}
+			fv := reflect.ValueOf(v)
+			if err := checkHost(fv, ft); err != nil {
+				return nil, fmt.Errorf("wasm: import %s.%s: %w", im.Module, im.Name, err)
+			}
+			hosts = append(hosts, fv)
+		case ExternMemory:
+			b, ok := v.([]byte)
+			if !ok || len(b)%vm.MemPageSize != 0 || uint64(len(b)/vm.MemPageSize) < uint64(im.Limits.Min) ||
+				im.Limits.HasMax && uint64(len(b)/vm.MemPageSize) > uint64(im.Limits.Max) {
+				return nil, fmt.Errorf("wasm: import %s.%s: incompatible memory", im.Module, im.Name)
+			}
+			memory, hasMemory = b, true
+			t.maxMem = maxPages(im.Limits)
+		case ExternGlobal:
+			g, err := toValue(im.Global.Type, v)
+			if err != nil {
+				return nil, fmt.Errorf("wasm: import %s.%s: %w", im.Module, im.Name, err)
+			}
+			globals = append(globals, g)
+		default:
+			return nil, fmt.Errorf("wasm: import %s.%s: unsupported %v import", im.Module, im.Name, im.Kind)
+		}
+	}
+	for _, g := range mod.Globals {
+		v, err := evalConst(g.Init, globals)
+		if err != nil {
+			return nil, err
+		}
+		globals = append(globals, v)
+	}
+	if len(mod.Memories) > 0 {
+		if hasMemory || len(mod.Memories) > 1 {
+			return nil, errors.New("wasm: multiple memories")
+		}
+		l := mod.Memories[0]
+		if l.Min > vm.MemMaxPages {
+			return nil, errors.New("wasm: memory too large")
+		}
+		memory, hasMemory = make([]byte, int(l.Min)*vm.MemPageSize), true
+		t.maxMem = maxPages(l)
+	}
+
+	// Data layout: memory, globals, tables, functions, host functions, then
+	// constants allocated during translation.
+	if hasMemory {
+		t.memory = len(t.data)
+		t.data = append(t.data, vm.ValueOf(memory))
+	}
+	for _, g := range globals {
+		t.global = append(t.global, len(t.data))
+		t.data = append(t.data, g)
+	}
+	var table, types []int
+	if len(mod.Tables) > 1 {
+		return nil, errors.New("wasm: multiple tables")
+	}
+	if len(mod.Tables) == 1 {
+		n := int(mod.Tables[0].Min)
+		table, types = make([]int, n), make([]int, n)
+		for i := range types {
+			types[i] = -1
+		}
+		t.table, t.types = len(t.data), len(t.data)+1
+		t.data = append(t.data, vm.ValueOf(table), vm.ValueOf(types))
+	}
+	nfuncs := len(hosts) + len(mod.Funcs)
+	for range nfuncs {
+		t.funcs = append(t.funcs, len(t.data))
+		t.data = append(t.data, vm.Value{})
+	}
+	inst := len(t.data)
+	t.data = append(t.data, vm.ValueOf(in))
+	for _, h := range hosts {
+		t.data = append(t.data, vm.ValueOf(h.Interface()))
+	}
+
+	// Translate functions, host functions first.
+	in.funcs = make([]int, nfuncs)
+	for i, h := range hosts {
+		ft, _ := mod.funcType(i)
+		in.funcs[i] = len(t.code)
+		t.host(inst+1+i, inst, h.Type(), ft)
+	}
+	for i, body := range mod.Bodies {
+		fi := len(hosts) + i
+		ft, ok := mod.funcType(fi)
+		if !ok {
+			return nil, fmt.Errorf("wasm: function %d: invalid type", fi)
+		}
+		in.funcs[fi] = len(t.code)
+		if err := t.function(fi, ft, body); err != nil {
+			return nil, err
+		}
+	}
+	for i, addr := range in.funcs {
+		t.data[t.funcs[i]] = vm.ValueOf(addr)
+	}
+	if err := reserve(t.code, t.data); err != nil {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+
+	// Initialize tables and memory.
+	for _, e := range mod.Elems {
+		off, err := offset(e.Offset, globals)
+		if err != nil {
+			return nil, err
+		}
+		if off+uint64(len(e.Funcs)) > uint64(len(table)) {
+			return nil, errors.New("wasm: element segment out of table bounds")
+		}
+		for i, f := range e.Funcs {
+			ft, ok := mod.funcType(int(f))
+			if !ok {
+				return nil, fmt.Errorf("wasm: element segment: invalid function %d", f)
+			}
+			table[off+uint64(i)] = in.funcs[f]
+			types[off+uint64(i)] = t.canonOf(ft)
+		}
+	}
+	for _, d := range mod.Datas {
+		off, err := offset(d.Offset, globals)
+		if err != nil {
+			return nil, err
+		}
+		if off+uint64(len(d.Init)) > uint64(len(memory)) {
+			return nil, errors.New("wasm: data segment out of memory bounds")
+		}
+		copy(memory[off:], d.Init)
+	}
+
+	in.m.Push(t.data...)
+	in.m.PushCode(t.code...)
+	in.globals, in.memory = t.global, t.memory
+	for _, e := range mod.Exports {
+		in.exports[e.Name] = e
+	}
+	if mod.Start >= 0 {
+		ft, ok := mod.funcType(mod.Start)
+		if !ok || len(ft.Params) > 0 || len(ft.Results) > 0 {
+			return nil, errors.New("wasm: invalid start function")
+		}
+		if _, err := in.invoke(mod.Start); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// canonOf returns the canonical type index of ft.
+func (t *translator) canonOf(ft FuncType) int {
+	for i, u := range t.mod.Types {
+		if ft.equal(u) {
+			return t.canon[i]
+		}
+	}
+	return -1
+}
+
+// host emits the code of a function calling the host function in data at
+// index h, of Go type ht and WebAssembly type ft.
+func (t *translator) host(h, inst int, ht reflect.Type, ft FuncType) {
+	np, nr := len(ft.Params), len(ft.Results)
+	t.emit(vm.Grow, 0, 0)
+	t.emit(vm.GetGlobal, h, 0)
+	narg := np
+	if ht.NumIn() > np {
+		t.emit(vm.GetGlobal, inst, 0)
+		narg++
+	}
+	for i, p := range ft.Params {
+		t.emit(vm.GetLocal, i-np-2, 0)
+		t.emit(vm.Convert, t.kindSlot(valKind(p)), 0)
+	}
+	t.emit(vm.Call, narg, nr)
+	for i, r := range ft.Results {
+		t.emit(vm.Convert, t.kindSlot(valKind(r)), nr-1-i)
+	}
+	t.emit(vm.Return, 0, 0)
+}
+
+// checkHost checks that fv is a function usable for type ft.
+func checkHost(fv reflect.Value, ft FuncType) error {
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return errors.New("not a function")
+	}
+	ht := fv.Type()
+	params := make([]reflect.Type, ht.NumIn())
+	for i := range params {
+		params[i] = ht.In(i)
+	}
+	if len(params) > 0 && params[0] == instanceType {
+		params = params[1:]
+	}
+	if ht.IsVariadic() || len(params) != len(ft.Params) || ht.NumOut() != len(ft.Results) {
+		return fmt.Errorf("function type %s does not match %v", ht, ft)
+	}
+	for i, p := range params {
+		if !isNumKind(p.Kind()) {
+			return fmt.Errorf("parameter %d: unsupported type %s", i, p)
+		}
+	}
+	for i := range ht.NumOut() {
+		if !isNumKind(ht.Out(i).Kind()) {
+			return fmt.Errorf("result %d: unsupported type %s", i, ht.Out(i))
+		}
+	}
+	return nil
+}
+
+func (ft FuncType) String() string {
+	return fmt.Sprintf("func%v %v", ft.Params, ft.Results)
+}
+
+func isNumKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64 && k != reflect.Uintptr
+}
+
+// maxPages returns the maximum number of pages of a memory of limits l.
+func maxPages(l Limits) int {
+	if l.HasMax && l.Max < vm.MemMaxPages {
+		return int(l.Max)
+	}
+	return vm.MemMaxPages
+}
+
+// reserve sets the stack depth reserved by the Grow of each function to
+// the maximum depth it reaches, then verifies the code.
+func reserve(code vm.Code, data []vm.Value) error {
+	depth, entry, _ := vm.Depths(code, len(data))
+	for ip, e := range entry {
+		if e >= 0 && code[e].Op == vm.Grow && int32(depth[ip]) > code[e].B { //nolint:gosec
+			code[e].B = int32(depth[ip]) //nolint:gosec
+		}
+	}
+	return vm.Verify(code, data)
+}
+
+// evalConst returns the value of the constant expression expr.
+func evalConst(expr []byte, globals []vm.Value) (vm.Value, error) {
+	r := &reader{b: expr}
+	var v vm.Value
+	switch r.byte() {
+	case opI32Const:
+		v = vm.ValueOf(int32(r.sleb(32))) //nolint:gosec
+	case opI64Const:
+		v = vm.ValueOf(r.sleb(64))
+	case opF32Const:
+		v = vm.ValueOf(f32Bits(r))
+	case opF64Const:
+		v = vm.ValueOf(f64Bits(r))
+	case opGlobalGet:
+		g := int(r.u32())
+		if g >= len(globals) {
+			return v, fmt.Errorf("wasm: constant expression: invalid global %d", g)
+		}
+		v = globals[g]
+	}
+	if r.err != nil {
+		return v, fmt.Errorf("wasm: constant expression: %w", r.err)
+	}
+	return v, nil
+}
+
+// offset returns the segment offset of the constant expression expr.
+func offset(expr []byte, globals []vm.Value) (uint64, error) {
+	v, err := evalConst(expr, globals)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(uint32(v.Int())), nil //nolint:gosec
+}
+
+// goType returns the Go type of the values of type vt.
+func goType(vt ValType) reflect.Type { return kindType[valKind(vt)] }
+
+// toValue returns the number a as a value of type vt.
+func toValue(vt ValType, a any) (vm.Value, error) {
+	rv := reflect.ValueOf(a)
+	if !rv.IsValid() || !isNumKind(rv.Kind()) {
+		return vm.Value{}, fmt.Errorf("%v is not a number", a)
+	}
+	return vm.ValueOf(rv.Convert(goType(vt)).Interface()), nil
+}
+
+// fromValue returns the Go value of v of type vt.
+func fromValue(vt ValType, v vm.Value) any {
+	switch vt {
+	case I64:
+		return v.Int()
+	case F32:
+		return float32(v.Float())
+	case F64:
+		return v.Float()
+	}
+	return int32(v.Int()) //nolint:gosec
+}
+
+// Machine returns the virtual machine of the instance, to set its limits or
+// I/O. Its stack is limited to 1<<20 value slots by default.
+func (in *Instance) Machine() *vm.Machine { return in.m }
+
+// Module returns the module of the instance.
+func (in *Instance) Module() *Module { return in.mod }
+
+// FuncType returns the type of the exported function name.
+func (in *Instance) FuncType(name string) (FuncType, bool) {
+	e, ok := in.exports[name]
+	if !ok || e.Kind != ExternFunc {
+		return FuncType{}, false
+	}
+	return in.mod.funcType(int(e.Index))
+}
+
+// Call calls the exported function name with args, numbers converted to
+// its parameter types. The results are int32, int64, float32 or float64.
+func (in *Instance) Call(name string, args ...any) ([]any, error) {
+	e, ok := in.exports[name]
+	if !ok || e.Kind != ExternFunc {
+		return nil, fmt.Errorf("wasm: no exported function %q", name)
+	}
+	ft, _ := in.mod.funcType(int(e.Index))
+	if len(args) != len(ft.Params) {
+		return nil, fmt.Errorf("wasm: %s: got %d arguments, want %d", name, len(args), len(ft.Params))
+	}
+	vals := make([]vm.Value, len(args))
+	for i, a := range args {
+		v, err := toValue(ft.Params[i], a)
+		if err != nil {
+			return nil, fmt.Errorf("wasm: %s: argument %d: %w", name, i, err)
+		}
+		vals[i] = v
+	}
+	res, err := in.invoke(int(e.Index), vals...)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]any, len(res))
+	for i, v := range res {
+		out[i] = fromValue(ft.Results[i], v)
+	}
+	return out, nil
+}
+
+// invoke calls function fi with args.
+func (in *Instance) invoke(fi int, args ...vm.Value) ([]vm.Value, error) {
+	ft, _ := in.mod.funcType(fi)
+	res, err := in.m.Invoke(in.funcs[fi], len(ft.Results), args...)
+	var pe *vm.PanicError
+	if errors.As(err, &pe) {
+		return nil, &Trap{Err: pe}
+	}
+	if le := (*vm.LimitError)(nil); errors.As(err, &le) && le.Kind == vm.LimitStack {
+		return nil, &Trap{Err: &vm.PanicError{Value: "call stack exhausted", Goroutine: 1}}
+	}
+	return res, err
+}
+
+// Memory returns the memory of the instance, or nil.
+func (in *Instance) Memory() []byte {
+	if in.memory < 0 {
+		return nil
+	}
+	return in.m.Global(in.memory).Interface().([]byte)
+}
+
+// Global returns the value of the exported global name.
+func (in *Instance) Global(name string) (any, bool) {
+	e, ok := in.exports[name]
+	if !ok || e.Kind != ExternGlobal || int(e.Index) >= len(in.globals) {
+		return nil, false
+	}
+	return fromValue(in.globalType(int(e.Index)), in.m.Global(in.globals[e.Index])), true
+}
+
+// globalType returns the type of global g, in the global index space.
+func (in *Instance) globalType(g int) ValType {
+	for _, im := range in.mod.Imports {
+		if im.Kind != ExternGlobal {
+			continue
+		}
+		if g == 0 {
+			return im.Global.Type
+		}
+		g--
+	}
+	return in.mod.Globals[g].Type.Type
+}
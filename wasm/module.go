@@ -0,0 +1,538 @@
+// Package wasm runs WebAssembly modules on the parscan virtual machine.
+//
+// A module in the binary format is decoded by Decode, then translated to
+// vm.Code and instantiated by Instantiate. Exported functions are called
+// with Instance.Call.
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ValType is a WebAssembly value type.
+type ValType byte
+
+// Value types.
+const (
+	I32 ValType = 0x7f
+	I64 ValType = 0x7e
+	F32 ValType = 0x7d
+	F64 ValType = 0x7c
+)
+
+func (t ValType) String() string {
+	switch t {
+	case I32:
+		return "i32"
+	case I64:
+		return "i64"
+	case F32:
+		return "f32"
+	case F64:
+		return "f64"
+	}
+	return fmt.Sprintf("valtype(%#x)", byte(t))
+}
+
+// ExternKind is the kind of an import or export.
+type ExternKind byte
+
+// Extern kinds.
+const (
+	ExternFunc ExternKind = iota
+	ExternTable
+	ExternMemory
+	ExternGlobal
+)
+
+func (k ExternKind) String() string {
+	switch k {
+	case ExternFunc:
+		return "func"
+	case ExternTable:
+		return "table"
+	case ExternMemory:
+		return "memory"
+	case ExternGlobal:
+		return "global"
+	}
+	return fmt.Sprintf("extern(%d)", byte(k))
+}
+
+// FuncType is a function signature.
+type FuncType struct {
+	Params, Results []ValType
+}
+
+func (t FuncType) equal(u FuncType) bool {
+	return bytes.Equal(valBytes(t.Params), valBytes(u.Params)) && bytes.Equal(valBytes(t.Results), valBytes(u.Results))
+}
+
+func valBytes(v []ValType) []byte {
+	b := make([]byte, len(v))
+	for i, t := range v {
+		b[i] = byte(t)
+	}
+	return b
+}
+
+// Limits are the size limits of a table or memory.
+type Limits struct {
+	Min    uint32
+	Max    uint32
+	HasMax bool
+}
+
+// GlobalType is the type of a global.
+type GlobalType struct {
+	Type    ValType
+	Mutable bool
+}
+
+// Import is an imported function, table, memory or global.
+type Import struct {
+	Module, Name string
+	Kind         ExternKind
+	Type         uint32     // type index of a function
+	Limits       Limits     // limits of a table or memory
+	Global       GlobalType // type of a global
+}
+
+// Global is a global defined in the module.
+type Global struct {
+	Type GlobalType
+	Init []byte // constant expression
+}
+
+// Export is an exported item, by index in its index space.
+type Export struct {
+	Name  string
+	Kind  ExternKind
+	Index uint32
+}
+
+// Elem is an active element segment of table 0.
+type Elem struct {
+	Offset []byte // constant expression
+	Funcs  []uint32
+}
+
+// Data is an active data segment of memory 0.
+type Data struct {
+	Offset []byte // constant expression
+	Init   []byte
+}
+
+// Body is the code of a function defined in the module.
+type Body struct {
+	Locals []ValType // declared locals, after parameters
+	Code   []byte    // instructions, ending with end
+}
+
+// Module is a decoded WebAssembly module.
+type Module struct {
+	Types    []FuncType
+	Imports  []Import
+	Funcs    []uint32 // type index of defined functions
+	Tables   []Limits
+	Memories []Limits
+	Globals  []Global
+	Exports  []Export
+	Start    int // index of the start function, or -1
+	Elems    []Elem
+	Datas    []Data
+	Bodies   []Body
+}
+
+// maxLocals is the maximum number of locals of a function.
+const maxLocals = 50000
+
+// Decode decodes a module in the WebAssembly binary format.
+func Decode(b []byte) (*Module, error) {
+	r := &reader{b: b}
+	if !bytes.HasPrefix(b, []byte("\x00asm")) {
+		return nil, errors.New("wasm: not a WebAssembly module")
+	}
+	r.off = 4
+	if v := r.u32le(); v != 1 {
+		return nil, fmt.Errorf("wasm: unsupported version %d", v)
+	}
+	mod := &Module{Start: -1}
+	last := byte(0)
+	for r.err == nil && r.off < len(b) {
+		id := r.byte()
+		size := int(r.u32())
+		if r.err != nil {
+			break
+		}
+		if size > len(b)-r.off {
+			return nil, fmt.Errorf("wasm: section %d: unexpected end", id)
+		}
+		s := &reader{b: b[r.off : r.off+size]}
+		r.off += size
+		if id != 0 {
+			if id <= last && !(id == 12 && last < 10) {
+				return nil, fmt.Errorf("wasm: section %d out of order", id)
+			}
+			last = id
+		}
+		mod.section(id, s)
+		if s.err == nil && s.off != len(s.b) {
+			s.err = errors.New("section size mismatch")
+		}
+		if s.err != nil {
+			return nil, fmt.Errorf("wasm: section %d: %w", id, s.err)
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("wasm: %w", r.err)
+	}
+	if len(mod.Bodies) != len(mod.Funcs) {
+		return nil, errors.New("wasm: function and code section sizes differ")
+	}
+	return mod, nil
+}
+
+// section decodes the content of the section id.
+func (mod *Module) section(id byte, r *reader) {
+	switch id {
+	case 0: // custom
+		r.off = len(r.b)
+	case 1: // type
+		for range r.count() {
+			if r.byte() != 0x60 {
+				r.fail("invalid function type")
+				return
+			}
+			mod.Types = append(mod.Types, FuncType{Params: r.valTypes(), Results: r.valTypes()})
+		}
+	case 2: // import
+		for range r.count() {
+			im := Import{Module: r.name(), Name: r.name(), Kind: ExternKind(r.byte())}
+			switch im.Kind {
+			case ExternFunc:
+				im.Type = r.u32()
+			case ExternTable:
+				r.refType()
+				im.Limits = r.limits()
+			case ExternMemory:
+				im.Limits = r.limits()
+			case ExternGlobal:
+				im.Global = r.globalType()
+			default:
+				r.fail("invalid import kind %d", im.Kind)
+			}
+			mod.Imports = append(mod.Imports, im)
+		}
+	case 3: // function
+		for range r.count() {
+			mod.Funcs = append(mod.Funcs, r.u32())
+		}
+	case 4: // table
+		for range r.count() {
+			r.refType()
+			mod.Tables = append(mod.Tables, r.limits())
+		}
+	case 5: // memory
+		for range r.count() {
+			mod.Memories = append(mod.Memories, r.limits())
+		}
+	case 6: // global
+		for range r.count() {
+			mod.Globals = append(mod.Globals, Global{Type: r.globalType(), Init: r.constExpr()})
+		}
+	case 7: // export
+		for range r.count() {
+			mod.Exports = append(mod.Exports, Export{Name: r.name(), Kind: ExternKind(r.byte()), Index: r.u32()})
+		}
+	case 8: // start
+		mod.Start = int(r.u32())
+	case 9: // element
+		for range r.count() {
+			switch flags := r.u32(); flags {
+			case 0:
+			case 2:
+				if r.u32() != 0 || r.byte() != 0x00 {
+					r.fail("unsupported element segment")
+				}
+			default:
+				r.fail("unsupported element segment kind %d", flags)
+				return
+			}
+			e := Elem{Offset: r.constExpr()}
+			for range r.count() {
+				e.Funcs = append(e.Funcs, r.u32())
+			}
+			mod.Elems = append(mod.Elems, e)
+		}
+	case 10: // code
+		for range r.count() {
+			size := int(r.u32())
+			if r.err != nil || size > len(r.b)-r.off {
+				r.fail("unexpected end")
+				return
+			}
+			f := &reader{b: r.b[r.off : r.off+size]}
+			r.off += size
+			var body Body
+			for range f.count() {
+				n, t := f.u32(), f.valType()
+				if uint64(n)+uint64(len(body.Locals)) > maxLocals {
+					r.fail("too many locals")
+					return
+				}
+				for range n {
+					body.Locals = append(body.Locals, t)
+				}
+			}
+			body.Code = f.b[f.off:]
+			if f.err != nil {
+				r.err = f.err
+				return
+			}
+			mod.Bodies = append(mod.Bodies, body)
+		}
+	case 11: // data
+		for range r.count() {
+			switch flags := r.u32(); flags {
+			case 0:
+			case 2:
+				if r.u32() != 0 {
+					r.fail("unsupported memory index")
+				}
+			default:
+				r.fail("unsupported data segment kind %d", flags)
+				return
+			}
+			d := Data{Offset: r.constExpr()}
+			n := int(r.u32())
+			if r.err == nil && n > len(r.b)-r.off {
+				r.fail("unexpected end")
+				return
+			}
+			d.Init = r.bytes(n)
+			mod.Datas = append(mod.Datas, d)
+		}
+	case 12: // data count
+		r.u32()
+	default:
+		r.fail("unknown section")
+	}
+}
+
+// funcType returns the type of function i, in the function index space.
+func (mod *Module) funcType(i int) (FuncType, bool) {
+	for _, im := range mod.Imports {
+		if im.Kind != ExternFunc {
+			continue
+		}
+		if i == 0 {
+			return mod.typeAt(im.Type)
+		}
+		i--
+	}
+	if i < 0 || i >= len(mod.Funcs) {
+		return FuncType{}, false
+	}
+	return mod.typeAt(mod.Funcs[i])
+}
+
+func (mod *Module) typeAt(i uint32) (FuncType, bool) {
+	if int(i) >= len(mod.Types) {
+		return FuncType{}, false
+	}
+	return mod.Types[i], true
+}
+
+// reader decodes values of the binary format. The first error is kept in
+// err, after which zero values are returned.
+type reader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *reader) fail(format string, a ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, a...)
+	}
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.off >= len(r.b) {
+		r.fail("unexpected end")
+		return 0
+	}
+	c := r.b[r.off]
+	r.off++
+	return c
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b)-r.off {
+		r.fail("unexpected end")
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *reader) u32le() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func (r *reader) u64le() uint64 {
+	lo := uint64(r.u32le())
+	return lo | uint64(r.u32le())<<32
+}
+
+// uleb decodes an unsigned LEB128 number of at most n bits.
+func (r *reader) uleb(n uint) uint64 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		c := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		if shift >= n || shift+7 > n && c&0x7f>>(n-shift) != 0 {
+			r.fail("integer too large")
+			return 0
+		}
+		v |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+// sleb decodes a signed LEB128 number of at most n bits.
+func (r *reader) sleb(n uint) int64 {
+	var v int64
+	for shift := uint(0); ; shift += 7 {
+		c := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		if shift >= n {
+			r.fail("integer too large")
+			return 0
+		}
+		v |= int64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			if shift+7 < 64 && c&0x40 != 0 {
+				v |= -1 << (shift + 7)
+			}
+			if n < 64 && (v < -1<<(n-1) || v >= 1<<(n-1)) {
+				r.fail("integer too large")
+				return 0
+			}
+			return v
+		}
+	}
+}
+
+func (r *reader) u32() uint32 { return uint32(r.uleb(32)) } //nolint:gosec
+
+// count decodes a vector length, bounded by the bytes left.
+func (r *reader) count() int {
+	n := int(r.u32())
+	if n > len(r.b)-r.off {
+		r.fail("vector too long")
+		return 0
+	}
+	return n
+}
+
+func (r *reader) name() string { return string(r.bytes(int(r.u32()))) }
+
+func (r *reader) valType() ValType {
+	switch t := ValType(r.byte()); t {
+	case I32, I64, F32, F64:
+		return t
+	default:
+		r.fail("unsupported value type %#x", byte(t))
+		return 0
+	}
+}
+
+func (r *reader) valTypes() []ValType {
+	n := r.count()
+	v := make([]ValType, n)
+	for i := range v {
+		v[i] = r.valType()
+	}
+	return v
+}
+
+func (r *reader) refType() {
+	if r.byte() != 0x70 {
+		r.fail("unsupported table element type")
+	}
+}
+
+func (r *reader) limits() Limits {
+	switch r.byte() {
+	case 0:
+		return Limits{Min: r.u32()}
+	case 1:
+		return Limits{Min: r.u32(), Max: r.u32(), HasMax: true}
+	}
+	r.fail("invalid limits")
+	return Limits{}
+}
+
+func (r *reader) globalType() GlobalType {
+	t := GlobalType{Type: r.valType()}
+	switch r.byte() {
+	case 0:
+	case 1:
+		t.Mutable = true
+	default:
+		r.fail("invalid global mutability")
+	}
+	return t
+}
+
+// constExpr returns a constant expression: one instruction then end.
+func (r *reader) constExpr() []byte {
+	start := r.off
+	switch r.byte() {
+	case opI32Const:
+		r.sleb(32)
+	case opI64Const:
+		r.sleb(64)
+	case opF32Const:
+		r.bytes(4)
+	case opF64Const:
+		r.bytes(8)
+	case opGlobalGet:
+		r.u32()
+	default:
+		r.fail("unsupported constant expression")
+	}
+	if r.byte() != opEnd {
+		r.fail("unsupported constant expression")
+	}
+	if r.err != nil {
+		return nil
+	}
+	return r.b[start:r.off]
+}
+
+func f32Bits(r *reader) float32 { return math.Float32frombits(r.u32le()) }
+
+func f64Bits(r *reader) float64 { return math.Float64frombits(r.u64le()) }
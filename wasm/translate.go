@@ -0,0 +1,897 @@
+package wasm
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/mvertes/parscan/vm"
+)
+
+// Opcodes of the instructions not in numOps.
+const (
+	opUnreachable  = 0x00
+	opNop          = 0x01
+	opBlock        = 0x02
+	opLoop         = 0x03
+	opIf           = 0x04
+	opElse         = 0x05
+	opEnd          = 0x0b
+	opBr           = 0x0c
+	opBrIf         = 0x0d
+	opBrTable      = 0x0e
+	opReturn       = 0x0f
+	opCall         = 0x10
+	opCallIndirect = 0x11
+	opDrop         = 0x1a
+	opSelect       = 0x1b
+	opSelectT      = 0x1c
+	opLocalGet     = 0x20
+	opLocalSet     = 0x21
+	opLocalTee     = 0x22
+	opGlobalGet    = 0x23
+	opGlobalSet    = 0x24
+	opI32Load      = 0x28
+	opI64Load32U   = 0x35
+	opI32Store     = 0x36
+	opI64Store32   = 0x3e
+	opMemorySize   = 0x3f
+	opMemoryGrow   = 0x40
+	opI32Const     = 0x41
+	opI64Const     = 0x42
+	opF32Const     = 0x43
+	opF64Const     = 0x44
+	opF32Le        = 0x5f
+	opF32Ge        = 0x60
+	opF64Le        = 0x65
+	opF64Ge        = 0x66
+	opPrefixFC     = 0xfc
+)
+
+// storeKind is the access kind of each store instruction, from opI32Store.
+var storeKind = [...]int{
+	vm.MemInt32, vm.MemInt64, vm.MemFloat32, vm.MemFloat64,
+	vm.MemInt8To32, vm.MemInt16To32, vm.MemInt8To64, vm.MemInt16To64, vm.MemInt32To64,
+}
+
+// numOp is the translation of a numeric instruction: it pops pop operands,
+// pushes one result, and runs code, where the A operand of Convert is a
+// reflect.Kind, replaced by the data index of the type.
+type numOp struct {
+	pop  int
+	code []vm.Instruction
+}
+
+func op(o vm.Op) vm.Instruction { return vm.Instruction{Op: o} }
+
+func push(n int32) vm.Instruction { return vm.Instruction{Op: vm.Push, A: n} }
+
+func conv(k reflect.Kind) vm.Instruction { return vm.Instruction{Op: vm.Convert, A: int32(k)} } //nolint:gosec
+
+// conv1 converts the value below the top of stack.
+func conv1(k reflect.Kind) vm.Instruction { return vm.Instruction{Op: vm.Convert, A: int32(k), B: 1} } //nolint:gosec
+
+func unary(code ...vm.Instruction) numOp  { return numOp{1, code} }
+func binary(code ...vm.Instruction) numOp { return numOp{2, code} }
+
+// Integer values are held sign-extended in num, with a signed kind or bool.
+// Results of unsigned operations are converted back to signed kinds.
+var numOps = map[byte]numOp{
+	// i32 comparisons.
+	0x45: unary(push(0), op(vm.Equal)),
+	0x46: binary(op(vm.Equal)),
+	0x47: binary(op(vm.Equal), op(vm.Not)),
+	0x48: binary(op(vm.LowerInt32)),
+	0x49: binary(op(vm.LowerUint32)),
+	0x4a: binary(op(vm.GreaterInt32)),
+	0x4b: binary(op(vm.GreaterUint32)),
+	0x4c: binary(op(vm.GreaterInt32), op(vm.Not)),
+	0x4d: binary(op(vm.GreaterUint32), op(vm.Not)),
+	0x4e: binary(op(vm.LowerInt32), op(vm.Not)),
+	0x4f: binary(op(vm.LowerUint32), op(vm.Not)),
+
+	// i64 comparisons.
+	0x50: unary(push(0), op(vm.Equal)),
+	0x51: binary(op(vm.Equal)),
+	0x52: binary(op(vm.Equal), op(vm.Not)),
+	0x53: binary(op(vm.LowerInt64)),
+	0x54: binary(op(vm.LowerUint64)),
+	0x55: binary(op(vm.GreaterInt64)),
+	0x56: binary(op(vm.GreaterUint64)),
+	0x57: binary(op(vm.GreaterInt64), op(vm.Not)),
+	0x58: binary(op(vm.GreaterUint64), op(vm.Not)),
+	0x59: binary(op(vm.LowerInt64), op(vm.Not)),
+	0x5a: binary(op(vm.LowerUint64), op(vm.Not)),
+
+	// Float comparisons, except le and ge.
+	0x5b: binary(op(vm.Equal)),
+	0x5c: binary(op(vm.Equal), op(vm.Not)),
+	0x5d: binary(op(vm.LowerFloat32)),
+	0x5e: binary(op(vm.GreaterFloat32)),
+	0x61: binary(op(vm.Equal)),
+	0x62: binary(op(vm.Equal), op(vm.Not)),
+	0x63: binary(op(vm.LowerFloat64)),
+	0x64: binary(op(vm.GreaterFloat64)),
+
+	// i32 arithmetic. Shift counts are taken modulo 32.
+	0x67: unary(op(vm.Clz32)),
+	0x68: unary(op(vm.Ctz32)),
+	0x69: unary(op(vm.Popcnt32)),
+	0x6a: binary(op(vm.AddInt32)),
+	0x6b: binary(op(vm.SubInt32)),
+	0x6c: binary(op(vm.MulInt32)),
+	0x6d: binary(op(vm.DivInt32)),
+	0x6e: binary(op(vm.DivUint32), conv(reflect.Int32)),
+	0x6f: binary(op(vm.RemInt32)),
+	0x70: binary(op(vm.RemUint32), conv(reflect.Int32)),
+	0x71: binary(op(vm.BitAnd)),
+	0x72: binary(op(vm.BitOr)),
+	0x73: binary(op(vm.BitXor)),
+	0x74: binary(push(31), op(vm.BitAnd), op(vm.BitShl), conv(reflect.Int32)),
+	0x75: binary(push(31), op(vm.BitAnd), op(vm.BitShr)),
+	0x76: binary(push(31), op(vm.BitAnd), conv1(reflect.Uint32), op(vm.BitShr), conv(reflect.Int32)),
+	0x77: binary(op(vm.Rotl32), conv(reflect.Int32)),
+	0x78: binary(op(vm.Rotr32), conv(reflect.Int32)),
+
+	// i64 arithmetic. Shift counts are taken modulo 64.
+	0x79: unary(op(vm.Clz64)),
+	0x7a: unary(op(vm.Ctz64)),
+	0x7b: unary(op(vm.Popcnt64)),
+	0x7c: binary(op(vm.AddInt64)),
+	0x7d: binary(op(vm.SubInt64)),
+	0x7e: binary(op(vm.MulInt64)),
+	0x7f: binary(op(vm.DivInt64)),
+	0x80: binary(op(vm.DivUint64), conv(reflect.Int64)),
+	0x81: binary(op(vm.RemInt64)),
+	0x82: binary(op(vm.RemUint64), conv(reflect.Int64)),
+	0x83: binary(op(vm.BitAnd)),
+	0x84: binary(op(vm.BitOr)),
+	0x85: binary(op(vm.BitXor)),
+	0x86: binary(push(63), op(vm.BitAnd), op(vm.BitShl)),
+	0x87: binary(push(63), op(vm.BitAnd), op(vm.BitShr)),
+	0x88: binary(push(63), op(vm.BitAnd), conv1(reflect.Uint64), op(vm.BitShr), conv(reflect.Int64)),
+	0x89: binary(op(vm.Rotl64)),
+	0x8a: binary(op(vm.Rotr64)),
+
+	// f32 arithmetic.
+	0x8b: unary(op(vm.AbsFloat32)),
+	0x8c: unary(op(vm.NegFloat32)),
+	0x8d: unary(op(vm.CeilFloat32)),
+	0x8e: unary(op(vm.FloorFloat32)),
+	0x8f: unary(op(vm.TruncFloat32)),
+	0x90: unary(op(vm.NearestFloat32)),
+	0x91: unary(op(vm.SqrtFloat32)),
+	0x92: binary(op(vm.AddFloat32)),
+	0x93: binary(op(vm.SubFloat32)),
+	0x94: binary(op(vm.MulFloat32)),
+	0x95: binary(op(vm.DivFloat32)),
+	0x96: binary(op(vm.MinFloat32)),
+	0x97: binary(op(vm.MaxFloat32)),
+	0x98: binary(op(vm.CopysignFloat32)),
+
+	// f64 arithmetic.
+	0x99: unary(op(vm.AbsFloat64)),
+	0x9a: unary(op(vm.NegFloat64)),
+	0x9b: unary(op(vm.CeilFloat64)),
+	0x9c: unary(op(vm.FloorFloat64)),
+	0x9d: unary(op(vm.TruncFloat64)),
+	0x9e: unary(op(vm.NearestFloat64)),
+	0x9f: unary(op(vm.SqrtFloat64)),
+	0xa0: binary(op(vm.AddFloat64)),
+	0xa1: binary(op(vm.SubFloat64)),
+	0xa2: binary(op(vm.MulFloat64)),
+	0xa3: binary(op(vm.DivFloat64)),
+	0xa4: binary(op(vm.MinFloat64)),
+	0xa5: binary(op(vm.MaxFloat64)),
+	0xa6: binary(op(vm.CopysignFloat64)),
+
+	// Conversions.
+	0xa7: unary(conv(reflect.Int32)),
+	0xa8: unary(conv(reflect.Int32)),
+	0xa9: unary(conv(reflect.Uint32), conv(reflect.Int32)),
+	0xaa: unary(conv(reflect.Int32)),
+	0xab: unary(conv(reflect.Uint32), conv(reflect.Int32)),
+	0xac: unary(conv(reflect.Int64)),
+	0xad: unary(conv(reflect.Uint32), conv(reflect.Int64)),
+	0xae: unary(conv(reflect.Int64)),
+	0xaf: unary(conv(reflect.Uint64), conv(reflect.Int64)),
+	0xb0: unary(conv(reflect.Int64)),
+	0xb1: unary(conv(reflect.Uint64), conv(reflect.Int64)),
+	0xb2: unary(conv(reflect.Float32)),
+	0xb3: unary(conv(reflect.Uint32), conv(reflect.Float32)),
+	0xb4: unary(conv(reflect.Float32)),
+	0xb5: unary(conv(reflect.Uint64), conv(reflect.Float32)),
+	0xb6: unary(conv(reflect.Float32)),
+	0xb7: unary(conv(reflect.Float64)),
+	0xb8: unary(conv(reflect.Uint32), conv(reflect.Float64)),
+	0xb9: unary(conv(reflect.Float64)),
+	0xba: unary(conv(reflect.Uint64), conv(reflect.Float64)),
+	0xbb: unary(conv(reflect.Float64)),
+	0xbc: unary(op(vm.Float32Bits), conv(reflect.Int32)),
+	0xbd: unary(op(vm.Float64Bits), conv(reflect.Int64)),
+	0xbe: unary(op(vm.Float32FromBits)),
+	0xbf: unary(op(vm.Float64FromBits)),
+
+	// Sign extensions.
+	0xc0: unary(conv(reflect.Int8), conv(reflect.Int32)),
+	0xc1: unary(conv(reflect.Int16), conv(reflect.Int32)),
+	0xc2: unary(conv(reflect.Int8), conv(reflect.Int64)),
+	0xc3: unary(conv(reflect.Int16), conv(reflect.Int64)),
+	0xc4: unary(conv(reflect.Int32), conv(reflect.Int64)),
+}
+
+// label is a block, loop, if, or the body of a function, being translated.
+type label struct {
+	loop     bool
+	fn       bool  // function body: a branch returns
+	height   int   // stack height below the block parameters
+	params   int   // number of block parameters
+	results  int   // number of block results
+	start    int   // loop: address of the loop start
+	elseJump int   // if: index of the jump to the else branch, or -1
+	ends     []int // indexes of the jumps to the block end
+}
+
+// arity returns the number of values passed by a branch to l.
+func (l *label) arity() int {
+	if l.loop {
+		return l.params
+	}
+	return l.results
+}
+
+// translator translates the functions of a module into VM code and data.
+type translator struct {
+	mod    *Module
+	code   vm.Code
+	data   []vm.Value
+	canon  []int       // canonical type index of each type index
+	funcs  []int       // data index of the code address of each function
+	global []int       // data index of each global
+	memory int         // data index of the memory, or -1
+	maxMem int         // maximum number of memory pages
+	table  int         // data index of the table code addresses, or -1
+	types  int         // data index of the table type indexes, or -1
+	slots  map[any]int // data index of constants and types
+
+	// Function being translated.
+	r       *reader
+	nparams int
+	nlocals int // number of declared locals
+	labels  []label
+	h       int  // operand stack height
+	dead    bool // current code is not reachable
+}
+
+// slot returns the data index of a constant value v, identified by key.
+func (t *translator) slot(key any, v vm.Value) int {
+	if i, ok := t.slots[key]; ok {
+		return i
+	}
+	t.slots[key] = len(t.data)
+	t.data = append(t.data, v)
+	return len(t.data) - 1
+}
+
+// kindSlot returns the data index of the zero value of kind k, which is also
+// a type for Convert.
+func (t *translator) kindSlot(k reflect.Kind) int {
+	return t.slot(k, vm.ValueOf(reflect.Zero(kindType[k]).Interface()))
+}
+
+var kindType = map[reflect.Kind]reflect.Type{
+	reflect.Int8:    reflect.TypeFor[int8](),
+	reflect.Int16:   reflect.TypeFor[int16](),
+	reflect.Int32:   reflect.TypeFor[int32](),
+	reflect.Int64:   reflect.TypeFor[int64](),
+	reflect.Uint32:  reflect.TypeFor[uint32](),
+	reflect.Uint64:  reflect.TypeFor[uint64](),
+	reflect.Float32: reflect.TypeFor[float32](),
+	reflect.Float64: reflect.TypeFor[float64](),
+}
+
+// valKind returns the kind of the Go values of type vt.
+func valKind(vt ValType) reflect.Kind {
+	switch vt {
+	case I64:
+		return reflect.Int64
+	case F32:
+		return reflect.Float32
+	case F64:
+		return reflect.Float64
+	}
+	return reflect.Int32
+}
+
+func (t *translator) emit(o vm.Op, a, b int) {
+	t.code = append(t.code, vm.Instruction{Op: o, A: int32(a), B: int32(b)}) //nolint:gosec
+}
+
+// scratch returns the local index of scratch local i.
+func (t *translator) scratch(i int) int { return t.nlocals + 1 + i }
+
+// function translates the body of function fi of type typ.
+func (t *translator) function(fi int, typ FuncType, body Body) error {
+	t.r = &reader{b: body.Code}
+	t.nparams, t.nlocals = len(typ.Params), len(body.Locals)
+	t.labels = []label{{fn: true, results: len(typ.Results), elseJump: -1}}
+	t.h, t.dead = 0, false
+
+	// The stack depth reserved by Grow is set once the code is complete.
+	t.emit(vm.Grow, t.nlocals+2, 0)
+	for i, lt := range body.Locals {
+		t.emit(vm.GetGlobal, t.kindSlot(valKind(lt)), 0)
+		t.emit(vm.SetLocal, i+1, 0)
+	}
+	for len(t.labels) > 0 {
+		if t.r.off >= len(t.r.b) {
+			return fmt.Errorf("wasm: function %d: unexpected end", fi)
+		}
+		at := t.r.off
+		if err := t.instruction(); err != nil {
+			return fmt.Errorf("wasm: function %d at %#x: %w", fi, at, err)
+		}
+		if t.r.err != nil {
+			return fmt.Errorf("wasm: function %d at %#x: %w", fi, at, t.r.err)
+		}
+	}
+	if t.r.off != len(t.r.b) {
+		return fmt.Errorf("wasm: function %d: code after end", fi)
+	}
+	return nil
+}
+
+// local returns the VM local index of local i, parameters first.
+func (t *translator) local(i uint32) (int, error) {
+	switch {
+	case int(i) < t.nparams:
+		return int(i) - t.nparams - 2, nil
+	case int(i) < t.nparams+t.nlocals:
+		return int(i) - t.nparams + 1, nil
+	}
+	return 0, fmt.Errorf("invalid local %d", i)
+}
+
+// blockType returns the number of parameters and results of a block type.
+func (t *translator) blockType() (int, int, error) {
+	r := t.r
+	if r.off < len(r.b) {
+		switch c := r.b[r.off]; {
+		case c == 0x40:
+			r.off++
+			return 0, 0, nil
+		case ValType(c) == I32 || ValType(c) == I64 || ValType(c) == F32 || ValType(c) == F64:
+			r.off++
+			return 0, 1, nil
+		}
+	}
+	i := r.sleb(33)
+	if i < 0 || int(i) >= len(t.mod.Types) {
+		return 0, 0, fmt.Errorf("invalid block type %d", i)
+	}
+	bt := t.mod.Types[i]
+	return len(bt.Params), len(bt.Results), nil
+}
+
+// skip skips the immediates of instruction o, in unreachable code.
+func (t *translator) skip(o byte) error {
+	r := t.r
+	switch {
+	case o == opBlock || o == opLoop || o == opIf:
+		_, _, err := t.blockType()
+		return err
+	case o == opBrTable:
+		for range r.count() {
+			r.u32()
+		}
+		r.u32()
+	case o == opBr || o == opBrIf || o == opCall || o >= opLocalGet && o <= opGlobalSet ||
+		o == opMemorySize || o == opMemoryGrow:
+		r.u32()
+	case o == opCallIndirect:
+		r.u32()
+		r.u32()
+	case o == opSelectT:
+		r.valTypes()
+	case o == opPrefixFC:
+		if r.u32() >= uint32(len(truncSat)) {
+			return fmt.Errorf("unsupported instruction %#x", o)
+		}
+	case o >= opI32Load && o <= opI64Store32:
+		r.u32()
+		r.u32()
+	case o == opI32Const:
+		r.sleb(32)
+	case o == opI64Const:
+		r.sleb(64)
+	case o == opF32Const:
+		r.bytes(4)
+	case o == opF64Const:
+		r.bytes(8)
+	case o == opUnreachable || o == opNop || o == opReturn || o == opDrop || o == opSelect || o == opF32Le ||
+		o == opF32Ge || o == opF64Le || o == opF64Ge:
+	default:
+		if _, ok := numOps[o]; !ok {
+			return fmt.Errorf("unsupported instruction %#x", o)
+		}
+	}
+	return nil
+}
+
+// instruction translates the next instruction.
+func (t *translator) instruction() error {
+	r := t.r
+	o := r.byte()
+	if t.dead {
+		// Unreachable code is skipped until the end of its block.
+		switch o {
+		case opElse, opEnd:
+		default:
+			if o == opBlock || o == opLoop || o == opIf {
+				t.labels = append(t.labels, label{elseJump: -1, height: -1})
+			}
+			return t.skip(o)
+		}
+		if l := &t.labels[len(t.labels)-1]; l.height < 0 {
+			// End of a block in unreachable code.
+			if o == opEnd {
+				t.labels = t.labels[:len(t.labels)-1]
+			}
+			return nil
+		}
+	}
+	switch o {
+	case opUnreachable:
+		t.emit(vm.GetGlobal, t.slot("unreachable", vm.ValueOf("unreachable")), 0)
+		t.emit(vm.Panic, 0, 0)
+		t.dead = true
+	case opNop:
+	case opBlock, opLoop, opIf:
+		np, nr, err := t.blockType()
+		if err != nil {
+			return err
+		}
+		if o == opIf {
+			t.h--
+		}
+		if t.h < np {
+			return fmt.Errorf("block parameters missing")
+		}
+		l := label{loop: o == opLoop, height: t.h - np, params: np, results: nr, start: len(t.code), elseJump: -1}
+		if o == opIf {
+			l.elseJump = len(t.code)
+			t.emit(vm.JumpFalse, 0, 0)
+		}
+		t.labels = append(t.labels, l)
+	case opElse:
+		l := &t.labels[len(t.labels)-1]
+		if l.loop || l.fn || l.elseJump < 0 {
+			return fmt.Errorf("else without if")
+		}
+		if !t.dead {
+			l.ends = append(l.ends, len(t.code))
+			t.emit(vm.Jump, 0, 0)
+		}
+		t.patch(l.elseJump)
+		l.elseJump = -1
+		t.h, t.dead = l.height+l.params, false
+	case opEnd:
+		l := t.labels[len(t.labels)-1]
+		t.labels = t.labels[:len(t.labels)-1]
+		if l.fn {
+			if !t.dead {
+				t.emit(vm.Return, 0, 0)
+			}
+			return nil
+		}
+		reached := !t.dead || len(l.ends) > 0 || l.elseJump >= 0
+		if l.elseJump >= 0 {
+			t.patch(l.elseJump)
+		}
+		for _, j := range l.ends {
+			t.patch(j)
+		}
+		t.h, t.dead = l.height+l.results, !reached
+	case opBr:
+		if err := t.branch(r.u32(), false); err != nil {
+			return err
+		}
+		t.dead = true
+	case opBrIf:
+		d := r.u32()
+		t.h--
+		if err := t.branch(d, true); err != nil {
+			return err
+		}
+	case opBrTable:
+		n := r.count()
+		targets := make([]uint32, n)
+		for i := range targets {
+			targets[i] = r.u32()
+		}
+		def := r.u32()
+		for i, d := range targets {
+			t.emit(vm.Push, i, 0)
+			t.emit(vm.EqualSet, 0, 0)
+			j := len(t.code)
+			t.emit(vm.JumpFalse, 0, 0)
+			t.h--
+			if err := t.branch(d, false); err != nil {
+				return err
+			}
+			t.h++
+			t.patch(j)
+		}
+		t.emit(vm.Pop, 1, 0)
+		t.h--
+		if err := t.branch(def, false); err != nil {
+			return err
+		}
+		t.dead = true
+	case opReturn:
+		t.emit(vm.Return, 0, 0)
+		t.dead = true
+	case opCall:
+		fi := int(r.u32())
+		ft, ok := t.mod.funcType(fi)
+		if !ok {
+			return fmt.Errorf("invalid function %d", fi)
+		}
+		np, nr := len(ft.Params), len(ft.Results)
+		t.emit(vm.CallImm, t.funcs[fi], np<<16|nr)
+		t.h += nr - np
+	case opCallIndirect:
+		ti, tab := r.u32(), r.u32()
+		ft, ok := t.mod.typeAt(ti)
+		if !ok || tab != 0 || t.table < 0 {
+			return fmt.Errorf("invalid indirect call")
+		}
+		np, nr := len(ft.Params), len(ft.Results)
+		s := t.scratch(0)
+		t.emit(vm.SetLocal, s, 0)
+		t.emit(vm.GetGlobal, t.types, 0)
+		t.emit(vm.GetLocal, s, 0)
+		t.emit(vm.Index, 0, 0)
+		t.emit(vm.Push, t.canon[ti], 0)
+		t.emit(vm.Equal, 0, 0)
+		t.emit(vm.JumpTrue, 3, 0)
+		t.emit(vm.GetGlobal, t.slot("indirect", vm.ValueOf("indirect call type mismatch")), 0)
+		t.emit(vm.Panic, 0, 0)
+		t.emit(vm.GetGlobal, t.table, 0)
+		t.emit(vm.GetLocal, s, 0)
+		t.emit(vm.Index, 0, 0)
+		// Move the function below its arguments.
+		for k := range np {
+			t.emit(vm.Swap, k, k+1)
+		}
+		t.emit(vm.Call, np, nr)
+		t.h += nr - np - 1
+	case opDrop:
+		t.emit(vm.Pop, 1, 0)
+		t.h--
+	case opSelect, opSelectT:
+		if o == opSelectT {
+			r.valTypes()
+		}
+		t.emit(vm.JumpFalse, 2, 0)
+		t.emit(vm.Jump, 2, 0)
+		t.emit(vm.Swap, 0, 1)
+		t.emit(vm.Pop, 1, 0)
+		t.h -= 2
+	case opLocalGet, opLocalSet, opLocalTee:
+		i, err := t.local(r.u32())
+		if err != nil {
+			return err
+		}
+		switch o {
+		case opLocalGet:
+			t.emit(vm.GetLocal, i, 0)
+			t.h++
+		case opLocalSet:
+			t.emit(vm.SetLocal, i, 0)
+			t.h--
+		default:
+			t.emit(vm.SetLocal, i, 0)
+			t.emit(vm.GetLocal, i, 0)
+		}
+	case opGlobalGet, opGlobalSet:
+		g := int(r.u32())
+		if g >= len(t.global) {
+			return fmt.Errorf("invalid global %d", g)
+		}
+		if o == opGlobalGet {
+			t.emit(vm.GetGlobal, t.global[g], 0)
+			t.h++
+		} else {
+			t.emit(vm.SetGlobal, t.global[g], 0)
+			t.h--
+		}
+	case opMemorySize, opMemoryGrow:
+		r.u32()
+		if t.memory < 0 {
+			return fmt.Errorf("no memory")
+		}
+		if o == opMemorySize {
+			t.emit(vm.MemSize, t.memory, 0)
+			t.h++
+		} else {
+			t.emit(vm.MemGrow, t.memory, t.maxMem)
+		}
+	case opI32Const:
+		n := int32(r.sleb(32)) //nolint:gosec
+		t.constant(int64(n), vm.ValueOf(n))
+	case opI64Const:
+		n := r.sleb(64)
+		t.constant(n, vm.ValueOf(n))
+	case opF32Const:
+		b := r.u32le()
+		t.emit(vm.GetGlobal, t.slot(constKey{F32, uint64(b)}, vm.ValueOf(math.Float32frombits(b))), 0)
+		t.h++
+	case opF64Const:
+		b := r.u64le()
+		t.emit(vm.GetGlobal, t.slot(constKey{F64, b}, vm.ValueOf(math.Float64frombits(b))), 0)
+		t.h++
+	case opF32Le, opF32Ge, opF64Le, opF64Ge:
+		// a <= b is a < b || a == b, false if a or b is NaN.
+		cmp := map[byte]vm.Op{opF32Le: vm.LowerFloat32, opF32Ge: vm.GreaterFloat32, opF64Le: vm.LowerFloat64, opF64Ge: vm.GreaterFloat64}[o]
+		a, b := t.scratch(0), t.scratch(1)
+		t.emit(vm.SetLocal, b, 0)
+		t.emit(vm.SetLocal, a, 0)
+		t.emit(vm.GetLocal, a, 0)
+		t.emit(vm.GetLocal, b, 0)
+		t.emit(cmp, 0, 0)
+		t.emit(vm.GetLocal, a, 0)
+		t.emit(vm.GetLocal, b, 0)
+		t.emit(vm.Equal, 0, 0)
+		t.emit(vm.BitOr, 0, 0)
+		t.h--
+	case opPrefixFC:
+		sub := r.u32()
+		if sub >= uint32(len(truncSat)) {
+			return fmt.Errorf("unsupported instruction %#x %d", o, sub)
+		}
+		if t.h < 1 {
+			return fmt.Errorf("stack underflow")
+		}
+		t.saturate(truncSat[sub])
+	default:
+		switch {
+		case o >= opI32Load && o <= opI64Load32U:
+			if err := t.memAccess(vm.Load, int(o-opI32Load)); err != nil {
+				return err
+			}
+		case o >= opI32Store && o <= opI64Store32:
+			if err := t.memAccess(vm.Store, storeKind[o-opI32Store]); err != nil {
+				return err
+			}
+			t.h -= 2
+		default:
+			n, ok := numOps[o]
+			if !ok {
+				return fmt.Errorf("unsupported instruction %#x", o)
+			}
+			t.check(o)
+			t.numOp(n)
+			t.h += 1 - n.pop
+		}
+	}
+	if t.h < 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	return nil
+}
+
+// truncRange is the open interval of the floats which truncate to an
+// integer in range, by float to integer truncation instruction.
+var truncRange = map[byte][2]float64{
+	0xa8: {math.MinInt32 - 1, -math.MinInt32},
+	0xa9: {-1, math.MaxUint32 + 1},
+	0xaa: {math.MinInt32 - 1, -math.MinInt32},
+	0xab: {-1, math.MaxUint32 + 1},
+	0xae: {-0x1.0000000000001p63, 0x1p63},
+	0xaf: {-1, 0x1p64},
+	0xb0: {-0x1.0000000000001p63, 0x1p63},
+	0xb1: {-1, 0x1p64},
+}
+
+// check emits the checks trapping before the numeric instruction o, where
+// the VM operation would silently return a result: a signed division
+// overflow, or a float truncated out of the integer range, or NaN.
+func (t *translator) check(o byte) {
+	var fail []int // indexes of the jumps to the trap
+	switch o {
+	case 0x6d, 0x7f:
+		minInt := constKey{I32, uint64(1) << 31}
+		minVal := vm.ValueOf(int32(math.MinInt32))
+		if o == 0x7f {
+			minInt, minVal = constKey{I64, uint64(1) << 63}, vm.ValueOf(int64(math.MinInt64))
+		}
+		a, b := t.scratch(0), t.scratch(1)
+		t.emit(vm.SetLocal, b, 0)
+		t.emit(vm.SetLocal, a, 0)
+		t.emit(vm.GetLocal, a, 0)
+		t.emit(vm.GetGlobal, t.slot(minInt, minVal), 0)
+		t.emit(vm.Equal, 0, 0)
+		ok := len(t.code)
+		t.emit(vm.JumpFalse, 0, 0)
+		t.emit(vm.GetLocal, b, 0)
+		t.emit(vm.Push, -1, 0)
+		t.emit(vm.Equal, 0, 0)
+		t.emit(vm.JumpFalse, 3, 0)
+		t.emit(vm.GetGlobal, t.slot("overflow", vm.ValueOf("integer overflow")), 0)
+		t.emit(vm.Panic, 0, 0)
+		t.code[ok].A = int32(len(t.code) - ok) //nolint:gosec
+		t.emit(vm.GetLocal, a, 0)
+		t.emit(vm.GetLocal, b, 0)
+		return
+	}
+	r, ok := truncRange[o]
+	if !ok {
+		return
+	}
+	s := t.scratch(0)
+	t.emit(vm.SetLocal, s, 0)
+	for i, cmp := range []vm.Op{vm.GreaterFloat64, vm.LowerFloat64} {
+		t.emit(vm.GetLocal, s, 0)
+		t.emit(vm.Convert, t.kindSlot(reflect.Float64), 0)
+		t.emit(vm.GetGlobal, t.slot(constKey{F64, math.Float64bits(r[i])}, vm.ValueOf(r[i])), 0)
+		t.emit(cmp, 0, 0)
+		fail = append(fail, len(t.code))
+		t.emit(vm.JumpFalse, 0, 0)
+	}
+	t.emit(vm.Jump, 3, 0)
+	for _, j := range fail {
+		t.code[j].A = int32(len(t.code) - j) //nolint:gosec
+	}
+	t.emit(vm.GetGlobal, t.slot("unrepresentable", vm.ValueOf("float unrepresentable in integer range")), 0)
+	t.emit(vm.Panic, 0, 0)
+	t.emit(vm.GetLocal, s, 0)
+}
+
+// numOp emits the code of the numeric instruction n.
+func (t *translator) numOp(n numOp) {
+	for _, in := range n.code {
+		if in.Op == vm.Convert {
+			in.A = int32(t.kindSlot(reflect.Kind(in.A))) //nolint:gosec
+		}
+		t.code = append(t.code, in)
+	}
+}
+
+// truncSat is the float to integer truncation instruction by sub-opcode of
+// the saturating truncations, 0xFC 0 to 7.
+var truncSat = [...]byte{0xa8, 0xa9, 0xaa, 0xab, 0xae, 0xaf, 0xb0, 0xb1}
+
+// saturate emits the truncation o, giving the bounds of the integer range
+// instead of trapping for floats out of it, and 0 for NaN.
+func (t *translator) saturate(o byte) {
+	lo, hi := int64(math.MinInt32), int64(math.MaxInt32)
+	if o >= 0xae {
+		lo, hi = math.MinInt64, math.MaxInt64
+	}
+	if o%2 == 1 {
+		lo, hi = 0, -1 // unsigned
+	}
+	bound := func(n int64) {
+		v := vm.ValueOf(n)
+		if o < 0xae {
+			v = vm.ValueOf(int32(n)) //nolint:gosec
+		}
+		t.constant(n, v)
+		t.h--
+	}
+	r := truncRange[o]
+	s := t.scratch(0)
+	compare := func(i int, cmp vm.Op) {
+		t.emit(vm.GetLocal, s, 0)
+		t.emit(vm.Convert, t.kindSlot(reflect.Float64), 0)
+		t.emit(vm.GetGlobal, t.slot(constKey{F64, math.Float64bits(r[i])}, vm.ValueOf(r[i])), 0)
+		t.emit(cmp, 0, 0)
+	}
+	var ends []int // indexes of the jumps to the end
+	t.emit(vm.SetLocal, s, 0)
+	compare(0, vm.GreaterFloat64)
+	above := len(t.code)
+	t.emit(vm.JumpTrue, 0, 0)
+	// Not above the low bound: below it, or NaN.
+	compare(1, vm.LowerFloat64)
+	t.emit(vm.JumpFalse, 3, 0)
+	bound(lo)
+	ends = append(ends, len(t.code))
+	t.emit(vm.Jump, 0, 0)
+	bound(0)
+	ends = append(ends, len(t.code))
+	t.emit(vm.Jump, 0, 0)
+	t.code[above].A = int32(len(t.code) - above) //nolint:gosec
+	compare(1, vm.LowerFloat64)
+	t.emit(vm.JumpTrue, 3, 0)
+	bound(hi)
+	ends = append(ends, len(t.code))
+	t.emit(vm.Jump, 0, 0)
+	t.emit(vm.GetLocal, s, 0)
+	t.numOp(numOps[o])
+	for _, j := range ends {
+		t.code[j].A = int32(len(t.code) - j) //nolint:gosec
+	}
+}
+
+// constKey identifies a constant in data.
+type constKey struct {
+	typ  ValType
+	bits uint64
+}
+
+// constant pushes the integer constant n, or v if n is too large for Push.
+func (t *translator) constant(n int64, v vm.Value) {
+	if n == int64(int32(n)) { //nolint:gosec
+		t.emit(vm.Push, int(n), 0)
+	} else {
+		t.emit(vm.GetGlobal, t.slot(constKey{I64, uint64(n)}, v), 0) //nolint:gosec
+	}
+	t.h++
+}
+
+// memAccess emits the Load or Store instruction o of access kind.
+func (t *translator) memAccess(o vm.Op, kind int) error {
+	t.r.u32() // alignment hint
+	offset := t.r.u32()
+	if t.memory < 0 {
+		return fmt.Errorf("no memory")
+	}
+	b, ok := vm.MemOperand(uint64(offset), kind)
+	if !ok {
+		return fmt.Errorf("memory offset %d too large", offset)
+	}
+	t.emit(o, t.memory, int(b))
+	return nil
+}
+
+// patch sets the jump at index j to the current end of code.
+func (t *translator) patch(j int) { t.code[j].A = int32(len(t.code) - j) } //nolint:gosec
+
+// branch emits a branch to the label at depth d, conditional if cond: the
+// values passed to the label are moved over the values it drops.
+func (t *translator) branch(d uint32, cond bool) error {
+	if int(d) >= len(t.labels) {
+		return fmt.Errorf("invalid branch depth %d", d)
+	}
+	l := &t.labels[len(t.labels)-1-int(d)]
+	n := l.arity()
+	drop := t.h - l.height - n
+	if drop < 0 {
+		return fmt.Errorf("branch values missing")
+	}
+	if cond && !l.fn && drop == 0 {
+		t.jump(l, vm.JumpTrue)
+		return nil
+	}
+	j := len(t.code)
+	if cond {
+		t.emit(vm.JumpFalse, 0, 0)
+	}
+	if l.fn {
+		t.emit(vm.Return, 0, 0)
+	} else {
+		if drop > 0 {
+			for i := range n {
+				t.emit(vm.Swap, n-1-i, drop+n-1-i)
+			}
+			t.emit(vm.Pop, drop, 0)
+		}
+		t.jump(l, vm.Jump)
+	}
+	if cond {
+		t.patch(j)
+	}
+	return nil
+}
+
+// jump emits the jump instruction o to label l.
+func (t *translator) jump(l *label, o vm.Op) {
+	if l.loop {
+		t.emit(o, l.start-len(t.code), 0)
+		return
+	}
+	l.ends = append(l.ends, len(t.code))
+	t.emit(o, 0, 0)
+}
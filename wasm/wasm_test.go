@@ -0,0 +1,546 @@
+package wasm_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/mvertes/parscan/vm"
+	"github.com/mvertes/parscan/wasm"
+)
+
+// Module assembly helpers.
+
+func uleb(n uint64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func sleb(n int64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 && c&0x40 == 0 || n == -1 && c&0x40 != 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func cat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func vec(items ...[]byte) []byte { return cat(uleb(uint64(len(items))), cat(items...)) }
+
+func str(s string) []byte { return cat(uleb(uint64(len(s))), []byte(s)) }
+
+func section(id byte, items ...[]byte) []byte {
+	if len(items) == 0 {
+		return nil
+	}
+	content := vec(items...)
+	return cat([]byte{id}, uleb(uint64(len(content))), content)
+}
+
+// types returns the value types of a signature letter string: i, I, f, F
+// for i32, i64, f32, f64.
+func types(s string) []byte {
+	b := []byte{}
+	for _, c := range s {
+		b = append(b, map[rune]byte{'i': 0x7f, 'I': 0x7e, 'f': 0x7d, 'F': 0x7c}[c])
+	}
+	return b
+}
+
+// sig returns a function type from "params:results".
+func sig(s string) []byte {
+	p, r, _ := strings.Cut(s, ":")
+	return cat([]byte{0x60}, uleb(uint64(len(p))), types(p), uleb(uint64(len(r))), types(r))
+}
+
+type fn struct {
+	sig    string // "params:results", see sig
+	locals string // declared locals, see types
+	code   []byte // instructions, end excluded
+	export string
+}
+
+type imp struct {
+	module, name string
+	sig          string // function signature, or "" for a memory
+}
+
+type mod struct {
+	imports []imp
+	funcs   []fn
+	memory  []byte // limits
+	globals [][]byte
+	table   []int // functions of table 0
+	data    []byte
+	start   int
+}
+
+func (m mod) bytes() []byte {
+	var typs, imps, funcs, exps, codes [][]byte
+	nimp := 0 // number of imported functions
+	for _, im := range m.imports {
+		if im.sig == "" {
+			imps = append(imps, cat(str(im.module), str(im.name), []byte{2, 0, 1}))
+			continue
+		}
+		imps = append(imps, cat(str(im.module), str(im.name), []byte{0}, uleb(uint64(len(typs)))))
+		typs = append(typs, sig(im.sig))
+		nimp++
+	}
+	for i, f := range m.funcs {
+		funcs = append(funcs, uleb(uint64(len(typs))))
+		typs = append(typs, sig(f.sig))
+		if f.export != "" {
+			exps = append(exps, cat(str(f.export), []byte{0}, uleb(uint64(nimp+i))))
+		}
+		var locals [][]byte
+		for _, t := range types(f.locals) {
+			locals = append(locals, []byte{1, t})
+		}
+		body := cat(vec(locals...), f.code, []byte{0x0b})
+		codes = append(codes, cat(uleb(uint64(len(body))), body))
+	}
+	var mems, tables, elems, datas [][]byte
+	if m.memory != nil {
+		mems = append(mems, m.memory)
+		exps = append(exps, cat(str("memory"), []byte{2, 0}))
+	}
+	if m.table != nil {
+		tables = append(tables, cat([]byte{0x70, 0}, uleb(uint64(len(m.table)))))
+		var fs [][]byte
+		for _, f := range m.table {
+			fs = append(fs, uleb(uint64(f)))
+		}
+		elems = append(elems, cat([]byte{0, 0x41, 0, 0x0b}, vec(fs...)))
+	}
+	if m.data != nil {
+		datas = append(datas, cat([]byte{0, 0x41, 8, 0x0b}, str(string(m.data))))
+	}
+	var globals [][]byte
+	for i, g := range m.globals {
+		globals = append(globals, g)
+		exps = append(exps, cat(str(fmt.Sprint("g", i)), []byte{3}, uleb(uint64(i))))
+	}
+	b := cat([]byte("\x00asm\x01\x00\x00\x00"),
+		section(1, typs...), section(2, imps...), section(3, funcs...), section(4, tables...),
+		section(5, mems...), section(6, globals...), section(7, exps...))
+	if m.start > 0 {
+		b = cat(b, []byte{8, 1, byte(m.start - 1)})
+	}
+	return cat(b, section(9, elems...), section(10, codes...), section(11, datas...))
+}
+
+func i32(n int32) []byte   { return cat([]byte{0x41}, sleb(int64(n))) }
+func i64(n int64) []byte   { return cat([]byte{0x42}, sleb(n)) }
+func f64(x float64) []byte { return cat([]byte{0x44}, u64le(math.Float64bits(x))) }
+func f32(x float32) []byte { return cat([]byte{0x43}, u64le(uint64(math.Float32bits(x)))[:4]) }
+func get(i int) []byte     { return cat([]byte{0x20}, uleb(uint64(i))) }
+func set(i int) []byte     { return cat([]byte{0x21}, uleb(uint64(i))) }
+func tee(i int) []byte     { return cat([]byte{0x22}, uleb(uint64(i))) }
+func call(i int) []byte    { return cat([]byte{0x10}, uleb(uint64(i))) }
+func br(op byte, d int) []byte {
+	return cat([]byte{op}, uleb(uint64(d)))
+}
+
+func u64le(n uint64) []byte {
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = byte(n >> (8 * i))
+	}
+	return b
+}
+
+func instantiate(t *testing.T, m mod, imports wasm.Imports) *wasm.Instance {
+	t.Helper()
+	dm, err := wasm.Decode(m.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := wasm.Instantiate(dm, imports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+// nan is the expected result of a call returning a NaN.
+type nan struct{}
+
+type ctest struct {
+	fn   string
+	args []any
+	res  any // result, or error message
+}
+
+func check(t *testing.T, in *wasm.Instance, tests []ctest) {
+	t.Helper()
+	for _, c := range tests {
+		res, err := in.Call(c.fn, c.args...)
+		if msg, ok := c.res.(string); ok {
+			if err == nil || !strings.Contains(err.Error(), msg) {
+				t.Errorf("%s%v: got %v %v, want error %q", c.fn, c.args, res, err, msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s%v: %v", c.fn, c.args, err)
+			continue
+		}
+		var got any
+		if len(res) > 0 {
+			got = res[0]
+		}
+		if f, ok := got.(float64); ok && math.IsNaN(f) {
+			got = nan{}
+		}
+		if got != c.res {
+			t.Errorf("%s%v: got %v (%T), want %v (%T)", c.fn, c.args, got, got, c.res, c.res)
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	for _, test := range []struct {
+		n     string
+		funcs []fn
+		calls []ctest
+	}{
+		{n: "add", funcs: []fn{{sig: "ii:i", code: cat(get(0), get(1), []byte{0x6a}), export: "add"}}, calls: []ctest{
+			{"add", []any{1, 2}, int32(3)},
+			{"add", []any{math.MaxInt32, 1}, int32(math.MinInt32)},
+			{"add", []any{uint32(math.MaxUint32), 2}, int32(1)},
+		}},
+		{n: "factorial loop", funcs: []fn{{sig: "I:I", locals: "I", export: "fact", code: cat(
+			i64(1), set(1),
+			[]byte{0x02, 0x40, 0x03, 0x40},    // block loop
+			get(0), []byte{0x50}, br(0x0d, 1), // br_if 1 if n == 0
+			get(1), get(0), []byte{0x7e}, set(1), // acc *= n
+			get(0), i64(1), []byte{0x7d}, set(0), // n--
+			br(0x0c, 0), []byte{0x0b, 0x0b}, // br 0
+			get(1))}}, calls: []ctest{
+			{"fact", []any{0}, int64(1)},
+			{"fact", []any{20}, int64(2432902008176640000)},
+		}},
+		{n: "recursive fib", funcs: []fn{{sig: "i:i", export: "fib", code: cat(
+			get(0), i32(2), []byte{0x48}, // n < 2
+			[]byte{0x04, 0x7f}, get(0), // if (result i32) n
+			[]byte{0x05},
+			get(0), i32(1), []byte{0x6b}, call(0),
+			get(0), i32(2), []byte{0x6b}, call(0),
+			[]byte{0x6a, 0x0b})}}, calls: []ctest{
+			{"fib", []any{10}, int32(55)},
+		}},
+		{n: "unsigned", funcs: []fn{
+			{sig: "ii:i", code: cat(get(0), get(1), []byte{0x6e}), export: "div_u"},
+			{sig: "ii:i", code: cat(get(0), get(1), []byte{0x76}), export: "shr_u"},
+			{sig: "ii:i", code: cat(get(0), get(1), []byte{0x49}), export: "lt_u"},
+			{sig: "ii:i", code: cat(get(0), get(1), []byte{0x74}), export: "shl"},
+			{sig: "i:I", code: cat(get(0), []byte{0xad}), export: "extend_u"},
+			{sig: "I:F", code: cat(get(0), []byte{0xba}), export: "convert_u"},
+			{sig: "i:i", code: cat(get(0), []byte{0x67}), export: "clz"},
+			{sig: "ii:i", code: cat(get(0), get(1), []byte{0x77}), export: "rotl"},
+			{sig: "II:I", code: cat(get(0), get(1), []byte{0x88}), export: "shr_u64"},
+		}, calls: []ctest{
+			{"div_u", []any{-1, 2}, int32(math.MaxInt32)},
+			{"div_u", []any{1, 0}, "integer divide by zero"},
+			{"shr_u", []any{-1, 36}, int32(0x0fffffff)},
+			{"lt_u", []any{1, -1}, int32(1)},
+			{"shl", []any{1, 31}, int32(math.MinInt32)},
+			{"extend_u", []any{-1}, int64(math.MaxUint32)},
+			{"convert_u", []any{-1}, float64(math.MaxUint64)},
+			{"clz", []any{1}, int32(31)},
+			{"rotl", []any{math.MinInt32 + 1, 1}, int32(3)},
+			{"shr_u64", []any{-1, 60}, int64(15)},
+		}},
+		{n: "float", funcs: []fn{
+			{sig: "FF:i", code: cat(get(0), get(1), []byte{0x65}), export: "le"},
+			{sig: "FF:i", code: cat(get(0), get(1), []byte{0x61}), export: "eq"},
+			{sig: "FF:F", code: cat(get(0), get(1), []byte{0xa4}), export: "min"},
+			{sig: "f:i", code: cat(get(0), []byte{0xbc}), export: "bits"},
+			{sig: "F:f", code: cat(get(0), []byte{0xb6}, f32(0.5), []byte{0x92}), export: "demote"},
+			{sig: "F:i", code: cat(get(0), []byte{0xaa}), export: "trunc"},
+			{sig: "I:F", code: cat(get(0), []byte{0xbf}, f64(1), []byte{0xa0}), export: "from_bits"},
+		}, calls: []ctest{
+			{"le", []any{1.0, 1.0}, int32(1)},
+			{"le", []any{2.0, 1.0}, int32(0)},
+			{"le", []any{math.NaN(), 1.0}, int32(0)},
+			{"eq", []any{math.NaN(), math.NaN()}, int32(0)},
+			{"eq", []any{0.0, math.Copysign(0, -1)}, int32(1)},
+			{"min", []any{1.0, math.NaN()}, nan{}},
+			{"bits", []any{-1.0}, int32(-0x40800000)},
+			{"demote", []any{1.25}, float32(1.75)},
+			{"trunc", []any{-3.9}, int32(-3)},
+			{"from_bits", []any{int64(math.Float64bits(2))}, 3.0},
+		}},
+		{n: "select br_table", funcs: []fn{
+			{sig: "i:i", code: cat(i32(10), i32(20), get(0), []byte{0x1b}), export: "select"},
+			{sig: "i:i", export: "switch", code: cat(
+				[]byte{0x02, 0x40, 0x02, 0x40, 0x02, 0x40}, // 3 nested blocks
+				get(0), []byte{0x0e, 2, 0, 1, 2}, // br_table 0 1 2
+				[]byte{0x0b}, i32(100), []byte{0x0f},
+				[]byte{0x0b}, i32(101), []byte{0x0f},
+				[]byte{0x0b}, i32(102))},
+			{sig: "i:i", export: "br_if_value", code: cat(
+				[]byte{0x02, 0x7f}, i32(7), i32(8), get(0), br(0x0d, 0), []byte{0x1a, 0x0b})},
+			{sig: "i:i", export: "dead_code", code: cat(
+				[]byte{0x02, 0x7f}, i32(1), br(0x0c, 0), []byte{0x6a, 0x02, 0x40, 0x0b, 0x1a}, i32(5), []byte{0x0b},
+				get(0), []byte{0x6a})},
+		}, calls: []ctest{
+			{"select", []any{1}, int32(10)},
+			{"select", []any{0}, int32(20)},
+			{"switch", []any{0}, int32(100)},
+			{"switch", []any{1}, int32(101)},
+			{"switch", []any{2}, int32(102)},
+			{"switch", []any{-1}, int32(102)},
+			{"br_if_value", []any{1}, int32(8)},
+			{"br_if_value", []any{0}, int32(7)},
+			{"dead_code", []any{2}, int32(3)},
+		}},
+		{n: "trap", funcs: []fn{
+			{sig: ":", code: []byte{0x00}, export: "unreachable"},
+			{sig: "ii:i", code: cat(get(0), get(1), []byte{0x6d}), export: "div_s"},
+			{sig: "II:I", code: cat(get(0), get(1), []byte{0x7f}), export: "div_s64"},
+			{sig: "F:i", code: cat(get(0), []byte{0xaa}), export: "trunc_s"},
+			{sig: "F:i", code: cat(get(0), []byte{0xab}), export: "trunc_u"},
+			{sig: "f:i", code: cat(get(0), []byte{0xa8}), export: "trunc_f32_s"},
+			{sig: "F:I", code: cat(get(0), []byte{0xb0}), export: "trunc_s64"},
+			{sig: "F:I", code: cat(get(0), []byte{0xb1}), export: "trunc_u64"},
+			{sig: "i:i", code: cat(get(0), call(8)), export: "recurse"},
+			{sig: "i:i", code: cat(get(0), []byte{0x02, 0x40, 0x0b}), export: "ok"},
+		}, calls: []ctest{
+			{"unreachable", nil, "wasm: trap: unreachable"},
+			{"div_s", []any{math.MinInt32, -1}, "wasm: trap: integer overflow"},
+			{"div_s", []any{math.MinInt32, 1}, int32(math.MinInt32)},
+			{"div_s", []any{-7, 2}, int32(-3)},
+			{"div_s64", []any{int64(math.MinInt64), -1}, "wasm: trap: integer overflow"},
+			{"div_s64", []any{int64(math.MinInt64), 2}, int64(math.MinInt64 / 2)},
+			{"trunc_s", []any{math.NaN()}, "float unrepresentable in integer range"},
+			{"trunc_s", []any{3e9}, "float unrepresentable in integer range"},
+			{"trunc_s", []any{-2147483648.9}, int32(math.MinInt32)},
+			{"trunc_s", []any{-2147483649.0}, "float unrepresentable in integer range"},
+			{"trunc_u", []any{-1.0}, "float unrepresentable in integer range"},
+			{"trunc_u", []any{-0.9}, int32(0)},
+			{"trunc_u", []any{4294967295.5}, int32(-1)},
+			{"trunc_f32_s", []any{float32(2147483648)}, "float unrepresentable in integer range"},
+			{"trunc_f32_s", []any{float32(-2147483648)}, int32(math.MinInt32)},
+			{"trunc_s64", []any{9.3e18}, "float unrepresentable in integer range"},
+			{"trunc_s64", []any{-9223372036854775808.0}, int64(math.MinInt64)},
+			{"trunc_u64", []any{1.8e19}, int64(-446744073709551616)},
+			{"trunc_u64", []any{math.Inf(1)}, "float unrepresentable in integer range"},
+			{"recurse", []any{1}, "wasm: trap: call stack exhausted"},
+			{"ok", []any{4}, int32(4)},
+			{"missing", nil, "no exported function"},
+			{"ok", nil, "got 0 arguments, want 1"},
+		}},
+		{n: "saturate", funcs: []fn{
+			{sig: "F:i", code: cat(get(0), []byte{0xfc, 2}), export: "sat_s"},
+			{sig: "F:i", code: cat(get(0), []byte{0xfc, 3}), export: "sat_u"},
+			{sig: "f:i", code: cat(get(0), []byte{0xfc, 0}), export: "sat_f32_s"},
+			{sig: "F:I", code: cat(get(0), []byte{0xfc, 6}), export: "sat_s64"},
+			{sig: "f:I", code: cat(get(0), []byte{0xfc, 5}), export: "sat_f32_u64"},
+		}, calls: []ctest{
+			{"sat_s", []any{-3.9}, int32(-3)},
+			{"sat_s", []any{3e9}, int32(math.MaxInt32)},
+			{"sat_s", []any{-3e9}, int32(math.MinInt32)},
+			{"sat_s", []any{math.NaN()}, int32(0)},
+			{"sat_u", []any{-1.0}, int32(0)},
+			{"sat_u", []any{4294967295.5}, int32(-1)},
+			{"sat_u", []any{1e10}, int32(-1)},
+			{"sat_f32_s", []any{float32(2147483648)}, int32(math.MaxInt32)},
+			{"sat_s64", []any{9.3e18}, int64(math.MaxInt64)},
+			{"sat_s64", []any{math.Inf(-1)}, int64(math.MinInt64)},
+			{"sat_s64", []any{-2.5}, int64(-2)},
+			{"sat_f32_u64", []any{float32(math.NaN())}, int64(0)},
+			{"sat_f32_u64", []any{float32(1e20)}, int64(-1)},
+		}},
+	} {
+		t.Run(test.n, func(t *testing.T) {
+			check(t, instantiate(t, mod{funcs: test.funcs}, nil), test.calls)
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	in := instantiate(t, mod{memory: []byte{1, 1, 2}, data: []byte("hello"), funcs: []fn{
+		{sig: "i:i", code: cat(get(0), []byte{0x2d, 0, 0}), export: "load8_u"},
+		{sig: "i:i", code: cat(get(0), []byte{0x28, 2, 0}), export: "load32"},
+		{sig: "i:i", code: cat(get(0), []byte{0x28, 2, 4}), export: "load32_off4"},
+		{sig: "i:I", code: cat(get(0), []byte{0x32, 1, 0}), export: "load16_s64"},
+		{sig: "i:F", code: cat(get(0), []byte{0x2b, 3, 0}), export: "loadf64"},
+		{sig: "ii:", code: cat(get(0), get(1), []byte{0x36, 2, 0}), export: "store32"},
+		{sig: "iF:", code: cat(get(0), get(1), []byte{0x39, 3, 0}), export: "storef64"},
+		{sig: ":i", code: []byte{0x3f, 0}, export: "size"},
+		{sig: "i:i", code: cat(get(0), []byte{0x40, 0}), export: "grow"},
+	}}, nil)
+	check(t, in, []ctest{
+		{"load8_u", []any{8}, int32('h')},
+		{"load32_off4", []any{8}, int32('o')},
+		{"store32", []any{0, -2}, nil},
+		{"load32", []any{0}, int32(-2)},
+		{"load8_u", []any{0}, int32(0xfe)},
+		{"load16_s64", []any{0}, int64(-2)},
+		{"storef64", []any{16, 1.5}, nil},
+		{"loadf64", []any{16}, 1.5},
+		{"load32", []any{vm.MemPageSize - 3}, "out of bounds memory access"},
+		{"load32", []any{-1}, "out of bounds memory access"},
+		{"size", nil, int32(1)},
+		{"grow", []any{1}, int32(1)},
+		{"size", nil, int32(2)},
+		{"grow", []any{1}, int32(-1)},
+		{"load32", []any{vm.MemPageSize + 4}, int32(0)},
+	})
+	if n := len(in.Memory()); n != 2*vm.MemPageSize {
+		t.Errorf("got memory size %d, want %d", n, 2*vm.MemPageSize)
+	}
+}
+
+func TestTable(t *testing.T) {
+	in := instantiate(t, mod{table: []int{0, 1}, funcs: []fn{
+		{sig: ":i", code: i32(1)},
+		{sig: "i:i", code: cat(get(0), get(0), []byte{0x6a})},
+		{sig: "ii:i", code: cat(get(1), get(0), []byte{0x11, 1, 0}), export: "dispatch"},
+		{sig: "i:i", code: cat(get(0), []byte{0x11, 0, 0}), export: "dispatch0"},
+	}}, nil)
+	check(t, in, []ctest{
+		{"dispatch", []any{1, 21}, int32(42)},
+		{"dispatch", []any{0, 21}, "indirect call type mismatch"},
+		{"dispatch", []any{2, 21}, "wasm: trap"},
+		{"dispatch0", []any{0}, int32(1)},
+	})
+}
+
+func TestImports(t *testing.T) {
+	var logged []int32
+	var inst *wasm.Instance
+	imports := wasm.Imports{"env": {
+		"add":  func(a, b int) int { return a + b },
+		"log":  func(in *wasm.Instance, v int32) { inst, logged = in, append(logged, v) },
+		"sqrt": math.Sqrt,
+		"mem":  make([]byte, vm.MemPageSize),
+	}}
+	m := mod{imports: []imp{{"env", "add", "ii:i"}, {"env", "log", "i:"}, {"env", "sqrt", "F:F"}, {"env", "mem", ""}}, funcs: []fn{
+		{sig: "ii:i", code: cat(get(0), get(1), call(0)), export: "sum"},
+		{sig: "i:", code: cat(get(0), call(1)), export: "log"},
+		{sig: "F:F", code: cat(get(0), call(2)), export: "sqrt"},
+		{sig: "i:i", code: cat(get(0), []byte{0x2d, 0, 0}), export: "load8_u"},
+	}}
+	in := instantiate(t, m, imports)
+	imports["env"]["mem"].([]byte)[3] = 7
+	check(t, in, []ctest{
+		{"sum", []any{40, 2}, int32(42)},
+		{"log", []any{-5}, nil},
+		{"sqrt", []any{2.25}, 1.5},
+		{"load8_u", []any{3}, int32(7)},
+	})
+	if len(logged) != 1 || logged[0] != -5 || inst != in {
+		t.Errorf("got log %v, instance %p, want [-5], %p", logged, inst, in)
+	}
+
+	for _, test := range []struct {
+		n       string
+		imports wasm.Imports
+		err     string
+	}{
+		{"missing", wasm.Imports{}, "unresolved import env.add"},
+		{"type", wasm.Imports{"env": {"add": func(a int) int { return a }}}, "does not match"},
+		{"not func", wasm.Imports{"env": {"add": 1}}, "not a function"},
+		{"param", wasm.Imports{"env": {"add": func(a, b string) int { return 0 }}}, "unsupported type string"},
+	} {
+		t.Run(test.n, func(t *testing.T) {
+			dm, err := wasm.Decode(mod{imports: []imp{{"env", "add", "ii:i"}}}.bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wasm.Instantiate(dm, test.imports); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	in := instantiate(t, mod{
+		globals: [][]byte{{0x7f, 1, 0x41, 5, 0x0b}, {0x7e, 0, 0x42, 7, 0x0b}},
+		funcs: []fn{
+			{sig: ":", code: []byte{0x23, 0, 0x41, 1, 0x6a, 0x24, 0}, export: "inc"},
+			{sig: ":I", code: []byte{0x23, 1}, export: "get1"},
+		},
+	}, nil)
+	check(t, in, []ctest{{"inc", nil, nil}, {"inc", nil, nil}, {"get1", nil, int64(7)}})
+	if g, _ := in.Global("g0"); g != int32(7) {
+		t.Errorf("got g0 %v, want 7", g)
+	}
+	if _, ok := in.Global("g2"); ok {
+		t.Error("got global g2")
+	}
+}
+
+func TestStart(t *testing.T) {
+	in := instantiate(t, mod{
+		globals: [][]byte{{0x7f, 1, 0x41, 0, 0x0b}},
+		funcs:   []fn{{sig: ":", code: cat(i32(42), []byte{0x24, 0})}},
+		start:   1,
+	}, nil)
+	if g, _ := in.Global("g0"); g != int32(42) {
+		t.Errorf("got g0 %v, want 42", g)
+	}
+
+	dm, err := wasm.Decode(mod{funcs: []fn{{sig: ":", code: []byte{0x00}}}, start: 1}.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trap *wasm.Trap
+	if _, err := wasm.Instantiate(dm, nil); !errors.As(err, &trap) {
+		t.Errorf("got error %v, want trap", err)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, test := range []struct {
+		n   string
+		b   []byte
+		err string
+	}{
+		{"magic", []byte("\x00wasm\x01\x00\x00\x00"), "wasm: "},
+		{"version", []byte("\x00asm\x02\x00\x00\x00"), "wasm: "},
+		{"truncated", mod{funcs: []fn{{sig: "i:i", code: get(0)}}}.bytes()[:20], "wasm: "},
+		{"prefix", mod{funcs: []fn{{sig: ":", code: []byte{0xfc, 8}}}}.bytes(), "unsupported instruction"},
+		{"saturate", mod{funcs: []fn{{sig: ":i", code: []byte{0xfc, 0}}}}.bytes(), "stack underflow"},
+		{"underflow", mod{funcs: []fn{{sig: ":i", code: []byte{0x6a}}}}.bytes(), "stack underflow"},
+		{"local", mod{funcs: []fn{{sig: ":", code: get(3)}}}.bytes(), "invalid local 3"},
+		{"branch", mod{funcs: []fn{{sig: ":", code: br(0x0c, 2)}}}.bytes(), "invalid branch depth 2"},
+	} {
+		t.Run(test.n, func(t *testing.T) {
+			dm, err := wasm.Decode(test.b)
+			if err == nil {
+				_, err = wasm.Instantiate(dm, nil)
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}